@@ -83,7 +83,8 @@ func setValue(servers []string, key string, value string) {
 	if err != nil {
 		setValue(servers, key, value)
 	} else {
-		if resp.ContentLength > 0 {
+		// Committed write carries its index, otherwise body is leader address
+		if resp.Header.Get("X-Commit-Index") == "" && resp.ContentLength > 0 {
 			body, _ := ioutil.ReadAll(resp.Body)
 			resp.Body.Close()
 			leader = string(body)
@@ -1,9 +1,14 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"log"
 	"net/http"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 
 	"dkvs"
 	"dkvs/raft"
@@ -15,12 +20,58 @@ var consumer chan raft.RPC
 
 func main() {
 	var new bool
+	var bootstrap bool
 	var addr string
+	var bindAddr, advertiseAddr string
 	var join string
+	var admin bool
+	var followerReads bool
+	var secret string
+	var cert, key, ca string
+	var dataFile string
+	var snapshotDir string
+	var compressSnapshots bool
+	var snapshotThreshold, snapshotSize uint64
+	var snapshotDeltas int
+	var witness bool
+	var maxWrites int
+	var dedupWindow int
+	var writeTimeout int64
+	var maxInflight int
+	var maxEntrySize int
+	var startupGrace int64
+	var electionPriority, maxElectionPriority int
+	var writeQuorum, readQuorum int
 
 	flag.BoolVar(&new, "n", false, "new server")
+	flag.BoolVar(&bootstrap, "bootstrap", false, "initialize a new cluster of this server and peers, only one node is bootstrapped")
 	flag.StringVar(&addr, "a", "localhost:8080", "server address")
-	flag.StringVar(&join, "j", "", "peers")
+	flag.StringVar(&bindAddr, "bind", "", "address to listen on, defaults to server address")
+	flag.StringVar(&advertiseAddr, "advertise", "", "address peers reach this server at, defaults to server address")
+	flag.StringVar(&join, "j", "", "peers, only used by a server with no state in its data file")
+	flag.StringVar(&dataFile, "data", "", "file raft log, term and vote are kept in, a restarted server rejoins from it. Kept in memory if it's not set")
+	flag.BoolVar(&admin, "admin", false, "enable admin endpoints")
+	flag.BoolVar(&followerReads, "follower-reads", false, "serve reads on followers within leader's lease")
+	flag.StringVar(&secret, "secret", "", "cluster secret used to sign RPCs")
+	flag.StringVar(&cert, "cert", "", "TLS certificate file, enables mutual TLS")
+	flag.StringVar(&key, "key", "", "TLS key file")
+	flag.StringVar(&ca, "ca", "", "CA file peer certificates are verified with")
+	flag.StringVar(&snapshotDir, "snapshots", "", "directory snapshots are stored in, enables snapshots")
+	flag.BoolVar(&compressSnapshots, "compress-snapshots", false, "gzip snapshots on disk and when sent to followers")
+	flag.Uint64Var(&snapshotThreshold, "snapshot-threshold", 0, "logs applied since the last snapshot before taking one, 0 disables it")
+	flag.Uint64Var(&snapshotSize, "snapshot-size", 0, "bytes of logs applied since the last snapshot before taking one, 0 disables it")
+	flag.IntVar(&snapshotDeltas, "snapshot-deltas", 0, "delta snapshots taken on top of a full one, 0 makes every snapshot full")
+	flag.BoolVar(&witness, "witness", false, "never start an election, only vote and replicate")
+	flag.IntVar(&maxWrites, "max-writes", 0, "client writes accepted per second, 0 means no limit")
+	flag.IntVar(&dedupWindow, "dedup-window", dkvs.DefaultConfig().DedupWindowSize, "latest client writes whose result answers retries without logging them again, 0 disables it")
+	flag.Int64Var(&writeTimeout, "write-timeout", dkvs.DefaultConfig().WriteTimeout, "milliseconds a write waits to commit before it's answered with 504, 0 means no limit")
+	flag.IntVar(&maxInflight, "max-inflight", raft.DefaultConfig().MaxInflightWrites, "writes waiting to be applied before new ones are refused with 503, 0 means no limit")
+	flag.IntVar(&maxEntrySize, "max-entry-size", raft.DefaultConfig().MaxLogEntrySize, "bytes of a write command before it's refused with 413, 0 means no limit")
+	flag.Int64Var(&startupGrace, "startup-grace", 0, "milliseconds after start a node doesn't start elections until it reaches quorum, 0 disables it")
+	flag.IntVar(&electionPriority, "election-priority", 0, "bias leadership toward nodes with a higher priority, at most max-election-priority")
+	flag.IntVar(&maxElectionPriority, "max-election-priority", 0, "highest election priority of the cluster, the same on every node, 0 means no bias")
+	flag.IntVar(&writeQuorum, "write-quorum", 0, "voters a write must be stored on, 0 means majority")
+	flag.IntVar(&readQuorum, "read-quorum", 0, "voters needed to elect and keep a leader, must intersect write quorum")
 
 	flag.Parse()
 
@@ -30,23 +81,130 @@ func main() {
 	if new {
 		consumer = make(chan raft.RPC)
 		config := raft.DefaultConfig()
-		transport := dkvs.NewHTTPTransport(addr, consumer)
-		ls := raft.NewInmemLogStore()
-		sm := dkvs.NewStateMachine()
-		server = raft.NewServer(config, transport, ls, sm)
+		config.SnapshotDir = snapshotDir
+		config.SnapshotCompression = compressSnapshots
+		config.SnapshotThreshold, config.SnapshotSizeThreshold = snapshotThreshold, snapshotSize
+		config.SnapshotDeltas = snapshotDeltas
+		config.DisableElection = witness
+		config.WriteQuorum, config.ReadQuorum = writeQuorum, readQuorum
+		config.MaxInflightWrites = maxInflight
+		config.MaxLogEntrySize = maxEntrySize
+		config.StartupGracePeriod = startupGrace
+		config.ElectionPriority, config.MaxElectionPriority = electionPriority, maxElectionPriority
+		kvConfig := dkvs.DefaultConfig()
+		kvConfig.BindAddr = bindAddr
+		kvConfig.AdvertiseAddr = advertiseAddr
+		kvConfig.EnableAdmin = admin
+		kvConfig.AllowFollowerReads = followerReads
+		kvConfig.ClusterSecret = secret
+		kvConfig.MaxWritesPerSecond = maxWrites
+		kvConfig.DedupWindowSize = dedupWindow
+		kvConfig.WriteTimeout = writeTimeout
+		if len(cert) > 0 {
+			tlsConfig, err := dkvs.NewTLSConfig(cert, key, ca)
+			if err != nil {
+				log.Fatal(err)
+			}
+			kvConfig.TLSConfig = tlsConfig
+		}
+		transport := dkvs.NewHTTPTransport(addr, consumer, kvConfig)
+		var ls raft.LogStore = raft.NewInmemLogStore()
+		if len(dataFile) > 0 {
+			fls, err := raft.NewFileLogStore(dataFile)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer fls.Close()
+			ls = fls
+		}
+		sm := dkvs.NewStateMachine(kvConfig)
+		var err error
+		server, err = raft.NewServer(config, transport, ls, sm)
+		if err != nil {
+			log.Fatal(err)
+		}
+		var peers []string
 		if len(join) > 0 {
-			peers := strings.Split(join, ",")
+			peers = strings.Split(join, ",")
+		}
+		// A server restarted on its data file already knows its term and
+		// members, they're recovered from its log on start
+		if server.CurrentTerm() > 0 || server.LastLogIndex() > 0 {
+			log.Printf("Rejoining from %s, term %d", dataFile, server.CurrentTerm())
+		} else if bootstrap {
+			if err := server.BootstrapCluster(peers); err != nil {
+				log.Fatal(err)
+			}
+		} else {
 			for _, peer := range peers {
-				server.AddPeer(peer)
+				if err := server.AddPeer(peer, 0); err != nil {
+					log.Fatal(err)
+				}
 			}
 		}
-		server.Start()
-		defer server.Stop()
+		if err := server.Start(); err != nil {
+			log.Fatal(err)
+		}
 
 		r.HandleFunc("/request_vote", transport.RequestVoteHandle(consumer)).Methods("POST")
 		r.HandleFunc("/append_entries", transport.AppendEntriesHandle(consumer)).Methods("POST")
+		r.HandleFunc("/timeout_now", transport.TimeoutNowHandle(consumer)).Methods("POST")
+		r.HandleFunc("/install_snapshot", transport.InstallSnapshotHandle(consumer)).Methods("POST")
+		r.HandleFunc("/store", transport.GetManyHandle(server)).Methods("GET")
 		r.HandleFunc("/store/{key}", transport.GetHandle(server)).Methods("GET")
 		r.HandleFunc("/store/{key}", transport.SetHandle(server)).Methods("POST")
-		_ = http.ListenAndServe(addr, r)
+		r.HandleFunc("/store/{key}/cas", transport.CASHandle(server)).Methods("POST")
+		r.HandleFunc("/store/{key}/{op}", transport.CommandHandle(server)).Methods("POST")
+		r.HandleFunc("/versions", transport.VersionsHandle(server)).Methods("GET")
+		r.HandleFunc("/watch/{key}", transport.WatchHandle(server)).Methods("GET")
+		r.HandleFunc("/txn", transport.TxnHandle(server)).Methods("POST")
+		r.HandleFunc("/barrier", transport.BarrierHandle(server)).Methods("POST")
+		r.HandleFunc("/cluster/leave", transport.LeaveHandle(server)).Methods("POST")
+		r.HandleFunc("/cluster/validate", transport.ValidateHandle(server)).Methods("POST")
+		r.HandleFunc("/cluster/config", transport.ClusterConfigHandle(server)).Methods("GET")
+		r.HandleFunc("/status", transport.StatusHandle(server)).Methods("GET")
+		r.HandleFunc("/healthz", transport.HealthzHandle(server)).Methods("GET")
+		r.HandleFunc("/readyz", transport.ReadyzHandle(server)).Methods("GET")
+		r.HandleFunc("/leader", transport.LeaderHandle(server)).Methods("GET")
+		r.HandleFunc("/admin/log", transport.AdminLogHandle(server)).Methods("GET")
+		r.HandleFunc("/admin/export", transport.AdminExportHandle(server)).Methods("GET")
+		r.HandleFunc("/admin/import", transport.AdminImportHandle(server)).Methods("POST")
+		r.HandleFunc("/admin/step_down", transport.AdminStepDownHandle(server)).Methods("POST")
+		r.HandleFunc("/admin/drain", transport.AdminDrainHandle(server)).Methods("POST")
+		r.HandleFunc("/admin/undrain", transport.AdminUndrainHandle(server)).Methods("POST")
+		r.HandleFunc("/admin/reset", transport.AdminResetHandle(server)).Methods("POST")
+
+		srv := &http.Server{Addr: transport.BindAddr(), Handler: r, TLSConfig: kvConfig.TLSConfig}
+		// Watch streams never end by themselves, Shutdown would wait forever
+		srv.RegisterOnShutdown(sm.CloseWatchers)
+
+		// On signal new connections are refused while raft drains writes in
+		// flight, their handlers still get a response
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			sigCh := make(chan os.Signal, 1)
+			signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+			<-sigCh
+
+			shutdown := make(chan error, 1)
+			go func() {
+				shutdown <- srv.Shutdown(context.Background())
+			}()
+			server.Stop()
+			if err := <-shutdown; err != nil {
+				log.Println(err)
+			}
+		}()
+
+		if kvConfig.TLSConfig != nil {
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+		<-done
 	}
 }
@@ -0,0 +1,48 @@
+package dkvs
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+)
+
+// Codec is used to encode command into raft log and decode it back when
+// the log is applied, every node of a cluster must use the same codec
+type Codec interface {
+	Encode(cmd Command) ([]byte, error)
+	Decode(data []byte) (Command, error)
+}
+
+// JSONCodec encode command as JSON, it also decodes KeyValue
+type JSONCodec struct{}
+
+// Encode ...
+func (JSONCodec) Encode(cmd Command) ([]byte, error) {
+	return json.Marshal(&cmd)
+}
+
+// Decode ...
+func (JSONCodec) Decode(data []byte) (Command, error) {
+	var cmd Command
+	err := json.Unmarshal(data, &cmd)
+	return cmd, err
+}
+
+// GobCodec encode command with encoding/gob
+type GobCodec struct{}
+
+// Encode ...
+func (GobCodec) Encode(cmd Command) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&cmd); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decode ...
+func (GobCodec) Decode(data []byte) (Command, error) {
+	var cmd Command
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&cmd)
+	return cmd, err
+}
@@ -0,0 +1,59 @@
+package dkvs
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	commands := []Command{
+		{Op: OpSet, Key: "a", Value: []byte("1"), Time: 100, ExpireAt: 200},
+		{Op: OpDelete, Key: "a", Time: 100},
+		{
+			Op: OpTxn,
+			Txn: []*Command{
+				{Op: OpSet, Key: "a", Value: []byte("1")},
+				{Op: OpDelete, Key: "b"},
+			},
+			Time: 100,
+		},
+	}
+
+	for name, codec := range map[string]Codec{"json": JSONCodec{}, "gob": GobCodec{}} {
+		for _, cmd := range commands {
+			data, err := codec.Encode(cmd)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			got, err := codec.Decode(data)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if !reflect.DeepEqual(got, cmd) {
+				t.Fatalf("%s: wrong command: %+v (want %+v)", name, got, cmd)
+			}
+		}
+	}
+}
+
+func TestStateMachineGobCodec(t *testing.T) {
+	config := &Config{Codec: GobCodec{}}
+	sm := NewStateMachine(config)
+
+	data, err := config.Codec.Encode(Command{Op: OpSet, Key: "a", Value: []byte("b")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.Set(data); err != nil {
+		t.Fatal(err)
+	}
+	if v := sm.Get("a"); v != "b" {
+		t.Fatalf("Wrong value: %v", v)
+	}
+
+	// Command encoded with another codec is rejected
+	data, _ = JSONCodec{}.Encode(Command{Op: OpSet, Key: "a", Value: []byte("c")})
+	if err := sm.Set(data); err == nil {
+		t.Fatalf("JSON command should not be decoded by gob codec")
+	}
+}
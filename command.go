@@ -0,0 +1,114 @@
+package dkvs
+
+import "fmt"
+
+// CommandOp describe operation of a command
+type CommandOp string
+
+const (
+	// OpSet is used to set value of a key
+	OpSet CommandOp = "set"
+	// OpDelete is used to delete a key
+	OpDelete CommandOp = "delete"
+	// OpTxn is used to apply a batch of set/delete atomically
+	OpTxn CommandOp = "txn"
+	// OpCAS is used to set value of a key only if its version matches
+	OpCAS CommandOp = "cas"
+)
+
+// CompareTarget describe what a txn compare checks of its key
+type CompareTarget string
+
+const (
+	// CompareValue is used to check value of a key
+	CompareValue CompareTarget = "value"
+	// CompareVersion is used to check version of a key
+	CompareVersion CompareTarget = "version"
+)
+
+// Compare is a condition of a txn on committed state, an absent key has
+// an empty value and version 0
+type Compare struct {
+	Key     string        `json:"key"`
+	Target  CompareTarget `json:"target"`
+	Value   []byte        `json:"value,omitempty"`
+	Version uint64        `json:"version,omitempty"`
+}
+
+// Command is replicated through raft log and applied by StateMachine.
+// A command without op is a set, so it's compatible with KeyValue.
+//
+// Time is the unix nano time leader accepted the command, it's used as
+// logical clock of StateMachine so every node expires keys at the same
+// log position. ExpireAt is the logical time a set key expires at.
+// Version is the version a cas expects its key at, 0 for an absent key.
+// A txn with Compare applies Txn if every compare holds, Failure if not.
+// ClientID and Seq identify a client write, a retried write with a seq
+// client already applied is skipped so it's applied exactly once. Value is
+// kept as raw bytes with the content type client wrote it with.
+type Command struct {
+	Op          CommandOp  `json:"op,omitempty"`
+	Key         string     `json:"key,omitempty"`
+	Value       []byte     `json:"value,omitempty"`
+	ContentType string     `json:"contentType,omitempty"`
+	Txn         []*Command `json:"txn,omitempty"`
+	Compare     []*Compare `json:"compare,omitempty"`
+	Failure     []*Command `json:"failure,omitempty"`
+	Time        int64      `json:"time,omitempty"`
+	ExpireAt    int64      `json:"expireAt,omitempty"`
+	Version     uint64     `json:"version,omitempty"`
+	ClientID    string     `json:"clientId,omitempty"`
+	Seq         uint64     `json:"seq,omitempty"`
+}
+
+// validate is used to check command can be applied, ops of handlers are
+// custom commands. A txn can't include custom commands.
+func (c *Command) validate(handlers map[CommandOp]CommandHandler) error {
+	if c.ClientID != "" && c.Seq == 0 {
+		return fmt.Errorf("missing seq of client %s command", c.ClientID)
+	}
+	switch c.Op {
+	case "", OpSet, OpDelete, OpCAS:
+		if c.Key == "" {
+			return fmt.Errorf("missing key of %s command", c.Op)
+		}
+		if c.ExpireAt != 0 && c.Op == OpDelete {
+			return fmt.Errorf("expiry is not supported by delete command")
+		}
+	case OpTxn:
+		for _, cmp := range c.Compare {
+			if cmp.Key == "" {
+				return fmt.Errorf("missing key of txn compare")
+			}
+			if cmp.Target != CompareValue && cmp.Target != CompareVersion {
+				return fmt.Errorf("unknown compare target: %s", cmp.Target)
+			}
+		}
+		if err := validateTxnOps(c.Txn); err != nil {
+			return err
+		}
+		if err := validateTxnOps(c.Failure); err != nil {
+			return err
+		}
+	default:
+		if _, ok := handlers[c.Op]; !ok {
+			return fmt.Errorf("unknown command op: %s", c.Op)
+		}
+	}
+	return nil
+}
+
+func validateTxnOps(ops []*Command) error {
+	for _, op := range ops {
+		if op.Op == OpTxn {
+			return fmt.Errorf("nested txn is not supported")
+		}
+		if op.Op == OpCAS {
+			return fmt.Errorf("cas is not supported in txn")
+		}
+		if err := op.validate(nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package dkvs
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Config provide options shared by HTTPTransport and StateMachine
+type Config struct {
+	// BindAddr is the address node listens on, e.g. 0.0.0.0:8080 in a
+	// container. It defaults to the address transport is created with
+	BindAddr string
+	// AdvertiseAddr is the address peers reach node at, it's node's
+	// identity in votes and peer lists. It defaults to the address
+	// transport is created with
+	AdvertiseAddr string
+	// Codec is used to encode commands replicated through raft log
+	Codec Codec
+	// ForwardToLeader makes followers proxy reads and writes to leader
+	// instead of answering with leader address
+	ForwardToLeader bool
+	// EnableAdmin exposes /admin endpoints for debugging, e.g. reading raw
+	// raft log. They're disabled by default
+	EnableAdmin bool
+	// ClusterSecret is shared by every node, when it's set RPCs are signed
+	// with it and RPCs without a valid signature are rejected
+	ClusterSecret string
+	// TLSConfig makes RPCs and forwarded requests use HTTPS, it's used as
+	// client config so it should hold this node's certificate for mutual
+	// TLS and the CA peers are verified with
+	TLSConfig *tls.Config
+	// MaxIdleConnsPerHost is the number of idle connections kept to each
+	// peer, so heartbeats and forwarded requests reuse them
+	MaxIdleConnsPerHost int
+	// IdleConnTimeout is the time in milliseconds an idle connection is
+	// kept before it's closed
+	IdleConnTimeout int64
+	// DialTimeout is the maximum time in milliseconds to connect a peer
+	DialTimeout int64
+	// RequestTimeout is the maximum time in milliseconds of a request to a
+	// peer, including reading its response
+	RequestTimeout int64
+	// DisableKeepAlives makes every request use a new connection
+	DisableKeepAlives bool
+	// AllowFollowerReads makes followers serve reads from their own state
+	// machine while they're within leader's lease. A follower that hasn't
+	// received the log X-Min-Index asks for, or is more than
+	// MaxFollowerReadLag logs behind leader, redirects instead.
+	AllowFollowerReads bool
+	// MaxFollowerReadLag is the number of logs committed by leader a
+	// follower may not have applied yet and still serve reads
+	MaxFollowerReadLag uint64
+	// MaxWritesPerSecond is the number of client writes a node accepts per
+	// second, with bursts of up to as many. Writes over it are rejected
+	// with 429 before they're replicated. Zero means no limit
+	MaxWritesPerSecond int
+	// DedupWindowSize is the number of latest client writes, by client id
+	// and seq, whose result is kept so a retry is answered without being
+	// logged again. Zero disables it, retries are still applied once
+	DedupWindowSize int
+	// WriteTimeout is the maximum time in milliseconds a client write waits
+	// to be committed, e.g. while leader can't reach quorum, it's answered
+	// with 504 after that. Zero means it waits as long as client does
+	WriteTimeout int64
+}
+
+// DefaultConfig return default config, commands are encoded as JSON
+func DefaultConfig() *Config {
+	return &Config{
+		Codec:               JSONCodec{},
+		MaxIdleConnsPerHost: 16,
+		IdleConnTimeout:     90000,
+		DialTimeout:         5000,
+		RequestTimeout:      15000,
+		MaxFollowerReadLag:  1000,
+		DedupWindowSize:     1024,
+		WriteTimeout:        10000,
+	}
+}
+
+// newHTTPClient return client used to send requests to peers, connections
+// are pooled per peer unless keep-alives are disabled
+func newHTTPClient(config *Config) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   time.Duration(config.DialTimeout) * time.Millisecond,
+		KeepAlive: 30 * time.Second,
+	}
+	return &http.Client{
+		Timeout: time.Duration(config.RequestTimeout) * time.Millisecond,
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			DialContext:         dialer.DialContext,
+			MaxIdleConnsPerHost: config.MaxIdleConnsPerHost,
+			IdleConnTimeout:     time.Duration(config.IdleConnTimeout) * time.Millisecond,
+			TLSHandshakeTimeout: 10 * time.Second,
+			TLSClientConfig:     config.TLSConfig,
+			DisableKeepAlives:   config.DisableKeepAlives,
+		},
+	}
+}
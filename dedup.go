@@ -0,0 +1,91 @@
+package dkvs
+
+import (
+	"container/list"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// dedupWindow keep results of the latest client writes, by client id and
+// seq, so a retry is answered without being logged again. A retry of a
+// write still in flight waits for it instead.
+type dedupWindow struct {
+	sync.Mutex
+	size   int
+	writes map[dedupKey]*list.Element
+	// order hold writes most recently seen first
+	order *list.List
+}
+
+type dedupKey struct {
+	clientID string
+	seq      uint64
+}
+
+type dedupWrite struct {
+	key dedupKey
+	// done is closed once the write is finished
+	done   chan struct{}
+	index  uint64
+	result interface{}
+	err    error
+}
+
+// newDedupWindow return window of the latest size writes, nil if size is
+// not positive which deduplicates nothing
+func newDedupWindow(size int) *dedupWindow {
+	if size <= 0 {
+		return nil
+	}
+	return &dedupWindow{
+		size:   size,
+		writes: make(map[dedupKey]*list.Element),
+		order:  list.New(),
+	}
+}
+
+// begin return write of key and true if it's already seen, otherwise a new
+// write caller must finish. The least recently seen write is evicted once
+// window is full.
+func (d *dedupWindow) begin(key dedupKey) (*dedupWrite, bool) {
+	d.Lock()
+	defer d.Unlock()
+	if e, ok := d.writes[key]; ok {
+		d.order.MoveToFront(e)
+		return e.Value.(*dedupWrite), true
+	}
+
+	w := &dedupWrite{key: key, done: make(chan struct{})}
+	d.writes[key] = d.order.PushFront(w)
+	for d.order.Len() > d.size {
+		oldest := d.order.Back()
+		d.order.Remove(oldest)
+		delete(d.writes, oldest.Value.(*dedupWrite).key)
+	}
+	return w, false
+}
+
+// finish is used to record result of write, a failed write is forgotten
+// so its retry is dispatched again
+func (d *dedupWindow) finish(w *dedupWrite, index uint64, result interface{}, err error) {
+	d.Lock()
+	w.index, w.result, w.err = index, result, err
+	if e, ok := d.writes[w.key]; ok && err != nil && e.Value == w {
+		d.order.Remove(e)
+		delete(d.writes, w.key)
+	}
+	d.Unlock()
+	close(w.done)
+}
+
+// clientWriteKey return client id and seq of request, false if it isn't
+// a client write
+func clientWriteKey(r *http.Request) (dedupKey, bool) {
+	clientID := r.Header.Get(HeaderClientID)
+	seq, err := strconv.ParseUint(r.Header.Get(HeaderClientSeq), 10, 64)
+	if clientID == "" || err != nil || seq == 0 {
+		return dedupKey{}, false
+	}
+	return dedupKey{clientID: clientID, seq: seq}, true
+}
@@ -0,0 +1,60 @@
+package dkvs
+
+import "container/heap"
+
+// expiryItem is a key due to expire at, it's stale once key is written
+// again or deleted
+type expiryItem struct {
+	at  int64
+	key string
+}
+
+// expiry is a min-heap of keys by expiry time, so expired keys are found
+// without walking every key stored with TTL
+type expiry []expiryItem
+
+func (e expiry) Len() int           { return len(e) }
+func (e expiry) Less(i, j int) bool { return e[i].at < e[j].at }
+func (e expiry) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+
+func (e *expiry) Push(x interface{}) {
+	*e = append(*e, x.(expiryItem))
+}
+
+func (e *expiry) Pop() interface{} {
+	old := *e
+	item := old[len(old)-1]
+	*e = old[:len(old)-1]
+	return item
+}
+
+// trackExpiry is used to track key expiring at, the heap is rebuilt once
+// stale items outnumber keys stored with TTL. Lock must be held.
+func (s *StateMachine) trackExpiry(key string, at int64) {
+	heap.Push(&s.expiry, expiryItem{at: at, key: key})
+	if len(s.expiry) > 2*len(s.expireAt)+64 {
+		s.rebuildExpiry()
+	}
+}
+
+// rebuildExpiry is used to track the keys of expireAt only, e.g. after
+// restore. Lock must be held.
+func (s *StateMachine) rebuildExpiry() {
+	s.expiry = make(expiry, 0, len(s.expireAt))
+	for key, at := range s.expireAt {
+		s.expiry = append(s.expiry, expiryItem{at: at, key: key})
+	}
+	heap.Init(&s.expiry)
+}
+
+// expireKeys is used to delete keys expired by now, as if log at index
+// deleted them. Now only moves with applied commands, so every node
+// deletes the same keys at the same log. Lock must be held.
+func (s *StateMachine) expireKeys(index uint64) {
+	for len(s.expiry) > 0 && s.expiry[0].at <= s.now {
+		item := heap.Pop(&s.expiry).(expiryItem)
+		if at, ok := s.expireAt[item.key]; ok && at == item.at {
+			s.delete(item.key, index)
+		}
+	}
+}
@@ -1,5 +1,7 @@
 module dkvs
 
+go 1.21
+
 require (
 	github.com/gofrs/uuid/v3 v3.1.1
 	github.com/gorilla/context v1.1.1 // indirect
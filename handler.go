@@ -0,0 +1,63 @@
+package dkvs
+
+import "fmt"
+
+// CommandHandler is used to apply a custom command, e.g. incrementing a
+// counter. It runs on every node at the same log position so it must be
+// deterministic, only depending on cmd and keys read from kv. Its result
+// is returned to the client which wrote the command.
+type CommandHandler func(kv *KV, cmd *Command) (string, error)
+
+// KV give a custom command access to keys while it's applied
+type KV struct {
+	sm    *StateMachine
+	index uint64
+}
+
+// Get ...
+func (kv *KV) Get(key string) ([]byte, bool) {
+	if kv.sm.expired(key) {
+		return nil, false
+	}
+	value, ok := kv.sm.data[key]
+	return value, ok
+}
+
+// Set is used to write value of key, it's versioned with index of the
+// command log and doesn't expire
+func (kv *KV) Set(key string, value []byte) {
+	kv.sm.set(&Command{Key: key, Value: value}, kv.index)
+}
+
+// Delete ...
+func (kv *KV) Delete(key string) {
+	kv.sm.delete(key, kv.index)
+}
+
+// RegisterCommand is used to apply commands with op by handler. Every node
+// must register the same handlers before it starts applying logs, like
+// Codec. Ops of builtin commands can't be replaced.
+func (s *StateMachine) RegisterCommand(op CommandOp, handler CommandHandler) error {
+	switch op {
+	case "", OpSet, OpDelete, OpTxn, OpCAS:
+		return fmt.Errorf("command op %q is builtin", op)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	handlers := make(map[CommandOp]CommandHandler, len(s.handlers)+1)
+	for existing, h := range s.handlers {
+		handlers[existing] = h
+	}
+	handlers[op] = handler
+	s.handlers = handlers
+	return nil
+}
+
+// hasCommand return whether op is a registered custom command
+func (s *StateMachine) hasCommand(op CommandOp) bool {
+	s.Lock()
+	defer s.Unlock()
+	_, ok := s.handlers[op]
+	return ok
+}
@@ -0,0 +1,78 @@
+package dkvs
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"dkvs/raft"
+)
+
+// increment add value of command to the counter at its key
+func increment(kv *KV, cmd *Command) (string, error) {
+	delta, err := strconv.Atoi(string(cmd.Value))
+	if err != nil {
+		return "", err
+	}
+	current, _ := kv.Get(cmd.Key)
+	n, _ := strconv.Atoi(string(current))
+	result := strconv.Itoa(n + delta)
+	kv.Set(cmd.Key, []byte(result))
+	return result, nil
+}
+
+func TestRegisterCommand(t *testing.T) {
+	sm := NewStateMachine(DefaultConfig())
+	if err := sm.RegisterCommand("increment", increment); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := uint64(1); i <= 3; i++ {
+		data, _ := json.Marshal(&Command{Op: "increment", Key: "counter", Value: []byte("2")})
+		log := &raft.Log{Index: i, Type: raft.LogCommand, Command: data}
+		sm.ApplyLogs([]*raft.Log{log})
+	}
+	if v := sm.Get("counter"); v != "6" {
+		t.Fatalf("Registered command should be applied on every log: %v", v)
+	}
+}
+
+func TestCustomCommandAcrossNodes(t *testing.T) {
+	cluster, leader := newTestCluster(t, 3)
+	defer stopCluster(cluster)
+	for _, s := range cluster {
+		if err := s.StateMachine().(*StateMachine).RegisterCommand("increment", increment); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := NewStateMachine(DefaultConfig()).RegisterCommand(OpSet, increment); err == nil {
+		t.Fatalf("Builtin op should not be replaced")
+	}
+
+	r := newTestRouter(leader, NewHTTPTransport("", nil, DefaultConfig()))
+	if w := doRequest(r, "POST", "/store/a/append", "1"); w.Code != http.StatusNotFound {
+		t.Fatalf("Unregistered command should not be found: %v", w.Code)
+	}
+
+	var result WriteResult
+	for i := 1; i <= 5; i++ {
+		w := doRequest(r, "POST", "/store/a/increment", strconv.Itoa(i))
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Fatalf("Failed to increment: %v %s", w.Code, w.Body.String())
+		}
+	}
+	if result.Result != "15" {
+		t.Fatalf("Client should get result of command: %q", result.Result)
+	}
+
+	for _, s := range cluster {
+		if err := s.WaitApplied(result.Index, time.Second); err != nil {
+			t.Fatal(err)
+		}
+		if v := s.StateMachine().Get("a"); v != "15" {
+			t.Fatalf("Command applied differently on %v: %v", s.LocalAddr(), v)
+		}
+	}
+}
@@ -2,9 +2,19 @@ package dkvs
 
 import (
 	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"dkvs/raft"
@@ -15,25 +25,118 @@ import (
 // KeyValue ...
 type KeyValue struct {
 	Key   string `json:"key"`
-	Value string `json:"value"`
+	Value []byte `json:"value"`
 }
 
+// WriteResult is returned on a committed write, Result is the result of a
+// custom command or the branch a txn with compares applied
+type WriteResult struct {
+	Index  uint64 `json:"index"`
+	Result string `json:"result,omitempty"`
+}
+
+// ReadResult is returned on multi-key read, values are as of the log at
+// Index
+type ReadResult struct {
+	Index  uint64            `json:"index"`
+	Values map[string]string `json:"values"`
+}
+
+// VersionsResult is returned on versions read, versions are as of the log
+// at Index
+type VersionsResult struct {
+	Index    uint64            `json:"index"`
+	Versions map[string]uint64 `json:"versions"`
+}
+
+// LeaderResult is returned on leader query
+type LeaderResult struct {
+	Leader string `json:"leader"`
+}
+
+const (
+	// HeaderMinIndex is set by client on read to get a value at least as
+	// fresh as the log at this index, e.g. the index of its last write
+	HeaderMinIndex = "X-Min-Index"
+	// HeaderCommitIndex is set on write response to the index of the log
+	// the write is committed at
+	HeaderCommitIndex = "X-Commit-Index"
+	// HeaderForwarded is set on requests forwarded to leader, they're never
+	// forwarded again so a stale leader address can't cause a loop
+	HeaderForwarded = "X-Forwarded-By"
+	// HeaderSignature is set on RPC to the hex HMAC-SHA256 of its body
+	// keyed with cluster secret
+	HeaderSignature = "X-Signature"
+	// HeaderVersion is set on read response to the version of the key, the
+	// index of the log that last wrote it
+	HeaderVersion = "X-Version"
+	// HeaderClientID and HeaderClientSeq are set by client on write to
+	// identify it, a retried write with the same seq is applied only once
+	HeaderClientID  = "X-Client-ID"
+	HeaderClientSeq = "X-Client-Seq"
+)
+
 // HTTPTransport ...
 type HTTPTransport struct {
 	consumer  <-chan raft.RPC
 	localAddr string
+	bindAddr  string
 	client    *http.Client
+	// waitTimeout is the maximum time a read waits for X-Min-Index
+	waitTimeout time.Duration
+	// writeTimeout is WriteTimeout of config
+	writeTimeout    time.Duration
+	codec           Codec
+	forwardToLeader bool
+	enableAdmin     bool
+	secret          []byte
+	scheme          string
+
+	// followerReads and maxFollowerReadLag are AllowFollowerReads and
+	// MaxFollowerReadLag of config
+	followerReads      bool
+	maxFollowerReadLag uint64
+	// writeLimit limits client writes to MaxWritesPerSecond
+	writeLimit *tokenBucket
+	// dedup answers retried client writes, see DedupWindowSize
+	dedup *dedupWindow
 }
 
-// NewHTTPTransport ...
-func NewHTTPTransport(addr string, consumer <-chan raft.RPC) *HTTPTransport {
-	return &HTTPTransport{
-		consumer:  consumer,
-		localAddr: addr,
-		client: &http.Client{
-			Timeout: 15 * time.Second,
-		},
+// NewHTTPTransport is used to create transport of node at addr, which is
+// overridden by BindAddr and AdvertiseAddr of config if they're set
+func NewHTTPTransport(addr string, consumer <-chan raft.RPC, config *Config) *HTTPTransport {
+	t := &HTTPTransport{
+		consumer:           consumer,
+		localAddr:          addr,
+		bindAddr:           addr,
+		client:             newHTTPClient(config),
+		waitTimeout:        5 * time.Second,
+		writeTimeout:       time.Duration(config.WriteTimeout) * time.Millisecond,
+		codec:              config.Codec,
+		forwardToLeader:    config.ForwardToLeader,
+		followerReads:      config.AllowFollowerReads,
+		maxFollowerReadLag: config.MaxFollowerReadLag,
+		writeLimit:         newTokenBucket(config.MaxWritesPerSecond),
+		dedup:              newDedupWindow(config.DedupWindowSize),
+		enableAdmin:        config.EnableAdmin,
+		secret:             []byte(config.ClusterSecret),
+		scheme:             "http",
+	}
+	if config.TLSConfig != nil {
+		t.scheme = "https"
 	}
+	if config.AdvertiseAddr != "" {
+		t.localAddr = config.AdvertiseAddr
+	}
+	if config.BindAddr != "" {
+		t.bindAddr = config.BindAddr
+	}
+	return t
+}
+
+// url return URL of path on node at addr
+func (t *HTTPTransport) url(addr, path string) string {
+	return t.scheme + "://" + addr + path
 }
 
 // Consumer ...
@@ -46,35 +149,15 @@ func (t *HTTPTransport) LocalAddr() string {
 	return t.localAddr
 }
 
-// RequestVote is used to send vote request
-func (t *HTTPTransport) RequestVote(target string, req *raft.RequestVoteRequest, resp *raft.RequestVoteResponse) error {
-	url := "http://" + target + "/request_vote"
-
-	data, err := json.Marshal(req)
-	if err != nil {
-		return err
-	}
-
-	request, err := http.NewRequest("POST", url, bytes.NewBuffer(data))
-	request.Header.Set("Content-Type", "application/json")
-
-	if err != nil {
-		return err
-	}
-
-	response, err := t.client.Do(request)
-
-	if err != nil {
-		return err
-	}
-
-	body, _ := ioutil.ReadAll(response.Body)
-
-	defer func() {
-		_ = response.Body.Close()
-	}()
+// BindAddr return the address node should listen on, it may differ from
+// LocalAddr peers reach node at
+func (t *HTTPTransport) BindAddr() string {
+	return t.bindAddr
+}
 
-	return json.Unmarshal(body, &resp)
+// RequestVote is used to send vote request
+func (t *HTTPTransport) RequestVote(ctx context.Context, target string, req *raft.RequestVoteRequest, resp *raft.RequestVoteResponse) error {
+	return t.sendRPC(ctx, t.url(target, "/request_vote"), req, resp)
 }
 
 // RequestVoteHandle ...
@@ -87,7 +170,10 @@ func (t *HTTPTransport) requestVoteHandle(consumer chan raft.RPC) http.HandlerFu
 
 		var req raft.RequestVoteRequest
 
-		body, _ := ioutil.ReadAll(r.Body)
+		body, ok := t.readRPC(w, r)
+		if !ok {
+			return
+		}
 
 		d := json.NewDecoder(bytes.NewBuffer(body))
 		d.UseNumber()
@@ -96,51 +182,89 @@ func (t *HTTPTransport) requestVoteHandle(consumer chan raft.RPC) http.HandlerFu
 			panic(err)
 		}
 
-		respCh := make(chan raft.RPCResponse)
-
-		rpc := raft.RPC{
-			Request: &req,
-			RespCh:  respCh,
+		resp, ok := dispatchRPC(r, consumer, &req)
+		if !ok {
+			return
 		}
 
-		consumer <- rpc
-
-		for resp := range respCh {
-			data, err := json.Marshal(resp.Response.(*raft.RequestVoteResponse))
-			if err != nil {
-				w.WriteHeader(http.StatusBadRequest)
-			}
-			_, _ = w.Write(data)
+		data, err := json.Marshal(resp.Response.(*raft.RequestVoteResponse))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
 		}
+		_, _ = w.Write(data)
 	}
 }
 
 // AppendEntries is used to send append entries
-func (t *HTTPTransport) AppendEntries(target string, req *raft.AppendEntryRequest, resp *raft.AppendEntryResponse) error {
-	url := "http://" + target + "/append_entries"
+func (t *HTTPTransport) AppendEntries(ctx context.Context, target string, req *raft.AppendEntryRequest, resp *raft.AppendEntryResponse) error {
+	return t.sendRPC(ctx, t.url(target, "/append_entries"), req, resp)
+}
 
+func (t *HTTPTransport) sendRPC(ctx context.Context, url string, req interface{}, resp interface{}) error {
 	data, err := json.Marshal(req)
 	if err != nil {
 		return err
 	}
 
 	request, err := http.NewRequest("POST", url, bytes.NewBuffer(data))
-	request.Header.Set("Content-Type", "application/json")
-
 	if err != nil {
 		return err
 	}
+	request = request.WithContext(ctx)
+	request.Header.Set("Content-Type", "application/json")
+	if len(t.secret) > 0 {
+		request.Header.Set(HeaderSignature, t.sign(data))
+	}
 
 	response, err := t.client.Do(request)
 	if err != nil {
 		return err
 	}
-	body, _ := ioutil.ReadAll(response.Body)
+
+	body, err := ioutil.ReadAll(response.Body)
+
 	defer func() {
 		_ = response.Body.Close()
 	}()
 
-	return json.Unmarshal(body, &resp)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode != http.StatusOK {
+		if len(body) > 0 {
+			return fmt.Errorf("RPC to %s failed: %w", url, raft.DecodeError(string(body)))
+		}
+		return fmt.Errorf("RPC to %s failed: %s", url, response.Status)
+	}
+
+	return json.Unmarshal(body, resp)
+}
+
+// sign return signature of RPC body
+func (t *HTTPTransport) sign(body []byte) string {
+	mac := hmac.New(sha256.New, t.secret)
+	_, _ = mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// readRPC is used to read body of incoming RPC, if cluster secret is set
+// RPC without a valid signature is rejected with 401
+func (t *HTTPTransport) readRPC(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return nil, false
+	}
+	if len(t.secret) == 0 {
+		return body, true
+	}
+
+	signature := r.Header.Get(HeaderSignature)
+	if !hmac.Equal([]byte(signature), []byte(t.sign(body))) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return nil, false
+	}
+	return body, true
 }
 
 // AppendEntriesHandle ...
@@ -153,7 +277,10 @@ func (t *HTTPTransport) appendEntriesHandle(consumer chan raft.RPC) http.Handler
 
 		var req raft.AppendEntryRequest
 
-		body, _ := ioutil.ReadAll(r.Body)
+		body, ok := t.readRPC(w, r)
+		if !ok {
+			return
+		}
 
 		d := json.NewDecoder(bytes.NewBuffer(body))
 		d.UseNumber()
@@ -162,26 +289,123 @@ func (t *HTTPTransport) appendEntriesHandle(consumer chan raft.RPC) http.Handler
 			panic(err)
 		}
 
-		respCh := make(chan raft.RPCResponse)
+		resp, ok := dispatchRPC(r, consumer, &req)
+		if !ok {
+			return
+		}
 
-		rpc := raft.RPC{
-			Request: &req,
-			RespCh:  respCh,
+		data, err := json.Marshal(resp.Response.(*raft.AppendEntryResponse))
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		_, err = w.Write(data)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
 		}
+	}
+}
 
-		consumer <- rpc
+// TimeoutNow is used to ask target to start election
+func (t *HTTPTransport) TimeoutNow(ctx context.Context, target string, req *raft.TimeoutNowRequest, resp *raft.TimeoutNowResponse) error {
+	return t.sendRPC(ctx, t.url(target, "/timeout_now"), req, resp)
+}
 
-		for resp := range respCh {
+// TimeoutNowHandle ...
+func (t *HTTPTransport) TimeoutNowHandle(consumer chan raft.RPC) http.HandlerFunc {
+	return t.timeoutNowHandle(consumer)
+}
 
-			data, err := json.Marshal(resp.Response.(*raft.AppendEntryResponse))
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-			}
-			_, err = w.Write(data)
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-			}
+func (t *HTTPTransport) timeoutNowHandle(consumer chan raft.RPC) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req raft.TimeoutNowRequest
+		body, ok := t.readRPC(w, r)
+		if !ok {
+			return
+		}
+		if err := json.Unmarshal(body, &req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		resp, ok := dispatchRPC(r, consumer, &req)
+		if !ok {
+			return
+		}
+
+		data, err := json.Marshal(resp.Response.(*raft.TimeoutNowResponse))
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write(data)
+	}
+}
+
+// InstallSnapshot is used to send a chunk of snapshot to target
+func (t *HTTPTransport) InstallSnapshot(ctx context.Context, target string, req *raft.InstallSnapshotRequest, resp *raft.InstallSnapshotResponse) error {
+	return t.sendRPC(ctx, t.url(target, "/install_snapshot"), req, resp)
+}
+
+// InstallSnapshotHandle ...
+func (t *HTTPTransport) InstallSnapshotHandle(consumer chan raft.RPC) http.HandlerFunc {
+	return t.installSnapshotHandle(consumer)
+}
+
+// installSnapshotHandle fails with 500 if chunk can't be written, so leader
+// sends the snapshot again from the start
+func (t *HTTPTransport) installSnapshotHandle(consumer chan raft.RPC) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req raft.InstallSnapshotRequest
+		body, ok := t.readRPC(w, r)
+		if !ok {
+			return
+		}
+		if err := json.Unmarshal(body, &req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		resp, ok := dispatchRPC(r, consumer, &req)
+		if !ok {
+			return
+		}
+		if resp.Error != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(resp.Error.Error()))
+			return
+		}
+
+		data, err := json.Marshal(resp.Response.(*raft.InstallSnapshotResponse))
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
 		}
+		_, _ = w.Write(data)
+	}
+}
+
+// dispatchRPC is used to hand request to raft server and wait for its
+// response, it gives up once the caller goes away
+func dispatchRPC(r *http.Request, consumer chan raft.RPC, req interface{}) (raft.RPCResponse, bool) {
+	respCh := make(chan raft.RPCResponse, 1)
+
+	rpc := raft.RPC{
+		Request: req,
+		RespCh:  respCh,
+		Ctx:     r.Context(),
+	}
+
+	select {
+	case consumer <- rpc:
+	case <-r.Context().Done():
+		return raft.RPCResponse{}, false
+	}
+
+	select {
+	case resp := <-respCh:
+		return resp, true
+	case <-r.Context().Done():
+		return raft.RPCResponse{}, false
 	}
 }
 
@@ -193,19 +417,248 @@ func (t *HTTPTransport) GetHandle(server *raft.Server) http.HandlerFunc {
 func (t *HTTPTransport) getHandle(server *raft.Server) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
+		if r.URL.Query().Get("at_index") != "" {
+			t.getAtIndex(w, r, server)
+			return
+		}
+		if !t.waitReadable(w, r, server) {
+			return
+		}
+
+		var value []byte
+		if sm, ok := server.StateMachine().(*StateMachine); ok {
+			entry, found := sm.GetEntry(vars["key"])
+			if !writeEntry(w, entry, found) {
+				return
+			}
+			value = entry.Value
+		} else {
+			value = []byte(server.StateMachine().Get(vars["key"]).(string))
+		}
+		_, err := w.Write(value)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}
+}
+
+// getAtIndex is used to read key as of a past committed index, logs up to
+// it are replayed against a fresh state machine. It's gone once these logs
+// are compacted.
+func (t *HTTPTransport) getAtIndex(w http.ResponseWriter, r *http.Request, server *raft.Server) {
+	sm, ok := server.StateMachine().(*StateMachine)
+	index, err := strconv.ParseUint(r.URL.Query().Get("at_index"), 10, 64)
+	if !ok || err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	past := sm.fresh()
+	err = server.ReplayLogs(past, index)
+	switch {
+	case errors.Is(err, raft.ErrCompacted):
+		w.WriteHeader(http.StatusGone)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	case err != nil:
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+
+	entry, found := past.GetEntry(mux.Vars(r)["key"])
+	if writeEntry(w, entry, found) {
+		_, _ = w.Write(entry.Value)
+	}
+}
+
+// writeEntry is used to write headers of a read entry, it returns false
+// once not found is written
+func writeEntry(w http.ResponseWriter, entry Entry, found bool) bool {
+	w.Header().Set(HeaderVersion, strconv.FormatUint(entry.Version, 10))
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return false
+	}
+	if entry.ContentType != "" {
+		w.Header().Set("Content-Type", entry.ContentType)
+	}
+	return true
+}
+
+// GetManyHandle ...
+func (t *HTTPTransport) GetManyHandle(server *raft.Server) http.HandlerFunc {
+	return t.getManyHandle(server)
+}
 
-		var value interface{}
+// getManyHandle is used to read the comma separated keys in query as of one
+// applied index, so a txn is seen either whole or not at all. With prefix
+// in query instead, every key with it is read from a scan.
+func (t *HTTPTransport) getManyHandle(server *raft.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sm, ok := server.StateMachine().(*StateMachine)
+		prefix, scan := r.URL.Query()["prefix"]
+		keys := strings.Split(r.URL.Query().Get("keys"), ",")
+		if !ok || !scan && (len(keys) == 0 || keys[0] == "") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if !t.waitReadable(w, r, server) {
+			return
+		}
 
-		if server.State() == raft.Leader {
-			value = server.StateMachine().Get(vars["key"])
+		var values map[string]string
+		var index uint64
+		if scan {
+			it := sm.Scan(prefix[0])
+			values = make(map[string]string)
+			for it.Next() {
+				values[it.Key()] = string(it.Value())
+			}
+			index = it.Index()
 		} else {
-			value = server.Leader()
+			values, index = sm.GetMany(keys)
+		}
+		data, err := json.Marshal(&ReadResult{Index: index, Values: values})
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write(data)
+	}
+}
+
+// VersionsHandle ...
+func (t *HTTPTransport) VersionsHandle(server *raft.Server) http.HandlerFunc {
+	return t.versionsHandle(server)
+}
+
+// versionsHandle is used to read the index each of the comma separated
+// keys in query was last written at, without their values, so clients can
+// tell cached values are stale
+func (t *HTTPTransport) versionsHandle(server *raft.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sm, ok := server.StateMachine().(*StateMachine)
+		keys := strings.Split(r.URL.Query().Get("keys"), ",")
+		if !ok || len(keys) == 0 || keys[0] == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if !t.waitReadable(w, r, server) {
+			return
 		}
-		_, err := w.Write([]byte(value.(string)))
+
+		versions, index := sm.GetVersions(keys)
+		data, err := json.Marshal(&VersionsResult{Index: index, Versions: versions})
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write(data)
+	}
+}
+
+// WatchHandle ...
+func (t *HTTPTransport) WatchHandle(server *raft.Server) http.HandlerFunc {
+	return t.watchHandle(server)
+}
+
+// watchHandle is used to stream changes of key as server-sent events, one
+// JSON Change per event with its index as event id, as node applies them.
+// Stream ends once client disconnects, or once it falls too far behind
+// and should watch again.
+func (t *HTTPTransport) watchHandle(server *raft.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sm, ok := server.StateMachine().(*StateMachine)
+		flusher, canFlush := w.(http.Flusher)
+		if !ok || !canFlush {
+			w.WriteHeader(http.StatusNotImplemented)
+			return
+		}
+
+		changes, cancel := sm.Watch(mux.Vars(r)["key"])
+		defer cancel()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+		for {
+			select {
+			case change, ok := <-changes:
+				if !ok {
+					return
+				}
+				data, err := json.Marshal(&change)
+				if err != nil {
+					return
+				}
+				if _, err := fmt.Fprintf(w, "id: %d\ndata: %s\n\n", change.Index, data); err != nil {
+					return
+				}
+				flusher.Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+}
+
+// waitReadable is used to wait until node can serve a read at least as
+// fresh as X-Min-Index, it returns false once request is answered instead,
+// with leader address, forwarded or failed
+func (t *HTTPTransport) waitReadable(w http.ResponseWriter, r *http.Request, server *raft.Server) bool {
+	var minIndex uint64
+	if h := r.Header.Get(HeaderMinIndex); h != "" {
+		idx, err := strconv.ParseUint(h, 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return false
+		}
+		minIndex = idx
+	}
+
+	// Fresh leader may not have applied every committed write until its
+	// no-op is applied
+	leading := server.State() == raft.Leader
+	if start := server.TermStartIndex(); leading && start > minIndex {
+		minIndex = start
+	}
+
+	// Any node can serve a read once it applied the log client wants,
+	// with follower reads only if it's fresh enough
+	serve := leading || minIndex > 0
+	if !leading && t.followerReads {
+		serve = t.followerReadable(server, minIndex)
+	}
+	if !serve {
+		if leader, ok := t.forwardTarget(server, r); ok {
+			t.forward(w, r, leader)
+		} else {
+			_, _ = w.Write([]byte(server.Leader()))
 		}
+		return false
+	}
+
+	if err := server.WaitApplied(minIndex, t.waitTimeout); err != nil {
+		w.WriteHeader(http.StatusGatewayTimeout)
+		return false
+	}
+	return true
+}
+
+// followerReadable return whether follower may serve read at least as
+// fresh as log at minIndex. It must have caught up since start, have heard
+// from leader within lease, already received log at minIndex and not lag
+// leader too much.
+func (t *HTTPTransport) followerReadable(server *raft.Server, minIndex uint64) bool {
+	if !server.CaughtUp() {
+		return false
+	}
+	if _, fresh := server.LeaderCommitIndex(); !fresh || minIndex > server.LastLogIndex() {
+		return false
 	}
+	return server.ApplyLag() <= t.maxFollowerReadLag
 }
 
 // SetHandle ...
@@ -215,32 +668,880 @@ func (t *HTTPTransport) SetHandle(server *raft.Server) http.HandlerFunc {
 
 func (t *HTTPTransport) setHandle(server *raft.Server) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		vars := mux.Vars(r)
+		if leader, ok := t.forwardTarget(server, r); ok {
+			t.forward(w, r, leader)
+			return
+		}
 
-		body, err := ioutil.ReadAll(r.Body)
-		if err != nil {
+		cmd, ok := keyCommand(r, OpSet)
+		if !ok {
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
 
-		kv := &KeyValue{
-			Key:   vars["key"],
-			Value: string(body),
+		command, err := t.codec.Encode(*cmd)
+
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
 		}
 
-		command, err := json.Marshal(kv)
+		t.apply(w, r, server, command)
+	}
+}
+
+// CASHandle ...
+func (t *HTTPTransport) CASHandle(server *raft.Server) http.HandlerFunc {
+	return t.casHandle(server)
+}
+
+// casHandle is used to set value of a key only if it's still at the version
+// given in query, version 0 means the key must be absent
+func (t *HTTPTransport) casHandle(server *raft.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if leader, ok := t.forwardTarget(server, r); ok {
+			t.forward(w, r, leader)
+			return
+		}
 
+		version, err := strconv.ParseUint(r.URL.Query().Get("version"), 10, 64)
 		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
 
-		err = server.Do(command)
+		cmd, ok := keyCommand(r, OpCAS)
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		cmd.Version = version
+
+		command, err := t.codec.Encode(*cmd)
 		if err != nil {
-			_, sErr := w.Write([]byte(err.Error()))
-			if sErr != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-			}
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		t.apply(w, r, server, command)
+	}
+}
+
+// CommandHandle ...
+func (t *HTTPTransport) CommandHandle(server *raft.Server) http.HandlerFunc {
+	return t.commandHandle(server)
+}
+
+// commandHandle is used to apply a custom command registered on state
+// machine with op in path, body is its value
+func (t *HTTPTransport) commandHandle(server *raft.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if leader, ok := t.forwardTarget(server, r); ok {
+			t.forward(w, r, leader)
+			return
 		}
+
+		op := CommandOp(mux.Vars(r)["op"])
+		if sm, ok := server.StateMachine().(*StateMachine); !ok || !sm.hasCommand(op) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		cmd, ok := keyCommand(r, op)
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		command, err := t.codec.Encode(*cmd)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		t.apply(w, r, server, command)
+	}
+}
+
+// keyCommand is used to build a command writing body to the key of request,
+// with expiry if ttl is given in query
+func keyCommand(r *http.Request, op CommandOp) (*Command, bool) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, false
+	}
+
+	cmd := &Command{
+		Op:          op,
+		Key:         mux.Vars(r)["key"],
+		Value:       body,
+		ContentType: r.Header.Get("Content-Type"),
+		Time:        time.Now().UnixNano(),
+	}
+
+	if v := r.URL.Query().Get("ttl"); v != "" {
+		ttl, err := time.ParseDuration(v)
+		if err != nil || ttl <= 0 {
+			return nil, false
+		}
+		cmd.ExpireAt = cmd.Time + ttl.Nanoseconds()
+	}
+
+	if !clientWrite(r, cmd) {
+		return nil, false
+	}
+
+	return cmd, true
+}
+
+// clientWrite is used to tag command with client id and seq of request,
+// it returns false if seq is missing or invalid
+func clientWrite(r *http.Request, cmd *Command) bool {
+	cmd.ClientID = r.Header.Get(HeaderClientID)
+	if cmd.ClientID == "" {
+		return true
+	}
+	seq, err := strconv.ParseUint(r.Header.Get(HeaderClientSeq), 10, 64)
+	if err != nil || seq == 0 {
+		return false
+	}
+	cmd.Seq = seq
+	return true
+}
+
+// apply is used to replicate command, the index it's committed at is
+// returned in header and body so client can read its own write from any
+// node. The write is traced from the request, writes over the rate limit
+// are rejected before they're replicated and retried client writes are
+// answered from the dedup window. A write not committed within
+// writeTimeout is abandoned with 504, it may still commit later.
+func (t *HTTPTransport) apply(w http.ResponseWriter, r *http.Request, server *raft.Server, command []byte) {
+	if !t.writeLimit.allow() {
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+
+	ctx, cancel := t.writeContext(r)
+	defer cancel()
+	ctx, span := server.Tracer().StartSpan(ctx, "dkvs.Write")
+	span.SetAttribute("path", r.URL.Path)
+	index, result, err := t.applyOnce(ctx, r, server, command)
+	span.End(err)
+	if err != nil {
+		t.writeApplyError(w, server, err)
+		return
+	}
+
+	written := &WriteResult{Index: index}
+	written.Result, _ = result.(string)
+	data, err := json.Marshal(written)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(HeaderCommitIndex, strconv.FormatUint(index, 10))
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(data)
+}
+
+// writeContext return context of a write of request r, it's done after
+// WriteTimeout if one is set
+func (t *HTTPTransport) writeContext(r *http.Request) (context.Context, context.CancelFunc) {
+	if t.writeTimeout > 0 {
+		return context.WithTimeout(r.Context(), t.writeTimeout)
+	}
+	return context.WithCancel(r.Context())
+}
+
+// writeApplyError is used to report failed write. A write which may still
+// commit, e.g. on lost leadership or a canceled request, is reported like
+// any other the client can retry.
+func (t *HTTPTransport) writeApplyError(w http.ResponseWriter, server *raft.Server, err error) {
+	switch {
+	case errors.Is(err, raft.ErrNotLeader):
+		_, _ = w.Write([]byte(server.Leader()))
+		return
+	case errors.Is(err, ErrVersionMismatch):
+		w.WriteHeader(http.StatusConflict)
+	case errors.Is(err, raft.ErrServerShutdown), errors.Is(err, raft.ErrQueueFull),
+		errors.Is(err, raft.ErrLeadershipLost), errors.Is(err, raft.ErrLeadershipTransferInProgress),
+		errors.Is(err, context.Canceled):
+		w.WriteHeader(http.StatusServiceUnavailable)
+	case errors.Is(err, raft.ErrLogEntryTooLarge):
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+	case errors.Is(err, context.DeadlineExceeded):
+		w.WriteHeader(http.StatusGatewayTimeout)
+		_, _ = w.Write([]byte("write not committed within " + t.writeTimeout.String()))
+		return
+	case errors.Is(err, raft.ErrTimeout):
+		w.WriteHeader(http.StatusGatewayTimeout)
+	}
+	_, sErr := w.Write([]byte(err.Error()))
+	if sErr != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// applyOnce is used to apply command unless the same client write is
+// already committed or in flight within dedup window, its result is
+// returned then
+func (t *HTTPTransport) applyOnce(ctx context.Context, r *http.Request, server *raft.Server, command []byte) (uint64, interface{}, error) {
+	key, ok := clientWriteKey(r)
+	if !ok || t.dedup == nil {
+		return server.ApplyResult(ctx, command)
+	}
+
+	for {
+		write, seen := t.dedup.begin(key)
+		if !seen {
+			index, result, err := server.ApplyResult(ctx, command)
+			t.dedup.finish(write, index, result, err)
+			return index, result, err
+		}
+
+		select {
+		case <-write.done:
+		case <-ctx.Done():
+			return 0, nil, ctx.Err()
+		}
+		// Failed write is forgotten, this one is dispatched instead
+		if write.err == nil {
+			return write.index, write.result, nil
+		}
+	}
+}
+
+// forwardTarget return leader address if request should be forwarded to it
+func (t *HTTPTransport) forwardTarget(server *raft.Server, r *http.Request) (string, bool) {
+	if !t.forwardToLeader || r.Header.Get(HeaderForwarded) != "" {
+		return "", false
+	}
+	if server.State() == raft.Leader {
+		return "", false
+	}
+	leader := server.Leader()
+	if leader == "" || leader == server.LocalAddr() {
+		return "", false
+	}
+	return leader, true
+}
+
+// forward is used to proxy request to leader and relay its response
+func (t *HTTPTransport) forward(w http.ResponseWriter, r *http.Request, leader string) {
+	request, err := http.NewRequest(r.Method, t.url(leader, r.URL.RequestURI()), r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	request = request.WithContext(r.Context())
+	request.Header = r.Header.Clone()
+	request.Header.Set(HeaderForwarded, t.localAddr)
+
+	response, err := t.client.Do(request)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+	defer func() {
+		_ = response.Body.Close()
+	}()
+
+	for k, v := range response.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(response.StatusCode)
+	_, _ = io.Copy(w, response.Body)
+}
+
+// txnOp is an op in body of a txn request, its value is a JSON string
+// rather than the base64 bytes Command is encoded with
+type txnOp struct {
+	*Command
+	Value string `json:"value,omitempty"`
+}
+
+// txnCompare is a compare in body of a txn request, value is a JSON string
+type txnCompare struct {
+	*Compare
+	Value string `json:"value,omitempty"`
+}
+
+// txnRequest is body of a txn request with compares, success ops are
+// applied if every compare holds and failure ops if not. A plain array of
+// ops is a txn without compares.
+type txnRequest struct {
+	Compare []txnCompare `json:"compare"`
+	Success []txnOp      `json:"success"`
+	Failure []txnOp      `json:"failure"`
+}
+
+func txnCommands(ops []txnOp) []*Command {
+	cmds := make([]*Command, len(ops))
+	for i, op := range ops {
+		if op.Command == nil {
+			op.Command = &Command{}
+		}
+		op.Command.Value = []byte(op.Value)
+		cmds[i] = op.Command
+	}
+	return cmds
+}
+
+// TxnHandle ...
+func (t *HTTPTransport) TxnHandle(server *raft.Server) http.HandlerFunc {
+	return t.txnHandle(server)
+}
+
+func (t *HTTPTransport) txnHandle(server *raft.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if leader, ok := t.forwardTarget(server, r); ok {
+			t.forward(w, r, leader)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var req txnRequest
+		if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+			err = json.Unmarshal(body, &req.Success)
+		} else {
+			err = json.Unmarshal(body, &req)
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		cmd := &Command{
+			Op:      OpTxn,
+			Txn:     txnCommands(req.Success),
+			Failure: txnCommands(req.Failure),
+			Time:    time.Now().UnixNano(),
+		}
+		for _, c := range req.Compare {
+			if c.Compare == nil {
+				c.Compare = &Compare{}
+			}
+			c.Compare.Value = []byte(c.Value)
+			cmd.Compare = append(cmd.Compare, c.Compare)
+		}
+		if !clientWrite(r, cmd) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if err := cmd.validate(nil); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+
+		command, err := t.codec.Encode(*cmd)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		t.apply(w, r, server, command)
+	}
+}
+
+// BarrierHandle ...
+func (t *HTTPTransport) BarrierHandle(server *raft.Server) http.HandlerFunc {
+	return t.barrierHandle(server)
+}
+
+// barrierHandle is used to wait until every write committed before the
+// request is applied on leader
+func (t *HTTPTransport) barrierHandle(server *raft.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := server.Barrier(t.waitTimeout)
+		switch {
+		case err == nil:
+			return
+		case errors.Is(err, raft.ErrNotLeader):
+			_, _ = w.Write([]byte(server.Leader()))
+			return
+		case errors.Is(err, raft.ErrTimeout):
+			w.WriteHeader(http.StatusGatewayTimeout)
+		case errors.Is(err, raft.ErrLeadershipLost), errors.Is(err, raft.ErrServerShutdown):
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		_, _ = w.Write([]byte(err.Error()))
+	}
+}
+
+// LeaveHandle ...
+func (t *HTTPTransport) LeaveHandle(server *raft.Server) http.HandlerFunc {
+	return t.leaveHandle(server)
+}
+
+// leaveHandle is used to remove the node from cluster. Leader leaves by
+// itself or removes the member given in query, a follower asks leader to
+// remove it and stops once the removal is committed. Nodes which can't do
+// either return leader address. Conflict is returned while another
+// membership change is pending.
+func (t *HTTPTransport) leaveHandle(server *raft.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		member := r.URL.Query().Get("member")
+		switch {
+		case member != "" && member != server.LocalAddr():
+			err = server.RemovePeer(member, t.waitTimeout)
+		case server.State() == raft.Leader:
+			err = server.Leave(t.waitTimeout)
+		default:
+			if leader := server.Leader(); leader != "" && leader != server.LocalAddr() {
+				t.leaveThrough(w, r, server, leader)
+				return
+			}
+			err = raft.ErrNotLeader
+		}
+		switch {
+		case err == nil:
+			return
+		case errors.Is(err, raft.ErrNotLeader):
+			_, _ = w.Write([]byte(server.Leader()))
+			return
+		case errors.Is(err, raft.ErrConfigChangeInProgress):
+			w.WriteHeader(http.StatusConflict)
+		case errors.Is(err, raft.ErrTimeout):
+			w.WriteHeader(http.StatusGatewayTimeout)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		_, _ = w.Write([]byte(err.Error()))
+	}
+}
+
+// leaveThrough is used to have leader remove this node, leader's response
+// is relayed if it doesn't commit the removal
+func (t *HTTPTransport) leaveThrough(w http.ResponseWriter, r *http.Request, server *raft.Server, leader string) {
+	path := "/cluster/leave?member=" + url.QueryEscape(server.LocalAddr())
+	request, err := http.NewRequestWithContext(r.Context(), "POST", t.url(leader, path), nil)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	request.Header = r.Header.Clone()
+	request.Header.Set(HeaderForwarded, t.localAddr)
+
+	response, err := t.client.Do(request)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+	defer func() {
+		_ = response.Body.Close()
+	}()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+	// A node which isn't leader anymore answers with leader address
+	if response.StatusCode != http.StatusOK || len(body) > 0 {
+		w.WriteHeader(response.StatusCode)
+		_, _ = w.Write(body)
+		return
+	}
+	server.Stop()
+}
+
+// ClusterConfigHandle ...
+func (t *HTTPTransport) ClusterConfigHandle(server *raft.Server) http.HandlerFunc {
+	return t.clusterConfigHandle(server)
+}
+
+// clusterConfigHandle is used to report voters and learners as this node
+// last applied them, comparing it across nodes shows whether they agree on
+// membership
+func (t *HTTPTransport) clusterConfigHandle(server *raft.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		data, err := json.Marshal(server.Configuration())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(data)
+	}
+}
+
+// configChange is body of a validate request, members to add and remove
+type configChange struct {
+	Add    []string `json:"add"`
+	Remove []string `json:"remove"`
+}
+
+// ValidateHandle ...
+func (t *HTTPTransport) ValidateHandle(server *raft.Server) http.HandlerFunc {
+	return t.validateHandle(server)
+}
+
+// validateHandle is used to check a membership change without applying
+// it, it's only answered by leader, other nodes return leader address.
+// Conflict is returned if the change would leave no reachable quorum.
+func (t *HTTPTransport) validateHandle(server *raft.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req configChange
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		err := server.ValidateConfigChange(req.Add, req.Remove)
+		switch {
+		case err == nil:
+			return
+		case errors.Is(err, raft.ErrNotLeader):
+			_, _ = w.Write([]byte(server.Leader()))
+			return
+		case errors.Is(err, raft.ErrQuorumUnreachable):
+			w.WriteHeader(http.StatusConflict)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		_, _ = w.Write([]byte(err.Error()))
+	}
+}
+
+// HealthzHandle ...
+func (t *HTTPTransport) HealthzHandle(server *raft.Server) http.HandlerFunc {
+	return t.healthzHandle(server)
+}
+
+// healthzHandle is used to report the process is alive, it doesn't depend
+// on cluster state
+func (t *HTTPTransport) healthzHandle(server *raft.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}
+}
+
+// ReadyzHandle ...
+func (t *HTTPTransport) ReadyzHandle(server *raft.Server) http.HandlerFunc {
+	return t.readyzHandle(server)
+}
+
+// readyzHandle is used to report whether node is a functioning member, it
+// must know the leader, have caught up since start and have applied every
+// log leader committed
+func (t *HTTPTransport) readyzHandle(server *raft.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !server.HasLeader() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte("no leader"))
+			return
+		}
+		if !server.CaughtUp() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte("catching up"))
+			return
+		}
+		if lag := server.ApplyLag(); lag > 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = fmt.Fprintf(w, "%d committed logs not applied", lag)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}
+}
+
+// LeaderHandle ...
+func (t *HTTPTransport) LeaderHandle(server *raft.Server) http.HandlerFunc {
+	return t.leaderHandle(server)
+}
+
+// leaderHandle is used to return address of the leader node knows, so
+// client can find it without a write
+func (t *HTTPTransport) leaderHandle(server *raft.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		leader := server.Leader()
+		if leader == "" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte("no leader"))
+			return
+		}
+
+		data, err := json.Marshal(&LeaderResult{Leader: leader})
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(data)
+	}
+}
+
+// AdminLogHandle ...
+func (t *HTTPTransport) AdminLogHandle(server *raft.Server) http.HandlerFunc {
+	return t.adminLogHandle(server)
+}
+
+// adminLogHandle is used to return raw logs with index in [from, to], so
+// logs of nodes can be compared. Range defaults to every log in store and
+// is capped to it. It's not found unless admin endpoints are enabled.
+func (t *HTTPTransport) adminLogHandle(server *raft.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !t.enableAdmin {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		ls := server.LogStore()
+		first, err := ls.FirstIndex()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		last, err := ls.LastIndex()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		from, err := queryIndex(r, "from", first)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		to, err := queryIndex(r, "to", last)
+		if err != nil || from > to {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if from < first {
+			from = first
+		}
+		if to > last {
+			to = last
+		}
+
+		logs := []*raft.Log{}
+		for idx := from; idx <= to && idx > 0; idx++ {
+			log, err := ls.GetLog(idx)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				_, _ = w.Write([]byte(err.Error()))
+				return
+			}
+			logs = append(logs, log)
+		}
+
+		data, err := json.Marshal(logs)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(data)
+	}
+}
+
+// queryIndex return log index in query param, def if it's not set
+func queryIndex(r *http.Request, param string, def uint64) (uint64, error) {
+	v := r.URL.Query().Get(param)
+	if v == "" {
+		return def, nil
+	}
+	return strconv.ParseUint(v, 10, 64)
+}
+
+// Status describe current status of a node
+type Status struct {
+	Addr         string              `json:"addr"`
+	State        string              `json:"state"`
+	Term         uint64              `json:"term"`
+	Leader       string              `json:"leader"`
+	CommitIndex  uint64              `json:"commitIndex"`
+	LastLogIndex uint64              `json:"lastLogIndex"`
+	LastApplied  uint64              `json:"lastApplied"`
+	Peers        []string            `json:"peers"`
+	Learners     []string            `json:"learners,omitempty"`
+	Replication  []raft.PeerProgress `json:"replication,omitempty"`
+}
+
+// StatusHandle ...
+func (t *HTTPTransport) StatusHandle(server *raft.Server) http.HandlerFunc {
+	return t.statusHandle(server)
+}
+
+func (t *HTTPTransport) statusHandle(server *raft.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		stats := server.Stats()
+		status := &Status{
+			Addr:         server.LocalAddr(),
+			State:        stats.State,
+			Term:         stats.Term,
+			Leader:       stats.Leader,
+			CommitIndex:  stats.CommitIndex,
+			LastLogIndex: stats.LastLogIndex,
+			LastApplied:  stats.LastApplied,
+			Peers:        server.Peers(),
+			Learners:     server.Learners(),
+			Replication:  stats.Replication,
+		}
+
+		data, err := json.Marshal(status)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(data)
+	}
+}
+
+// AdminExportHandle ...
+func (t *HTTPTransport) AdminExportHandle(server *raft.Server) http.HandlerFunc {
+	return t.adminExportHandle(server)
+}
+
+// adminExportHandle is used to back up committed state of cluster, it's
+// only served by leader, other nodes return leader address
+func (t *HTTPTransport) adminExportHandle(server *raft.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !t.enableAdmin {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		ctx, cancel := t.writeContext(r)
+		defer cancel()
+		var buf bytes.Buffer
+		err := server.Export(ctx, &buf)
+		if err == nil {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			_, _ = w.Write(buf.Bytes())
+			return
+		}
+		t.writeAdminError(w, server, err)
+	}
+}
+
+// AdminImportHandle ...
+func (t *HTTPTransport) AdminImportHandle(server *raft.Server) http.HandlerFunc {
+	return t.adminImportHandle(server)
+}
+
+// adminImportHandle is used to restore an export into a fresh single node
+// cluster, a cluster with other members or data rejects it with conflict
+func (t *HTTPTransport) adminImportHandle(server *raft.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !t.enableAdmin {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		ctx, cancel := t.writeContext(r)
+		defer cancel()
+		if err := server.Import(ctx, r.Body); err != nil {
+			t.writeAdminError(w, server, err)
+		}
+	}
+}
+
+// AdminStepDownHandle ...
+func (t *HTTPTransport) AdminStepDownHandle(server *raft.Server) http.HandlerFunc {
+	return t.adminStepDownHandle(server)
+}
+
+// adminStepDownHandle is used to make leader step down so a new leader is
+// elected, other nodes do nothing and return leader address
+func (t *HTTPTransport) adminStepDownHandle(server *raft.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !t.enableAdmin {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if err := server.StepDown(); err != nil {
+			t.writeAdminError(w, server, err)
+		}
+	}
+}
+
+// AdminDrainHandle ...
+func (t *HTTPTransport) AdminDrainHandle(server *raft.Server) http.HandlerFunc {
+	return t.adminDrainHandle(server)
+}
+
+// adminDrainHandle is used to keep node from becoming leader until it's
+// undrained, leader hands leadership to a peer first
+func (t *HTTPTransport) adminDrainHandle(server *raft.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !t.enableAdmin {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if err := server.Drain(t.waitTimeout); err != nil {
+			t.writeAdminError(w, server, err)
+		}
+	}
+}
+
+// AdminUndrainHandle ...
+func (t *HTTPTransport) AdminUndrainHandle(server *raft.Server) http.HandlerFunc {
+	return t.adminUndrainHandle(server)
+}
+
+// adminUndrainHandle is used to let drained node become leader again
+func (t *HTTPTransport) adminUndrainHandle(server *raft.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !t.enableAdmin {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		server.Undrain()
+	}
+}
+
+// AdminResetHandle ...
+func (t *HTTPTransport) AdminResetHandle(server *raft.Server) http.HandlerFunc {
+	return t.adminResetHandle(server)
+}
+
+// adminResetHandle is used to wipe log and state machine of a follower so
+// it catches up from leader again, leader and voters refuse with conflict
+func (t *HTTPTransport) adminResetHandle(server *raft.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !t.enableAdmin {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if err := server.Reset(); err != nil {
+			t.writeAdminError(w, server, err)
+		}
+	}
+}
+
+// writeAdminError is used to report failed admin operation
+func (t *HTTPTransport) writeAdminError(w http.ResponseWriter, server *raft.Server, err error) {
+	switch {
+	case errors.Is(err, raft.ErrNotLeader):
+		_, _ = w.Write([]byte(server.Leader()))
+		return
+	case errors.Is(err, raft.ErrNotEmpty), errors.Is(err, raft.ErrIsLeader), errors.Is(err, raft.ErrIsVoter):
+		w.WriteHeader(http.StatusConflict)
+	case errors.Is(err, raft.ErrSnapshotUnsupported), errors.Is(err, raft.ErrResetUnsupported):
+		w.WriteHeader(http.StatusNotImplemented)
+	case errors.Is(err, raft.ErrTimeout), errors.Is(err, context.DeadlineExceeded):
+		w.WriteHeader(http.StatusGatewayTimeout)
+	case errors.Is(err, raft.ErrLeadershipLost), errors.Is(err, raft.ErrServerShutdown), errors.Is(err, context.Canceled):
+		w.WriteHeader(http.StatusServiceUnavailable)
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
 	}
+	_, _ = w.Write([]byte(err.Error()))
 }
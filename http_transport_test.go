@@ -0,0 +1,1819 @@
+package dkvs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"dkvs/raft"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	testElectionTimeout = 150 * time.Millisecond
+)
+
+// newRaftServer is used to create raft server with default config and
+// in-memory log store
+func newRaftServer(t *testing.T, transport raft.Transport, sm raft.StateMachine) *raft.Server {
+	s, err := raft.NewServer(raft.DefaultConfig(), transport, raft.NewInmemLogStore(), sm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func newTestLeader(t *testing.T) (*raft.Server, *HTTPTransport) {
+	transport := raft.NewInmemTransport("")
+	s := newRaftServer(t, transport, NewStateMachine(DefaultConfig()))
+	s.Start()
+
+	deadline := time.Now().Add(20 * testElectionTimeout)
+	for s.State() != raft.Leader {
+		if time.Now().After(deadline) {
+			s.Stop()
+			t.Fatalf("Server not promote to leader")
+		}
+		time.Sleep(testElectionTimeout / 10)
+	}
+
+	return s, NewHTTPTransport(s.LocalAddr(), nil, DefaultConfig())
+}
+
+// newTestCluster is used to create started cluster backed by StateMachine
+func newTestCluster(t *testing.T, total int) ([]*raft.Server, *raft.Server) {
+	return newTestClusterAddrs(t, make([]string, total))
+}
+
+// newTestClusterAddrs is used to create started cluster with given
+// server addresses, empty ones are generated
+func newTestClusterAddrs(t *testing.T, addrs []string) ([]*raft.Server, *raft.Server) {
+	var transports []*raft.InmemTransport
+	for _, addr := range addrs {
+		transports = append(transports, raft.NewInmemTransport(addr))
+	}
+
+	var cluster []*raft.Server
+	for _, transport := range transports {
+		s := newRaftServer(t, transport, NewStateMachine(DefaultConfig()))
+		for _, peer := range transports {
+			if peer != transport {
+				transport.AddPeer(peer)
+				s.AddPeer(peer.LocalAddr(), 0)
+			}
+		}
+		cluster = append(cluster, s)
+	}
+	for _, s := range cluster {
+		s.Start()
+	}
+
+	// Wait until every server follows the same leader
+	deadline := time.Now().Add(20 * testElectionTimeout)
+	for time.Now().Before(deadline) {
+		for _, leader := range cluster {
+			if leader.State() != raft.Leader {
+				continue
+			}
+			agreed := true
+			for _, s := range cluster {
+				agreed = agreed && s.Leader() == leader.LocalAddr()
+			}
+			if agreed {
+				return cluster, leader
+			}
+		}
+		time.Sleep(testElectionTimeout / 10)
+	}
+	stopCluster(cluster)
+	t.Fatalf("Cannot elect leader")
+	return nil, nil
+}
+
+func stopCluster(cluster []*raft.Server) {
+	for _, s := range cluster {
+		s.Stop()
+	}
+}
+
+func newTestRouter(s *raft.Server, transport *HTTPTransport) *mux.Router {
+	r := mux.NewRouter()
+	r.HandleFunc("/store", transport.GetManyHandle(s)).Methods("GET")
+	r.HandleFunc("/store/{key}", transport.GetHandle(s)).Methods("GET")
+	r.HandleFunc("/store/{key}", transport.SetHandle(s)).Methods("POST")
+	r.HandleFunc("/store/{key}/cas", transport.CASHandle(s)).Methods("POST")
+	r.HandleFunc("/store/{key}/{op}", transport.CommandHandle(s)).Methods("POST")
+	r.HandleFunc("/versions", transport.VersionsHandle(s)).Methods("GET")
+	r.HandleFunc("/watch/{key}", transport.WatchHandle(s)).Methods("GET")
+	r.HandleFunc("/txn", transport.TxnHandle(s)).Methods("POST")
+	r.HandleFunc("/barrier", transport.BarrierHandle(s)).Methods("POST")
+	r.HandleFunc("/cluster/leave", transport.LeaveHandle(s)).Methods("POST")
+	r.HandleFunc("/cluster/validate", transport.ValidateHandle(s)).Methods("POST")
+	r.HandleFunc("/cluster/config", transport.ClusterConfigHandle(s)).Methods("GET")
+	r.HandleFunc("/status", transport.StatusHandle(s)).Methods("GET")
+	r.HandleFunc("/healthz", transport.HealthzHandle(s)).Methods("GET")
+	r.HandleFunc("/readyz", transport.ReadyzHandle(s)).Methods("GET")
+	r.HandleFunc("/leader", transport.LeaderHandle(s)).Methods("GET")
+	r.HandleFunc("/admin/log", transport.AdminLogHandle(s)).Methods("GET")
+	r.HandleFunc("/admin/export", transport.AdminExportHandle(s)).Methods("GET")
+	r.HandleFunc("/admin/import", transport.AdminImportHandle(s)).Methods("POST")
+	r.HandleFunc("/admin/step_down", transport.AdminStepDownHandle(s)).Methods("POST")
+	r.HandleFunc("/admin/drain", transport.AdminDrainHandle(s)).Methods("POST")
+	r.HandleFunc("/admin/undrain", transport.AdminUndrainHandle(s)).Methods("POST")
+	r.HandleFunc("/admin/reset", transport.AdminResetHandle(s)).Methods("POST")
+	return r
+}
+
+func doRequest(r http.Handler, method, url, body string, headers ...string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(method, url, strings.NewReader(body))
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestStatusHandle(t *testing.T) {
+	s, transport := newTestLeader(t)
+	defer s.Stop()
+
+	r := newTestRouter(s, transport)
+	// Leader's no-op takes the first index
+	if w := doRequest(r, "POST", "/store/a", "b"); w.Code != http.StatusOK || w.Header().Get(HeaderCommitIndex) != "2" {
+		t.Fatalf("Failed to set key: %v %s", w.Code, w.Body.String())
+	}
+
+	w := doRequest(r, "GET", "/status", "")
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Wrong status code: %v", w.Code)
+	}
+
+	var status Status
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Addr != s.LocalAddr() || status.State != "Leader" || status.Leader != s.LocalAddr() {
+		t.Fatalf("Wrong node status: %+v", status)
+	}
+	if status.Term != s.CurrentTerm() || status.CommitIndex != 2 || status.LastLogIndex != 2 || status.LastApplied != 2 {
+		t.Fatalf("Wrong log status: %+v", status)
+	}
+}
+
+func TestTxnHandle(t *testing.T) {
+	s, transport := newTestLeader(t)
+	defer s.Stop()
+
+	r := newTestRouter(s, transport)
+	doRequest(r, "POST", "/store/c", "3")
+
+	w := doRequest(r, "POST", "/txn", `[{"op":"set","key":"a","value":"1"},{"op":"set","key":"b","value":"2"},{"op":"delete","key":"c"}]`)
+	if w.Code != http.StatusOK || w.Header().Get(HeaderCommitIndex) != "3" {
+		t.Fatalf("Failed to apply txn: %v %s", w.Code, w.Body.String())
+	}
+
+	sm := s.StateMachine()
+	for key, want := range map[string]string{"a": "1", "b": "2", "c": ""} {
+		if v := sm.Get(key); v != want {
+			t.Fatalf("Wrong value of %s: %v (want %v)", key, v, want)
+		}
+	}
+
+	// Invalid operation rejects the whole txn
+	w = doRequest(r, "POST", "/txn", `[{"op":"set","key":"a","value":"10"},{"op":"incr","key":"b"}]`)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Invalid txn should be rejected: %v", w.Code)
+	}
+	if v := sm.Get("a"); v != "1" {
+		t.Fatalf("Rejected txn should not be applied: %v", v)
+	}
+}
+
+func TestTxnHandleCompare(t *testing.T) {
+	s, transport := newTestLeader(t)
+	defer s.Stop()
+
+	r := newTestRouter(s, transport)
+	sm := s.StateMachine()
+	doRequest(r, "POST", "/store/a", "1")
+
+	// Every compare holds, success ops are applied
+	w := doRequest(r, "POST", "/txn", `{"compare":[{"key":"a","target":"value","value":"1"},{"key":"a","target":"version","version":2},{"key":"b","target":"version","version":0}],`+
+		`"success":[{"op":"set","key":"b","value":"2"}],"failure":[{"op":"set","key":"c","value":"3"}]}`)
+	var result WriteResult
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil || result.Result != TxnSuccess {
+		t.Fatalf("Txn should succeed: %v %s", w.Code, w.Body.String())
+	}
+	if sm.Get("b") != "2" || sm.Get("c") != "" {
+		t.Fatalf("Wrong values after success: %v %v", sm.Get("b"), sm.Get("c"))
+	}
+
+	// Stale version fails the txn, only failure ops are applied
+	w = doRequest(r, "POST", "/txn", `{"compare":[{"key":"a","target":"value","value":"1"},{"key":"b","target":"version","version":0}],`+
+		`"success":[{"op":"delete","key":"a"}],"failure":[{"op":"set","key":"c","value":"3"}]}`)
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil || result.Result != TxnFailure {
+		t.Fatalf("Txn should fail: %v %s", w.Code, w.Body.String())
+	}
+	if sm.Get("a") != "1" || sm.Get("c") != "3" {
+		t.Fatalf("Wrong values after failure: %v %v", sm.Get("a"), sm.Get("c"))
+	}
+
+	w = doRequest(r, "POST", "/txn", `{"compare":[{"key":"a","target":"ttl"}],"success":[]}`)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Unknown compare target should be rejected: %v", w.Code)
+	}
+}
+
+func TestTxnAtomicVisibility(t *testing.T) {
+	s, transport := newTestLeader(t)
+	defer s.Stop()
+
+	r := newTestRouter(s, transport)
+	sm := s.StateMachine().(*StateMachine)
+	total := 50
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 1; i <= total; i++ {
+			body := fmt.Sprintf(`[{"op":"set","key":"x","value":"%d"},{"op":"set","key":"y","value":"%d"}]`, i, i)
+			doRequest(r, "POST", "/txn", body)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 1; i <= total; i++ {
+			doRequest(r, "POST", "/store/z", fmt.Sprint(i))
+		}
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	for {
+		sm.Lock()
+		x, y := sm.data["x"], sm.data["y"]
+		sm.Unlock()
+		if !bytes.Equal(x, y) {
+			t.Fatalf("Partial txn is visible: x=%s y=%s", x, y)
+		}
+
+		select {
+		case <-done:
+			if x := sm.Get("x"); x != fmt.Sprint(total) {
+				t.Fatalf("Wrong final value: %v", x)
+			}
+			if z := sm.Get("z"); z != fmt.Sprint(total) {
+				t.Fatalf("Wrong final value: %v", z)
+			}
+			return
+		default:
+		}
+	}
+}
+
+func TestGetManyHandle(t *testing.T) {
+	s, transport := newTestLeader(t)
+	defer s.Stop()
+
+	r := newTestRouter(s, transport)
+	total := 50
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1; i <= total; i++ {
+			body := fmt.Sprintf(`[{"op":"set","key":"x","value":"%d"},{"op":"set","key":"y","value":"%d"}]`, i, i)
+			doRequest(r, "POST", "/txn", body)
+		}
+	}()
+
+	var last uint64
+	for reading := true; reading; {
+		select {
+		case <-done:
+			reading = false
+		default:
+		}
+
+		w := doRequest(r, "GET", "/store?keys=x,y", "")
+		var result ReadResult
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Fatalf("Failed to read keys: %v %s", w.Code, w.Body.String())
+		}
+		if result.Values["x"] != result.Values["y"] {
+			t.Fatalf("Partial txn is visible: %v", result.Values)
+		}
+		if result.Index < last {
+			t.Fatalf("Read index should not go backward: %d after %d", result.Index, last)
+		}
+		last = result.Index
+	}
+
+	w := doRequest(r, "GET", "/store?keys=x,y,z", "")
+	var result ReadResult
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"x": fmt.Sprint(total), "y": fmt.Sprint(total), "z": ""}
+	if !reflect.DeepEqual(result.Values, want) || result.Index != s.LastApplied() {
+		t.Fatalf("Wrong read result: %+v", result)
+	}
+
+	if w := doRequest(r, "GET", "/store", ""); w.Code != http.StatusBadRequest {
+		t.Fatalf("Read without keys should be rejected: %v", w.Code)
+	}
+
+	w = doRequest(r, "GET", "/store?prefix=", "")
+	result = ReadResult{}
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	want = map[string]string{"x": fmt.Sprint(total), "y": fmt.Sprint(total)}
+	if !reflect.DeepEqual(result.Values, want) || result.Index != s.LastApplied() {
+		t.Fatalf("Wrong scan result: %+v", result)
+	}
+}
+
+func TestHTTPTransportRPC(t *testing.T) {
+	consumer := make(chan raft.RPC)
+	transport := NewHTTPTransport("", consumer, DefaultConfig())
+	s := newRaftServer(t, transport, NewStateMachine(DefaultConfig()))
+	s.Start()
+	defer s.Stop()
+
+	r := mux.NewRouter()
+	r.HandleFunc("/request_vote", transport.RequestVoteHandle(consumer)).Methods("POST")
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	req := &raft.RequestVoteRequest{Term: 1, Candidate: "foo"}
+	var resp raft.RequestVoteResponse
+	if err := transport.RequestVote(ctx, strings.TrimPrefix(ts.URL, "http://"), req, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Term != 1 || !resp.Granted {
+		t.Fatalf("Wrong vote response: %+v", resp)
+	}
+}
+
+func TestHTTPTransportAdvertiseAddr(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	// Node listens on one address and is known to peers by another
+	config := DefaultConfig()
+	config.BindAddr = listener.Addr().String()
+	config.AdvertiseAddr = "localhost:" + port
+	consumer := make(chan raft.RPC)
+	transport := NewHTTPTransport("unused:8080", consumer, config)
+	if transport.BindAddr() != config.BindAddr || transport.LocalAddr() != config.AdvertiseAddr {
+		t.Fatalf("Wrong addresses: bind %v advertise %v", transport.BindAddr(), transport.LocalAddr())
+	}
+	s := newRaftServer(t, transport, NewStateMachine(config))
+	s.Start()
+	defer s.Stop()
+	if s.LocalAddr() != config.AdvertiseAddr {
+		t.Fatalf("Server should be identified by advertised address: %v", s.LocalAddr())
+	}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/request_vote", transport.RequestVoteHandle(consumer)).Methods("POST")
+	ts := &httptest.Server{Listener: listener, Config: &http.Server{Handler: r}}
+	ts.Start()
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	req := &raft.RequestVoteRequest{Term: 1, Candidate: "foo"}
+	var resp raft.RequestVoteResponse
+	if err := NewHTTPTransport("", nil, DefaultConfig()).RequestVote(ctx, s.LocalAddr(), req, &resp); err != nil {
+		t.Fatalf("Peer should reach node at advertised address: %v", err)
+	}
+	if !resp.Granted {
+		t.Fatalf("Wrong vote response: %+v", resp)
+	}
+}
+
+func TestHTTPTransportSignedRPC(t *testing.T) {
+	config := DefaultConfig()
+	config.ClusterSecret = "secret"
+	consumer := make(chan raft.RPC)
+	transport := NewHTTPTransport("", consumer, config)
+	s := newRaftServer(t, transport, NewStateMachine(config))
+	s.Start()
+	defer s.Stop()
+
+	r := mux.NewRouter()
+	r.HandleFunc("/request_vote", transport.RequestVoteHandle(consumer)).Methods("POST")
+	r.HandleFunc("/append_entries", transport.AppendEntriesHandle(consumer)).Methods("POST")
+	r.HandleFunc("/timeout_now", transport.TimeoutNowHandle(consumer)).Methods("POST")
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+	target := strings.TrimPrefix(ts.URL, "http://")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// Node sharing the secret is accepted
+	var resp raft.RequestVoteResponse
+	if err := NewHTTPTransport("", nil, config).RequestVote(ctx, target, &raft.RequestVoteRequest{Term: 1, Candidate: "foo"}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Term != 1 || !resp.Granted {
+		t.Fatalf("Wrong vote response: %+v", resp)
+	}
+
+	// Unsigned RPC and RPC signed with another secret are rejected
+	wrong := DefaultConfig()
+	wrong.ClusterSecret = "other"
+	for _, c := range []*Config{DefaultConfig(), wrong} {
+		other := NewHTTPTransport("", nil, c)
+		if err := other.RequestVote(ctx, target, &raft.RequestVoteRequest{Term: 2, Candidate: "bar"}, &raft.RequestVoteResponse{}); err == nil {
+			t.Fatalf("RequestVote without valid signature should be rejected")
+		}
+		if err := other.AppendEntries(ctx, target, &raft.AppendEntryRequest{Term: 2, Leader: "bar"}, &raft.AppendEntryResponse{}); err == nil {
+			t.Fatalf("AppendEntries without valid signature should be rejected")
+		}
+		if err := other.TimeoutNow(ctx, target, &raft.TimeoutNowRequest{Term: 2, Leader: "bar"}, &raft.TimeoutNowResponse{}); err == nil {
+			t.Fatalf("TimeoutNow without valid signature should be rejected")
+		}
+	}
+	if s.VotedFor() == "bar" || s.Leader() == "bar" {
+		t.Fatalf("Rejected RPC should not reach raft server")
+	}
+
+	// Tampered body doesn't match signature
+	req := httptest.NewRequest("POST", "/request_vote", strings.NewReader(`{"term":"3","candidate":"bar"}`))
+	req.Header.Set(HeaderSignature, transport.sign([]byte(`{"term":"1","candidate":"bar"}`)))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("Tampered RPC should be rejected: %v", w.Code)
+	}
+}
+
+func TestHTTPTransportRPCTimeout(t *testing.T) {
+	block := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-block:
+		case <-r.Context().Done():
+		}
+	}))
+	defer ts.Close()
+	defer close(block)
+
+	transport := NewHTTPTransport("", nil, DefaultConfig())
+	timeout := 50 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	start := time.Now()
+	var resp raft.AppendEntryResponse
+	err := transport.AppendEntries(ctx, strings.TrimPrefix(ts.URL, "http://"), &raft.AppendEntryRequest{}, &resp)
+	if err == nil {
+		t.Fatalf("RPC to hung server should fail")
+	}
+	if elapsed := time.Since(start); elapsed > 4*timeout {
+		t.Fatalf("RPC should return once deadline elapse: %v", elapsed)
+	}
+}
+
+func TestHTTPTransportRemoteError(t *testing.T) {
+	consumer := make(chan raft.RPC)
+	transport := NewHTTPTransport("", consumer, DefaultConfig())
+	s := newRaftServer(t, transport, NewStateMachine(DefaultConfig()))
+	s.Start()
+	defer s.Stop()
+
+	r := mux.NewRouter()
+	r.HandleFunc("/install_snapshot", transport.InstallSnapshotHandle(consumer)).Methods("POST")
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// Server without snapshot dir can't install one
+	req := &raft.InstallSnapshotRequest{Term: 1, Leader: "foo", LastIndex: 1, LastTerm: 1, Done: true}
+	err := transport.InstallSnapshot(ctx, strings.TrimPrefix(ts.URL, "http://"), req, &raft.InstallSnapshotResponse{})
+	if !errors.Is(err, raft.ErrSnapshotUnsupported) {
+		t.Fatalf("Remote error should keep its identity: %v", err)
+	}
+}
+
+func TestReadYourWritesOnFollower(t *testing.T) {
+	cluster, leader := newTestCluster(t, 3)
+	defer stopCluster(cluster)
+
+	var follower *raft.Server
+	for _, s := range cluster {
+		if s != leader {
+			follower = s
+		}
+	}
+
+	transport := NewHTTPTransport("", nil, DefaultConfig())
+	transport.waitTimeout = 2 * testElectionTimeout
+	leaderRouter := newTestRouter(leader, transport)
+	followerRouter := newTestRouter(follower, transport)
+
+	w := doRequest(leaderRouter, "POST", "/store/a", "b")
+	index := w.Header().Get(HeaderCommitIndex)
+	if w.Code != http.StatusOK || index != "3" {
+		t.Fatalf("Write should return its commit index: %v %q", w.Code, index)
+	}
+
+	// Follower waits until it applied the write before reading
+	w = doRequest(followerRouter, "GET", "/store/a", "", HeaderMinIndex, index)
+	if w.Code != http.StatusOK || w.Body.String() != "b" {
+		t.Fatalf("Follower should read own write: %v %q", w.Code, w.Body.String())
+	}
+
+	// Read without min index is still answered with leader address
+	w = doRequest(followerRouter, "GET", "/store/a", "")
+	if w.Body.String() != leader.LocalAddr() {
+		t.Fatalf("Follower should return leader address: %q", w.Body.String())
+	}
+
+	// Index which is never applied times out
+	w = doRequest(followerRouter, "GET", "/store/a", "", HeaderMinIndex, "100")
+	if w.Code != http.StatusGatewayTimeout {
+		t.Fatalf("Read should time out waiting for index: %v", w.Code)
+	}
+
+	w = doRequest(followerRouter, "GET", "/store/a", "", HeaderMinIndex, "abc")
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Invalid min index should be rejected: %v", w.Code)
+	}
+}
+
+func TestFollowerReads(t *testing.T) {
+	cluster, leader := newTestCluster(t, 3)
+	defer stopCluster(cluster)
+
+	var follower *raft.Server
+	for _, s := range cluster {
+		if s != leader {
+			follower = s
+		}
+	}
+
+	config := DefaultConfig()
+	config.AllowFollowerReads = true
+	transport := NewHTTPTransport("", nil, config)
+	leaderRouter := newTestRouter(leader, transport)
+	followerRouter := newTestRouter(follower, transport)
+
+	w := doRequest(leaderRouter, "POST", "/store/a", "b")
+	index := w.Header().Get(HeaderCommitIndex)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Failed to set key: %v", w.Code)
+	}
+
+	// Follower within lease serves read once it applied the write
+	idx, _ := strconv.ParseUint(index, 10, 64)
+	if err := follower.WaitApplied(idx, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	w = doRequest(followerRouter, "GET", "/store/a", "", HeaderMinIndex, index)
+	if w.Code != http.StatusOK || w.Body.String() != "b" {
+		t.Fatalf("Follower should serve read: %v %q", w.Code, w.Body.String())
+	}
+	w = doRequest(followerRouter, "GET", "/store/a", "")
+	if w.Code != http.StatusOK || w.Body.String() != "b" {
+		t.Fatalf("Follower should serve read without min index: %v %q", w.Code, w.Body.String())
+	}
+
+	// Lagging follower doesn't know the next write is committed
+	follower.Stop()
+	w = doRequest(leaderRouter, "POST", "/store/a", "c")
+	index = w.Header().Get(HeaderCommitIndex)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Failed to set key: %v", w.Code)
+	}
+	w = doRequest(followerRouter, "GET", "/store/a", "", HeaderMinIndex, index)
+	if w.Code != http.StatusOK || w.Body.String() != leader.LocalAddr() {
+		t.Fatalf("Lagging follower should redirect to leader: %v %q", w.Code, w.Body.String())
+	}
+
+	// Once lease expires any read is redirected
+	time.Sleep(time.Duration(raft.DefaultConfig().LeaderLeaseTimeout) * time.Millisecond)
+	w = doRequest(followerRouter, "GET", "/store/a", "")
+	if w.Code != http.StatusOK || w.Body.String() != leader.LocalAddr() {
+		t.Fatalf("Follower out of lease should redirect to leader: %v %q", w.Code, w.Body.String())
+	}
+}
+
+func TestSetHandleTTL(t *testing.T) {
+	cluster, leader := newTestCluster(t, 3)
+	defer stopCluster(cluster)
+
+	transport := NewHTTPTransport("", nil, DefaultConfig())
+	r := newTestRouter(leader, transport)
+
+	if w := doRequest(r, "POST", "/store/a?ttl=abc", "1"); w.Code != http.StatusBadRequest {
+		t.Fatalf("Invalid ttl should be rejected: %v", w.Code)
+	}
+
+	w := doRequest(r, "POST", "/store/a?ttl=50ms", "1")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Failed to set key with ttl: %v", w.Code)
+	}
+	index, _ := strconv.ParseUint(w.Header().Get(HeaderCommitIndex), 10, 64)
+
+	// Key expires only when a later command moves logical clock forward
+	time.Sleep(60 * time.Millisecond)
+	for _, s := range cluster {
+		if err := s.WaitApplied(index, time.Second); err != nil {
+			t.Fatal(err)
+		}
+		if v := s.StateMachine().Get("a"); v != "1" {
+			t.Fatalf("Key should not expire by wall clock on %v: %v", s.LocalAddr(), v)
+		}
+	}
+
+	w = doRequest(r, "POST", "/store/b", "2")
+	index, _ = strconv.ParseUint(w.Header().Get(HeaderCommitIndex), 10, 64)
+	for _, s := range cluster {
+		if err := s.WaitApplied(index, time.Second); err != nil {
+			t.Fatal(err)
+		}
+		if v := s.StateMachine().Get("a"); v != "" {
+			t.Fatalf("Key should expire on %v: %v", s.LocalAddr(), v)
+		}
+	}
+}
+
+func TestKeyVersion(t *testing.T) {
+	cluster, leader := newTestCluster(t, 3)
+	defer stopCluster(cluster)
+
+	transport := NewHTTPTransport("", nil, DefaultConfig())
+	r := newTestRouter(leader, transport)
+
+	if w := doRequest(r, "GET", "/store/a", ""); w.Header().Get(HeaderVersion) != "0" {
+		t.Fatalf("Absent key should have version 0: %q", w.Header().Get(HeaderVersion))
+	}
+
+	var last uint64
+	for i := 0; i < 3; i++ {
+		w := doRequest(r, "POST", "/store/a", strconv.Itoa(i))
+		index := w.Header().Get(HeaderCommitIndex)
+
+		w = doRequest(r, "GET", "/store/a", "")
+		version, _ := strconv.ParseUint(w.Header().Get(HeaderVersion), 10, 64)
+		if w.Header().Get(HeaderVersion) != index || version <= last {
+			t.Fatalf("Version should be index of last write %v: %v", index, version)
+		}
+		last = version
+	}
+}
+
+func TestVersionsHandle(t *testing.T) {
+	s, transport := newTestLeader(t)
+	defer s.Stop()
+
+	r := newTestRouter(s, transport)
+	want := map[string]uint64{"c": 0}
+	for _, key := range []string{"a", "b", "a"} {
+		w := doRequest(r, "POST", "/store/"+key, "v")
+		index, err := strconv.ParseUint(w.Header().Get(HeaderCommitIndex), 10, 64)
+		if err != nil {
+			t.Fatalf("Failed to write %s: %v", key, w.Code)
+		}
+		want[key] = index
+	}
+
+	w := doRequest(r, "GET", "/versions?keys=a,b,c", "")
+	var result VersionsResult
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatalf("Failed to read versions: %v %s", w.Code, w.Body.String())
+	}
+	if !reflect.DeepEqual(result.Versions, want) || result.Index != s.LastApplied() {
+		t.Fatalf("Wrong versions: %+v (want %v)", result, want)
+	}
+	if w := doRequest(r, "GET", "/versions", ""); w.Code != http.StatusBadRequest {
+		t.Fatalf("Versions without keys should be rejected: %v", w.Code)
+	}
+}
+
+func TestGetHandleMissingKey(t *testing.T) {
+	cluster, leader := newTestCluster(t, 3)
+	defer stopCluster(cluster)
+
+	transport := NewHTTPTransport("", nil, DefaultConfig())
+	r := newTestRouter(leader, transport)
+
+	if w := doRequest(r, "GET", "/store/a", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("Missing key should not be found: %v", w.Code)
+	}
+
+	doRequest(r, "POST", "/store/a", "")
+	if w := doRequest(r, "GET", "/store/a", ""); w.Code != http.StatusOK || w.Body.String() != "" {
+		t.Fatalf("Empty value should be found: %v %q", w.Code, w.Body.String())
+	}
+
+	doRequest(r, "POST", "/store/b", "1")
+	if w := doRequest(r, "GET", "/store/b", ""); w.Code != http.StatusOK || w.Body.String() != "1" {
+		t.Fatalf("Value should be found: %v %q", w.Code, w.Body.String())
+	}
+
+	// Expired key is gone once a later command moves logical clock forward
+	doRequest(r, "POST", "/store/c?ttl=1ms", "1")
+	time.Sleep(5 * time.Millisecond)
+	doRequest(r, "POST", "/store/b", "2")
+	if w := doRequest(r, "GET", "/store/c", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("Expired key should not be found: %v", w.Code)
+	}
+}
+
+func TestSetHandleBinaryValue(t *testing.T) {
+	cluster, leader := newTestCluster(t, 3)
+	defer stopCluster(cluster)
+
+	transport := NewHTTPTransport("", nil, DefaultConfig())
+	r := newTestRouter(leader, transport)
+
+	value := "\x00\xff\xfe\x00a\xc3\x28"
+	if w := doRequest(r, "POST", "/store/a", value, "Content-Type", "application/x-protobuf"); w.Code != http.StatusOK {
+		t.Fatalf("Binary value should be written: %v %s", w.Code, w.Body.String())
+	}
+	w := doRequest(r, "GET", "/store/a", "")
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), []byte(value)) {
+		t.Fatalf("Binary value should round trip: %v %q", w.Code, w.Body.Bytes())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/x-protobuf" {
+		t.Fatalf("Content type should be preserved: %q", ct)
+	}
+
+	// Followers restore the same bytes from their own copy of the log
+	for _, s := range cluster {
+		if err := s.WaitApplied(leader.CommitIndex(), time.Second); err != nil {
+			t.Fatal(err)
+		}
+		e, _ := s.StateMachine().(*StateMachine).GetEntry("a")
+		if !bytes.Equal(e.Value, []byte(value)) || e.ContentType != "application/x-protobuf" {
+			t.Fatalf("Wrong entry on %v: %q %q", s.LocalAddr(), e.Value, e.ContentType)
+		}
+	}
+}
+
+func TestSetHandleEntryTooLarge(t *testing.T) {
+	s, transport := newTestLeader(t)
+	defer s.Stop()
+
+	r := newTestRouter(s, transport)
+	limit := raft.DefaultConfig().MaxLogEntrySize
+	if w := doRequest(r, "POST", "/store/a", strings.Repeat("a", limit+1)); w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("Value over the limit should be refused: %v", w.Code)
+	}
+	if v := s.StateMachine().Get("a"); v != "" {
+		t.Fatalf("Refused value should not be written: %d bytes", len(v.(string)))
+	}
+	if w := doRequest(r, "POST", "/store/a", strings.Repeat("a", limit/2)); w.Code != http.StatusOK {
+		t.Fatalf("Value under the limit should be written: %v", w.Code)
+	}
+}
+
+func TestSetHandleWriteTimeout(t *testing.T) {
+	cluster, leader := newTestCluster(t, 3)
+	defer stopCluster(cluster)
+
+	config := DefaultConfig()
+	config.WriteTimeout = 50
+	r := newTestRouter(leader, NewHTTPTransport("", nil, config))
+	if w := doRequest(r, "POST", "/store/a", "1"); w.Code != http.StatusOK {
+		t.Fatalf("Write with quorum should commit: %v", w.Code)
+	}
+
+	// Leader cut off from quorum can't commit, client isn't kept waiting.
+	// Write times out before leader notices it lost its lease.
+	for _, s := range cluster {
+		if s != leader {
+			s.Stop()
+		}
+	}
+	start := time.Now()
+	w := doRequest(r, "POST", "/store/a", "2")
+	if w.Code != http.StatusGatewayTimeout {
+		t.Fatalf("Write without quorum should time out: %v %s", w.Code, w.Body.String())
+	}
+	if elapsed := time.Since(start); elapsed > time.Duration(raft.DefaultConfig().LeaderLeaseTimeout)*time.Millisecond {
+		t.Fatalf("Write should be abandoned after WriteTimeout: %v", elapsed)
+	}
+	if v := leader.StateMachine().Get("a"); v != "1" {
+		t.Fatalf("Timed out write should not be applied: %v", v)
+	}
+}
+
+func TestWriteApplyError(t *testing.T) {
+	s, transport := newTestLeader(t)
+	defer s.Stop()
+
+	cases := []struct {
+		err  error
+		code int
+	}{
+		{raft.ErrQueueFull, http.StatusServiceUnavailable},
+		{raft.ErrServerShutdown, http.StatusServiceUnavailable},
+		{raft.ErrLeadershipLost, http.StatusServiceUnavailable},
+		{fmt.Errorf("log 3: %w", raft.ErrLeadershipLost), http.StatusServiceUnavailable},
+		{raft.DecodeError(raft.ErrLeadershipTransferInProgress.Error()), http.StatusServiceUnavailable},
+		{context.Canceled, http.StatusServiceUnavailable},
+		{raft.ErrTimeout, http.StatusGatewayTimeout},
+		{context.DeadlineExceeded, http.StatusGatewayTimeout},
+		{raft.ErrLogEntryTooLarge, http.StatusRequestEntityTooLarge},
+		{ErrVersionMismatch, http.StatusConflict},
+	}
+	for _, tc := range cases {
+		w := httptest.NewRecorder()
+		transport.writeApplyError(w, s, tc.err)
+		if w.Code != tc.code {
+			t.Fatalf("%v should be answered with %d: %d", tc.err, tc.code, w.Code)
+		}
+	}
+
+	// Follower answers with leader address to retry at
+	w := httptest.NewRecorder()
+	transport.writeApplyError(w, s, raft.ErrNotLeader)
+	if w.Code != http.StatusOK || w.Body.String() != s.Leader() {
+		t.Fatalf("Not leader should return leader address: %v %q", w.Code, w.Body.String())
+	}
+}
+
+func TestGetHandleAtIndex(t *testing.T) {
+	cluster, leader := newTestCluster(t, 3)
+	defer stopCluster(cluster)
+
+	transport := NewHTTPTransport("", nil, DefaultConfig())
+	r := newTestRouter(leader, transport)
+
+	var indexes []string
+	for i := 0; i < 4; i++ {
+		w := doRequest(r, "POST", "/store/a", strconv.Itoa(i))
+		indexes = append(indexes, w.Header().Get(HeaderCommitIndex))
+		doRequest(r, "POST", "/store/b", strconv.Itoa(i))
+	}
+
+	for i, index := range indexes {
+		w := doRequest(r, "GET", "/store/a?at_index="+index, "")
+		if w.Code != http.StatusOK || w.Body.String() != strconv.Itoa(i) {
+			t.Fatalf("Wrong value at index %s: %v %q", index, w.Code, w.Body.String())
+		}
+		if w.Header().Get(HeaderVersion) != index {
+			t.Fatalf("Wrong version at index %s: %v", index, w.Header().Get(HeaderVersion))
+		}
+	}
+	if w := doRequest(r, "GET", "/store/a?at_index=1", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("Key should be absent before its first write: %v", w.Code)
+	}
+	if w := doRequest(r, "GET", "/store/a?at_index=1000", ""); w.Code != http.StatusBadRequest {
+		t.Fatalf("Index not committed yet should be rejected: %v", w.Code)
+	}
+}
+
+func TestSetHandleRateLimit(t *testing.T) {
+	s, _ := newTestLeader(t)
+	defer s.Stop()
+
+	config := DefaultConfig()
+	config.MaxWritesPerSecond = 5
+	r := newTestRouter(s, NewHTTPTransport(s.LocalAddr(), nil, config))
+
+	limited := 0
+	var accepted string
+	for i := 0; i < 20; i++ {
+		w := doRequest(r, "POST", "/store/a", strconv.Itoa(i))
+		switch w.Code {
+		case http.StatusOK:
+			accepted = strconv.Itoa(i)
+		case http.StatusTooManyRequests:
+			limited++
+		default:
+			t.Fatalf("Unexpected status: %v", w.Code)
+		}
+	}
+	if limited == 0 || limited > 20-config.MaxWritesPerSecond {
+		t.Fatalf("Burst over the limit should be partly rejected: %d of 20", limited)
+	}
+	if v := s.StateMachine().Get("a"); v != accepted {
+		t.Fatalf("Rejected write should not be applied: %v (want %v)", v, accepted)
+	}
+
+	// Limit is per second, tokens come back over time
+	time.Sleep(time.Second / time.Duration(config.MaxWritesPerSecond))
+	if w := doRequest(r, "POST", "/store/a", "1"); w.Code != http.StatusOK {
+		t.Fatalf("Write should be accepted once a token is back: %v", w.Code)
+	}
+}
+
+func TestCASHandleVersion(t *testing.T) {
+	cluster, leader := newTestCluster(t, 3)
+	defer stopCluster(cluster)
+
+	transport := NewHTTPTransport("", nil, DefaultConfig())
+	r := newTestRouter(leader, transport)
+
+	if w := doRequest(r, "POST", "/store/a/cas", "1"); w.Code != http.StatusBadRequest {
+		t.Fatalf("CAS without version should be rejected: %v", w.Code)
+	}
+
+	// Version 0 creates absent key
+	w := doRequest(r, "POST", "/store/a/cas?version=0", "1")
+	if w.Code != http.StatusOK {
+		t.Fatalf("CAS should create absent key: %v %q", w.Code, w.Body.String())
+	}
+	stale := w.Header().Get(HeaderCommitIndex)
+
+	w = doRequest(r, "POST", "/store/a/cas?version="+stale, "2")
+	if w.Code != http.StatusOK {
+		t.Fatalf("CAS with current version should succeed: %v %q", w.Code, w.Body.String())
+	}
+
+	w = doRequest(r, "POST", "/store/a/cas?version="+stale, "3")
+	if w.Code != http.StatusConflict {
+		t.Fatalf("CAS with stale version should be rejected: %v", w.Code)
+	}
+	if w = doRequest(r, "GET", "/store/a", ""); w.Body.String() != "2" {
+		t.Fatalf("Rejected CAS should not write: %q", w.Body.String())
+	}
+}
+
+func TestSetHandleDedupWindow(t *testing.T) {
+	s, transport := newTestLeader(t)
+	defer s.Stop()
+
+	r := newTestRouter(s, transport)
+	lastIndex := s.LastLogIndex()
+
+	// Duplicates sent at once, while the first is in flight, become one log
+	responses := make(chan *httptest.ResponseRecorder, 10)
+	for i := 0; i < cap(responses); i++ {
+		go func() {
+			responses <- doRequest(r, "POST", "/store/a", "1", HeaderClientID, "c", HeaderClientSeq, "1")
+		}()
+	}
+	for i := 0; i < cap(responses); i++ {
+		w := <-responses
+		if w.Code != http.StatusOK || w.Header().Get(HeaderCommitIndex) != strconv.FormatUint(lastIndex+1, 10) {
+			t.Fatalf("Duplicate should get result of the first write: %v %s", w.Code, w.Header().Get(HeaderCommitIndex))
+		}
+	}
+	if s.LastLogIndex() != lastIndex+1 {
+		t.Fatalf("Duplicates should be logged once: %d logs", s.LastLogIndex()-lastIndex)
+	}
+
+	// Next seq of client is a new write
+	if w := doRequest(r, "POST", "/store/a", "2", HeaderClientID, "c", HeaderClientSeq, "2"); w.Code != http.StatusOK || s.LastLogIndex() != lastIndex+2 {
+		t.Fatalf("New seq should be logged: %v", w.Code)
+	}
+}
+
+func TestSetHandleClientRetry(t *testing.T) {
+	cluster, leader := newTestCluster(t, 3)
+	defer stopCluster(cluster)
+
+	transport := NewHTTPTransport("", nil, DefaultConfig())
+	r := newTestRouter(leader, transport)
+
+	// Retried create succeeds again instead of conflicting with itself
+	for i := 0; i < 2; i++ {
+		w := doRequest(r, "POST", "/store/a/cas?version=0", "1", HeaderClientID, "c", HeaderClientSeq, "1")
+		if w.Code != http.StatusOK {
+			t.Fatalf("Retried write should succeed: %v %q", w.Code, w.Body.String())
+		}
+	}
+	w := doRequest(r, "GET", "/store/a", "")
+	if version := w.Header().Get(HeaderVersion); version != "3" {
+		t.Fatalf("Retried write should be applied once: version %v", version)
+	}
+
+	if w := doRequest(r, "POST", "/store/a", "1", HeaderClientID, "c"); w.Code != http.StatusBadRequest {
+		t.Fatalf("Client write without seq should be rejected: %v", w.Code)
+	}
+}
+
+func TestBarrierHandle(t *testing.T) {
+	cluster, leader := newTestCluster(t, 3)
+	defer stopCluster(cluster)
+
+	transport := NewHTTPTransport("", nil, DefaultConfig())
+	r := newTestRouter(leader, transport)
+	doRequest(r, "POST", "/store/a", "1")
+
+	if w := doRequest(r, "POST", "/barrier", ""); w.Code != http.StatusOK || w.Body.Len() != 0 {
+		t.Fatalf("Barrier failed on leader: %v %s", w.Code, w.Body.String())
+	}
+	if leader.LastApplied() != leader.CommitIndex() {
+		t.Fatalf("Every committed log should be applied: %v %v", leader.LastApplied(), leader.CommitIndex())
+	}
+
+	for _, s := range cluster {
+		if s == leader {
+			continue
+		}
+		w := doRequest(newTestRouter(s, transport), "POST", "/barrier", "")
+		if w.Body.String() != leader.LocalAddr() {
+			t.Fatalf("Follower should return leader address: %q", w.Body.String())
+		}
+	}
+}
+
+func TestLeaveHandle(t *testing.T) {
+	var handlers []*swapHandler
+	var addrs []string
+	for i := 0; i < 3; i++ {
+		h := &swapHandler{h: http.NotFoundHandler()}
+		ts := httptest.NewServer(h)
+		defer ts.Close()
+		handlers = append(handlers, h)
+		addrs = append(addrs, strings.TrimPrefix(ts.URL, "http://"))
+	}
+	cluster, leader := newTestClusterAddrs(t, addrs)
+	defer stopCluster(cluster)
+
+	routers := map[*raft.Server]http.Handler{}
+	var follower *raft.Server
+	for i, s := range cluster {
+		r := newTestRouter(s, NewHTTPTransport(s.LocalAddr(), nil, DefaultConfig()))
+		handlers[i].set(r)
+		routers[s] = r
+		if s != leader {
+			follower = s
+		}
+	}
+	// Changes are rejected until leader's bootstrap configuration commits
+	if err := leader.Barrier(time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// Follower has leader remove it, then stops
+	w := doRequest(routers[follower], "POST", "/cluster/leave", "")
+	if w.Code != http.StatusOK || w.Body.Len() != 0 {
+		t.Fatalf("Follower failed to leave: %v %s", w.Code, w.Body.String())
+	}
+	if follower.State() != raft.Stopped {
+		t.Fatalf("Follower should stop after leaving: %v", follower.State())
+	}
+	config := leader.Configuration()
+	if len(config.Voters) != 2 || leader.QuorumSize() != 2 {
+		t.Fatalf("Departed follower should be removed: %v", config)
+	}
+	if w := doRequest(routers[leader], "POST", "/store/a", "1"); w.Code != http.StatusOK {
+		t.Fatalf("Remaining nodes should commit writes: %v %s", w.Code, w.Body.String())
+	}
+
+	w = doRequest(routers[leader], "POST", "/cluster/leave", "")
+	if w.Code != http.StatusOK || w.Body.Len() != 0 {
+		t.Fatalf("Leader failed to leave: %v %s", w.Code, w.Body.String())
+	}
+	if leader.State() != raft.Stopped {
+		t.Fatalf("Leader should stop after leaving: %v", leader.State())
+	}
+}
+
+func TestValidateHandle(t *testing.T) {
+	cluster, leader := newTestCluster(t, 3)
+	defer stopCluster(cluster)
+
+	transport := NewHTTPTransport("", nil, DefaultConfig())
+	r := newTestRouter(leader, transport)
+	var followers []*raft.Server
+	for _, s := range cluster {
+		if s != leader {
+			followers = append(followers, s)
+		}
+	}
+	if w := doRequest(newTestRouter(followers[0], transport), "POST", "/cluster/validate", `{}`); w.Code != http.StatusOK || w.Body.String() != leader.LocalAddr() {
+		t.Fatalf("Follower should return leader address: %v %q", w.Code, w.Body.String())
+	}
+	if w := doRequest(r, "POST", "/cluster/validate", "{"); w.Code != http.StatusBadRequest {
+		t.Fatalf("Malformed change should be rejected: %v", w.Code)
+	}
+	body := fmt.Sprintf(`{"remove":[%q]}`, followers[1].LocalAddr())
+	if w := doRequest(r, "POST", "/cluster/validate", body); w.Code != http.StatusOK || w.Body.Len() != 0 {
+		t.Fatalf("Removing a peer of a healthy cluster should be valid: %v %s", w.Code, w.Body.String())
+	}
+
+	// With the other follower down, leader would be left without quorum
+	followers[0].Stop()
+	deadline := time.Now().Add(time.Second)
+	for {
+		w := doRequest(r, "POST", "/cluster/validate", body)
+		if w.Code == http.StatusConflict {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Change breaking quorum should be flagged: %v %s", w.Code, w.Body.String())
+		}
+		time.Sleep(testElectionTimeout / 10)
+	}
+	if leader.MemberCount() != 3 {
+		t.Fatalf("Validation should not change configuration: %v", leader.MemberCount())
+	}
+}
+
+func TestClusterConfigHandle(t *testing.T) {
+	cluster, leader := newTestCluster(t, 4)
+	defer stopCluster(cluster)
+
+	// Removed node is stopped first so its elections don't disturb the rest
+	var members []string
+	var remaining []*raft.Server
+	var removed *raft.Server
+	for _, s := range cluster {
+		if s != leader && removed == nil {
+			removed = s
+			s.Stop()
+			continue
+		}
+		members = append(members, s.LocalAddr())
+		remaining = append(remaining, s)
+	}
+	if err := leader.Barrier(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := leader.Reconfigure(members, 2*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := leader.Barrier(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	index := leader.LastApplied()
+
+	transport := NewHTTPTransport("", nil, DefaultConfig())
+	sort.Strings(members)
+	var want string
+	for _, s := range remaining {
+		if err := s.WaitApplied(index, time.Second); err != nil {
+			t.Fatal(err)
+		}
+		w := doRequest(newTestRouter(s, transport), "GET", "/cluster/config", "")
+		var config raft.Configuration
+		if err := json.Unmarshal(w.Body.Bytes(), &config); err != nil {
+			t.Fatalf("Failed to read config of %s: %v %s", s.LocalAddr(), w.Code, w.Body.String())
+		}
+		if !reflect.DeepEqual(config.Voters, members) || config.OldVoters != nil {
+			t.Fatalf("Wrong config on %s: %+v", s.LocalAddr(), config)
+		}
+		if want == "" {
+			want = w.Body.String()
+		}
+		if w.Body.String() != want {
+			t.Fatalf("Nodes should report identical config: %s and %s", want, w.Body.String())
+		}
+	}
+}
+
+// swapHandler let a test server be started before its handler exists
+type swapHandler struct {
+	sync.Mutex
+	h http.Handler
+}
+
+func (s *swapHandler) set(h http.Handler) {
+	s.Lock()
+	defer s.Unlock()
+	s.h = h
+}
+
+func (s *swapHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	h := s.h
+	s.Unlock()
+	h.ServeHTTP(w, r)
+}
+
+func TestForwardToLeader(t *testing.T) {
+	var handlers []*swapHandler
+	var addrs []string
+	for i := 0; i < 3; i++ {
+		h := &swapHandler{h: http.NotFoundHandler()}
+		ts := httptest.NewServer(h)
+		defer ts.Close()
+		handlers = append(handlers, h)
+		addrs = append(addrs, strings.TrimPrefix(ts.URL, "http://"))
+	}
+
+	cluster, leader := newTestClusterAddrs(t, addrs)
+	defer stopCluster(cluster)
+
+	config := DefaultConfig()
+	config.ForwardToLeader = true
+	var followerRouter http.Handler
+	for i, s := range cluster {
+		r := newTestRouter(s, NewHTTPTransport(s.LocalAddr(), nil, config))
+		handlers[i].set(r)
+		if s != leader {
+			followerRouter = r
+		}
+	}
+
+	w := doRequest(followerRouter, "POST", "/store/a", "1")
+	if w.Code != http.StatusOK || w.Header().Get(HeaderCommitIndex) == "" {
+		t.Fatalf("Write on follower should be forwarded: %v %q", w.Code, w.Body.String())
+	}
+	if v := leader.StateMachine().Get("a"); v != "1" {
+		t.Fatalf("Forwarded write should be applied on leader: %v", v)
+	}
+
+	w = doRequest(followerRouter, "GET", "/store/a", "")
+	if w.Code != http.StatusOK || w.Body.String() != "1" {
+		t.Fatalf("Read on follower should be forwarded: %v %q", w.Code, w.Body.String())
+	}
+
+	// Request forwarded already is answered with leader address
+	w = doRequest(followerRouter, "POST", "/store/a", "2", HeaderForwarded, "other")
+	if w.Body.String() != leader.LocalAddr() {
+		t.Fatalf("Forwarded request should not be forwarded again: %q", w.Body.String())
+	}
+	if v := leader.StateMachine().Get("a"); v != "1" {
+		t.Fatalf("Rejected write should not be applied: %v", v)
+	}
+}
+
+func TestHealthzReadyzLeader(t *testing.T) {
+	s, transport := newTestLeader(t)
+	defer s.Stop()
+
+	r := newTestRouter(s, transport)
+	if w := doRequest(r, "GET", "/healthz", ""); w.Code != http.StatusOK {
+		t.Fatalf("Node should be alive: %v", w.Code)
+	}
+	// Leader's no-op is applied apart from its commit
+	if err := s.WaitApplied(s.CommitIndex(), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if w := doRequest(r, "GET", "/readyz", ""); w.Code != http.StatusOK {
+		t.Fatalf("Leader should be ready: %v %s", w.Code, w.Body.String())
+	}
+}
+
+func TestReadyzWithoutLeader(t *testing.T) {
+	// Peer never answers so server keeps running elections
+	rt := raft.NewInmemTransport("")
+	s := newRaftServer(t, rt, NewStateMachine(DefaultConfig()))
+	s.AddPeer("unreachable", 0)
+	s.Start()
+	defer s.Stop()
+
+	deadline := time.Now().Add(20 * testElectionTimeout)
+	for s.State() != raft.Candidate {
+		if time.Now().After(deadline) {
+			t.Fatalf("Server should become candidate")
+		}
+		time.Sleep(testElectionTimeout / 10)
+	}
+
+	r := newTestRouter(s, NewHTTPTransport(s.LocalAddr(), nil, DefaultConfig()))
+	if w := doRequest(r, "GET", "/healthz", ""); w.Code != http.StatusOK {
+		t.Fatalf("Node should be alive: %v", w.Code)
+	}
+	if w := doRequest(r, "GET", "/readyz", ""); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Candidate without leader should not be ready: %v", w.Code)
+	}
+}
+
+func TestLeaderHandle(t *testing.T) {
+	cluster, leader := newTestCluster(t, 3)
+	defer stopCluster(cluster)
+
+	transport := NewHTTPTransport("", nil, DefaultConfig())
+	for _, s := range cluster {
+		w := doRequest(newTestRouter(s, transport), "GET", "/leader", "")
+		var result LeaderResult
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != http.StatusOK || result.Leader != leader.LocalAddr() {
+			t.Fatalf("%v should report leader %v: %v %q", s.LocalAddr(), leader.LocalAddr(), w.Code, result.Leader)
+		}
+	}
+}
+
+func TestLeaderHandleWithoutLeader(t *testing.T) {
+	rt := raft.NewInmemTransport("")
+	s := newRaftServer(t, rt, NewStateMachine(DefaultConfig()))
+	s.AddPeer("unreachable", 0)
+	s.Start()
+	defer s.Stop()
+
+	r := newTestRouter(s, NewHTTPTransport(s.LocalAddr(), nil, DefaultConfig()))
+	if w := doRequest(r, "GET", "/leader", ""); w.Code != http.StatusServiceUnavailable || w.Body.String() != "no leader" {
+		t.Fatalf("Node without leader should return 503: %v %q", w.Code, w.Body.String())
+	}
+}
+
+func TestReadyzCatchingUp(t *testing.T) {
+	rt := raft.NewInmemTransport("")
+	rt.AddPeer(rt)
+	s := newRaftServer(t, rt, NewStateMachine(DefaultConfig()))
+	s.Start()
+	defer s.Stop()
+	r := newTestRouter(s, NewHTTPTransport(s.LocalAddr(), nil, DefaultConfig()))
+
+	entries := []*raft.Log{
+		{Index: 1, Term: 1, Command: []byte(`{"op":"set","key":"a","value":"b"}`)},
+		{Index: 2, Term: 1, Command: []byte(`{"op":"set","key":"c","value":"d"}`)},
+	}
+	appendEntries := func(prevLogIndex uint64, entries []*raft.Log) {
+		req := &raft.AppendEntryRequest{
+			Term:              1,
+			PrevLogIndex:      prevLogIndex,
+			PrevLogTerm:       1,
+			Entries:           entries,
+			Leader:            "leader",
+			LeaderCommitIndex: 2,
+		}
+		if prevLogIndex == 0 {
+			req.PrevLogTerm = 0
+		}
+		var resp raft.AppendEntryResponse
+		if err := rt.AppendEntries(context.Background(), s.LocalAddr(), req, &resp); err != nil || !resp.Success {
+			t.Fatalf("AppendEntries failed: %+v %v", resp, err)
+		}
+	}
+
+	// Leader committed 2 logs but follower only has the first one
+	appendEntries(0, entries[:1])
+	if w := doRequest(r, "GET", "/readyz", ""); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Follower catching up should not be ready: %v", w.Code)
+	}
+
+	appendEntries(1, entries[1:])
+	if err := s.WaitApplied(2, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if w := doRequest(r, "GET", "/readyz", ""); w.Code != http.StatusOK {
+		t.Fatalf("Follower caught up should be ready: %v %s", w.Code, w.Body.String())
+	}
+}
+
+func TestSetHandleCommitIndex(t *testing.T) {
+	s, transport := newTestLeader(t)
+	defer s.Stop()
+
+	r := newTestRouter(s, transport)
+	for i := 1; i <= 3; i++ {
+		w := doRequest(r, "POST", "/store/a", strconv.Itoa(i))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Failed to set key: %v %s", w.Code, w.Body.String())
+		}
+
+		var result WriteResult
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Fatal(err)
+		}
+		// Every write is appended right after the previous one, the first
+		// one after leader's no-op
+		if result.Index != uint64(i+1) || result.Index != s.LastLogIndex() {
+			t.Fatalf("Wrong commit index: %v (last log %v)", result.Index, s.LastLogIndex())
+		}
+		if h := w.Header().Get(HeaderCommitIndex); h != strconv.Itoa(i+1) {
+			t.Fatalf("Header should match body: %q", h)
+		}
+	}
+}
+
+func TestAdminLogHandle(t *testing.T) {
+	s, _ := newTestLeader(t)
+	defer s.Stop()
+
+	config := DefaultConfig()
+	config.EnableAdmin = true
+	r := newTestRouter(s, NewHTTPTransport(s.LocalAddr(), nil, config))
+	// Key and value of a write are its index, leader's no-op is the first log
+	for i := 2; i <= 6; i++ {
+		if w := doRequest(r, "POST", "/store/k"+strconv.Itoa(i), strconv.Itoa(i)); w.Code != http.StatusOK {
+			t.Fatalf("Failed to set key: %v %s", w.Code, w.Body.String())
+		}
+	}
+
+	w := doRequest(r, "GET", "/admin/log?from=2&to=4", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Wrong status code: %v", w.Code)
+	}
+	var logs []*raft.Log
+	if err := json.Unmarshal(w.Body.Bytes(), &logs); err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 3 {
+		t.Fatalf("Wrong number of logs: %v", len(logs))
+	}
+	for i, log := range logs {
+		index := uint64(i + 2)
+		cmd, err := JSONCodec{}.Decode(log.Command)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if log.Index != index || log.Term != s.CurrentTerm() || log.Type != raft.LogCommand {
+			t.Fatalf("Wrong log %d: %+v", index, log)
+		}
+		if cmd.Key != "k"+strconv.Itoa(int(index)) || string(cmd.Value) != strconv.Itoa(int(index)) {
+			t.Fatalf("Wrong command of log %d: %+v", index, cmd)
+		}
+	}
+
+	// Range is capped to logs in store
+	w = doRequest(r, "GET", "/admin/log?from=4&to=100", "")
+	if err := json.Unmarshal(w.Body.Bytes(), &logs); err != nil || len(logs) != 3 {
+		t.Fatalf("Range should be capped: %v %v", len(logs), err)
+	}
+	if w := doRequest(r, "GET", "/admin/log?from=4&to=2", ""); w.Code != http.StatusBadRequest {
+		t.Fatalf("Invalid range should be rejected: %v", w.Code)
+	}
+
+	// Admin endpoints are not exposed by default
+	r = newTestRouter(s, NewHTTPTransport(s.LocalAddr(), nil, DefaultConfig()))
+	if w := doRequest(r, "GET", "/admin/log", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("Admin endpoint should be disabled: %v", w.Code)
+	}
+}
+
+func TestAdminExportImport(t *testing.T) {
+	cluster, leader := newTestCluster(t, 3)
+	defer stopCluster(cluster)
+
+	config := DefaultConfig()
+	config.EnableAdmin = true
+	r := newTestRouter(leader, NewHTTPTransport(leader.LocalAddr(), nil, config))
+	keys := []string{"a", "b", "c", "d"}
+	for i, key := range keys {
+		if w := doRequest(r, "POST", "/store/"+key, strconv.Itoa(i)); w.Code != http.StatusOK {
+			t.Fatalf("Failed to set key: %v %s", w.Code, w.Body.String())
+		}
+	}
+	w := doRequest(r, "GET", "/admin/export", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Failed to export: %v %s", w.Code, w.Body.String())
+	}
+	backup := w.Body.String()
+
+	raftConfig := raft.DefaultConfig()
+	raftConfig.SnapshotDir = t.TempDir()
+	s, err := raft.NewServer(raftConfig, raft.NewInmemTransport(""), raft.NewInmemLogStore(), NewStateMachine(DefaultConfig()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Start()
+	defer s.Stop()
+	deadline := time.Now().Add(20 * testElectionTimeout)
+	for s.State() != raft.Leader {
+		if time.Now().After(deadline) {
+			t.Fatalf("Server not promote to leader")
+		}
+		time.Sleep(testElectionTimeout / 10)
+	}
+
+	r = newTestRouter(s, NewHTTPTransport(s.LocalAddr(), nil, config))
+	if w := doRequest(r, "POST", "/admin/import", backup); w.Code != http.StatusOK {
+		t.Fatalf("Failed to import: %v %s", w.Code, w.Body.String())
+	}
+	for i, key := range keys {
+		if w := doRequest(r, "GET", "/store/"+key, ""); w.Body.String() != strconv.Itoa(i) {
+			t.Fatalf("Wrong value of %s after import: %q", key, w.Body.String())
+		}
+	}
+	if w := doRequest(r, "POST", "/admin/import", backup); w.Code != http.StatusConflict {
+		t.Fatalf("Import into cluster with data should be rejected: %v", w.Code)
+	}
+}
+
+// gatedTransport holds AppendEntries until gate is closed, elections still
+// go through
+type gatedTransport struct {
+	*raft.InmemTransport
+	gate chan struct{}
+}
+
+func (g *gatedTransport) AppendEntries(ctx context.Context, target string, req *raft.AppendEntryRequest, resp *raft.AppendEntryResponse) error {
+	select {
+	case <-g.gate:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return g.InmemTransport.AppendEntries(ctx, target, req, resp)
+}
+
+func TestLeaderReadWaitsForNoop(t *testing.T) {
+	var transports []*raft.InmemTransport
+	for i := 0; i < 3; i++ {
+		transports = append(transports, raft.NewInmemTransport(""))
+	}
+	gate := make(chan struct{})
+	var cluster []*raft.Server
+	for _, transport := range transports {
+		gated := &gatedTransport{InmemTransport: transport, gate: gate}
+		s := newRaftServer(t, gated, NewStateMachine(DefaultConfig()))
+		for _, peer := range transports {
+			if peer != transport {
+				transport.AddPeer(peer)
+				s.AddPeer(peer.LocalAddr(), 0)
+			}
+		}
+		cluster = append(cluster, s)
+		s.Start()
+	}
+	defer stopCluster(cluster)
+
+	var leader *raft.Server
+	deadline := time.Now().Add(20 * testElectionTimeout)
+	for leader == nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("Cannot elect leader")
+		}
+		for _, s := range cluster {
+			if s.State() == raft.Leader {
+				leader = s
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Read on fresh leader is only served once its no-op is committed,
+	// which needs followers to receive it
+	var released int32
+	early := make(chan bool, 1)
+	go func() {
+		w := doRequest(newTestRouter(leader, NewHTTPTransport("", nil, DefaultConfig())), "GET", "/store/a", "")
+		served := w.Code == http.StatusOK || w.Code == http.StatusNotFound
+		early <- !served || atomic.LoadInt32(&released) == 0
+	}()
+	time.Sleep(testElectionTimeout / 3)
+	atomic.StoreInt32(&released, 1)
+	close(gate)
+
+	if <-early {
+		t.Fatalf("Read should wait for no-op")
+	}
+	if leader.LastApplied() < leader.TermStartIndex() {
+		t.Fatalf("Read served before no-op applied: applied %v start %v", leader.LastApplied(), leader.TermStartIndex())
+	}
+}
+
+func benchmarkRequestVote(b *testing.B, config *Config) {
+	consumer := make(chan raft.RPC)
+	go func() {
+		for rpc := range consumer {
+			rpc.Response(&raft.RequestVoteResponse{Term: 1}, nil)
+		}
+	}()
+	defer close(consumer)
+
+	r := mux.NewRouter()
+	r.HandleFunc("/request_vote", NewHTTPTransport("", consumer, config).RequestVoteHandle(consumer)).Methods("POST")
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+	target := strings.TrimPrefix(ts.URL, "http://")
+
+	transport := NewHTTPTransport("", nil, config)
+	ctx := context.Background()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var resp raft.RequestVoteResponse
+		if err := transport.RequestVote(ctx, target, &raft.RequestVoteRequest{Term: 1}, &resp); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRequestVoteReuseConns(b *testing.B) {
+	benchmarkRequestVote(b, DefaultConfig())
+}
+
+func BenchmarkRequestVoteNewConns(b *testing.B) {
+	config := DefaultConfig()
+	config.DisableKeepAlives = true
+	benchmarkRequestVote(b, config)
+}
+
+func TestAdminStepDown(t *testing.T) {
+	cluster, leader := newTestCluster(t, 3)
+	defer stopCluster(cluster)
+
+	if w := doRequest(newTestRouter(leader, NewHTTPTransport("", nil, DefaultConfig())), "POST", "/admin/step_down", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("Step down should not be found unless admin is enabled: %v", w.Code)
+	}
+
+	config := DefaultConfig()
+	config.EnableAdmin = true
+	for _, s := range cluster {
+		if s == leader {
+			continue
+		}
+		w := doRequest(newTestRouter(s, NewHTTPTransport("", nil, config)), "POST", "/admin/step_down", "")
+		if w.Code != http.StatusOK || w.Body.String() != leader.LocalAddr() || s.State() != raft.Follower {
+			t.Fatalf("Follower should do nothing and return leader: %v %q", w.Code, w.Body.String())
+		}
+	}
+
+	term := leader.CurrentTerm()
+	if w := doRequest(newTestRouter(leader, NewHTTPTransport("", nil, config)), "POST", "/admin/step_down", ""); w.Code != http.StatusOK {
+		t.Fatalf("Leader should step down: %v %s", w.Code, w.Body.String())
+	}
+	if leader.State() == raft.Leader {
+		t.Fatalf("Leader should revert to follower right away")
+	}
+
+	deadline := time.Now().Add(20 * testElectionTimeout)
+	for {
+		var elected *raft.Server
+		for _, s := range cluster {
+			if s.State() == raft.Leader && s.CurrentTerm() > term {
+				elected = s
+			}
+		}
+		if elected != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("New leader should be elected after term %d", term)
+		}
+		time.Sleep(testElectionTimeout / 10)
+	}
+}
+
+func TestAdminDrain(t *testing.T) {
+	cluster, leader := newTestCluster(t, 3)
+	defer stopCluster(cluster)
+
+	config := DefaultConfig()
+	config.EnableAdmin = true
+	drained := newTestRouter(leader, NewHTTPTransport("", nil, config))
+	if w := doRequest(drained, "POST", "/admin/drain", ""); w.Code != http.StatusOK {
+		t.Fatalf("Leader should be drained: %v %s", w.Code, w.Body.String())
+	}
+	if leader.State() == raft.Leader || !leader.Drained() {
+		t.Fatalf("Drained leader should hand off leadership: %v", leader.State())
+	}
+
+	// Whichever peer leads steps down, drained node never wins the election
+	waitNewLeader := func(term uint64) *raft.Server {
+		deadline := time.Now().Add(20 * testElectionTimeout)
+		for {
+			for _, s := range cluster {
+				if s.State() == raft.Leader && s.CurrentTerm() > term {
+					return s
+				}
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("New leader should be elected after term %d", term)
+			}
+			time.Sleep(testElectionTimeout / 10)
+		}
+	}
+	elected := waitNewLeader(0)
+	for i := 0; i < 3; i++ {
+		if elected == leader {
+			t.Fatalf("Drained node should not become leader")
+		}
+		term := elected.CurrentTerm()
+		if err := elected.StepDown(); err != nil {
+			t.Fatal(err)
+		}
+		elected = waitNewLeader(term)
+	}
+
+	// Drained node keeps replicating and serving reads
+	if w := doRequest(newTestRouter(elected, NewHTTPTransport("", nil, config)), "POST", "/store/a", "1"); w.Code != http.StatusOK {
+		t.Fatalf("Failed to write: %v", w.Code)
+	}
+	if err := leader.WaitApplied(elected.CommitIndex(), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if v := leader.StateMachine().Get("a"); v != "1" {
+		t.Fatalf("Drained node should apply writes: %v", v)
+	}
+
+	if w := doRequest(drained, "POST", "/admin/undrain", ""); w.Code != http.StatusOK || leader.Drained() {
+		t.Fatalf("Node should be undrained: %v", w.Code)
+	}
+}
+
+func TestAdminReset(t *testing.T) {
+	cluster, leader := newTestCluster(t, 3)
+	defer stopCluster(cluster)
+
+	if w := doRequest(newTestRouter(leader, NewHTTPTransport("", nil, DefaultConfig())), "POST", "/admin/reset", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("Reset should not be found unless admin is enabled: %v", w.Code)
+	}
+
+	config := DefaultConfig()
+	config.EnableAdmin = true
+	if w := doRequest(newTestRouter(leader, NewHTTPTransport("", nil, config)), "POST", "/admin/reset", ""); w.Code != http.StatusConflict {
+		t.Fatalf("Leader should refuse to reset: %v", w.Code)
+	}
+	if w := doRequest(newTestRouter(leader, NewHTTPTransport("", nil, config)), "POST", "/store/a", "1"); w.Code != http.StatusOK {
+		t.Fatalf("Failed to write: %v", w.Code)
+	}
+
+	var follower *raft.Server
+	for _, s := range cluster {
+		if s != leader {
+			follower = s
+		}
+	}
+	if w := doRequest(newTestRouter(follower, NewHTTPTransport("", nil, config)), "POST", "/admin/reset", ""); w.Code != http.StatusConflict {
+		t.Fatalf("Voter should refuse to reset: %v", w.Code)
+	}
+	if err := leader.DemotePeer(follower.LocalAddr(), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := follower.WaitApplied(leader.CommitIndex(), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if w := doRequest(newTestRouter(follower, NewHTTPTransport("", nil, config)), "POST", "/admin/reset", ""); w.Code != http.StatusOK {
+		t.Fatalf("Follower should reset: %v %s", w.Code, w.Body.String())
+	}
+	if err := follower.WaitApplied(leader.CommitIndex(), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if v := follower.StateMachine().Get("a"); v != "1" {
+		t.Fatalf("Reset follower should catch up: %v", v)
+	}
+}
+
+func TestWatchHandle(t *testing.T) {
+	s, transport := newTestLeader(t)
+	defer s.Stop()
+
+	r := newTestRouter(s, transport)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/watch/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Wrong watch response: %v %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	// Writes of other keys aren't streamed
+	for _, req := range [][2]string{{"/store/b", "x"}, {"/store/a", "1"}, {"/txn", `[{"op":"delete","key":"a"}]`}} {
+		if w := doRequest(r, "POST", req[0], req[1]); w.Code != http.StatusOK {
+			t.Fatalf("Write should succeed: %v %s", w.Code, w.Body.String())
+		}
+	}
+
+	var changes []Change
+	scanner := bufio.NewScanner(resp.Body)
+	for len(changes) < 2 && scanner.Scan() {
+		if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+			var change Change
+			if err := json.Unmarshal([]byte(data), &change); err != nil {
+				t.Fatal(err)
+			}
+			changes = append(changes, change)
+		}
+	}
+	if len(changes) != 2 || changes[0].Value != "1" || changes[0].Deleted || !changes[1].Deleted || changes[1].Index <= changes[0].Index {
+		t.Fatalf("Wrong changes: %+v", changes)
+	}
+
+	// Watcher is removed once client disconnects
+	resp.Body.Close()
+	sm := s.StateMachine().(*StateMachine)
+	deadline := time.Now().Add(time.Second)
+	for {
+		sm.Lock()
+		n := len(sm.watchers)
+		sm.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Watcher should be removed after disconnect")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
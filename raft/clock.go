@@ -0,0 +1,162 @@
+package raft
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is the source of time of election, heartbeat and lease timing,
+// tests swap it with a MockClock to drive timeouts without waiting for
+// them
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+	After(d time.Duration) <-chan time.Time
+}
+
+// Timer is a timer created by Clock, it behaves like time.Timer
+type Timer interface {
+	C() <-chan time.Time
+	Reset(d time.Duration) bool
+	Stop() bool
+}
+
+type realClock struct{}
+
+// Now ...
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// NewTimer ...
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+// After ...
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+type realTimer struct {
+	*time.Timer
+}
+
+// C ...
+func (t realTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+// clock return Config.Clock, the real clock if it's not set
+func (s *Server) clock() Clock {
+	if s.config.Clock == nil {
+		return realClock{}
+	}
+	return s.config.Clock
+}
+
+// MockClock is a Clock whose time only moves on Advance, timers fire once
+// it passes their deadline
+type MockClock struct {
+	now    time.Time
+	timers map[*mockTimer]struct{}
+	cond   *sync.Cond
+	sync.Mutex
+}
+
+// NewMockClock return mock clock starting at the unix epoch
+func NewMockClock() *MockClock {
+	c := &MockClock{
+		now:    time.Unix(0, 0),
+		timers: make(map[*mockTimer]struct{}),
+	}
+	c.cond = sync.NewCond(&c.Mutex)
+	return c
+}
+
+// Now ...
+func (c *MockClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+// NewTimer ...
+func (c *MockClock) NewTimer(d time.Duration) Timer {
+	t := &mockTimer{clock: c, ch: make(chan time.Time, 1)}
+	t.Reset(d)
+	return t
+}
+
+// After ...
+func (c *MockClock) After(d time.Duration) <-chan time.Time {
+	return c.NewTimer(d).C()
+}
+
+// Advance is used to move time forward by d, firing timers due by then
+func (c *MockClock) Advance(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.now = c.now.Add(d)
+	for t := range c.timers {
+		if !t.deadline.After(c.now) {
+			t.fire()
+		}
+	}
+}
+
+// BlockUntil is used to wait until n timers are pending, so an Advance
+// after it can't run before the timers it's meant to fire are set
+func (c *MockClock) BlockUntil(n int) {
+	c.Lock()
+	defer c.Unlock()
+	for len(c.timers) < n {
+		c.cond.Wait()
+	}
+}
+
+type mockTimer struct {
+	clock    *MockClock
+	deadline time.Time
+	ch       chan time.Time
+}
+
+// C ...
+func (t *mockTimer) C() <-chan time.Time {
+	return t.ch
+}
+
+// Reset ...
+func (t *mockTimer) Reset(d time.Duration) bool {
+	c := t.clock
+	c.Lock()
+	defer c.Unlock()
+	_, active := c.timers[t]
+	t.deadline = c.now.Add(d)
+	c.timers[t] = struct{}{}
+	if d <= 0 {
+		t.fire()
+	}
+	c.cond.Broadcast()
+	return active
+}
+
+// Stop ...
+func (t *mockTimer) Stop() bool {
+	c := t.clock
+	c.Lock()
+	defer c.Unlock()
+	_, active := c.timers[t]
+	delete(c.timers, t)
+	return active
+}
+
+// fire is used to send the time on timer's channel, clock lock must be
+// held. Like time.Timer, a tick nobody received yet isn't doubled.
+func (t *mockTimer) fire() {
+	delete(t.clock.timers, t)
+	select {
+	case t.ch <- t.clock.now:
+	default:
+	}
+}
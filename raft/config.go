@@ -1,6 +1,7 @@
 package raft
 
 import (
+	"fmt"
 	"log"
 	"os"
 )
@@ -8,15 +9,220 @@ import (
 // Config provide any necessary config for Raft node
 type Config struct {
 	HeartbeatInterval int64
-	ElectionTimeout   int64
-	Logger            *log.Logger
+	// MaxHeartbeatInterval is the longest time in milliseconds leader waits
+	// between heartbeats to a caught up follower, the interval doubles from
+	// HeartbeatInterval while follower has every log. It must be less than
+	// ElectionTimeoutMin
+	MaxHeartbeatInterval int64
+	// HeartbeatJitter is the maximum random time in milliseconds added to
+	// each heartbeat interval, so heartbeats to followers spread out
+	// instead of going in bursts. MaxHeartbeatInterval plus it must be
+	// less than ElectionTimeoutMin
+	HeartbeatJitter int64
+	// ElectionTimeoutMin and ElectionTimeoutMax are the window in
+	// milliseconds election timeout is randomly picked from, a wider
+	// window reduces split votes
+	ElectionTimeoutMin int64
+	ElectionTimeoutMax int64
+	// ElectionPriority biases leadership toward nodes with a higher one, a
+	// node of priority p picks election timeout from the window shifted
+	// later by MaxElectionPriority-p whole windows. Windows of different
+	// priorities don't overlap, so a lower priority node always waits
+	// longer. Votes still go by log freshness, a behind node can't win
+	// whatever its priority
+	ElectionPriority int
+	// MaxElectionPriority is the highest ElectionPriority of the cluster,
+	// every node must be configured with the same one
+	MaxElectionPriority int
+	// RPCTimeout is the maximum time in milliseconds to wait for a
+	// response of a RPC, the RPC is considered failed after that
+	RPCTimeout int64
+	// MaxRetryBackoff is the maximum time in milliseconds to wait before
+	// retrying a failed RPC to a peer
+	MaxRetryBackoff int64
+	// LeaderLeaseTimeout is the time in milliseconds a leader keeps its
+	// leadership without hearing from a quorum, it steps down after that.
+	// It must be more than MaxHeartbeatInterval plus HeartbeatJitter, so an
+	// idle leader keeps it, and less than ElectionTimeoutMin, so a leader
+	// cut off from quorum steps down before followers elect another one
+	LeaderLeaseTimeout int64
+	// MaxAppendEntries is the maximum number of logs sent in a single
+	// AppendEntries, a lagging follower catches up over several RPCs.
+	// Zero means no limit
+	MaxAppendEntries int
+	// MaxFailures is the number of consecutive failed RPCs after which
+	// leader reports a follower as suspected down. It's still replicated
+	// to, but isn't picked for leadership transfer. Zero disables it
+	MaxFailures int
+	// MaxInflightWrites is the maximum number of writes accepted by Apply
+	// which aren't committed and applied yet, Apply fails right away with
+	// ErrQueueFull beyond it. Zero means no limit
+	MaxInflightWrites int
+	// MaxLogEntrySize is the maximum size in bytes of a command written by
+	// Apply, larger ones fail with ErrLogEntryTooLarge before they are
+	// logged. Zero means no limit
+	MaxLogEntrySize int
+	// ShutdownTimeout is the maximum time in milliseconds Stop waits for
+	// logs already dispatched to commit, they fail after that
+	ShutdownTimeout int64
+	// ApplyTimeout is the time in milliseconds applying committed logs to
+	// state machine may take before it's reported as slow. Logs are applied
+	// apart from replication so a slow state machine doesn't stall it.
+	// Zero disables the report
+	ApplyTimeout int64
+	// SnapshotDir is the directory snapshots are stored in, snapshots are
+	// disabled if it's empty
+	SnapshotDir string
+	// SnapshotCompression makes snapshots gzipped on disk and when sent to
+	// followers, it's transparent to state machine
+	SnapshotCompression bool
+	// SnapshotChunkSize is the maximum number of bytes of snapshot sent in
+	// a single InstallSnapshot
+	SnapshotChunkSize int
+	// SnapshotDeltas is the number of delta snapshots taken on top of a
+	// full one before the next snapshot is full again, if state machine
+	// implements DeltaSnapshotStateMachine. Restoring reads the full
+	// snapshot then each delta. Zero makes every snapshot full
+	SnapshotDeltas int
+	// SnapshotThreshold and SnapshotSizeThreshold make server take a
+	// snapshot once that many logs, or logs with that many bytes of
+	// command, were applied since the last one, whichever is hit first.
+	// Zero disables either, they only apply when SnapshotDir is set
+	SnapshotThreshold     uint64
+	SnapshotSizeThreshold uint64
+	// DisableElection keeps server from ever starting an election, e.g. a
+	// witness which helps form quorum but must not lead. It still votes
+	// and receives logs, it waits for another server to win on election
+	// timeout and ignores TimeoutNow.
+	DisableElection bool
+	// StartupGracePeriod is the time in milliseconds after start during
+	// which server stays follower on election timeout unless it reaches a
+	// quorum of voters, e.g. while a cluster is rolling out, rather than
+	// inflating its term with elections it can't win. Zero disables it
+	StartupGracePeriod int64
+	// WriteQuorum and ReadQuorum override the majority of voters, leader
+	// included, a log must be stored on to commit and that must grant a
+	// vote or stay in touch with leader within its lease. Every read
+	// quorum must intersect every write quorum so WriteQuorum + ReadQuorum
+	// must exceed the number of voters, majority is used while they don't
+	// and in joint phase. Both are 0 for majority.
+	WriteQuorum int
+	ReadQuorum  int
+	// Tracer is used to trace RPCs and writes, nothing is traced if it's
+	// nil
+	Tracer Tracer
+	// Clock drives election, heartbeat and lease timing, the real clock is
+	// used if it's nil
+	Clock  Clock
+	Logger *log.Logger
+}
+
+// checkQuorums is used to check WriteQuorum and ReadQuorum intersect in a
+// cluster of given number of voters
+func (c *Config) checkQuorums(voters int) error {
+	if c.WriteQuorum == 0 {
+		return nil
+	}
+	if c.WriteQuorum > voters || c.ReadQuorum > voters || c.WriteQuorum+c.ReadQuorum <= voters {
+		return fmt.Errorf("WriteQuorum (%d) and ReadQuorum (%d) must not exceed %d voters and must sum to more",
+			c.WriteQuorum, c.ReadQuorum, voters)
+	}
+	return nil
 }
 
 // DefaultConfig return default config for Raft node
 func DefaultConfig() *Config {
 	return &Config{
-		HeartbeatInterval: 75,
-		ElectionTimeout:   150,
-		Logger:            log.New(os.Stdout, "", log.LstdFlags),
+		HeartbeatInterval:    75,
+		MaxHeartbeatInterval: 100,
+		HeartbeatJitter:      10,
+		ElectionTimeoutMin:   150,
+		ElectionTimeoutMax:   300,
+		RPCTimeout:           500,
+		MaxRetryBackoff:      1000,
+		LeaderLeaseTimeout:   130,
+		MaxAppendEntries:     64,
+		MaxInflightWrites:    1024,
+		MaxLogEntrySize:      1 << 20,
+		MaxFailures:          5,
+		ShutdownTimeout:      500,
+		ApplyTimeout:         1000,
+		SnapshotChunkSize:    1 << 20,
+		Logger:               log.New(os.Stdout, "", log.LstdFlags),
+	}
+}
+
+// Validate is used to check config can run a server, the first violation
+// found is returned naming the field to fix
+func (c *Config) Validate() error {
+	if c.HeartbeatInterval <= 0 {
+		return fmt.Errorf("HeartbeatInterval (%d) must be positive", c.HeartbeatInterval)
+	}
+	if c.ElectionTimeoutMin <= 0 {
+		return fmt.Errorf("ElectionTimeoutMin (%d) must be positive", c.ElectionTimeoutMin)
+	}
+	if c.ElectionTimeoutMin >= c.ElectionTimeoutMax {
+		return fmt.Errorf("ElectionTimeoutMin (%d) must be less than ElectionTimeoutMax (%d)",
+			c.ElectionTimeoutMin, c.ElectionTimeoutMax)
+	}
+	if c.ElectionPriority < 0 || c.ElectionPriority > c.MaxElectionPriority {
+		return fmt.Errorf("ElectionPriority (%d) must be in [0, MaxElectionPriority (%d)]",
+			c.ElectionPriority, c.MaxElectionPriority)
+	}
+	if c.MaxHeartbeatInterval < c.HeartbeatInterval || c.MaxHeartbeatInterval >= c.ElectionTimeoutMin {
+		return fmt.Errorf("MaxHeartbeatInterval (%d) must be in [HeartbeatInterval (%d), ElectionTimeoutMin (%d))",
+			c.MaxHeartbeatInterval, c.HeartbeatInterval, c.ElectionTimeoutMin)
+	}
+	if c.HeartbeatJitter < 0 || c.MaxHeartbeatInterval+c.HeartbeatJitter >= c.ElectionTimeoutMin {
+		return fmt.Errorf("HeartbeatJitter (%d) must not be negative and MaxHeartbeatInterval (%d) plus it must be less than ElectionTimeoutMin (%d)",
+			c.HeartbeatJitter, c.MaxHeartbeatInterval, c.ElectionTimeoutMin)
+	}
+	if c.RPCTimeout <= 0 {
+		return fmt.Errorf("RPCTimeout (%d) must be positive", c.RPCTimeout)
+	}
+	if c.MaxRetryBackoff < 0 {
+		return fmt.Errorf("MaxRetryBackoff (%d) must not be negative", c.MaxRetryBackoff)
+	}
+	if c.LeaderLeaseTimeout <= 0 {
+		return fmt.Errorf("LeaderLeaseTimeout (%d) must be positive", c.LeaderLeaseTimeout)
+	}
+	if c.LeaderLeaseTimeout <= c.MaxHeartbeatInterval+c.HeartbeatJitter || c.LeaderLeaseTimeout >= c.ElectionTimeoutMin {
+		return fmt.Errorf("LeaderLeaseTimeout (%d) must be more than MaxHeartbeatInterval (%d) plus HeartbeatJitter (%d) and less than ElectionTimeoutMin (%d)",
+			c.LeaderLeaseTimeout, c.MaxHeartbeatInterval, c.HeartbeatJitter, c.ElectionTimeoutMin)
+	}
+	if c.MaxAppendEntries < 0 {
+		return fmt.Errorf("MaxAppendEntries (%d) must not be negative, use 0 for no limit", c.MaxAppendEntries)
+	}
+	if c.MaxFailures < 0 {
+		return fmt.Errorf("MaxFailures (%d) must not be negative, use 0 to disable", c.MaxFailures)
+	}
+	if c.MaxInflightWrites < 0 {
+		return fmt.Errorf("MaxInflightWrites (%d) must not be negative, use 0 for no limit", c.MaxInflightWrites)
+	}
+	if c.MaxLogEntrySize < 0 {
+		return fmt.Errorf("MaxLogEntrySize (%d) must not be negative, use 0 for no limit", c.MaxLogEntrySize)
+	}
+	if c.ShutdownTimeout < 0 {
+		return fmt.Errorf("ShutdownTimeout (%d) must not be negative", c.ShutdownTimeout)
+	}
+	if c.StartupGracePeriod < 0 {
+		return fmt.Errorf("StartupGracePeriod (%d) must not be negative, use 0 to disable", c.StartupGracePeriod)
+	}
+	if c.ApplyTimeout < 0 {
+		return fmt.Errorf("ApplyTimeout (%d) must not be negative, use 0 to disable", c.ApplyTimeout)
+	}
+	if c.WriteQuorum < 0 || c.ReadQuorum < 0 || (c.WriteQuorum == 0) != (c.ReadQuorum == 0) {
+		return fmt.Errorf("WriteQuorum (%d) and ReadQuorum (%d) must both be positive or both be 0",
+			c.WriteQuorum, c.ReadQuorum)
+	}
+	if c.SnapshotDeltas < 0 {
+		return fmt.Errorf("SnapshotDeltas (%d) must not be negative, use 0 for full snapshots only", c.SnapshotDeltas)
+	}
+	if c.SnapshotDir != "" && c.SnapshotChunkSize <= 0 {
+		return fmt.Errorf("SnapshotChunkSize (%d) must be positive when SnapshotDir is set", c.SnapshotChunkSize)
+	}
+	if c.Logger == nil {
+		return fmt.Errorf("Logger must be set")
 	}
+	return nil
 }
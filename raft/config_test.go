@@ -0,0 +1,77 @@
+package raft
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestConfigValidate(t *testing.T) {
+	if err := DefaultConfig().Validate(); err != nil {
+		t.Fatalf("Default config should be valid: %v", err)
+	}
+
+	cases := []struct {
+		field  string
+		modify func(c *Config)
+	}{
+		{"HeartbeatInterval", func(c *Config) { c.HeartbeatInterval = 0 }},
+		{"ElectionTimeoutMin", func(c *Config) { c.ElectionTimeoutMin = 0 }},
+		{"ElectionTimeoutMin", func(c *Config) { c.ElectionTimeoutMax = c.ElectionTimeoutMin }},
+		{"ElectionPriority", func(c *Config) { c.ElectionPriority = -1 }},
+		{"ElectionPriority", func(c *Config) { c.ElectionPriority = c.MaxElectionPriority + 1 }},
+		{"MaxHeartbeatInterval", func(c *Config) { c.HeartbeatInterval = c.ElectionTimeoutMin }},
+		{"MaxHeartbeatInterval", func(c *Config) { c.MaxHeartbeatInterval = c.HeartbeatInterval - 1 }},
+		{"HeartbeatJitter", func(c *Config) { c.HeartbeatJitter = -1 }},
+		{"HeartbeatJitter", func(c *Config) { c.HeartbeatJitter = c.ElectionTimeoutMin - c.MaxHeartbeatInterval }},
+		{"RPCTimeout", func(c *Config) { c.RPCTimeout = 0 }},
+		{"MaxRetryBackoff", func(c *Config) { c.MaxRetryBackoff = -1 }},
+		{"LeaderLeaseTimeout", func(c *Config) { c.LeaderLeaseTimeout = 0 }},
+		{"LeaderLeaseTimeout", func(c *Config) { c.LeaderLeaseTimeout = c.ElectionTimeoutMin }},
+		{"LeaderLeaseTimeout", func(c *Config) { c.LeaderLeaseTimeout = c.MaxHeartbeatInterval + c.HeartbeatJitter }},
+		{"MaxAppendEntries", func(c *Config) { c.MaxAppendEntries = -1 }},
+		{"MaxFailures", func(c *Config) { c.MaxFailures = -1 }},
+		{"MaxInflightWrites", func(c *Config) { c.MaxInflightWrites = -1 }},
+		{"StartupGracePeriod", func(c *Config) { c.StartupGracePeriod = -1 }},
+		{"SnapshotDeltas", func(c *Config) { c.SnapshotDeltas = -1 }},
+		{"MaxLogEntrySize", func(c *Config) { c.MaxLogEntrySize = -1 }},
+		{"ShutdownTimeout", func(c *Config) { c.ShutdownTimeout = -1 }},
+		{"ApplyTimeout", func(c *Config) { c.ApplyTimeout = -1 }},
+		{"WriteQuorum", func(c *Config) { c.WriteQuorum = 2 }},
+		{"WriteQuorum", func(c *Config) { c.WriteQuorum, c.ReadQuorum = 2, -1 }},
+		{"SnapshotChunkSize", func(c *Config) { c.SnapshotDir, c.SnapshotChunkSize = t.TempDir(), 0 }},
+		{"Logger", func(c *Config) { c.Logger = nil }},
+	}
+	for _, tc := range cases {
+		c := DefaultConfig()
+		tc.modify(c)
+		err := c.Validate()
+		if err == nil || !strings.HasPrefix(err.Error(), tc.field) {
+			t.Fatalf("Invalid %s should be reported: %v", tc.field, err)
+		}
+	}
+}
+
+func TestNewServerInvalid(t *testing.T) {
+	invalid := DefaultConfig()
+	invalid.RPCTimeout = 0
+
+	cases := []struct {
+		name      string
+		config    *Config
+		transport Transport
+		ls        LogStore
+		sm        StateMachine
+	}{
+		{"config", nil, NewInmemTransport(""), NewInmemLogStore(), NewInMemStateMachine()},
+		{"RPCTimeout", invalid, NewInmemTransport(""), NewInmemLogStore(), NewInMemStateMachine()},
+		{"transport", DefaultConfig(), nil, NewInmemLogStore(), NewInMemStateMachine()},
+		{"log store", DefaultConfig(), NewInmemTransport(""), nil, NewInMemStateMachine()},
+		{"state machine", DefaultConfig(), NewInmemTransport(""), NewInmemLogStore(), nil},
+	}
+	for _, tc := range cases {
+		s, err := NewServer(tc.config, tc.transport, tc.ls, tc.sm)
+		if s != nil || err == nil || !strings.HasPrefix(err.Error(), tc.name) {
+			t.Fatalf("Server with invalid %s should not be created: %v", tc.name, err)
+		}
+	}
+}
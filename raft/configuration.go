@@ -0,0 +1,604 @@
+package raft
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// configuration is the members of cluster, it's replicated through
+// LogConfig so every node agrees on the quorum. OldMembers is only set in
+// joint phase of a membership change, quorum of both is needed then.
+type configuration struct {
+	Members    []string `json:"members"`
+	OldMembers []string `json:"oldMembers,omitempty"`
+	Learners   []string `json:"learners,omitempty"`
+}
+
+// configuration return current members of cluster, this server included
+func (s *Server) configuration() *configuration {
+	s.Lock()
+	defer s.Unlock()
+	c := &configuration{
+		Members:  append([]string{s.localAddr}, s.peers...),
+		Learners: append([]string{}, s.learners...),
+	}
+	if s.oldPeers != nil {
+		c.OldMembers = append([]string{s.localAddr}, s.oldPeers...)
+	}
+	return c
+}
+
+// Configuration is cluster membership as a server last applied it from a
+// committed configuration log, OldVoters is set in joint phase. Addresses
+// are sorted so configurations of different servers compare equal.
+type Configuration struct {
+	Voters    []string `json:"voters"`
+	OldVoters []string `json:"oldVoters,omitempty"`
+	Learners  []string `json:"learners"`
+}
+
+// Configuration return membership of cluster known by this server
+func (s *Server) Configuration() Configuration {
+	c := s.configuration()
+	sorted := func(addrs []string) []string {
+		if addrs == nil {
+			return nil
+		}
+		addrs = append([]string{}, addrs...)
+		sort.Strings(addrs)
+		return addrs
+	}
+	return Configuration{Voters: sorted(c.Members), OldVoters: sorted(c.OldMembers), Learners: sorted(c.Learners)}
+}
+
+// majority return number of servers forming majority of total
+func majority(total int) int {
+	return total/2 + 1
+}
+
+// quorums return the write and read quorum of total voters, configured
+// ones if they intersect and majority otherwise
+func (s *Server) quorums(total int) (int, int) {
+	if s.config.WriteQuorum == 0 || s.config.checkQuorums(total) != nil {
+		return majority(total), majority(total)
+	}
+	return s.config.WriteQuorum, s.config.ReadQuorum
+}
+
+// hasQuorum return whether agreed servers, this server included, form a
+// read quorum of current configuration, and majority of both
+// configurations in joint phase
+func (s *Server) hasQuorum(agreed map[string]bool) bool {
+	s.Lock()
+	peers, oldPeers := s.peers, s.oldPeers
+	s.Unlock()
+
+	quorum := majority(len(peers) + 1)
+	if oldPeers == nil {
+		_, quorum = s.quorums(len(peers) + 1)
+	}
+
+	count := func(peers []string) int {
+		n := 1
+		for _, peer := range peers {
+			if agreed[peer] {
+				n++
+			}
+		}
+		return n
+	}
+	if count(peers) < quorum {
+		return false
+	}
+	return oldPeers == nil || count(oldPeers) >= majority(len(oldPeers)+1)
+}
+
+// applyConfiguration is used to switch to committed configuration, peers
+// of this server are the members other than itself
+func (s *Server) applyConfiguration(data []byte) error {
+	var c configuration
+	if err := json.Unmarshal(data, &c); err != nil {
+		return err
+	}
+
+	s.Lock()
+	s.peers = without(c.Members, s.localAddr)
+	s.oldPeers = nil
+	if len(c.OldMembers) > 0 {
+		s.oldPeers = without(c.OldMembers, s.localAddr)
+	}
+	s.learners = without(c.Learners, s.localAddr)
+	s.nonVoter = !contains(c.Members, s.localAddr) && !contains(c.OldMembers, s.localAddr)
+	leading := s.state == Leader
+	s.debug("Configuration applied: peers %v old peers %v learners %v", s.peers, s.oldPeers, s.learners)
+	s.Unlock()
+
+	// Members added by the configuration need logs from leader, removed
+	// ones don't anymore
+	if leading {
+		s.stopRemovedReplication()
+		for _, peer := range s.voters() {
+			s.startReplication(peer, false)
+		}
+		for _, learner := range s.Learners() {
+			s.startReplication(learner, true)
+		}
+		s.promoteReplication()
+	}
+	return nil
+}
+
+// promoteReplication is used to count followers of learners promoted to
+// voters for commit
+func (s *Server) promoteReplication() {
+	s.Lock()
+	promoted := []*follower{}
+	for _, peer := range s.peers {
+		if f, ok := s.followers[peer]; ok {
+			promoted = append(promoted, f)
+		}
+	}
+	s.Unlock()
+
+	for _, f := range promoted {
+		f.Lock()
+		f.learner = false
+		f.Unlock()
+	}
+}
+
+// noteConfiguration is used to track index of the latest configuration log
+// stored
+func (s *Server) noteConfiguration(logs ...*Log) {
+	s.Lock()
+	defer s.Unlock()
+	for _, log := range logs {
+		if log.Type == LogConfig && log.Index > s.configIndex {
+			s.configIndex = log.Index
+		}
+	}
+}
+
+// configChangePending return whether the latest configuration log isn't
+// committed yet. Leader accepts one change at a time, the next one could
+// form a quorum disjoint from the pending one's otherwise.
+func (s *Server) configChangePending() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.configIndex > s.commitIndex
+}
+
+// bootstrapConfiguration is used by leader to log its configuration if
+// cluster was started from peers given on command line and never logged
+// one, so every node learns membership from the log
+func (s *Server) bootstrapConfiguration() {
+	s.Lock()
+	logged := s.configIndex > 0
+	s.Unlock()
+	if logged || len(s.voters()) == 0 {
+		return
+	}
+
+	data, err := json.Marshal(s.configuration())
+	if err != nil {
+		s.err("Failed to encode configuration: %v", err)
+		return
+	}
+	s.dispatchLog(&Log{Type: LogConfig, Command: data})
+}
+
+// BootstrapCluster is used to initialize a fresh cluster of this server
+// and peers before Start, it writes the first configuration log so every
+// member agrees on the quorum from the start. Only one node should be
+// bootstrapped, the others join once it's elected and replicates the
+// configuration to them. ErrBootstrapped is returned if log isn't empty.
+func (s *Server) BootstrapCluster(peers []string) error {
+	lastSnapshotIndex, _ := s.LastSnapshotInfo()
+	if s.LastLogIndex() > 0 || lastSnapshotIndex > 0 {
+		return ErrBootstrapped
+	}
+
+	c := &configuration{Members: append([]string{s.LocalAddr()}, without(peers, s.LocalAddr())...)}
+	if err := s.config.checkQuorums(len(c.Members)); err != nil {
+		return err
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	// Log is in term 0 so a leader elected without this node replaces it
+	// rather than keeping a different log at the same index and term
+	log := &Log{Index: 1, Term: 0, Type: LogConfig, Command: data}
+	if err := s.logStore.SetLog(log); err != nil {
+		return err
+	}
+	s.setLastLogInfo(log.Index, log.Term)
+	s.noteConfiguration(log)
+	return s.applyConfiguration(data)
+}
+
+// recover is used on start to load state kept by log store and snapshots,
+// the latest snapshot then the latest configuration in log, e.g. when a
+// stopped server is started again. On a persistent store, e.g.
+// FileLogStore, a restarted process rejoins with the members in its log
+// and term and vote are loaded by NewServer.
+func (s *Server) recover() error {
+	if _, ok := s.StateMachine().(SnapshotStateMachine); ok && s.snapshots != nil {
+		if err := s.restoreSnapshot(); err != nil && err != ErrNoSnapshot {
+			return err
+		}
+	}
+
+	lastSnapshotIndex, _ := s.LastSnapshotInfo()
+	for idx := s.LastLogIndex(); idx > lastSnapshotIndex; idx-- {
+		log, err := s.logStore.GetLog(idx)
+		if err != nil {
+			return err
+		}
+		if log.Type == LogConfig {
+			s.noteConfiguration(log)
+			return s.applyConfiguration(log.Command)
+		}
+	}
+	return nil
+}
+
+// changeConfiguration is used to commit new configuration through raft
+// log, it returns once the configuration is applied on leader
+func (s *Server) changeConfiguration(c *configuration, timeout time.Duration) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	return s.dispatch(&Log{
+		Type:    LogConfig,
+		Command: data,
+		errCh:   make(chan error, 1),
+	}, timeout)
+}
+
+// changeMembers is used to apply change to membership. Before Start it
+// only edits members server starts with. A running leader commits the
+// changed configuration through the log within timeout, so followers
+// learn it and a later configuration doesn't revert it, it takes effect
+// once applied. Other running servers return ErrNotLeader. Nothing is
+// logged if change keeps membership as it is.
+func (s *Server) changeMembers(change func(c *configuration) (bool, error), timeout time.Duration) error {
+	state := s.State()
+	if state != Stopped && state != Leader {
+		return ErrNotLeader
+	}
+	if state == Leader && s.configChangePending() {
+		return ErrConfigChangeInProgress
+	}
+
+	c := s.configuration()
+	if state == Leader && c.OldMembers != nil {
+		return ErrConfigChangeInProgress
+	}
+	changed, err := change(c)
+	if err != nil || !changed {
+		return err
+	}
+
+	if state == Stopped {
+		s.Lock()
+		s.peers = without(c.Members, s.localAddr)
+		s.learners = without(c.Learners, s.localAddr)
+		s.Unlock()
+		return nil
+	}
+	if err := s.config.checkQuorums(len(c.Members)); err != nil {
+		return err
+	}
+	return s.changeConfiguration(c, timeout)
+}
+
+// Reconfigure is used to change voting members of cluster, several servers
+// can be added and removed at once. Leader first commits a joint
+// configuration of old and new members, decisions need majority of both
+// from then on so two disjoint majorities can never exist. The new
+// configuration alone is committed next. Leader must stay in members, use
+// Leave to remove it.
+func (s *Server) Reconfigure(members []string, timeout time.Duration) error {
+	if s.State() != Leader {
+		return ErrNotLeader
+	}
+	if !contains(members, s.LocalAddr()) {
+		return fmt.Errorf("leader %s must be in new configuration", s.LocalAddr())
+	}
+	if err := s.config.checkQuorums(len(members)); err != nil {
+		return err
+	}
+	deadline := time.Now().Add(timeout)
+
+	current := s.configuration()
+	if current.OldMembers != nil || s.configChangePending() {
+		return ErrConfigChangeInProgress
+	}
+	learners := []string{}
+	for _, learner := range current.Learners {
+		if !contains(members, learner) {
+			learners = append(learners, learner)
+		}
+	}
+
+	joint := &configuration{Members: members, OldMembers: current.Members, Learners: learners}
+	if err := s.changeConfiguration(joint, timeout); err != nil {
+		return err
+	}
+	return s.changeConfiguration(&configuration{Members: members, Learners: learners}, time.Until(deadline))
+}
+
+// ValidateConfigChange is used to check, without changing anything,
+// whether adding and removing members would keep a quorum reachable. Peers
+// which responded within LeaderLeaseTimeout are reachable. Reconfigure
+// goes through a joint phase, so majority of current members must be
+// reachable as well as a quorum of the resulting ones, ErrQuorumUnreachable
+// is returned otherwise. Only leader knows which peers respond,
+// ErrNotLeader is returned on other servers.
+func (s *Server) ValidateConfigChange(add, remove []string) error {
+	if s.State() != Leader {
+		return ErrNotLeader
+	}
+
+	current := s.configuration().Members
+	members := []string{}
+	for _, member := range append(current, add...) {
+		if !contains(members, member) && !contains(remove, member) {
+			members = append(members, member)
+		}
+	}
+	if len(members) == 0 {
+		return fmt.Errorf("no member would be left: %w", ErrQuorumUnreachable)
+	}
+	if err := s.config.checkQuorums(len(members)); err != nil {
+		return err
+	}
+
+	reachable := s.contactedPeers(time.Duration(s.config.LeaderLeaseTimeout) * time.Millisecond)
+	reachable[s.LocalAddr()] = true
+	check := func(members []string, quorum int) error {
+		n := 0
+		for _, member := range members {
+			if reachable[member] {
+				n++
+			}
+		}
+		if n < quorum {
+			return fmt.Errorf("%d of members %v reachable, %d needed: %w", n, members, quorum, ErrQuorumUnreachable)
+		}
+		return nil
+	}
+	if err := check(current, majority(len(current))); err != nil {
+		return err
+	}
+	// Joint phase needs majority of them, the configuration alone both
+	// quorums after it
+	quorum := majority(len(members))
+	writeQuorum, readQuorum := s.quorums(len(members))
+	for _, q := range []int{writeQuorum, readQuorum} {
+		if q > quorum {
+			quorum = q
+		}
+	}
+	return check(members, quorum)
+}
+
+// Leave is used to remove this server from cluster. Leader commits the
+// configuration without itself, hands leadership to the most up to date
+// peer then stops. Only leader can commit the change, ErrNotLeader is
+// returned on other servers, they leave by having leader RemovePeer them.
+func (s *Server) Leave(timeout time.Duration) error {
+	if s.State() != Leader {
+		return ErrNotLeader
+	}
+	if s.configChangePending() {
+		return ErrConfigChangeInProgress
+	}
+	deadline := s.clock().Now().Add(timeout)
+
+	c := s.configuration()
+	c.Members = without(c.Members, s.LocalAddr())
+	if err := s.config.checkQuorums(len(c.Members)); len(c.Members) > 0 && err != nil {
+		return err
+	}
+	if err := s.changeConfiguration(c, timeout); err != nil {
+		return err
+	}
+
+	// Let peers learn the configuration is committed before leadership
+	// moves, new leader may not commit it otherwise
+	s.Lock()
+	followers := make([]*follower, 0, len(s.followers))
+	for _, f := range s.followers {
+		followers = append(followers, f)
+	}
+	s.Unlock()
+	for _, f := range followers {
+		s.replicateTo(f)
+	}
+
+	if len(c.Members) > 0 {
+		if err := s.TransferLeadership(deadline.Sub(s.clock().Now())); err != nil {
+			return fmt.Errorf("failed to transfer leadership: %v", err)
+		}
+	}
+
+	s.Stop()
+	return nil
+}
+
+// TransferLeadership is used to hand leadership to the voting peer with
+// the highest match index, peers suspected down are skipped. Once the peer
+// has every log it's asked to start election, ErrTimeout is returned if
+// this server is still leader after timeout. New logs are refused with
+// ErrLeadershipTransferInProgress meanwhile, and once asked the server
+// starts no election for ElectionTimeoutMax so the peer wins first.
+func (s *Server) TransferLeadership(timeout time.Duration) error {
+	if s.State() != Leader {
+		return ErrNotLeader
+	}
+	s.Lock()
+	if s.leadershipTransfer {
+		s.Unlock()
+		return ErrLeadershipTransferInProgress
+	}
+	s.leadershipTransfer = true
+	s.Unlock()
+	defer func() {
+		s.Lock()
+		s.leadershipTransfer = false
+		s.Unlock()
+	}()
+	deadline := s.clock().Now().Add(timeout)
+
+	s.Lock()
+	followers := make([]*follower, 0, len(s.peers))
+	for _, peer := range s.peers {
+		if f, ok := s.followers[peer]; ok {
+			followers = append(followers, f)
+		}
+	}
+	s.Unlock()
+
+	// A peer suspected down is only picked if every peer is
+	var target *follower
+	var targetMatch uint64
+	var targetDown bool
+	for _, f := range followers {
+		matchIndex, _ := f.progress()
+		down := s.suspectedDown(f)
+		if target == nil || (targetDown && !down) || (down == targetDown && matchIndex > targetMatch) {
+			target, targetMatch, targetDown = f, matchIndex, down
+		}
+	}
+	if target == nil {
+		return fmt.Errorf("no peer to transfer leadership to")
+	}
+
+	// Wait for target to catch up, it can't win election otherwise
+	for {
+		matchIndex, _ := target.progress()
+		if matchIndex >= s.LastLogIndex() {
+			break
+		}
+		if s.State() != Leader {
+			return ErrLeadershipLost
+		}
+		if s.clock().Now().After(deadline) {
+			return ErrTimeout
+		}
+		asyncNotifyCh(target.replicateCh)
+		time.Sleep(time.Duration(s.config.HeartbeatInterval) * time.Millisecond / 10)
+	}
+
+	req := &TimeoutNowRequest{
+		Term:   s.CurrentTerm(),
+		Leader: s.LocalAddr(),
+	}
+	s.holdCampaign(time.Duration(s.config.ElectionTimeoutMax) * time.Millisecond)
+	var resp TimeoutNowResponse
+	ctx, cancel := s.rpcContext()
+	err := s.Transport().TimeoutNow(ctx, target.peer, req, &resp)
+	cancel()
+	if err != nil {
+		s.holdCampaign(0)
+		return err
+	}
+
+	for s.State() == Leader {
+		if s.clock().Now().After(deadline) {
+			return ErrTimeout
+		}
+		time.Sleep(time.Duration(s.config.HeartbeatInterval) * time.Millisecond / 10)
+	}
+	return nil
+}
+
+// transferringLeadership return whether TransferLeadership is running
+func (s *Server) transferringLeadership() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.leadershipTransfer
+}
+
+// holdCampaign is used to keep server from starting elections for d
+func (s *Server) holdCampaign(d time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+	s.campaignAfter = s.clock().Now().Add(d)
+}
+
+// campaignHeldOff return whether server handed leadership away too
+// recently to start an election
+func (s *Server) campaignHeldOff() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.clock().Now().Before(s.campaignAfter)
+}
+
+// StepDown is used to make leader revert to follower right away, peers
+// elect a new leader once their election timeout passes. It's meant to
+// recover from a leader which is alive but stuck, any server may win the
+// election, this one included. ErrNotLeader is returned on other servers.
+func (s *Server) StepDown() error {
+	if s.State() != Leader {
+		return ErrNotLeader
+	}
+	s.warn("Stepping down as asked, leaving term %d to a new election", s.CurrentTerm())
+	s.stepDown(s.CurrentTerm())
+	// Run loop only leaves leader state, stopping heartbeats, once woken
+	asyncNotifyCh(s.commitCh)
+	return nil
+}
+
+// Drain is used to keep server from becoming leader, e.g. before its
+// maintenance, leadership is transferred away if it leads. Drained server
+// still votes, replicates logs and serves reads until Undrain.
+func (s *Server) Drain(timeout time.Duration) error {
+	s.Lock()
+	s.drained = true
+	s.Unlock()
+	if s.State() != Leader {
+		return nil
+	}
+	s.warn("Draining, transferring leadership of term %d", s.CurrentTerm())
+	return s.TransferLeadership(timeout)
+}
+
+// Undrain is used to let drained server become leader again
+func (s *Server) Undrain() {
+	s.Lock()
+	defer s.Unlock()
+	s.drained = false
+}
+
+// isNonVoter return whether the latest configuration applied leaves this
+// server out of voters
+func (s *Server) isNonVoter() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.nonVoter
+}
+
+// Drained return whether server is kept from becoming leader
+func (s *Server) Drained() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.drained
+}
+
+// without return a copy of addrs without addr
+func without(addrs []string, addr string) []string {
+	out := make([]string, 0, len(addrs))
+	for _, a := range addrs {
+		if a != addr {
+			out = append(out, a)
+		}
+	}
+	return out
+}
@@ -0,0 +1,392 @@
+package raft
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTransferLeadership(t *testing.T) {
+	// Time only passes on the clock advanced, nothing times out otherwise
+	_, cluster := NewTestNetworkCluster(3)
+	clocks := make([]*MockClock, len(cluster))
+	for i, s := range cluster {
+		clocks[i] = NewMockClock()
+		s.config.Clock = clocks[i]
+		s.Start()
+		defer s.Stop()
+	}
+	for _, clock := range clocks {
+		clock.BlockUntil(1)
+	}
+	clocks[0].Advance(time.Duration(cluster[0].config.ElectionTimeoutMax) * time.Millisecond)
+	leader := waitForLeader(t, cluster)
+	if leader != cluster[0] {
+		t.Fatalf("First server should lead: %v", leader.LocalAddr())
+	}
+	if err := leader.Do([]byte("a:b")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Writes are refused while leadership is handed over
+	leader.Lock()
+	leader.leadershipTransfer = true
+	leader.Unlock()
+	if err := leader.Do([]byte("c:d")); !errors.Is(err, ErrLeadershipTransferInProgress) {
+		t.Fatalf("Write should be refused during transfer: %v", err)
+	}
+	leader.Lock()
+	leader.leadershipTransfer = false
+	leader.Unlock()
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- leader.TransferLeadership(time.Second)
+	}()
+
+	// Target wins without its election timeout, old leader learns of it
+	// from the first heartbeat, due once lease and heartbeat timers are set
+	var newLeader *Server
+	deadline := time.Now().Add(20 * testElectionTimeout)
+	for newLeader == nil {
+		for i, s := range cluster[1:] {
+			if s.State() == Leader {
+				newLeader = s
+				clocks[i+1].BlockUntil(3)
+				clocks[i+1].Advance(time.Duration(s.config.HeartbeatInterval) * time.Millisecond)
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Leadership should move to another server")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	if leader.State() == Leader {
+		t.Fatalf("Old leader should step down")
+	}
+	if newLeader.LastLogIndex() < 1 {
+		t.Fatalf("New leader should have every log: %v", newLeader.LastLogIndex())
+	}
+
+	// Old leader's election timeout passes but it doesn't campaign until
+	// target had its own
+	term := leader.CurrentTerm()
+	clocks[0].Advance(time.Duration(leader.config.ElectionTimeoutMax-1) * time.Millisecond)
+	deadline = time.Now().Add(testElectionTimeout)
+	for leader.Leader() != "" {
+		if time.Now().After(deadline) {
+			t.Fatalf("Old leader's election timeout should pass")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if leader.State() != Follower || leader.CurrentTerm() != term {
+		t.Fatalf("Old leader should not campaign: %v term %d", leader.State(), leader.CurrentTerm())
+	}
+}
+
+func TestReconfigureJointConsensus(t *testing.T) {
+	network, cluster := NewTestNetworkCluster(3)
+	for _, s := range cluster {
+		s.Start()
+		defer s.Stop()
+	}
+	leader := waitForLeader(t, cluster)
+	var removed *Server
+	for _, s := range cluster {
+		if s != leader {
+			removed = s
+			break
+		}
+	}
+
+	// New servers know the target configuration, they can't win an
+	// election before leader reaches them
+	var members []string
+	for _, s := range cluster {
+		if s != removed {
+			members = append(members, s.LocalAddr())
+		}
+	}
+	added := []*Server{}
+	for i := 0; i < 2; i++ {
+		transport := network.NewTransport("")
+		members = append(members, transport.LocalAddr())
+		added = append(added, mustNewServer(DefaultConfig(), transport, NewInmemLogStore(), NewInMemStateMachine()))
+	}
+	for _, s := range added {
+		s.peers = without(members, s.LocalAddr())
+		s.Start()
+		defer s.Stop()
+	}
+
+	// Cluster keeps committing writes during the whole change
+	stopWrites := make(chan struct{})
+	writeErrs := make(chan error, 1)
+	go func() {
+		defer close(writeErrs)
+		for {
+			select {
+			case <-stopWrites:
+				return
+			default:
+			}
+			if err := leader.Do([]byte("a:b")); err != nil {
+				writeErrs <- err
+				return
+			}
+		}
+	}()
+
+	// Leader's bootstrap configuration must commit before any change
+	if err := leader.Barrier(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := leader.Reconfigure(members, 2*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	close(stopWrites)
+	if err := <-writeErrs; err != nil {
+		t.Fatalf("Writes should not fail during reconfiguration: %v", err)
+	}
+
+	if leader.State() != Leader {
+		t.Fatalf("Leader should keep leadership")
+	}
+	if leader.MemberCount() != 4 || leader.QuorumSize() != 3 {
+		t.Fatalf("Wrong configuration: members %v quorum %v", leader.MemberCount(), leader.QuorumSize())
+	}
+
+	// Removed server is not needed to commit anymore
+	removed.Stop()
+	index, err := leader.Apply([]byte("c:d"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range added {
+		if err := s.WaitApplied(index, time.Second); err != nil {
+			t.Fatalf("Added server %v should catch up: %v", s.LocalAddr(), err)
+		}
+		if s.StateMachine().Get([]byte("c")) != "d" {
+			t.Fatalf("Added server %v should apply logs", s.LocalAddr())
+		}
+	}
+}
+
+func TestJointQuorum(t *testing.T) {
+	s := NewTestServer()
+	s.peers = []string{"s2", "s4", "s5"}
+	s.oldPeers = []string{"s2", "s3"}
+
+	if s.MemberCount() != 5 || s.QuorumSize() != 3 {
+		t.Fatalf("Wrong joint quorum: members %v quorum %v", s.MemberCount(), s.QuorumSize())
+	}
+	if s.hasQuorum(map[string]bool{"s4": true, "s5": true}) {
+		t.Fatalf("Majority of new configuration alone is not a quorum")
+	}
+	if s.hasQuorum(map[string]bool{"s3": true}) {
+		t.Fatalf("Majority of old configuration alone is not a quorum")
+	}
+	if !s.hasQuorum(map[string]bool{"s3": true, "s4": true, "s5": true}) {
+		t.Fatalf("Majority of both configurations is a quorum")
+	}
+
+	s.setLastLogInfo(10, 1)
+	s.followers = map[string]*follower{
+		"s2": {matchIndex: 2},
+		"s3": {matchIndex: 5},
+		"s4": {matchIndex: 8},
+		"s5": {matchIndex: 9},
+	}
+	// New configuration alone stores up to 8, old one up to 5
+	if index := s.quorumMatchIndex(); index != 5 {
+		t.Fatalf("Wrong joint commit index: %v", index)
+	}
+}
+
+func TestLeaveLeader(t *testing.T) {
+	_, cluster := NewTestNetworkCluster(3)
+	for _, s := range cluster {
+		s.Start()
+		defer s.Stop()
+	}
+
+	leader := waitForLeader(t, cluster)
+	var rest []*Server
+	for _, s := range cluster {
+		if s != leader {
+			rest = append(rest, s)
+		}
+	}
+
+	if err := leader.Barrier(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := leader.Leave(2 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if leader.State() != Stopped {
+		t.Fatalf("Server should stop after leaving: %v", leader.State())
+	}
+
+	for _, s := range rest {
+		if err := s.WaitApplied(leader.LastLogIndex(), time.Second); err != nil {
+			t.Fatal(err)
+		}
+		if peers := s.Peers(); len(peers) != 1 || peers[0] == leader.LocalAddr() {
+			t.Fatalf("Departed server should be removed from %v: %v", s.LocalAddr(), peers)
+		}
+		if s.QuorumSize() != 2 {
+			t.Fatalf("Wrong quorum size on %v: %v", s.LocalAddr(), s.QuorumSize())
+		}
+	}
+
+	// Remaining servers commit writes without the departed one
+	newLeader := waitForLeader(t, rest)
+	if err := newLeader.Do([]byte("a:b")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLeaveNotLeader(t *testing.T) {
+	s := NewTestServer()
+	if err := s.Leave(time.Second); err != ErrNotLeader {
+		t.Fatalf("Only leader can leave: %v", err)
+	}
+}
+
+func TestBootstrapCluster(t *testing.T) {
+	cluster := NewTestCluster(3)
+	bootstrapped := cluster[0]
+	peers := bootstrapped.Peers()
+	bootstrapped.peers = nil
+
+	if err := bootstrapped.BootstrapCluster(peers); err != nil {
+		t.Fatal(err)
+	}
+	if len(bootstrapped.Peers()) != 2 || bootstrapped.LastLogIndex() != 1 {
+		t.Fatalf("Bootstrap should log configuration: peers %v last %d", bootstrapped.Peers(), bootstrapped.LastLogIndex())
+	}
+	if err := bootstrapped.BootstrapCluster(peers); !errors.Is(err, ErrBootstrapped) {
+		t.Fatalf("Second bootstrap should fail: %v", err)
+	}
+	if bootstrapped.LastLogIndex() != 1 {
+		t.Fatalf("Second bootstrap should not log configuration again: %d", bootstrapped.LastLogIndex())
+	}
+
+	for _, s := range cluster {
+		s.Start()
+		defer s.Stop()
+	}
+	leader := waitForLeader(t, cluster)
+	if err := leader.Do([]byte("a:b")); err != nil {
+		t.Fatal(err)
+	}
+
+	configs := 0
+	for idx := uint64(1); idx <= leader.LastLogIndex(); idx++ {
+		log, err := leader.logStore.GetLog(idx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if log.Type == LogConfig {
+			configs++
+		}
+	}
+	if configs != 1 {
+		t.Fatalf("Cluster should have one configuration log: %d", configs)
+	}
+}
+
+func TestConfigChangeInProgressRejected(t *testing.T) {
+	network, cluster := NewTestNetworkCluster(3)
+	for _, s := range cluster {
+		s.Start()
+		defer s.Stop()
+	}
+	leader := waitForLeader(t, cluster)
+	if err := leader.Barrier(time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	network.SetLatency(testElectionTimeout / 10)
+	members := leader.configuration().Members
+	done := make(chan error, 1)
+	go func() {
+		done <- leader.Reconfigure(members, time.Second)
+	}()
+	deadline := time.Now().Add(time.Second)
+	for !leader.configChangePending() {
+		if time.Now().After(deadline) {
+			t.Fatalf("First change should be pending")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := leader.Reconfigure(members, time.Second); !errors.Is(err, ErrConfigChangeInProgress) {
+		t.Fatalf("Second change should be rejected: %v", err)
+	}
+	if err := leader.AddPeer("unknown", time.Second); !errors.Is(err, ErrConfigChangeInProgress) {
+		t.Fatalf("Adding peer should be rejected: %v", err)
+	}
+	if err := leader.Leave(time.Second); !errors.Is(err, ErrConfigChangeInProgress) {
+		t.Fatalf("Leaving should be rejected: %v", err)
+	}
+
+	if err := <-done; err != nil {
+		t.Fatalf("First change should commit: %v", err)
+	}
+	if err := leader.Reconfigure(members, time.Second); err != nil {
+		t.Fatalf("Change after the committed one should be accepted: %v", err)
+	}
+}
+
+func TestValidateConfigChange(t *testing.T) {
+	network, cluster := NewTestNetworkCluster(3)
+	for _, s := range cluster {
+		s.Start()
+		defer s.Stop()
+	}
+	leader := waitForLeader(t, cluster)
+	var followers []*Server
+	for _, s := range cluster {
+		if s != leader {
+			followers = append(followers, s)
+		}
+	}
+	if err := followers[0].ValidateConfigChange(nil, nil); !errors.Is(err, ErrNotLeader) {
+		t.Fatalf("Follower should not validate: %v", err)
+	}
+	if err := leader.ValidateConfigChange(nil, []string{followers[0].LocalAddr()}); err != nil {
+		t.Fatalf("Removing a peer of a healthy cluster should be valid: %v", err)
+	}
+
+	// Once a follower stops responding, removing the other one leaves
+	// leader alone with it
+	down, up := followers[0], followers[1]
+	network.Isolate(down.LocalAddr())
+	deadline := time.Now().Add(time.Second)
+	for {
+		err := leader.ValidateConfigChange(nil, []string{up.LocalAddr()})
+		if errors.Is(err, ErrQuorumUnreachable) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Removing the reachable peer should break quorum: %v", err)
+		}
+		time.Sleep(testElectionTimeout / 10)
+	}
+	if err := leader.ValidateConfigChange([]string{"new"}, nil); !errors.Is(err, ErrQuorumUnreachable) {
+		t.Fatalf("Adding an unreachable peer should break quorum: %v", err)
+	}
+	if err := leader.ValidateConfigChange(nil, []string{down.LocalAddr()}); err != nil {
+		t.Fatalf("Removing the unreachable peer should be valid: %v", err)
+	}
+
+	// Nothing is changed
+	if leader.MemberCount() != 3 {
+		t.Fatalf("Validation should not change configuration: %v", leader.MemberCount())
+	}
+}
@@ -0,0 +1,102 @@
+package raft
+
+import (
+	"errors"
+	"strings"
+)
+
+var (
+	// ErrTimeout is returned when an operation doesn't finish in time
+	ErrTimeout = errors.New("timeout")
+	// ErrLeadershipLost is returned when leader steps down before a log
+	// it dispatched is committed
+	ErrLeadershipLost = errors.New("leadership lost")
+	// ErrNotLeader is returned when an operation can only be done by
+	// leader, e.g. Apply on a follower
+	ErrNotLeader = errors.New("not leader")
+	// ErrIsLeader is returned when an operation can't be done by leader,
+	// e.g. Reset, leadership must be transferred first
+	ErrIsLeader = errors.New("server is leader")
+	// ErrIsVoter is returned when an operation can't be done by a voting
+	// member, e.g. Reset, it must be demoted first
+	ErrIsVoter = errors.New("server is a voter")
+	// ErrResetUnsupported is returned when resetting a server whose state
+	// machine doesn't implement ResetStateMachine
+	ErrResetUnsupported = errors.New("reset is not supported")
+	// ErrServerShutdown is returned when server is stopped before a log is
+	// accepted or committed
+	ErrServerShutdown = errors.New("server shutdown")
+	// ErrQueueFull is returned when a write is refused because
+	// MaxInflightWrites writes are already waiting to be applied
+	ErrQueueFull = errors.New("write queue is full")
+	// ErrLogEntryTooLarge is returned when a write is refused because its
+	// command exceeds MaxLogEntrySize
+	ErrLogEntryTooLarge = errors.New("log entry is too large")
+	// ErrUnknownCommand is returned for an RPC or a log whose type server
+	// doesn't know
+	ErrUnknownCommand = errors.New("unknown command")
+	// ErrBootstrapped is returned when bootstrapping a server whose log
+	// already holds cluster state
+	ErrBootstrapped = errors.New("cluster is already bootstrapped")
+	// ErrNotEmpty is returned when importing into a cluster which has
+	// more than one member or already holds data
+	ErrNotEmpty = errors.New("cluster is not empty")
+	// ErrCompacted is returned when logs needed are compacted into a
+	// snapshot, e.g. by LogStore.GetLog for an index below its first index
+	ErrCompacted = errors.New("logs are compacted")
+	// ErrConfigChangeInProgress is returned when changing membership on a
+	// leader whose latest configuration log isn't committed yet
+	ErrConfigChangeInProgress = errors.New("configuration change is already in progress")
+	// ErrQuorumUnreachable is returned when validating a membership change
+	// whose members currently reachable couldn't form a quorum
+	ErrQuorumUnreachable = errors.New("quorum would be unreachable")
+	// ErrLogNotFound is returned by LogStore.GetLog for an index it never
+	// stored or which was truncated
+	ErrLogNotFound = errors.New("log not found")
+	// ErrLeadershipTransferInProgress is returned when a write is refused
+	// because leader is handing leadership to a peer
+	ErrLeadershipTransferInProgress = errors.New("leadership transfer in progress")
+)
+
+// remoteErrors are errors which keep their identity when a peer sends
+// them back as text
+var remoteErrors = []error{
+	ErrTimeout,
+	ErrLeadershipLost,
+	ErrNotLeader,
+	ErrServerShutdown,
+	ErrUnknownCommand,
+	ErrSnapshotUnsupported,
+	ErrNoSnapshot,
+	ErrCompacted,
+	ErrQuorumUnreachable,
+	ErrLeadershipTransferInProgress,
+}
+
+// DecodeError is used by transports to turn error message received from a
+// peer back into an error, errors wrapping one of the package errors stay
+// comparable with errors.Is
+func DecodeError(msg string) error {
+	for _, err := range remoteErrors {
+		if wrapped := err.Error(); msg == wrapped || strings.HasSuffix(msg, ": "+wrapped) {
+			return &remoteError{msg: msg, err: err}
+		}
+	}
+	return errors.New(msg)
+}
+
+// remoteError is an error received from a peer
+type remoteError struct {
+	msg string
+	err error
+}
+
+// Error ...
+func (e *remoteError) Error() string {
+	return e.msg
+}
+
+// Unwrap ...
+func (e *remoteError) Unwrap() error {
+	return e.err
+}
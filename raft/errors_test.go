@@ -0,0 +1,76 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestApplyErrors(t *testing.T) {
+	cluster := NewTestCluster(3)
+	for _, s := range cluster {
+		s.Start()
+		defer s.Stop()
+	}
+	leader := waitForLeader(t, cluster)
+
+	var follower *Server
+	for _, s := range cluster {
+		if s != leader {
+			follower = s
+		}
+	}
+	if _, err := follower.Apply([]byte("a:b")); !errors.Is(err, ErrNotLeader) {
+		t.Fatalf("Apply on follower should fail with ErrNotLeader: %v", err)
+	}
+	if err := follower.WaitApplied(100, 10*time.Millisecond); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("Wait should fail with ErrTimeout: %v", err)
+	}
+
+	follower.Stop()
+	if _, err := follower.Apply([]byte("a:b")); !errors.Is(err, ErrServerShutdown) {
+		t.Fatalf("Apply on stopped server should fail with ErrServerShutdown: %v", err)
+	}
+}
+
+func TestUnknownCommandErrors(t *testing.T) {
+	s := mustNewServer(DefaultConfig(), NewInmemTransport(""), NewInmemLogStore(), NewInMemStateMachine())
+
+	respCh := make(chan RPCResponse, 1)
+	s.processRPC(RPC{Request: "foo", RespCh: respCh})
+	if resp := <-respCh; !errors.Is(resp.Error, ErrUnknownCommand) {
+		t.Fatalf("Unknown request should fail with ErrUnknownCommand: %v", resp.Error)
+	}
+
+	errs := s.applyBatch([]*Log{{Index: 1, Type: LogType(100)}})
+	if !errors.Is(errs[0], ErrUnknownCommand) {
+		t.Fatalf("Unknown log type should fail with ErrUnknownCommand: %v", errs[0])
+	}
+}
+
+func TestTransportErrors(t *testing.T) {
+	t1, t2 := NewInmemTransport(""), NewInmemTransport("")
+	t1.AddPeer(t2)
+	// Nobody consumes t2 so the RPC times out
+	if _, err := t1.sentRPC(context.Background(), t2.LocalAddr(), &AppendEntryRequest{}, 10*time.Millisecond); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("Unanswered RPC should fail with ErrTimeout: %v", err)
+	}
+
+	tcp1 := newTestTCPTransport(t, "127.0.0.1:0")
+	defer tcp1.Close()
+	tcp2 := newTestTCPTransport(t, "127.0.0.1:0")
+	defer tcp2.Close()
+
+	go func() {
+		rpc := <-tcp2.Consumer()
+		rpc.Response(&AppendEntryResponse{}, fmt.Errorf("append entries: %w", ErrServerShutdown))
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	var resp AppendEntryResponse
+	if err := tcp1.AppendEntries(ctx, tcp2.LocalAddr(), &AppendEntryRequest{}, &resp); !errors.Is(err, ErrServerShutdown) {
+		t.Fatalf("Remote error should keep its identity: %v", err)
+	}
+}
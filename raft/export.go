@@ -0,0 +1,226 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+)
+
+// Export is used to write state machine as of a read index to w, so data
+// can be backed up independent of snapshot store. Leader commits a
+// barrier first, every write committed before the call is in the export.
+// It gives up once ctx is done.
+func (s *Server) Export(ctx context.Context, w io.Writer) error {
+	sm, ok := s.StateMachine().(SnapshotStateMachine)
+	if !ok {
+		return ErrSnapshotUnsupported
+	}
+	if err := s.readBarrier(ctx); err != nil {
+		return err
+	}
+
+	// State is saved under applyLock and written afterwards, so a slow
+	// writer doesn't hold up applying logs. Next snapshot is full, state
+	// machine may forget changes a delta would need once it's saved.
+	var buf bytes.Buffer
+	s.applyLock.Lock()
+	err := sm.Snapshot(&buf)
+	s.deltaBase = false
+	s.applyLock.Unlock()
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, &buf)
+	return err
+}
+
+// Import is used to load an export into a fresh single node cluster. The
+// state machine is restored on leader and a snapshot is taken right away,
+// so data survives restart and peers added later receive it. It gives up
+// once ctx is done.
+func (s *Server) Import(ctx context.Context, r io.Reader) error {
+	sm, ok := s.StateMachine().(SnapshotStateMachine)
+	if !ok || s.snapshots == nil {
+		return ErrSnapshotUnsupported
+	}
+	if err := s.readBarrier(ctx); err != nil {
+		return err
+	}
+
+	s.applyLock.Lock()
+	empty, err := s.empty()
+	if err == nil && !empty {
+		err = ErrNotEmpty
+	}
+	if err == nil {
+		err = sm.Restore(r)
+		s.deltaBase = false
+	}
+	s.applyLock.Unlock()
+	if err != nil {
+		return err
+	}
+	return s.Snapshot()
+}
+
+// Reset is used to rebuild a follower whose log or state machine is
+// corrupted. Server is stopped, its log, snapshot, state machine and
+// configuration are wiped and it's started again empty, catching up from
+// leader with a snapshot and AppendEntries. A voter wiped of logs it
+// acknowledged could lose committed writes, so it must be demoted with
+// DemotePeer on leader first and promoted again with PromotePeer once
+// CaughtUp, ErrIsVoter is returned otherwise. It never starts an election
+// until a configuration makes it a voter. Term and vote are kept so it
+// can't vote twice in a term. Leader refuses with ErrIsLeader.
+func (s *Server) Reset() error {
+	if s.State() == Leader {
+		return ErrIsLeader
+	}
+	sm, ok := s.StateMachine().(ResetStateMachine)
+	if !ok {
+		return ErrResetUnsupported
+	}
+	if !s.isNonVoter() {
+		return ErrIsVoter
+	}
+	s.warn("Resetting log and state machine, catching up from leader")
+	s.Stop()
+
+	// Run loop is stopped, snapshot being received can't be finished
+	if s.pendingSnapshot != nil {
+		s.pendingSnapshot.cancel()
+		s.pendingSnapshot = nil
+	}
+
+	first, err := s.logStore.FirstIndex()
+	if err != nil {
+		return err
+	}
+	last, err := s.logStore.LastIndex()
+	if err != nil {
+		return err
+	}
+	if last > 0 {
+		if err := s.logStore.DeleteRange(first, last); err != nil {
+			return err
+		}
+	}
+	if s.snapshots != nil {
+		if err := s.snapshots.remove(); err != nil {
+			return err
+		}
+	}
+	s.applyLock.Lock()
+	err = sm.Reset()
+	s.deltaBase = false
+	s.applyLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	s.lastLogIndex, s.lastLogTerm = 0, 0
+	s.lastSnapshotIndex, s.lastSnapshotTerm = 0, 0
+	s.appliedSinceSnapshot, s.bytesSinceSnapshot = 0, 0
+	s.commitIndex, s.lastApplied, s.leaderCommitIndex = 0, 0, 0
+	s.peers, s.oldPeers, s.learners = []string{}, nil, nil
+	s.configIndex = 0
+	s.Unlock()
+	return s.Start()
+}
+
+// readBarrier is used to wait until leader applied every log committed
+// before the call, it returns ErrNotLeader on other nodes and
+// ErrServerShutdown if server isn't running. Waiting stops once ctx is
+// done, like ApplyResult.
+func (s *Server) readBarrier(ctx context.Context) error {
+	if s.State() == Stopped {
+		return ErrServerShutdown
+	}
+	entry := &Log{
+		Type:  LogBarrier,
+		errCh: make(chan error, 1),
+	}
+
+	select {
+	case s.applyCh <- entry:
+	case <-s.shutdownCh:
+		return ErrServerShutdown
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-entry.errCh:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// empty return whether cluster is this node alone and no command was ever
+// committed to it
+func (s *Server) empty() (bool, error) {
+	c := s.configuration()
+	if len(c.Members) > 1 || len(c.Learners) > 0 || c.OldMembers != nil {
+		return false, nil
+	}
+	if index, _ := s.LastSnapshotInfo(); index > 0 {
+		return false, nil
+	}
+
+	first, err := s.logStore.FirstIndex()
+	if err != nil {
+		return false, err
+	}
+	for idx := first; idx <= s.LastLogIndex() && idx > 0; idx++ {
+		log, err := s.logStore.GetLog(idx)
+		if err != nil {
+			return false, err
+		}
+		if log.Type == LogCommand {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// ReplayLogs is used to apply committed command logs up to index to sm,
+// e.g. a fresh state machine to read state as of a past index. It returns
+// ErrCompacted once logs before index are in a snapshot.
+func (s *Server) ReplayLogs(sm StateMachine, index uint64) error {
+	if index > s.CommitIndex() {
+		return fmt.Errorf("log %d is not committed", index)
+	}
+	if lastSnapshotIndex, _ := s.LastSnapshotInfo(); lastSnapshotIndex > 0 {
+		return ErrCompacted
+	}
+	first, err := s.logStore.FirstIndex()
+	if err != nil {
+		return err
+	}
+	if first > 1 {
+		return ErrCompacted
+	}
+
+	var logs []*Log
+	for idx := first; idx <= index && idx > 0; idx++ {
+		log, err := s.logStore.GetLog(idx)
+		if err != nil {
+			return err
+		}
+		if log.Type == LogCommand {
+			logs = append(logs, log)
+		}
+	}
+
+	// Commands fail the same way they did when they were first applied
+	if indexed, ok := sm.(LogStateMachine); ok {
+		indexed.ApplyLogs(logs)
+		return nil
+	}
+	for _, log := range logs {
+		_ = sm.Set(log.Command)
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestExportImport(t *testing.T) {
+	cluster := NewTestCluster(3)
+	for _, s := range cluster {
+		s.Start()
+		defer s.Stop()
+	}
+	leader := waitForLeader(t, cluster)
+	for i := 0; i < 5; i++ {
+		if err := leader.Do([]byte(fmt.Sprintf("k%d:v%d", i, i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, s := range cluster {
+		if s != leader {
+			if err := s.Export(context.Background(), &bytes.Buffer{}); err != ErrNotLeader {
+				t.Fatalf("Export should only be served by leader: %v", err)
+			}
+		}
+	}
+	var backup bytes.Buffer
+	if err := leader.Export(context.Background(), &backup); err != nil {
+		t.Fatal(err)
+	}
+
+	fresh := NewTestServer()
+	fresh.snapshots = newSnapshotStore(t.TempDir())
+	fresh.Start()
+	defer fresh.Stop()
+	waitForLeader(t, []*Server{fresh})
+
+	data := backup.Bytes()
+	if err := fresh.Import(context.Background(), bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	want := leader.StateMachine().(*InmemStateMachine)
+	got := fresh.StateMachine().(*InmemStateMachine)
+	want.Lock()
+	got.Lock()
+	equal := reflect.DeepEqual(want.data, got.data)
+	want.Unlock()
+	got.Unlock()
+	if !equal {
+		t.Fatalf("Imported state differs: %v (want %v)", got.data, want.data)
+	}
+	if index, _ := fresh.LastSnapshotInfo(); index == 0 {
+		t.Fatalf("Import should be saved in a snapshot")
+	}
+
+	// Only an empty cluster accepts import
+	if err := fresh.Import(context.Background(), bytes.NewReader(data)); err != ErrNotEmpty {
+		t.Fatalf("Import into cluster with data should be rejected: %v", err)
+	}
+}
+
+func TestExportImportNotRunning(t *testing.T) {
+	s := NewTestServer()
+	s.snapshots = newSnapshotStore(t.TempDir())
+
+	// Server which was never started has no run loop to take the barrier
+	errCh := make(chan error, 2)
+	go func() {
+		errCh <- s.Export(context.Background(), &bytes.Buffer{})
+		errCh <- s.Import(context.Background(), &bytes.Buffer{})
+	}()
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errCh:
+			if err != ErrServerShutdown {
+				t.Fatalf("Server not running should return shutdown: %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Export and import should not wait on a server which isn't running")
+		}
+	}
+}
+
+func TestResetFollowerResyncs(t *testing.T) {
+	cluster := NewTestCluster(3)
+	for _, s := range cluster {
+		s.snapshots = newSnapshotStore(t.TempDir())
+		s.Start()
+		defer s.Stop()
+	}
+	leader := waitForLeader(t, cluster)
+	write := func(from, to int) {
+		for i := from; i < to; i++ {
+			if err := leader.Do([]byte(fmt.Sprintf("k%d:v%d", i, i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	write(0, 5)
+	if err := leader.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	write(5, 10)
+
+	if err := leader.Reset(); err != ErrIsLeader {
+		t.Fatalf("Leader should refuse to reset: %v", err)
+	}
+
+	var corrupt *Server
+	for _, s := range cluster {
+		if s != leader {
+			corrupt = s
+		}
+	}
+	if err := corrupt.WaitApplied(leader.CommitIndex(), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	sm := corrupt.StateMachine().(*InmemStateMachine)
+	sm.Lock()
+	sm.data["k0"] = "corrupt"
+	sm.Unlock()
+
+	// A voter would forget logs counted in quorum, it's demoted first
+	if err := corrupt.Reset(); err != ErrIsVoter {
+		t.Fatalf("Voter should refuse to reset: %v", err)
+	}
+	if err := leader.DemotePeer(corrupt.LocalAddr(), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := corrupt.WaitApplied(leader.CommitIndex(), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := corrupt.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	write(10, 12)
+
+	// Compacted logs come from leader's snapshot, the rest are replicated
+	if err := corrupt.WaitApplied(leader.CommitIndex(), 10*testElectionTimeout); err != nil {
+		t.Fatalf("Reset follower should catch up: %v", err)
+	}
+	if corrupt.LastLogIndex() != leader.LastLogIndex() {
+		t.Fatalf("Wrong last log: %v (leader %v)", corrupt.LastLogIndex(), leader.LastLogIndex())
+	}
+	want := leader.StateMachine().(*InmemStateMachine)
+	want.Lock()
+	sm.Lock()
+	equal := reflect.DeepEqual(sm.data, want.data)
+	sm.Unlock()
+	want.Unlock()
+	if !equal {
+		t.Fatalf("Reset follower should match leader: %v", sm.data)
+	}
+	if corrupt.State() != Follower || len(corrupt.Peers()) != 2 {
+		t.Fatalf("Reset follower should learn configuration from leader: %v %v", corrupt.State(), corrupt.Peers())
+	}
+
+	if err := leader.PromotePeer(corrupt.LocalAddr(), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if leader.QuorumSize() != 2 || len(leader.Learners()) != 0 {
+		t.Fatalf("Caught up follower should be promoted: learners %v", leader.Learners())
+	}
+}
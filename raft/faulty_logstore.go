@@ -0,0 +1,103 @@
+package raft
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrInjectedFault is returned by FaultyLogStore on a call set to fail
+var ErrInjectedFault = errors.New("injected log store fault")
+
+// LogStoreOp is a LogStore method faults can be injected into
+type LogStoreOp int
+
+const (
+	// OpGetLog is LogStore.GetLog
+	OpGetLog LogStoreOp = iota
+	// OpSetLog is LogStore.SetLog
+	OpSetLog
+	// OpSetLogs is LogStore.SetLogs
+	OpSetLogs
+	// OpDeleteRange is LogStore.DeleteRange
+	OpDeleteRange
+)
+
+// FaultyLogStore wraps a LogStore and fails chosen calls with
+// ErrInjectedFault, it's used to test how server handles storage failures.
+// Failed calls don't reach the wrapped store.
+type FaultyLogStore struct {
+	LogStore
+
+	calls  map[LogStoreOp]int
+	faults map[LogStoreOp]map[int]bool
+	sync.Mutex
+}
+
+// NewFaultyLogStore ...
+func NewFaultyLogStore(store LogStore) *FaultyLogStore {
+	return &FaultyLogStore{
+		LogStore: store,
+		calls:    map[LogStoreOp]int{},
+		faults:   map[LogStoreOp]map[int]bool{},
+	}
+}
+
+// FailOn is used to make the nth call (starting from 1) of op fail, calls
+// are counted since the store is created
+func (f *FaultyLogStore) FailOn(op LogStoreOp, n int) {
+	f.Lock()
+	defer f.Unlock()
+	if f.faults[op] == nil {
+		f.faults[op] = map[int]bool{}
+	}
+	f.faults[op][n] = true
+}
+
+// Calls return number of calls of op so far, failed ones included
+func (f *FaultyLogStore) Calls(op LogStoreOp) int {
+	f.Lock()
+	defer f.Unlock()
+	return f.calls[op]
+}
+
+func (f *FaultyLogStore) fault(op LogStoreOp) error {
+	f.Lock()
+	defer f.Unlock()
+	f.calls[op]++
+	if f.faults[op][f.calls[op]] {
+		return ErrInjectedFault
+	}
+	return nil
+}
+
+// GetLog ...
+func (f *FaultyLogStore) GetLog(index uint64) (*Log, error) {
+	if err := f.fault(OpGetLog); err != nil {
+		return nil, err
+	}
+	return f.LogStore.GetLog(index)
+}
+
+// SetLog ...
+func (f *FaultyLogStore) SetLog(log *Log) error {
+	if err := f.fault(OpSetLog); err != nil {
+		return err
+	}
+	return f.LogStore.SetLog(log)
+}
+
+// SetLogs ...
+func (f *FaultyLogStore) SetLogs(logs []*Log) error {
+	if err := f.fault(OpSetLogs); err != nil {
+		return err
+	}
+	return f.LogStore.SetLogs(logs)
+}
+
+// DeleteRange ...
+func (f *FaultyLogStore) DeleteRange(min, max uint64) error {
+	if err := f.fault(OpDeleteRange); err != nil {
+		return err
+	}
+	return f.LogStore.DeleteRange(min, max)
+}
@@ -0,0 +1,33 @@
+package raft
+
+import "testing"
+
+func TestFaultyLogStore(t *testing.T) {
+	ls := NewFaultyLogStore(NewInmemLogStore())
+	ls.FailOn(OpSetLog, 2)
+	ls.FailOn(OpGetLog, 1)
+
+	if err := ls.SetLog(&Log{Index: 1, Term: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ls.SetLog(&Log{Index: 2, Term: 1}); err != ErrInjectedFault {
+		t.Fatalf("Second SetLog should fail: %v", err)
+	}
+	if err := ls.SetLog(&Log{Index: 2, Term: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if ls.Calls(OpSetLog) != 3 {
+		t.Fatalf("Wrong number of calls: %v", ls.Calls(OpSetLog))
+	}
+
+	if _, err := ls.GetLog(1); err != ErrInjectedFault {
+		t.Fatalf("First GetLog should fail: %v", err)
+	}
+	// Failed call never reached the wrapped store
+	if last, _ := ls.LastIndex(); last != 2 {
+		t.Fatalf("Wrong last index: %v", last)
+	}
+	if log, err := ls.GetLog(2); err != nil || log.Index != 2 {
+		t.Fatalf("Failed to get log: %+v %v", log, err)
+	}
+}
@@ -0,0 +1,272 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// fileLogStoreSlack is how many records the file of a FileLogStore can
+// hold beyond twice its live logs before it's rewritten
+const fileLogStoreSlack = 1024
+
+// fileRecord is a line of the file of a FileLogStore, a change replayed in
+// order on open
+type fileRecord struct {
+	Logs   []*Log `json:"logs,omitempty"`
+	Delete bool   `json:"delete,omitempty"`
+	Min    uint64 `json:"min,omitempty"`
+	Max    uint64 `json:"max,omitempty"`
+	State  bool   `json:"state,omitempty"`
+	Term   uint64 `json:"term,omitempty"`
+	Vote   string `json:"vote,omitempty"`
+}
+
+// FileLogStore is a LogStore and StableStore keeping logs in memory and
+// every change in a file, synced before a call returns, so a server
+// restarted on the same file resumes its log, term and vote. The file is
+// rewritten with live logs only once deleted ones outnumber them. A failed
+// write leaves memory ahead of the file, so the store refuses every call
+// after it and must be opened again.
+type FileLogStore struct {
+	path string
+	file *os.File
+	logs *RingLogStore
+	term uint64
+	vote string
+	// records is the count of logs and changes written since the file was
+	// last rewritten
+	records int
+	err     error
+	sync.Mutex
+}
+
+// NewFileLogStore is used to open the store kept in file at path, it's
+// created if it doesn't exist. A last line cut short by a crash is
+// dropped, it was never acknowledged.
+func NewFileLogStore(path string) (*FileLogStore, error) {
+	f := &FileLogStore{path: path, logs: NewRingLogStore()}
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	size := 0
+	for len(data[size:]) > 0 {
+		end := bytes.IndexByte(data[size:], '\n')
+		if end < 0 {
+			break
+		}
+		var record fileRecord
+		if err := json.Unmarshal(data[size:size+end], &record); err != nil {
+			return nil, fmt.Errorf("%s at byte %d: %w", path, size, err)
+		}
+		if err := f.replay(&record); err != nil {
+			return nil, fmt.Errorf("%s at byte %d: %w", path, size, err)
+		}
+		size += end + 1
+	}
+
+	if f.file, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644); err != nil {
+		return nil, err
+	}
+	if err := f.file.Truncate(int64(size)); err != nil {
+		f.file.Close()
+		return nil, err
+	}
+	if _, err := f.file.Seek(int64(size), 0); err != nil {
+		f.file.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// replay is used to apply record read from file to memory
+func (f *FileLogStore) replay(record *fileRecord) error {
+	f.records += len(record.Logs) + 1
+	switch {
+	case record.State:
+		f.term, f.vote = record.Term, record.Vote
+		return nil
+	case record.Delete:
+		return f.logs.DeleteRange(record.Min, record.Max)
+	default:
+		return f.logs.SetLogs(record.Logs)
+	}
+}
+
+// FirstIndex return index of the first log, it's 0 if store is empty
+func (f *FileLogStore) FirstIndex() (uint64, error) {
+	return f.logs.FirstIndex()
+}
+
+// LastIndex ...
+func (f *FileLogStore) LastIndex() (uint64, error) {
+	return f.logs.LastIndex()
+}
+
+// GetLog ...
+func (f *FileLogStore) GetLog(idx uint64) (*Log, error) {
+	return f.logs.GetLog(idx)
+}
+
+// SetLog ...
+func (f *FileLogStore) SetLog(entry *Log) error {
+	return f.SetLogs([]*Log{entry})
+}
+
+// SetLogs is used to append logs, the first one must follow the last log
+// stored unless store is empty
+func (f *FileLogStore) SetLogs(entries []*Log) error {
+	f.Lock()
+	defer f.Unlock()
+	if f.err != nil {
+		return f.err
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	if err := f.logs.SetLogs(entries); err != nil {
+		return err
+	}
+	logs := make([]*Log, len(entries))
+	for i, entry := range entries {
+		logs[i] = entry.copy()
+	}
+	return f.write(&fileRecord{Logs: logs})
+}
+
+// DeleteRange is used to delete logs with index in [min, max], the range
+// must cover either the first or the last log
+func (f *FileLogStore) DeleteRange(min, max uint64) error {
+	f.Lock()
+	defer f.Unlock()
+	if f.err != nil {
+		return f.err
+	}
+	if err := f.logs.DeleteRange(min, max); err != nil {
+		return err
+	}
+	return f.write(&fileRecord{Delete: true, Min: min, Max: max})
+}
+
+// SetState is used to keep current term and vote in it
+func (f *FileLogStore) SetState(term uint64, vote string) error {
+	f.Lock()
+	defer f.Unlock()
+	if f.err != nil {
+		return f.err
+	}
+	f.term, f.vote = term, vote
+	return f.write(&fileRecord{State: true, Term: term, Vote: vote})
+}
+
+// State return the term and vote last kept
+func (f *FileLogStore) State() (uint64, string, error) {
+	f.Lock()
+	defer f.Unlock()
+	return f.term, f.vote, f.err
+}
+
+// Close is used to close the file, store can't be used after it
+func (f *FileLogStore) Close() error {
+	f.Lock()
+	defer f.Unlock()
+	if f.err == nil {
+		f.err = fmt.Errorf("%s is closed", f.path)
+	}
+	return f.file.Close()
+}
+
+// write is used to append record to file and sync it, the file is
+// rewritten once it holds too many dead records. Lock must be held.
+func (f *FileLogStore) write(record *fileRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		f.err = err
+		return err
+	}
+	if _, err := f.file.Write(append(data, '\n')); err != nil {
+		f.err = err
+		return err
+	}
+	if err := f.file.Sync(); err != nil {
+		f.err = err
+		return err
+	}
+
+	f.records += len(record.Logs) + 1
+	if f.records > 2*f.liveLogs()+fileLogStoreSlack {
+		if err := f.rewrite(); err != nil {
+			f.err = err
+			return err
+		}
+	}
+	return nil
+}
+
+// liveLogs return the count of logs in store
+func (f *FileLogStore) liveLogs() int {
+	first, _ := f.logs.FirstIndex()
+	if first == 0 {
+		return 0
+	}
+	last, _ := f.logs.LastIndex()
+	return int(last - first + 1)
+}
+
+// rewrite is used to replace file with one holding live logs and state
+// only, it's renamed over the old file once synced so a crash leaves
+// either of them whole. Lock must be held.
+func (f *FileLogStore) rewrite() error {
+	logs := []*Log{}
+	first, _ := f.logs.FirstIndex()
+	last, _ := f.logs.LastIndex()
+	for idx := first; first > 0 && idx <= last; idx++ {
+		log, err := f.logs.GetLog(idx)
+		if err != nil {
+			return err
+		}
+		logs = append(logs, log.copy())
+	}
+
+	var buf bytes.Buffer
+	for _, record := range []*fileRecord{{Logs: logs}, {State: true, Term: f.term, Vote: f.vote}} {
+		data, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		buf.Write(append(data, '\n'))
+	}
+
+	tmp := f.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(buf.Bytes()); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := os.Rename(tmp, f.path); err != nil {
+		file.Close()
+		return err
+	}
+	if dir, err := os.Open(filepath.Dir(f.path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	f.file.Close()
+	f.file = file
+	f.records = len(logs) + 1
+	return nil
+}
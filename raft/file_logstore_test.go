@@ -0,0 +1,109 @@
+package raft
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileLogStoreReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "raft.log")
+	store, err := NewFileLogStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := uint64(1); i <= 5; i++ {
+		if err := store.SetLog(&Log{Index: i, Term: 1, Command: []byte("a:b")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.DeleteRange(1, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DeleteRange(5, 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetLog(&Log{Index: 5, Term: 2, Extensions: map[string]string{"trace": "abc"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetState(2, "node"); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	// A write cut short by a crash is dropped
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"logs":[{"index":6`)
+	file.Close()
+
+	store, err = NewFileLogStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	first, _ := store.FirstIndex()
+	last, _ := store.LastIndex()
+	if first != 3 || last != 5 {
+		t.Fatalf("Wrong range of logs: %d to %d", first, last)
+	}
+	if log, err := store.GetLog(3); err != nil || string(log.Command) != "a:b" {
+		t.Fatalf("Wrong log 3: %+v %v", log, err)
+	}
+	if log, err := store.GetLog(5); err != nil || log.Term != 2 || log.Extensions["trace"] != "abc" {
+		t.Fatalf("Truncated log should be replaced: %+v %v", log, err)
+	}
+	if _, err := store.GetLog(2); !errors.Is(err, ErrCompacted) {
+		t.Fatalf("Deleted prefix should stay compacted: %v", err)
+	}
+	if term, vote, err := store.State(); err != nil || term != 2 || vote != "node" {
+		t.Fatalf("Wrong state: %d %q %v", term, vote, err)
+	}
+
+	// Store appends after the dropped write
+	if err := store.SetLog(&Log{Index: 6, Term: 2}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileLogStoreRewrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "raft.log")
+	store, err := NewFileLogStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := uint64(1); i <= 2*fileLogStoreSlack; i++ {
+		if err := store.SetLog(&Log{Index: i, Term: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before, _ := os.Stat(path)
+	if err := store.DeleteRange(1, 2*fileLogStoreSlack-10); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetState(3, ""); err != nil {
+		t.Fatal(err)
+	}
+	after, _ := os.Stat(path)
+	if after.Size() >= before.Size() {
+		t.Fatalf("File should be rewritten once deleted logs outnumber live ones: %d >= %d", after.Size(), before.Size())
+	}
+	store.Close()
+
+	store, err = NewFileLogStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	first, _ := store.FirstIndex()
+	last, _ := store.LastIndex()
+	if first != 2*fileLogStoreSlack-9 || last != 2*fileLogStoreSlack {
+		t.Fatalf("Wrong range of logs after rewrite: %d to %d", first, last)
+	}
+	if term, _, _ := store.State(); term != 3 {
+		t.Fatalf("Rewrite should keep state: %d", term)
+	}
+}
@@ -18,11 +18,15 @@ func NewInmemLogStore() *InmemLogStore {
 	}
 }
 
-// FirstIndex ...
+// FirstIndex return index of the first log, it's 0 if store is empty
 func (i *InmemLogStore) FirstIndex() (uint64, error) {
 	i.Lock()
 	defer i.Unlock()
-	return i.entries[0].Index, nil
+	if len(i.entries) > 0 {
+		return i.entries[0].Index, nil
+	}
+
+	return 0, nil
 }
 
 // LastIndex ...
@@ -41,12 +45,15 @@ func (i *InmemLogStore) LastIndex() (uint64, error) {
 func (i *InmemLogStore) GetLog(idx uint64) (*Log, error) {
 	i.Lock()
 	defer i.Unlock()
+	if len(i.entries) > 0 && idx < i.entries[0].Index {
+		return nil, fmt.Errorf("log %d: %w", idx, ErrCompacted)
+	}
 	for _, entry := range i.entries {
 		if entry.Index == idx {
 			return entry, nil
 		}
 	}
-	return nil, fmt.Errorf("Can't get log with index %d", idx)
+	return nil, fmt.Errorf("log %d: %w", idx, ErrLogNotFound)
 }
 
 // SetLog ...
@@ -65,16 +72,16 @@ func (i *InmemLogStore) SetLogs(entries []*Log) error {
 	return nil
 }
 
-// DeleteRange ...
+// DeleteRange is used to delete logs with index in [min, max]
 func (i *InmemLogStore) DeleteRange(min, max uint64) error {
 	i.Lock()
 	defer i.Unlock()
-	for j := min; j < max; j++ {
-		for _, entry := range i.entries {
-			if entry.Index == j {
-				i.entries = append(i.entries[:j], i.entries[j+1:]...)
-			}
+	entries := i.entries[:0]
+	for _, entry := range i.entries {
+		if entry.Index < min || entry.Index > max {
+			entries = append(entries, entry)
 		}
 	}
+	i.entries = entries
 	return nil
 }
@@ -0,0 +1,78 @@
+package raft
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestInmemLogStoreDeleteRange(t *testing.T) {
+	store := NewInmemLogStore()
+	for i := uint64(1); i <= 5; i++ {
+		if err := store.SetLog(&Log{Index: i, Term: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := store.DeleteRange(2, 4); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, idx := range []uint64{2, 3, 4} {
+		if _, err := store.GetLog(idx); err == nil {
+			t.Fatalf("Log %d should be deleted", idx)
+		}
+	}
+	for _, idx := range []uint64{1, 5} {
+		if _, err := store.GetLog(idx); err != nil {
+			t.Fatalf("Log %d should be kept: %v", idx, err)
+		}
+	}
+}
+
+func TestInmemLogStoreFirstIndexEmpty(t *testing.T) {
+	store := NewInmemLogStore()
+
+	idx, err := store.FirstIndex()
+	if err != nil || idx != 0 {
+		t.Fatalf("Empty store should have first index 0: %v %v", idx, err)
+	}
+
+	if err := store.SetLogs([]*Log{{Index: 3, Term: 1}, {Index: 4, Term: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if idx, _ := store.FirstIndex(); idx != 3 {
+		t.Fatalf("Wrong first index: %v", idx)
+	}
+
+	if err := store.DeleteRange(3, 4); err != nil {
+		t.Fatal(err)
+	}
+	if idx, err := store.FirstIndex(); err != nil || idx != 0 {
+		t.Fatalf("Emptied store should have first index 0: %v %v", idx, err)
+	}
+}
+
+func TestInmemLogStoreGetLogErrors(t *testing.T) {
+	store := NewInmemLogStore()
+	if _, err := store.GetLog(1); !errors.Is(err, ErrLogNotFound) {
+		t.Fatalf("Log of empty store should not be found: %v", err)
+	}
+
+	for i := uint64(1); i <= 5; i++ {
+		if err := store.SetLog(&Log{Index: i, Term: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.DeleteRange(1, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, idx := range []uint64{1, 3} {
+		if _, err := store.GetLog(idx); !errors.Is(err, ErrCompacted) {
+			t.Fatalf("Log %d below first index should be compacted: %v", idx, err)
+		}
+	}
+	if _, err := store.GetLog(6); !errors.Is(err, ErrLogNotFound) || errors.Is(err, ErrCompacted) {
+		t.Fatalf("Log above last index should not be found: %v", err)
+	}
+}
@@ -1,7 +1,9 @@
 package raft
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"strings"
 	"sync"
 )
@@ -23,6 +25,21 @@ func NewInMemStateMachine() *InmemStateMachine {
 func (sm *InmemStateMachine) Set(data interface{}) error {
 	sm.Lock()
 	defer sm.Unlock()
+	return sm.set(data)
+}
+
+// SetBatch ...
+func (sm *InmemStateMachine) SetBatch(data []interface{}) []error {
+	sm.Lock()
+	defer sm.Unlock()
+	errs := make([]error, len(data))
+	for i := range data {
+		errs[i] = sm.set(data[i])
+	}
+	return errs
+}
+
+func (sm *InmemStateMachine) set(data interface{}) error {
 	command := string(data.([]byte))
 
 	result := strings.Split(command, ":")
@@ -45,3 +62,31 @@ func (sm *InmemStateMachine) Get(data interface{}) interface{} {
 	}
 	return fmt.Errorf("cannot get")
 }
+
+// Snapshot ...
+func (sm *InmemStateMachine) Snapshot(w io.Writer) error {
+	sm.Lock()
+	defer sm.Unlock()
+	return json.NewEncoder(w).Encode(sm.data)
+}
+
+// Reset ...
+func (sm *InmemStateMachine) Reset() error {
+	sm.Lock()
+	defer sm.Unlock()
+	sm.data = make(map[string]string)
+	return nil
+}
+
+// Restore ...
+func (sm *InmemStateMachine) Restore(r io.Reader) error {
+	data := make(map[string]string)
+	if err := json.NewDecoder(r).Decode(&data); err != nil {
+		return err
+	}
+
+	sm.Lock()
+	defer sm.Unlock()
+	sm.data = data
+	return nil
+}
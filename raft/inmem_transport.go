@@ -1,7 +1,7 @@
 package raft
 
 import (
-	"errors"
+	"context"
 	"fmt"
 	"sync"
 	"time"
@@ -16,6 +16,8 @@ type InmemTransport struct {
 	localAddr  string
 	peers      map[string]*InmemTransport
 	timeout    time.Duration
+	// latency is added before every RPC is delivered
+	latency time.Duration
 }
 
 // NewInmemAddr ...
@@ -46,6 +48,20 @@ func (i *InmemTransport) AddPeer(peer *InmemTransport) {
 	i.peers[peer.LocalAddr()] = peer
 }
 
+// RemovePeer is used to disconnect from peer, RPC to it fail afterward
+func (i *InmemTransport) RemovePeer(peer string) {
+	i.Lock()
+	defer i.Unlock()
+	delete(i.peers, peer)
+}
+
+// SetLatency is used to delay every RPC sent over this transport
+func (i *InmemTransport) SetLatency(latency time.Duration) {
+	i.Lock()
+	defer i.Unlock()
+	i.latency = latency
+}
+
 // Consumer ...
 func (i *InmemTransport) Consumer() <-chan RPC {
 	return i.consumerCh
@@ -57,8 +73,8 @@ func (i *InmemTransport) LocalAddr() string {
 }
 
 // RequestVote ...
-func (i *InmemTransport) RequestVote(target string, req *RequestVoteRequest, resp *RequestVoteResponse) error {
-	rpcResp, err := i.sentRPC(target, req, i.timeout)
+func (i *InmemTransport) RequestVote(ctx context.Context, target string, req *RequestVoteRequest, resp *RequestVoteResponse) error {
+	rpcResp, err := i.sentRPC(ctx, target, req, i.timeout)
 	if err != nil {
 		return err
 	}
@@ -70,8 +86,15 @@ func (i *InmemTransport) RequestVote(target string, req *RequestVoteRequest, res
 }
 
 // AppendEntries ...
-func (i *InmemTransport) AppendEntries(target string, req *AppendEntryRequest, resp *AppendEntryResponse) error {
-	rpcResp, err := i.sentRPC(target, req, i.timeout)
+func (i *InmemTransport) AppendEntries(ctx context.Context, target string, req *AppendEntryRequest, resp *AppendEntryResponse) error {
+	// Entries are copied as the wire would, peer must not share logs with
+	// their unexported result and dispatcher state
+	copied := *req
+	copied.Entries = make([]*Log, len(req.Entries))
+	for idx, entry := range req.Entries {
+		copied.Entries[idx] = entry.copy()
+	}
+	rpcResp, err := i.sentRPC(ctx, target, &copied, i.timeout)
 	if err != nil {
 		return err
 	}
@@ -82,7 +105,31 @@ func (i *InmemTransport) AppendEntries(target string, req *AppendEntryRequest, r
 	return nil
 }
 
-func (i *InmemTransport) sentRPC(target string, req interface{}, timeout time.Duration) (rpcResp RPCResponse, err error) {
+// TimeoutNow ...
+func (i *InmemTransport) TimeoutNow(ctx context.Context, target string, req *TimeoutNowRequest, resp *TimeoutNowResponse) error {
+	rpcResp, err := i.sentRPC(ctx, target, req, i.timeout)
+	if err != nil {
+		return err
+	}
+	// Copy back
+	out := rpcResp.Response.(*TimeoutNowResponse)
+	*resp = *out
+	return nil
+}
+
+// InstallSnapshot ...
+func (i *InmemTransport) InstallSnapshot(ctx context.Context, target string, req *InstallSnapshotRequest, resp *InstallSnapshotResponse) error {
+	rpcResp, err := i.sentRPC(ctx, target, req, i.timeout)
+	if err != nil {
+		return err
+	}
+	// Copy back
+	out := rpcResp.Response.(*InstallSnapshotResponse)
+	*resp = *out
+	return nil
+}
+
+func (i *InmemTransport) sentRPC(ctx context.Context, target string, req interface{}, timeout time.Duration) (rpcResp RPCResponse, err error) {
 	i.RLock()
 	peer, ok := i.peers[target]
 	i.RUnlock()
@@ -92,10 +139,37 @@ func (i *InmemTransport) sentRPC(target string, req interface{}, timeout time.Du
 		return
 	}
 
-	respCh := make(chan RPCResponse)
-	peer.consumerCh <- RPC{
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	i.RLock()
+	latency := i.latency
+	i.RUnlock()
+	if latency > 0 {
+		select {
+		case <-time.After(latency):
+		case <-timer.C:
+			err = fmt.Errorf("RPC to %s: %w", target, ErrTimeout)
+			return
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+		}
+	}
+
+	respCh := make(chan RPCResponse, 1)
+	select {
+	case peer.consumerCh <- RPC{
 		Request: req,
 		RespCh:  respCh,
+		Ctx:     ctx,
+	}:
+	case <-timer.C:
+		err = fmt.Errorf("RPC to %s: %w", target, ErrTimeout)
+		return
+	case <-ctx.Done():
+		err = ctx.Err()
+		return
 	}
 
 	select {
@@ -103,8 +177,99 @@ func (i *InmemTransport) sentRPC(target string, req interface{}, timeout time.Du
 		if rpcResp.Error != nil {
 			err = rpcResp.Error
 		}
-	case <-time.After(timeout):
-		err = errors.New("sentRPC timeout")
+	case <-timer.C:
+		err = fmt.Errorf("RPC to %s: %w", target, ErrTimeout)
+	case <-ctx.Done():
+		err = ctx.Err()
 	}
 	return
 }
+
+// InmemNetwork is a registry of InmemTransport keyed by address, it's used
+// to wire servers in the same process and inject partitions in tests
+type InmemNetwork struct {
+	sync.Mutex
+	transports map[string]*InmemTransport
+}
+
+// NewInmemNetwork ...
+func NewInmemNetwork() *InmemNetwork {
+	return &InmemNetwork{
+		transports: make(map[string]*InmemTransport),
+	}
+}
+
+// NewTransport is used to create transport connected to every transport
+// already in the network
+func (n *InmemNetwork) NewTransport(addr string) *InmemTransport {
+	t := NewInmemTransport(addr)
+
+	n.Lock()
+	defer n.Unlock()
+	for _, peer := range n.transports {
+		t.AddPeer(peer)
+		peer.AddPeer(t)
+	}
+	n.transports[t.LocalAddr()] = t
+	return t
+}
+
+// Transport return transport registered with addr
+func (n *InmemNetwork) Transport(addr string) *InmemTransport {
+	n.Lock()
+	defer n.Unlock()
+	return n.transports[addr]
+}
+
+// Disconnect is used to drop RPC between a and b in both directions
+func (n *InmemNetwork) Disconnect(a, b string) {
+	n.Lock()
+	defer n.Unlock()
+	if t, ok := n.transports[a]; ok {
+		t.RemovePeer(b)
+	}
+	if t, ok := n.transports[b]; ok {
+		t.RemovePeer(a)
+	}
+}
+
+// Reconnect is used to restore RPC between a and b
+func (n *InmemNetwork) Reconnect(a, b string) {
+	n.Lock()
+	defer n.Unlock()
+	ta, okA := n.transports[a]
+	tb, okB := n.transports[b]
+	if !okA || !okB {
+		return
+	}
+	ta.AddPeer(tb)
+	tb.AddPeer(ta)
+}
+
+// Isolate is used to disconnect addr from every other transport
+func (n *InmemNetwork) Isolate(addr string) {
+	for _, peer := range n.addrs() {
+		if peer != addr {
+			n.Disconnect(addr, peer)
+		}
+	}
+}
+
+// SetLatency is used to delay RPC sent by every transport in the network
+func (n *InmemNetwork) SetLatency(latency time.Duration) {
+	n.Lock()
+	defer n.Unlock()
+	for _, t := range n.transports {
+		t.SetLatency(latency)
+	}
+}
+
+func (n *InmemNetwork) addrs() []string {
+	n.Lock()
+	defer n.Unlock()
+	addrs := make([]string, 0, len(n.transports))
+	for addr := range n.transports {
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
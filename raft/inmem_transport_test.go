@@ -0,0 +1,100 @@
+package raft
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func sendTestVote(from *InmemTransport, to string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	var resp RequestVoteResponse
+	return from.RequestVote(ctx, to, newVoteRequest(1, from.LocalAddr(), 0, 0), &resp)
+}
+
+func serveTestVotes(t *InmemTransport, stopCh chan struct{}) {
+	for {
+		select {
+		case rpc := <-t.Consumer():
+			rpc.Response(&RequestVoteResponse{Granted: true}, nil)
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+func TestInmemNetworkDisconnect(t *testing.T) {
+	network := NewInmemNetwork()
+	a := network.NewTransport("a")
+	b := network.NewTransport("b")
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go serveTestVotes(a, stopCh)
+	go serveTestVotes(b, stopCh)
+
+	if err := sendTestVote(a, "b"); err != nil {
+		t.Fatal(err)
+	}
+
+	network.Disconnect("a", "b")
+	if err := sendTestVote(a, "b"); err == nil {
+		t.Fatalf("RPC should fail after disconnect")
+	}
+	if err := sendTestVote(b, "a"); err == nil {
+		t.Fatalf("RPC should fail in both directions")
+	}
+
+	network.Reconnect("a", "b")
+	if err := sendTestVote(b, "a"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInmemNetworkLatency(t *testing.T) {
+	network := NewInmemNetwork()
+	a := network.NewTransport("a")
+	network.NewTransport("b")
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go serveTestVotes(network.Transport("b"), stopCh)
+
+	network.SetLatency(20 * time.Millisecond)
+	start := time.Now()
+	if err := sendTestVote(a, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Fatalf("RPC should be delayed: %v", elapsed)
+	}
+
+	// Latency longer than timeout fails the RPC
+	network.SetLatency(2 * a.timeout)
+	if err := sendTestVote(a, "b"); err == nil {
+		t.Fatalf("RPC should time out")
+	}
+}
+
+func TestInmemNetworkElection(t *testing.T) {
+	network, cluster := NewTestNetworkCluster(3)
+	network.SetLatency(time.Millisecond)
+	for _, s := range cluster {
+		s.Start()
+		defer s.Stop()
+	}
+
+	leader := waitForLeader(t, cluster)
+
+	// Followers learn the leader from heartbeat
+	deadline := time.Now().Add(10 * testElectionTimeout)
+	for _, s := range cluster {
+		for s.Leader() != leader.LocalAddr() {
+			if time.Now().After(deadline) {
+				t.Fatalf("Server %v doesn't know leader: %q", s.LocalAddr(), s.Leader())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
@@ -1,6 +1,9 @@
 package raft
 
-import "errors"
+import (
+	"context"
+	"encoding/json"
+)
 
 // LogType describe type of log
 type LogType uint8
@@ -8,28 +11,122 @@ type LogType uint8
 const (
 	// LogCommand is used for appendEntries and requestVote
 	LogCommand LogType = iota
+	// LogBarrier is a no-op log, once it's applied every log before it is
+	// applied too. It's not passed to state machine.
+	LogBarrier
+	// LogConfig carry members of cluster, every node switches to it once
+	// it's committed
+	LogConfig
+	// LogNoop carry nothing, it only advances commit index. It's not passed
+	// to state machine.
+	LogNoop
 )
 
-// Log entries are replicate to all member
+// Log entries are replicate to all member, Marshal is their encoding on
+// the wire and on disk. Extensions are metadata of the write, e.g. a trace
+// ID, they are replicated with the log and passed to apply observers but
+// never to state machine.
 type Log struct {
-	Index   uint64  `json:"index"`
-	Term    uint64  `json:"term"`
-	Type    LogType `json:"type"`
-	Command []byte  `json:"command"`
+	Index      uint64
+	Term       uint64
+	Type       LogType
+	Command    []byte
+	Extensions map[string]string
+
+	errCh  chan error
+	result interface{}
+	// done is called once dispatcher is notified, if it's set
+	done func()
+	// ctx is the context of the write which dispatched the log
+	ctx context.Context
+}
+
+// logRecord is the encoding of a log, shared by transports and log stores.
+// Decoding ignores fields it doesn't know and leaves missing ones zero, so
+// a field added later must have a zero value meaning what older nodes do.
+type logRecord struct {
+	Index      uint64            `json:"index"`
+	Term       uint64            `json:"term"`
+	Type       LogType           `json:"type"`
+	Command    []byte            `json:"command"`
+	Extensions map[string]string `json:"extensions,omitempty"`
+}
+
+// Marshal is used to encode log for the wire or disk
+func (l *Log) Marshal() ([]byte, error) {
+	return json.Marshal(&logRecord{Index: l.Index, Term: l.Term, Type: l.Type, Command: l.Command, Extensions: l.Extensions})
+}
+
+// Unmarshal is used to decode log encoded by Marshal
+func (l *Log) Unmarshal(data []byte) error {
+	var record logRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return err
+	}
+	l.Index, l.Term, l.Type, l.Command = record.Index, record.Term, record.Type, record.Command
+	l.Extensions = record.Extensions
+	return nil
+}
+
+// copy return the exported fields of log, without its dispatcher state
+func (l *Log) copy() *Log {
+	copied := &Log{Index: l.Index, Term: l.Term, Type: l.Type, Command: l.Command}
+	if l.Extensions != nil {
+		copied.Extensions = make(map[string]string, len(l.Extensions))
+		for k, v := range l.Extensions {
+			copied.Extensions[k] = v
+		}
+	}
+	return copied
+}
 
-	errCh chan error
+type extensionsKey struct{}
 
-	// not exported, only for checking majority members
-	// already applied
-	majorityQuorum int
-	count          int
+// WithExtensions return context whose writes are logged with extensions,
+// see Log
+func WithExtensions(ctx context.Context, extensions map[string]string) context.Context {
+	return context.WithValue(ctx, extensionsKey{}, extensions)
 }
 
-func (l *Log) responseLeaderAddress(leader string) {
-	l.errCh <- errors.New(leader)
+// extensionsFrom return extensions set on ctx by WithExtensions
+func extensionsFrom(ctx context.Context) map[string]string {
+	extensions, _ := ctx.Value(extensionsKey{}).(map[string]string)
+	return extensions
 }
 
-// LogStore provide interface for working with log
+// MarshalJSON is used so logs embedded in a JSON message, e.g. entries of
+// an AppendEntries, are encoded by Marshal
+func (l *Log) MarshalJSON() ([]byte, error) {
+	return l.Marshal()
+}
+
+// UnmarshalJSON ...
+func (l *Log) UnmarshalJSON(data []byte) error {
+	return l.Unmarshal(data)
+}
+
+// SetResult is used by LogStateMachine to hand result of applying the log
+// to the caller of ApplyResult. It's only seen on the leader which
+// dispatched the log.
+func (l *Log) SetResult(result interface{}) {
+	l.result = result
+}
+
+// respond is used to notify the log dispatcher with the result of the log
+func (l *Log) respond(err error) {
+	if l.errCh == nil {
+		return
+	}
+	l.errCh <- err
+	close(l.errCh)
+	if l.done != nil {
+		l.done()
+	}
+}
+
+// LogStore provide interface for working with log. GetLog returns
+// ErrCompacted for an index below FirstIndex and ErrLogNotFound for any
+// other missing log.
 type LogStore interface {
 	FirstIndex() (uint64, error)
 	LastIndex() (uint64, error)
@@ -38,3 +135,11 @@ type LogStore interface {
 	SetLogs(logs []*Log) error
 	DeleteRange(min, max uint64) error
 }
+
+// StableStore can be implemented by a LogStore which persists, server
+// keeps current term and vote in it so once restarted it resumes its term
+// and never votes twice in one
+type StableStore interface {
+	SetState(term uint64, vote string) error
+	State() (term uint64, vote string, err error)
+}
@@ -0,0 +1,60 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestLogMarshalRoundTrip(t *testing.T) {
+	log := &Log{Index: 7, Term: 3, Type: LogConfig, Command: []byte("\x00{\"members\":[]}\xff")}
+	data, err := log.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded Log
+	if err := decoded.Unmarshal(data); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&decoded, log) {
+		t.Fatalf("Wrong decoded log: %+v (want %+v)", decoded, log)
+	}
+
+	// Entries of an RPC are encoded the same way as a single log
+	req, err := json.Marshal(&AppendEntryRequest{Entries: []*Log{log}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(req, data) {
+		t.Fatalf("RPC should embed log as Marshal encodes it: %s", req)
+	}
+	var decodedReq AppendEntryRequest
+	if err := json.Unmarshal(req, &decodedReq); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decodedReq.Entries[0], log) {
+		t.Fatalf("Wrong log decoded from RPC: %+v", decodedReq.Entries[0])
+	}
+}
+
+func TestLogUnmarshalCompatible(t *testing.T) {
+	// A log from a newer node carries a field this one doesn't know
+	var newer Log
+	if err := newer.Unmarshal([]byte(`{"index":2,"term":1,"type":0,"command":"YQ==","checksum":42}`)); err != nil {
+		t.Fatal(err)
+	}
+	if newer.Index != 2 || newer.Term != 1 || newer.Type != LogCommand || string(newer.Command) != "a" {
+		t.Fatalf("Known fields should be decoded: %+v", newer)
+	}
+
+	// A log from an older node lacks a field, it's left zero
+	var older Log
+	if err := older.Unmarshal([]byte(`{"index":3,"term":1,"type":3}`)); err != nil {
+		t.Fatal(err)
+	}
+	if older.Index != 3 || older.Type != LogNoop || older.Command != nil {
+		t.Fatalf("Missing fields should be zero: %+v", older)
+	}
+}
@@ -0,0 +1,137 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ErrRPCDropped is returned by LossyTransport on an RPC it dropped
+var ErrRPCDropped = errors.New("RPC dropped")
+
+// RPCKind is an RPC of Transport loss can be injected into
+type RPCKind int
+
+const (
+	// RPCRequestVote is Transport.RequestVote
+	RPCRequestVote RPCKind = iota
+	// RPCAppendEntries is Transport.AppendEntries
+	RPCAppendEntries
+	// RPCTimeoutNow is Transport.TimeoutNow
+	RPCTimeoutNow
+	// RPCInstallSnapshot is Transport.InstallSnapshot
+	RPCInstallSnapshot
+)
+
+// Loss is how a LossyTransport degrades an RPC kind
+type Loss struct {
+	// Drop is the probability in [0, 1] an RPC is lost, either before or
+	// after peer handles it
+	Drop float64
+	// MaxDelay is the maximum random delay an RPC is sent after, RPCs
+	// sent close together may be delivered out of order
+	MaxDelay time.Duration
+}
+
+// LossyTransport wraps a Transport and drops or delays RPCs it sends, it's
+// used to test the cluster makes progress over an unreliable network. The
+// faults drawn are deterministic given seed, which RPC gets which of them
+// depends on the order they're sent in.
+type LossyTransport struct {
+	Transport
+
+	rand    *rand.Rand
+	loss    map[RPCKind]Loss
+	dropped map[RPCKind]int
+	sync.Mutex
+}
+
+// NewLossyTransport ...
+func NewLossyTransport(transport Transport, seed int64) *LossyTransport {
+	return &LossyTransport{
+		Transport: transport,
+		rand:      rand.New(rand.NewSource(seed)),
+		loss:      map[RPCKind]Loss{},
+		dropped:   map[RPCKind]int{},
+	}
+}
+
+// SetLoss is used to degrade RPCs of kind sent from now on
+func (l *LossyTransport) SetLoss(kind RPCKind, loss Loss) {
+	l.Lock()
+	defer l.Unlock()
+	l.loss[kind] = loss
+}
+
+// Dropped return number of RPCs of kind dropped so far
+func (l *LossyTransport) Dropped(kind RPCKind) int {
+	l.Lock()
+	defer l.Unlock()
+	return l.dropped[kind]
+}
+
+// fault is used to draw whether RPC of kind is dropped, whether it's
+// dropped after reaching peer and how long it's delayed
+func (l *LossyTransport) fault(kind RPCKind) (drop, delivered bool, delay time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+	loss := l.loss[kind]
+	if loss.MaxDelay > 0 {
+		delay = time.Duration(l.rand.Int63n(int64(loss.MaxDelay) + 1))
+	}
+	if loss.Drop > 0 && l.rand.Float64() < loss.Drop {
+		drop, delivered = true, l.rand.Intn(2) == 0
+		l.dropped[kind]++
+	}
+	return
+}
+
+func (l *LossyTransport) send(ctx context.Context, kind RPCKind, target string, rpc func() error) error {
+	drop, delivered, delay := l.fault(kind)
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if !drop {
+		return rpc()
+	}
+	// Lost response, peer handled RPC but sender never learns of it
+	if delivered {
+		_ = rpc()
+	}
+	return fmt.Errorf("RPC to %s: %w", target, ErrRPCDropped)
+}
+
+// RequestVote ...
+func (l *LossyTransport) RequestVote(ctx context.Context, target string, req *RequestVoteRequest, resp *RequestVoteResponse) error {
+	return l.send(ctx, RPCRequestVote, target, func() error {
+		return l.Transport.RequestVote(ctx, target, req, resp)
+	})
+}
+
+// AppendEntries ...
+func (l *LossyTransport) AppendEntries(ctx context.Context, target string, req *AppendEntryRequest, resp *AppendEntryResponse) error {
+	return l.send(ctx, RPCAppendEntries, target, func() error {
+		return l.Transport.AppendEntries(ctx, target, req, resp)
+	})
+}
+
+// TimeoutNow ...
+func (l *LossyTransport) TimeoutNow(ctx context.Context, target string, req *TimeoutNowRequest, resp *TimeoutNowResponse) error {
+	return l.send(ctx, RPCTimeoutNow, target, func() error {
+		return l.Transport.TimeoutNow(ctx, target, req, resp)
+	})
+}
+
+// InstallSnapshot ...
+func (l *LossyTransport) InstallSnapshot(ctx context.Context, target string, req *InstallSnapshotRequest, resp *InstallSnapshotResponse) error {
+	return l.send(ctx, RPCInstallSnapshot, target, func() error {
+		return l.Transport.InstallSnapshot(ctx, target, req, resp)
+	})
+}
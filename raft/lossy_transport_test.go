@@ -0,0 +1,92 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLossyTransportDeterministic(t *testing.T) {
+	type fault struct {
+		drop, delivered bool
+		delay           time.Duration
+	}
+	draw := func() []fault {
+		l := NewLossyTransport(NewInmemTransport(""), 1)
+		l.SetLoss(RPCAppendEntries, Loss{Drop: 0.5, MaxDelay: time.Second})
+		var faults []fault
+		for i := 0; i < 20; i++ {
+			drop, delivered, delay := l.fault(RPCAppendEntries)
+			faults = append(faults, fault{drop, delivered, delay})
+		}
+		return faults
+	}
+	if a, b := draw(), draw(); !reflect.DeepEqual(a, b) {
+		t.Fatalf("Faults drawn with the same seed should be the same: %v %v", a, b)
+	}
+
+	// Kinds without loss set are untouched
+	l := NewLossyTransport(NewInmemTransport(""), 1)
+	l.SetLoss(RPCAppendEntries, Loss{Drop: 1})
+	if drop, _, delay := l.fault(RPCRequestVote); drop || delay != 0 {
+		t.Fatalf("RequestVote should not be degraded: %v %v", drop, delay)
+	}
+}
+
+func TestLossyTransportClusterProgress(t *testing.T) {
+	cluster := NewTestCluster(3)
+	transports := []*LossyTransport{}
+	kinds := []RPCKind{RPCRequestVote, RPCAppendEntries, RPCTimeoutNow, RPCInstallSnapshot}
+	for i, s := range cluster {
+		transport := NewLossyTransport(s.Transport(), int64(i+1))
+		for _, kind := range kinds {
+			transport.SetLoss(kind, Loss{Drop: 0.2, MaxDelay: 5 * time.Millisecond})
+		}
+		s.setTransport(transport)
+		transports = append(transports, transport)
+	}
+	for _, s := range cluster {
+		s.Start()
+		defer s.Stop()
+	}
+
+	// Writes are retried on whichever node leads, they may fail while
+	// leadership moves under loss
+	for i := 0; i < 50; i++ {
+		command := []byte(fmt.Sprintf("k%d:v%d", i, i))
+		deadline := time.Now().Add(40 * testElectionTimeout)
+		for {
+			leader := waitForLeader(t, cluster)
+			ctx, cancel := context.WithTimeout(context.Background(), 10*testElectionTimeout)
+			_, _, err := leader.ApplyResult(ctx, command)
+			cancel()
+			if err == nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Write %d not committed under loss: %v", i, err)
+			}
+		}
+	}
+
+	dropped := 0
+	for _, transport := range transports {
+		for _, kind := range kinds {
+			dropped += transport.Dropped(kind)
+		}
+	}
+	if dropped == 0 {
+		t.Fatalf("RPCs should be dropped")
+	}
+	deadline := time.Now().Add(20 * testElectionTimeout)
+	for _, s := range cluster {
+		for s.StateMachine().Get([]byte("k49")) != "v49" {
+			if time.Now().After(deadline) {
+				t.Fatalf("Write not replicated to %s", s.LocalAddr())
+			}
+			time.Sleep(testElectionTimeout / 10)
+		}
+	}
+}
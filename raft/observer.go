@@ -0,0 +1,108 @@
+package raft
+
+import "sync"
+
+// ApplyObserver is called for every log applied by server with index, term,
+// type and extensions of the log, err is the result of applying it
+type ApplyObserver func(index uint64, term uint64, logType LogType, extensions map[string]string, err error)
+
+// RegisterApplyObserver is used to add observer notified in apply order
+// after each log is applied
+func (s *Server) RegisterApplyObserver(observer ApplyObserver) {
+	s.Lock()
+	defer s.Unlock()
+	s.observers = append(s.observers, observer)
+}
+
+func (s *Server) notifyApplied(log *Log, err error) {
+	s.Lock()
+	observers := s.observers
+	s.Unlock()
+
+	for _, observer := range observers {
+		s.observe(observer, log, err)
+	}
+}
+
+// observe run observer, a panicking observer is only logged so it can't
+// stop apply loop
+func (s *Server) observe(observer ApplyObserver, log *Log, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			s.err("Apply observer panicked on log %d: %v", log.Index, r)
+		}
+	}()
+	observer(log.Index, log.Term, log.Type, log.Extensions, err)
+}
+
+// ApplyCh return channel receiving a copy of every log once it's applied,
+// in index order and exactly once, so derived state such as secondary
+// indexes can be maintained from it. Logs state machine rejected are
+// skipped, and so are logs applied before the first call or restored from
+// a snapshot. Logs are queued so a slow consumer doesn't hold back server.
+func (s *Server) ApplyCh() <-chan *Log {
+	s.Lock()
+	defer s.Unlock()
+	if s.applyStream == nil {
+		s.applyStream = newLogStream()
+		go s.applyStream.run()
+	}
+	return s.applyStream.out
+}
+
+// streamApplied is used to queue applied logs for ApplyCh consumer
+func (s *Server) streamApplied(logs []*Log, errs []error) {
+	s.Lock()
+	stream := s.applyStream
+	s.Unlock()
+	if stream == nil {
+		return
+	}
+
+	applied := make([]*Log, 0, len(logs))
+	for i, log := range logs {
+		if errs[i] == nil {
+			applied = append(applied, log.copy())
+		}
+	}
+	stream.push(applied)
+}
+
+// logStream relay logs to out through an unbounded queue
+type logStream struct {
+	sync.Mutex
+	queue  []*Log
+	notify chan struct{}
+	out    chan *Log
+}
+
+func newLogStream() *logStream {
+	return &logStream{
+		notify: make(chan struct{}, 1),
+		out:    make(chan *Log),
+	}
+}
+
+func (st *logStream) push(logs []*Log) {
+	st.Lock()
+	st.queue = append(st.queue, logs...)
+	st.Unlock()
+	asyncNotifyCh(st.notify)
+}
+
+func (st *logStream) run() {
+	for {
+		st.Lock()
+		queue := st.queue
+		st.queue = nil
+		st.Unlock()
+
+		if len(queue) == 0 {
+			<-st.notify
+			continue
+		}
+		for _, log := range queue {
+			st.out <- log
+		}
+	}
+}
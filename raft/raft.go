@@ -1,28 +1,85 @@
 package raft
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"runtime"
+	"sort"
 	"time"
 )
 
 // Start is used to start Raft server
-func (s *Server) Start() {
+func (s *Server) Start() error {
+	// Config may be changed since server was created
+	if err := s.config.Validate(); err != nil {
+		return err
+	}
+
+	if err := s.recover(); err != nil {
+		return err
+	}
+
 	s.stopCh = make(chan struct{})
+	s.shutdownCh = make(chan struct{})
+	s.Lock()
+	s.startCommitIndex, s.startCommitKnown, s.caughtUp = 0, false, false
+	s.startedAt = s.clock().Now()
+	s.Unlock()
 	s.setState(Follower)
-	go s.run()
+
+	// run loop is tracked so goroutines it starts are added to wg before
+	// Stop waits on it
+	s.wg.Add(2)
+	go func() {
+		defer s.wg.Done()
+		s.run()
+	}()
+	go func() {
+		defer s.wg.Done()
+		s.runApply()
+	}()
+	return nil
 }
 
-// Stop is used to stop Raft server
+// Stop is used to stop Raft server. New logs are refused with
+// ErrServerShutdown right away, logs already dispatched get up to
+// ShutdownTimeout to commit before they fail with it too.
 func (s *Server) Stop() {
 	if s.State() == Stopped {
 		return
 	}
+	close(s.shutdownCh)
+	s.drain(time.Duration(s.config.ShutdownTimeout) * time.Millisecond)
 	close(s.stopCh)
 	s.wg.Wait()
 	s.setState(Stopped)
 	s.debug("Server %s %s", s.LocalAddr(), s.State().String())
 }
 
+// drain is used to wait until every log leader dispatched is applied or
+// timeout passes
+func (s *Server) drain(timeout time.Duration) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		s.Lock()
+		if len(s.applying) == 0 {
+			s.Unlock()
+			return
+		}
+		appliedCh := s.appliedCh
+		s.Unlock()
+
+		select {
+		case <-appliedCh:
+		case <-timer.C:
+			return
+		}
+	}
+}
+
 func (s *Server) run() {
 	state := s.State()
 	for state != Stopped {
@@ -43,20 +100,54 @@ func (s *Server) run() {
 	}
 }
 
+// electionTimeout return random timeout within configured election window,
+// it's shifted later by a whole window per priority below the highest
+func (s *Server) electionTimeout() time.Duration {
+	min, max := s.config.ElectionTimeoutMin, s.config.ElectionTimeoutMax
+	shift := int64(s.config.MaxElectionPriority-s.config.ElectionPriority) * (max - min)
+	return randomDuration(min+shift, max+shift)
+}
+
 func (s *Server) runAsFollower() {
 	s.debug("Server %s enter %s state", s.LocalAddr(), s.State().String())
-	electionTimeout := time.NewTimer(randomDuration(s.config.ElectionTimeout))
+	electionTimeout := s.clock().NewTimer(s.electionTimeout())
+	defer electionTimeout.Stop()
+	// probeCh receives whether quorum was reached by the pending probe,
+	// it's dropped once an RPC arrives meanwhile
+	var probeCh <-chan bool
 	for s.State() == Follower {
 		select {
 		case rpc := <-s.rpcCh:
-			electionTimeout.Reset(randomDuration(s.config.ElectionTimeout))
+			probeCh = nil
 			s.processRPC(rpc)
+			// Only a granted vote request holds election off, or a
+			// behind candidate timing out first would keep others
+			// from ever electing
+			if req, ok := rpc.Request.(*RequestVoteRequest); !ok || (req.Candidate != "" && s.VotedFor() == req.Candidate) {
+				electionTimeout.Reset(s.electionTimeout())
+			}
 		case log := <-s.applyCh:
-			s.debug("return leader address")
-			log.responseLeaderAddress(s.Leader())
-		case <-electionTimeout.C:
+			s.debug("reject log, not leader")
+			log.respond(ErrNotLeader)
+		case <-electionTimeout.C():
 			s.setLeader("")
+			if s.config.DisableElection || s.Drained() || s.campaignHeldOff() || s.isNonVoter() {
+				electionTimeout.Reset(s.electionTimeout())
+				continue
+			}
+			if s.inStartupGrace() {
+				probeCh = s.probeQuorum()
+				continue
+			}
 			s.setState(Candidate)
+		case reached := <-probeCh:
+			probeCh = nil
+			if reached {
+				s.setState(Candidate)
+				continue
+			}
+			s.warn("Server %s can't reach quorum within startup grace period, waiting for peers before election", s.LocalAddr())
+			electionTimeout.Reset(s.electionTimeout())
 		case <-s.stopCh:
 			return
 		}
@@ -65,38 +156,50 @@ func (s *Server) runAsFollower() {
 
 func (s *Server) runAsCandidate() {
 	s.debug("Server %v enter %v state", s.LocalAddr(), s.State().String())
-	voteCh := s.selfElect()
-	electionTimer := time.NewTimer(randomDuration(s.config.ElectionTimeout))
 
-	grantedVotes := 0
-	voteNeeded := s.QuorumSize()
+	// Election is aborted once candidate leaves this state, pending vote
+	// requests give up instead of retrying for an election that is over
+	election, abort := context.WithCancel(context.Background())
+	defer abort()
+
+	voteCh := s.selfElect(election)
+	electionTimer := s.clock().NewTimer(s.electionTimeout())
+	defer electionTimer.Stop()
+
+	granted := map[string]bool{}
 
 	for s.State() == Candidate {
 		select {
 		case rpc := <-s.rpcCh:
 			s.processRPC(rpc)
 		case log := <-s.applyCh:
-			log.responseLeaderAddress(s.Leader())
+			log.respond(ErrNotLeader)
 		case vote := <-voteCh:
-			// Check if response Term is greater than ours, step down
+			// A newer term ends this election for good, candidate waits as
+			// follower of that term rather than counting any more votes
 			if vote.Term > s.CurrentTerm() {
-				s.debug("Newer term discoverd, stepdown")
-				s.setState(Follower)
-				s.setCurrentTerm(vote.Term)
+				s.debug("Newer term %d discoverd from %v, stepdown", vote.Term, vote.voter)
+				s.stepDown(vote.Term)
+				return
 			}
 
 			if vote.Granted {
-				grantedVotes++
-				s.debug("Vote granted from %v. Granted votes: %d", vote.voter, grantedVotes)
+				granted[vote.voter] = true
+				s.debug("Vote granted from %v. Granted votes: %d", vote.voter, len(granted))
 			}
 
-			if grantedVotes >= voteNeeded {
-				s.debug("Election won. Granted votes: %d", grantedVotes)
-				s.setState(Leader)
-				s.setLeader(s.LocalAddr())
+			// Votes must form a majority of both configurations in joint phase
+			if s.hasQuorum(granted) {
+				// Server may be drained while its election is running
+				if s.Drained() {
+					s.setState(Follower)
+					return
+				}
+				s.debug("Election won. Granted votes: %d", len(granted))
+				s.becomeLeader()
 				return
 			}
-		case <-electionTimer.C:
+		case <-electionTimer.C():
 			s.warn("ElectionTimeout, restarting election")
 			return
 		case <-s.stopCh:
@@ -108,103 +211,457 @@ func (s *Server) runAsCandidate() {
 
 func (s *Server) runAsLeader() {
 	s.debug("Server %s enter %s state", s.LocalAddr(), s.State().String())
+	s.Lock()
 	s.followers = make(map[string]*follower)
 	s.applying = make(map[uint64]*Log)
-	s.commitCh = make(chan *Log)
+	s.Unlock()
 
 	// send heartbeat to notify leadership
-	for _, peer := range s.peers {
-		s.startReplication(peer)
+	for _, peer := range s.voters() {
+		s.startReplication(peer, false)
+	}
+	for _, learner := range s.Learners() {
+		s.startReplication(learner, true)
 	}
 
+	// Leader only knows which logs of previous terms are committed once a
+	// log of its own term is committed (§8)
+	noop := &Log{Type: LogNoop}
+	s.dispatchLog(noop)
+	s.Lock()
+	s.termStartIndex = noop.Index
+	s.Unlock()
+	s.bootstrapConfiguration()
+
 	defer func() {
+		s.Lock()
 		for _, f := range s.followers {
 			close(f.stopCh)
 		}
+		s.followers = nil
+		applying := s.applying
+		s.applying = nil
+		s.Unlock()
+
+		// Logs not committed yet may never be, don't let dispatchers wait
+		err := ErrLeadershipLost
+		select {
+		case <-s.shutdownCh:
+			err = ErrServerShutdown
+		default:
+		}
+		for _, log := range applying {
+			log.respond(err)
+		}
 	}()
 
+	// Lease is checked often enough that leader steps down within
+	// ElectionTimeoutMin of losing quorum, not lease/2 after it expired
+	leaseTimeout := time.Duration(s.config.LeaderLeaseTimeout) * time.Millisecond
+	leaseCheck := leaseTimeout / 2
+	if slack := time.Duration(s.config.ElectionTimeoutMin)*time.Millisecond - leaseTimeout; slack < leaseCheck {
+		leaseCheck = slack
+	}
+	lease := s.clock().NewTimer(leaseCheck)
+	defer lease.Stop()
+
 	for s.State() == Leader {
 		select {
 		case rpc := <-s.rpcCh:
 			s.processRPC(rpc)
 		case newLog := <-s.applyCh:
+			if s.transferringLeadership() {
+				newLog.respond(ErrLeadershipTransferInProgress)
+				continue
+			}
 			s.dispatchLog(newLog)
-		case log := <-s.commitCh:
-			s.commitLog(log)
+		case <-s.commitCh:
+			s.advanceCommit()
+		case <-lease.C():
+			s.checkLeaderLease(leaseTimeout)
+			lease.Reset(leaseCheck)
 		case <-s.stopCh:
 			return
 		}
 	}
 }
 
-func (s *Server) startReplication(peer string) {
+// checkLeaderLease is used to step down if a quorum of peers hasn't
+// responded within leaseTimeout, leader may be partitioned from them
+func (s *Server) checkLeaderLease(leaseTimeout time.Duration) {
+	contacted := s.contactedPeers(leaseTimeout)
+	if !s.hasQuorum(contacted) {
+		s.warn("Failed to contact quorum (%d/%d voters) within %v, stepdown", len(contacted)+1, s.MemberCount(), leaseTimeout)
+		s.stepDown(s.CurrentTerm())
+	}
+}
+
+// contactedPeers return peers replicated to, learners included, which
+// responded within timeout
+func (s *Server) contactedPeers(timeout time.Duration) map[string]bool {
+	s.Lock()
+	followers := make([]*follower, 0, len(s.followers))
+	for _, f := range s.followers {
+		followers = append(followers, f)
+	}
+	s.Unlock()
+
+	contacted := map[string]bool{}
+	for _, f := range followers {
+		if s.clock().Now().Sub(f.LastContact()) <= timeout {
+			contacted[f.peer] = true
+		}
+	}
+	return contacted
+}
+
+// startReplication is used to start replicating log to peer, it does
+// nothing if server is not leading anymore
+func (s *Server) startReplication(peer string, learner bool) {
 	lastLogIndex := s.LastLogIndex()
 	f := &follower{
 		peer:        peer,
+		learner:     learner,
 		currentTerm: s.CurrentTerm(),
 		matchIndex:  0,
 		nextIndex:   lastLogIndex + 1,
+		lastContact: s.clock().Now(),
 		replicateCh: make(chan struct{}),
 		stopCh:      make(chan bool),
 	}
 
+	s.Lock()
+	defer s.Unlock()
+	if s.followers == nil {
+		return
+	}
+	if _, ok := s.followers[peer]; ok {
+		return
+	}
 	s.followers[peer] = f
-	go s.replicate(f)
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.replicate(f)
+	}()
+}
+
+// stopRemovedReplication is used to stop replicating log to followers
+// which are no longer voters or learners, their goroutines exit right away
+func (s *Server) stopRemovedReplication() {
+	members := map[string]bool{}
+	for _, peer := range s.voters() {
+		members[peer] = true
+	}
+	for _, learner := range s.Learners() {
+		members[learner] = true
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	for peer, f := range s.followers {
+		if !members[peer] {
+			s.debug("Stop replicating to removed peer %s", peer)
+			delete(s.followers, peer)
+			close(f.stopCh)
+		}
+	}
 }
 
 func (s *Server) dispatchLog(applyLog *Log) {
+	// Run loop dispatches one log at a time, so of two changes racing the
+	// later one always sees the earlier one pending
+	if applyLog.Type == LogConfig && s.configChangePending() {
+		applyLog.respond(ErrConfigChangeInProgress)
+		return
+	}
+
 	currentTerm := s.CurrentTerm()
 	lastLogIndex := s.LastLogIndex()
 
 	applyLog.Term = currentTerm
 	applyLog.Index = lastLogIndex + 1
-	applyLog.majorityQuorum = s.QuorumSize()
-	applyLog.count = 0
 	s.debug("applyLog: %+v", applyLog)
 
 	if err := s.logStore.SetLog(applyLog); err != nil {
 		s.err("%v", err)
-		applyLog.errCh <- err
+		applyLog.respond(err)
 		return
 	}
 
 	s.setLastLogInfo(lastLogIndex+1, currentTerm)
+	s.noteConfiguration(applyLog)
 
-	applyLog.count++
-	s.debug("applyLog: %+v", applyLog)
+	s.Lock()
+	s.applying[applyLog.Index] = applyLog
+	s.Unlock()
 
-	if len(s.followers) > 0 {
-		s.applying[applyLog.Index] = applyLog
+	// Leader's copy may be enough to reach quorum (e.g. single node
+	// cluster), commit right away without waiting for any replication
+	s.advanceCommit()
 
-		for _, f := range s.followers {
-			asyncNotifyCh(f.replicateCh)
+	s.Lock()
+	for _, f := range s.followers {
+		asyncNotifyCh(f.replicateCh)
+	}
+	s.Unlock()
+}
+
+// quorumMatchIndex return the highest index stored on a write quorum, it's
+// computed from sorted match index of voting members (leader included).
+// In joint phase the index must be stored on majority of both
+// configurations.
+func (s *Server) quorumMatchIndex() uint64 {
+	s.Lock()
+	lastLogIndex := s.lastLogIndex
+	peers, oldPeers := s.peers, s.oldPeers
+	followers := make(map[string]*follower, len(s.followers))
+	for peer, f := range s.followers {
+		followers[peer] = f
+	}
+	s.Unlock()
+
+	matchIndex := func(peers []string, quorum int) uint64 {
+		matches := make([]uint64, 0, len(peers)+1)
+		matches = append(matches, lastLogIndex)
+		for _, peer := range peers {
+			var match uint64
+			if f, ok := followers[peer]; ok {
+				match, _ = f.progress()
+			}
+			matches = append(matches, match)
+		}
+		sort.Slice(matches, func(i, j int) bool { return matches[i] > matches[j] })
+		return matches[quorum-1]
+	}
+
+	if oldPeers != nil {
+		return min(matchIndex(peers, majority(len(peers)+1)), matchIndex(oldPeers, majority(len(oldPeers)+1)))
+	}
+	quorum, _ := s.quorums(len(peers) + 1)
+	return matchIndex(peers, quorum)
+}
+
+// advanceCommit is used to commit up to the index stored on a write quorum.
+// Only logs of current term are committed by counting replicas, logs from
+// previous terms are committed indirectly (§5.4.2)
+func (s *Server) advanceCommit() {
+	index := s.quorumMatchIndex()
+	if index <= s.CommitIndex() {
+		return
+	}
+
+	s.Lock()
+	log, ok := s.applying[index]
+	s.Unlock()
+	if !ok {
+		var err error
+		log, err = s.logStore.GetLog(index)
+		if err != nil {
+			s.err("Failed to get log %d to commit: %v", index, err)
+			return
+		}
+	}
+	if log.Term != s.CurrentTerm() {
+		return
+	}
+
+	s.commitLog(index)
+}
+
+// commitLog is used to advance commit index to given index. Every log
+// before it is committed too, this is how logs from previous terms get
+// committed.
+func (s *Server) commitLog(index uint64) {
+	if index <= s.CommitIndex() {
+		return
+	}
+
+	s.setCommitIndex(index)
+	s.debug("Commited Log Idx: %v", s.CommitIndex())
+	asyncNotifyCh(s.commitNotifyCh)
+}
+
+// runApply is used to apply logs as they're committed, apart from run loop
+// so replication and commit advance while state machine is busy
+func (s *Server) runApply() {
+	for {
+		select {
+		case <-s.commitNotifyCh:
+			s.Lock()
+			s.applyWakeups++
+			s.Unlock()
+			// Let logs committing right behind this one join its run, rather
+			// than waking again for each of them
+			runtime.Gosched()
+			s.applyLogs()
+			s.snapshotOnThreshold()
+		case <-s.stopCh:
+			return
+		}
+	}
+}
+
+// applyLogs is used to apply every committed log which is not applied yet
+// to the state machine. The whole run is applied at once then dispatchers
+// of these logs are notified together.
+func (s *Server) applyLogs() {
+	s.applyLock.Lock()
+	defer s.applyLock.Unlock()
+
+	commitIndex := s.CommitIndex()
+	lastApplied := s.LastApplied()
+	if commitIndex <= lastApplied {
+		return
+	}
+
+	logs := make([]*Log, 0, commitIndex-lastApplied)
+	dispatched := make([]bool, 0, commitIndex-lastApplied)
+	for idx := lastApplied + 1; idx <= commitIndex; idx++ {
+		s.Lock()
+		log, ok := s.applying[idx]
+		delete(s.applying, idx)
+		s.Unlock()
+
+		if !ok {
+			var err error
+			log, err = s.logStore.GetLog(idx)
+			if err != nil {
+				s.err("Failed to get log %d to apply: %v", idx, err)
+				break
+			}
+		}
+		logs = append(logs, log)
+		dispatched = append(dispatched, ok)
+	}
+
+	spans := make([]Span, len(logs))
+	for i, log := range logs {
+		if dispatched[i] && log.ctx != nil {
+			_, spans[i] = s.Tracer().StartSpan(log.ctx, "raft.ApplyLog")
+		}
+	}
+	errs := s.applyBatchTimed(logs)
+	for i, span := range spans {
+		if span != nil {
+			span.SetAttribute("batch", len(logs))
+			span.End(errs[i])
 		}
-	} else {
-		s.commitCh <- applyLog
 	}
+	s.streamApplied(logs, errs)
+	s.setLastApplied(lastApplied + uint64(len(logs)))
+	s.Lock()
+	s.appliedSinceSnapshot += uint64(len(logs))
+	for _, log := range logs {
+		s.bytesSinceSnapshot += uint64(len(log.Command))
+	}
+	s.Unlock()
+
+	for i, log := range logs {
+		if errs[i] != nil {
+			s.err("Failed to apply log %d: %v", log.Index, errs[i])
+		}
+		s.notifyApplied(log, errs[i])
+		if dispatched[i] {
+			log.respond(errs[i])
+		}
+	}
+}
+
+// applyBatchTimed is used to apply logs, reporting it once it takes over
+// ApplyTimeout while it's still running
+func (s *Server) applyBatchTimed(logs []*Log) []error {
+	if s.config.ApplyTimeout == 0 || len(logs) == 0 {
+		return s.applyBatch(logs)
+	}
+
+	start := time.Now()
+	slow := time.AfterFunc(time.Duration(s.config.ApplyTimeout)*time.Millisecond, func() {
+		s.Lock()
+		s.slowApplies++
+		s.Unlock()
+		s.warn("Applying logs %d to %d is taking over %dms", logs[0].Index, logs[len(logs)-1].Index, s.config.ApplyTimeout)
+	})
+	errs := s.applyBatch(logs)
+	if !slow.Stop() {
+		s.warn("Logs %d to %d applied in %v", logs[0].Index, logs[len(logs)-1].Index, time.Since(start))
+	}
+	return errs
 }
 
-func (s *Server) commitLog(log *Log) {
-	err := s.StateMachine().Set(log.Command)
+// applyBatch is used to route logs by type, only command logs are applied
+// to state machine, in one call if the state machine supports it.
+// Configuration logs update peers of the server itself.
+func (s *Server) applyBatch(logs []*Log) []error {
+	errs := make([]error, len(logs))
+	commands := make([]interface{}, 0, len(logs))
+	commandLogs := make([]*Log, 0, len(logs))
+	positions := make([]int, 0, len(logs))
+	for i, log := range logs {
+		switch log.Type {
+		case LogCommand:
+			commands = append(commands, log.Command)
+			commandLogs = append(commandLogs, log)
+			positions = append(positions, i)
+		case LogConfig:
+			errs[i] = s.applyConfiguration(log.Command)
+		case LogNoop, LogBarrier:
+			// Nothing to apply, committing them is enough
+		default:
+			errs[i] = fmt.Errorf("log type %d: %w", log.Type, ErrUnknownCommand)
+		}
+	}
+	if len(commands) == 0 {
+		return errs
+	}
+
+	sm := s.StateMachine()
+	if indexed, ok := sm.(LogStateMachine); ok {
+		for i, err := range indexed.ApplyLogs(commandLogs) {
+			errs[positions[i]] = err
+		}
+		return errs
+	}
+	if batch, ok := sm.(BatchStateMachine); ok {
+		for i, err := range batch.SetBatch(commands) {
+			errs[positions[i]] = err
+		}
+		return errs
+	}
 
-	if err == nil {
-		s.setCommitIndex(log.Index)
-		s.debug("Commited Log Idx: %v", s.CommitIndex())
-	} else {
-		s.err(err.Error())
+	for i := range commands {
+		errs[positions[i]] = sm.Set(commands[i])
 	}
-	log.errCh <- err
+	return errs
 }
 
 func (s *Server) processRPC(rpc RPC) {
+	ctx := rpc.Ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
 	switch req := rpc.Request.(type) {
 	case *AppendEntryRequest:
+		_, span := s.Tracer().StartSpan(ctx, "raft.HandleAppendEntries")
+		span.SetAttribute("entries", len(req.Entries))
 		s.handleAppendEntries(rpc, req)
+		span.End(nil)
 	case *RequestVoteRequest:
+		_, span := s.Tracer().StartSpan(ctx, "raft.HandleRequestVote")
 		s.handleRequestVote(rpc, req)
+		span.End(nil)
+	case *TimeoutNowRequest:
+		_, span := s.Tracer().StartSpan(ctx, "raft.HandleTimeoutNow")
+		s.handleTimeoutNow(rpc, req)
+		span.End(nil)
+	case *InstallSnapshotRequest:
+		_, span := s.Tracer().StartSpan(ctx, "raft.HandleInstallSnapshot")
+		s.handleInstallSnapshot(rpc, req)
+		span.End(nil)
 	default:
-		s.err("Unknow request type: %#v", rpc.Request)
-		rpc.Response(nil, errors.New("Unknow request type"))
+		s.err("Unknown request type: %#v", rpc.Request)
+		rpc.Response(nil, fmt.Errorf("request type %T: %w", rpc.Request, ErrUnknownCommand))
 	}
 
 }
@@ -222,6 +679,9 @@ func (s *Server) handleAppendEntries(rpc RPC, req *AppendEntryRequest) {
 
 	var err error
 	defer func() {
+		// Report last index at response time, logs may have been truncated
+		// or appended, leader backtracks nextIndex from it on rejection
+		resp.LastLogIndex = s.LastLogIndex()
 		if len(req.Entries) > 0 {
 			s.debug("AE.Response: %+v", resp)
 		}
@@ -234,78 +694,108 @@ func (s *Server) handleAppendEntries(rpc RPC, req *AppendEntryRequest) {
 	}
 
 	if req.Term > s.CurrentTerm() || s.State() != Follower {
-		s.setCurrentTerm(req.Term)
-		s.setState(Follower)
+		s.stepDown(req.Term)
+		asyncNotifyCh(s.commitCh)
 		resp.Term = req.Term
 	}
 	s.setLeader(req.Leader)
+	s.setLeaderCommitIndex(req.LeaderCommitIndex)
 
 	lastLogIndex, lastLogTerm := s.LastLogInfo()
+	lastSnapshotIndex, lastSnapshotTerm := s.LastSnapshotInfo()
+	if req.PrevLogIndex > lastLogIndex {
+		// Follower is behind, leader can continue right after its last log
+		resp.ConflictIndex = lastLogIndex + 1
+		return
+	}
+
 	var prevLogTerm uint64
-	if req.PrevLogIndex == lastLogIndex {
+	switch {
+	case req.PrevLogIndex == 0:
+		// Entries from the start of log always follow on
+	case req.PrevLogIndex == lastLogIndex:
 		prevLogTerm = lastLogTerm
-	} else {
+	case req.PrevLogIndex == lastSnapshotIndex:
+		// Previous log may be compacted into snapshot already
+		prevLogTerm = lastSnapshotTerm
+	default:
 		prevLog, err := s.logStore.GetLog(req.PrevLogIndex)
-		if err != nil {
+		switch {
+		case errors.Is(err, ErrCompacted):
+			// Compacted logs are committed, so they match leader's
+			prevLogTerm = req.PrevLogTerm
+		case err != nil:
 			s.err("AE.Failed to get previous log: %v %s (last %v)", req.PrevLogIndex, err, lastLogIndex)
 			return
+		default:
+			prevLogTerm = prevLog.Term
 		}
-		prevLogTerm = prevLog.Term
 	}
 
 	if req.PrevLogTerm != prevLogTerm {
 		s.err("AE.Previouse log term mis-match: current: %v request: %v", prevLogTerm, req.PrevLogTerm)
+		resp.ConflictTerm = prevLogTerm
+		resp.ConflictIndex = s.firstIndexOfTerm(req.PrevLogIndex, prevLogTerm, lastSnapshotIndex)
 		return
 	}
 
-	// Process any new entry
-	if n := len(req.Entries); n > 0 {
-		first := req.Entries[0]
-		last := req.Entries[n-1]
-		// s.debug("first: %+v, last: %+v", first, last)
-		lastLogIndex := s.LastLogIndex()
+	// Process any new entry, entries follower already has are skipped so a
+	// delayed AppendEntries never truncates logs appended after it (§5.3)
+	entries, matchedTerm := req.Entries, prevLogTerm
+	for len(entries) > 0 && entries[0].Index <= lastLogIndex {
+		if entries[0].Index > lastSnapshotIndex {
+			log, err := s.logStore.GetLog(entries[0].Index)
+			if !errors.Is(err, ErrCompacted) && (err != nil || log.Term != entries[0].Term) {
+				break
+			}
+		}
+		matchedTerm = entries[0].Term
+		entries = entries[1:]
+	}
+	if n := len(entries); n > 0 {
+		first := entries[0]
+		last := entries[n-1]
 		if first.Index <= lastLogIndex {
 			s.debug("server.log.clear: from %d to %d", first.Index, lastLogIndex)
 			if err := s.logStore.DeleteRange(first.Index, lastLogIndex); err != nil {
 				s.err("server.logs.clear.failed: %v", err)
 				return
 			}
+			s.setLastLogInfo(first.Index-1, matchedTerm)
 		}
 
-		if err := s.logStore.SetLogs(req.Entries); err != nil {
+		if err := s.logStore.SetLogs(entries); err != nil {
 			s.err("server.logs.append.failed: %v", err)
 			return
 		}
+		s.noteConfiguration(entries...)
 
 		s.setLastLogInfo(last.Index, last.Term)
-		resp.LastLogIndex = s.LastLogIndex()
-		// s.debug("server.entry.append: LastLogIndex: %v LastLogTerm: %v", last.Index, last.Term)
 	}
 
-	// Update commit index
+	// Update commit index, only logs known to match leader's can be
+	// committed
 	if req.LeaderCommitIndex > s.CommitIndex() {
-		idx := min(req.LeaderCommitIndex, s.LastLogIndex())
+		idx := min(req.LeaderCommitIndex, req.PrevLogIndex+uint64(len(req.Entries)))
 		s.debug("Server: %v, Commited Index: %v", s.LocalAddr(), s.CommitIndex())
 
-		log, err := s.logStore.GetLog(idx)
-		if err != nil {
-			s.err(err.Error())
-			return
-		}
+		s.commitLog(idx)
+	}
 
-		log.errCh = make(chan error, 1)
-		s.commitLog(log)
+	resp.Success = true
+}
 
-		for commitErr := range log.errCh {
-			if commitErr != nil {
-				err = commitErr
-				return
-			}
-			close(log.errCh)
+// firstIndexOfTerm return the first index of the run of logs of term
+// ending at index, logs compacted into snapshot are not looked up
+func (s *Server) firstIndexOfTerm(index, term, lastSnapshotIndex uint64) uint64 {
+	for index-1 > lastSnapshotIndex {
+		log, err := s.logStore.GetLog(index - 1)
+		if err != nil || log.Term != term {
+			break
 		}
+		index--
 	}
-
-	resp.Success = true
+	return index
 }
 
 func (s *Server) handleRequestVote(rpc RPC, req *RequestVoteRequest) {
@@ -325,13 +815,18 @@ func (s *Server) handleRequestVote(rpc RPC, req *RequestVoteRequest) {
 	}
 
 	// If term of request larger than current term, update current term
+	// and step down, leader of older term must not keep replicating.
 	// If term is equal but already voted for different candidate then
 	// don't vote for this candidate
 	if req.Term > s.CurrentTerm() {
-		s.setCurrentTerm(req.Term)
+		if s.State() != Follower {
+			s.debug("Newer term discoverd from %v, stepdown", req.Candidate)
+		}
+		s.stepDown(req.Term)
+		asyncNotifyCh(s.commitCh)
 		resp.Term = s.CurrentTerm()
-	} else if s.votedFor != "" && s.votedFor != req.Candidate {
-		s.debug("server.vote.duplicate: %s already vote for %s", req.Candidate, s.votedFor)
+	} else if votedFor := s.VotedFor(); votedFor != "" && votedFor != req.Candidate {
+		s.debug("server.vote.duplicate: %s already vote for %s", req.Candidate, votedFor)
 		return
 	}
 
@@ -343,23 +838,64 @@ func (s *Server) handleRequestVote(rpc RPC, req *RequestVoteRequest) {
 		return
 	}
 
-	// If everything ok then vote
+	// If everything ok then vote, once the vote is persisted. It's kept
+	// in memory even if not so no other candidate gets it.
+	s.Lock()
 	s.votedFor = req.Candidate
+	err = s.saveState()
+	s.Unlock()
+	if err != nil {
+		return
+	}
 	resp.Granted = true
 	resp.Term = s.CurrentTerm()
 	s.debug("Response: %+v", resp)
 }
 
+// handleTimeoutNow is used to start election right away on request of
+// leader, leader only sends it once this server has every log
+func (s *Server) handleTimeoutNow(rpc RPC, req *TimeoutNowRequest) {
+	resp := &TimeoutNowResponse{
+		Term: s.CurrentTerm(),
+	}
+
+	defer func() {
+		rpc.Response(resp, nil)
+	}()
+
+	if req.Term < s.CurrentTerm() {
+		return
+	}
+
+	if s.config.DisableElection || s.Drained() || s.isNonVoter() {
+		s.warn("Leadership transfer requested by %v, election is disabled", req.Leader)
+		return
+	}
+	s.debug("Leadership transfer requested by %v, start election", req.Leader)
+	s.setLeader("")
+	s.setState(Candidate)
+}
+
 type voteResult struct {
 	RequestVoteResponse
 	voter string
 }
 
-func (s *Server) selfElect() <-chan *voteResult {
-	respCh := make(chan *voteResult, len(s.peers)+1)
+func (s *Server) selfElect(election context.Context) <-chan *voteResult {
+	peers := s.voters()
+	respCh := make(chan *voteResult, len(peers)+1)
 
-	// Increase current term
-	s.setCurrentTerm(s.CurrentTerm() + 1)
+	// Increase current term and vote for itself in it, at once so nothing
+	// sees the new term without its vote
+	s.Lock()
+	s.currentTerm++
+	s.votedFor = s.localAddr
+	err := s.saveState()
+	s.Unlock()
+	// Without its vote persisted it doesn't campaign, election times out
+	if err != nil {
+		return respCh
+	}
 
 	// Create request vote
 	lastLogIdx, lastLogTerm := s.LastLogInfo()
@@ -370,8 +906,12 @@ func (s *Server) selfElect() <-chan *voteResult {
 		LastLogTerm:  lastLogTerm,
 	}
 
-	for _, peer := range s.peers {
-		go s.requestVote(peer, req, respCh)
+	for _, peer := range peers {
+		s.wg.Add(1)
+		go func(peer string) {
+			defer s.wg.Done()
+			s.requestVote(election, peer, req, respCh)
+		}(peer)
 	}
 
 	// Include own vote
@@ -386,33 +926,193 @@ func (s *Server) selfElect() <-chan *voteResult {
 	return respCh
 }
 
-func (s *Server) requestVote(peer string, req *RequestVoteRequest, respCh chan *voteResult) {
+// inStartupGrace return whether server started less than
+// StartupGracePeriod ago
+func (s *Server) inStartupGrace() bool {
+	s.Lock()
+	startedAt := s.startedAt
+	s.Unlock()
+	grace := time.Duration(s.config.StartupGracePeriod) * time.Millisecond
+	return s.clock().Now().Before(startedAt.Add(grace))
+}
+
+// probeQuorum is used to check whether voters forming a quorum with this
+// server answer RPCs, without starting an election. Probe is a vote request
+// of term 0 from no candidate, which every server rejects or grants to
+// nobody, so it changes no term or vote.
+func (s *Server) probeQuorum() <-chan bool {
+	peers := s.voters()
+	reachedCh := make(chan bool, 1)
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ctx, cancel := s.rpcContext()
+		defer cancel()
+
+		answered := make(chan string, len(peers))
+		for _, peer := range peers {
+			go func(peer string) {
+				resp := &RequestVoteResponse{}
+				if err := s.Transport().RequestVote(ctx, peer, &RequestVoteRequest{}, resp); err != nil {
+					peer = ""
+				}
+				answered <- peer
+			}(peer)
+		}
+
+		reached := map[string]bool{}
+		for range peers {
+			if peer := <-answered; peer != "" {
+				reached[peer] = true
+				if s.hasQuorum(reached) {
+					break
+				}
+			}
+		}
+		reachedCh <- s.hasQuorum(reached)
+	}()
+	return reachedCh
+}
+
+// requestVote is used to ask peer for its vote, failed RPC is retried
+// until election is aborted. respCh is buffered for every peer so sending
+// the result never blocks, even if candidate stopped reading it.
+func (s *Server) requestVote(election context.Context, peer string, req *RequestVoteRequest, respCh chan *voteResult) {
 	resp := &voteResult{voter: peer}
-	err := s.Transport().RequestVote(peer, req, &resp.RequestVoteResponse)
-	if err != nil {
+	for failures := uint64(1); ; failures++ {
+		ctx, cancel := s.rpcContextFrom(election)
+		err := s.Transport().RequestVote(ctx, peer, req, &resp.RequestVoteResponse)
+		cancel()
+		if err == nil {
+			break
+		}
+		if election.Err() != nil {
+			return
+		}
 		s.err("Failed to sent RequestVote RPC to %v: %v", peer, err)
-		resp.Term = req.Term
-		resp.Granted = false
+
+		// Retry until the election of this term is over
+		select {
+		case <-s.clock().After(s.retryBackoff(failures)):
+		case <-election.Done():
+			return
+		case <-s.stopCh:
+			return
+		}
 	}
 
 	respCh <- resp
 }
 
-// Do ...
-func (s *Server) Do(command []byte) error {
+// Apply is used to replicate command through raft log, it returns index
+// of the log once the command is committed and applied to state machine.
+// ErrNotLeader is returned if server isn't leader.
+func (s *Server) Apply(command []byte) (uint64, error) {
+	index, _, err := s.ApplyResult(context.Background(), command)
+	return index, err
+}
+
+// ApplyResult is like Apply, it also returns the result state machine set
+// on the log with SetResult, nil if it set none. Write is traced as a child
+// of the span ctx carries, and logged with extensions set by
+// WithExtensions. It stops waiting once ctx is done, the command may still
+// be committed.
+func (s *Server) ApplyResult(ctx context.Context, command []byte) (index uint64, result interface{}, err error) {
 	s.debug("Server %s doing command", s.LocalAddr())
+	ctx, span := s.Tracer().StartSpan(ctx, "raft.Apply")
+	defer func() {
+		span.SetAttribute("index", index)
+		span.End(err)
+	}()
+
+	if limit := s.config.MaxLogEntrySize; limit > 0 && len(command) > limit {
+		return 0, nil, fmt.Errorf("%d bytes, limit %d: %w", len(command), limit, ErrLogEntryTooLarge)
+	}
+	if !s.acquireWrite() {
+		return 0, nil, ErrQueueFull
+	}
 	entry := &Log{
-		Command: command,
-		errCh:   make(chan error, 1),
+		Command:    command,
+		Extensions: extensionsFrom(ctx),
+		errCh:      make(chan error, 1),
+		ctx:        ctx,
+		done:       s.releaseWrite,
 	}
 
-	s.applyCh <- entry
+	select {
+	case s.applyCh <- entry:
+	case <-s.shutdownCh:
+		s.releaseWrite()
+		return 0, nil, ErrServerShutdown
+	case <-ctx.Done():
+		s.releaseWrite()
+		return 0, nil, ctx.Err()
+	}
 
-	for err := range entry.errCh {
-		if err != nil {
-			return err
-		}
+	select {
+	case err = <-entry.errCh:
+	case <-ctx.Done():
+		return 0, nil, ctx.Err()
+	}
+	if err != nil {
+		return 0, nil, err
 	}
+	return entry.Index, entry.result, nil
+}
 
-	return nil
+// acquireWrite is used to count a write accepted by Apply, it returns
+// false if MaxInflightWrites are already waiting
+func (s *Server) acquireWrite() bool {
+	s.Lock()
+	defer s.Unlock()
+	if limit := s.config.MaxInflightWrites; limit > 0 && s.inflightWrites >= limit {
+		return false
+	}
+	s.inflightWrites++
+	return true
+}
+
+// releaseWrite is used once a write counted by acquireWrite is responded
+// or never reached the leader loop
+func (s *Server) releaseWrite() {
+	s.Lock()
+	defer s.Unlock()
+	s.inflightWrites--
+}
+
+// Barrier is used to commit a no-op log, once it returns every log
+// committed before the call is applied to state machine. ErrLeadershipLost
+// is returned if leader steps down before the log is committed.
+func (s *Server) Barrier(timeout time.Duration) error {
+	return s.dispatch(&Log{
+		Type:  LogBarrier,
+		errCh: make(chan error, 1),
+	}, timeout)
+}
+
+// dispatch is used to hand log to leader loop and wait until it's applied
+func (s *Server) dispatch(entry *Log, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case s.applyCh <- entry:
+	case <-s.shutdownCh:
+		return ErrServerShutdown
+	case <-timer.C:
+		return ErrTimeout
+	}
+
+	select {
+	case err := <-entry.errCh:
+		return err
+	case <-timer.C:
+		return ErrTimeout
+	}
+}
+
+// Do is used to replicate command through raft log
+func (s *Server) Do(command []byte) error {
+	_, err := s.Apply(command)
+	return err
 }
@@ -1,6 +1,16 @@
 package raft
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -9,6 +19,25 @@ const (
 	testElectionTimeout = 150 * time.Millisecond
 )
 
+// waitForLeader is used to wait until exactly one server of cluster is leader
+func waitForLeader(t *testing.T, cluster []*Server) *Server {
+	deadline := time.Now().Add(20 * testElectionTimeout)
+	for time.Now().Before(deadline) {
+		var leaders []*Server
+		for _, server := range cluster {
+			if server.State() == Leader {
+				leaders = append(leaders, server)
+			}
+		}
+		if len(leaders) == 1 {
+			return leaders[0]
+		}
+		time.Sleep(testElectionTimeout / 10)
+	}
+	t.Fatalf("Cannot elect leader")
+	return nil
+}
+
 func TestRaftServerStartAsFollower(t *testing.T) {
 	s := NewTestServer()
 	s.Start()
@@ -28,7 +57,7 @@ func TestRaftServerRequestVote(t *testing.T) {
 	req := newVoteRequest(1, "foo", 0, 0)
 
 	var resp RequestVoteResponse
-	err := s.Transport().RequestVote(s.Transport().LocalAddr(), req, &resp)
+	err := s.Transport().RequestVote(context.Background(), s.Transport().LocalAddr(), req, &resp)
 	if err != nil {
 		t.Fatalf("Failed to sent request vote")
 	}
@@ -46,7 +75,7 @@ func TestServerRequestVoteDeniedForSmallTerm(t *testing.T) {
 	req := newVoteRequest(1, "foo", 1, 0)
 
 	var resp RequestVoteResponse
-	err := s.Transport().RequestVote(s.Transport().LocalAddr(), req, &resp)
+	err := s.Transport().RequestVote(context.Background(), s.Transport().LocalAddr(), req, &resp)
 
 	if err != nil {
 		t.Fatalf("Failed to sent request vote")
@@ -70,7 +99,7 @@ func TestServerRequestVoteDeniedIfAlreadyVoted(t *testing.T) {
 	req := newVoteRequest(2, "foo", 1, 0)
 
 	var resp RequestVoteResponse
-	err := s.Transport().RequestVote(s.Transport().LocalAddr(), req, &resp)
+	err := s.Transport().RequestVote(context.Background(), s.Transport().LocalAddr(), req, &resp)
 
 	if err != nil {
 		t.Fatalf("Failed to sent request vote")
@@ -81,7 +110,7 @@ func TestServerRequestVoteDeniedIfAlreadyVoted(t *testing.T) {
 	}
 	req = newVoteRequest(2, "bar", 1, 0)
 
-	err = s.Transport().RequestVote(s.Transport().LocalAddr(), req, &resp)
+	err = s.Transport().RequestVote(context.Background(), s.Transport().LocalAddr(), req, &resp)
 
 	if err != nil {
 		t.Fatalf("Failed to sent request vote")
@@ -101,7 +130,7 @@ func TestServerRequestVoteApprovedIfAlreadyVotedInOlderTerm(t *testing.T) {
 	req := newVoteRequest(2, "foo", 1, 0)
 	var resp RequestVoteResponse
 
-	err := s.Transport().RequestVote(s.Transport().LocalAddr(), req, &resp)
+	err := s.Transport().RequestVote(context.Background(), s.Transport().LocalAddr(), req, &resp)
 
 	if err != nil {
 		t.Fatalf("Failed to sent request vote")
@@ -112,7 +141,7 @@ func TestServerRequestVoteApprovedIfAlreadyVotedInOlderTerm(t *testing.T) {
 	}
 	req = newVoteRequest(3, "bar", 1, 0)
 
-	err = s.Transport().RequestVote(s.Transport().LocalAddr(), req, &resp)
+	err = s.Transport().RequestVote(context.Background(), s.Transport().LocalAddr(), req, &resp)
 
 	if err != nil {
 		t.Fatalf("Failed to sent request vote")
@@ -148,27 +177,27 @@ func TestServerRequestVoteDenyIfCandidateLogIsBehind(t *testing.T) {
 
 	req := newVoteRequest(3, "foo", 2, 2)
 	var resp RequestVoteResponse
-	_ = s.Transport().RequestVote(s.LocalAddr(), req, &resp)
+	_ = s.Transport().RequestVote(context.Background(), s.LocalAddr(), req, &resp)
 	if resp.Term != 3 || resp.Granted {
 		t.Fatalf("Behind index should have been denied [%v/%v]", resp.Term, resp.Granted)
 	}
 
 	req = newVoteRequest(2, "foo", 3, 2)
-	_ = s.Transport().RequestVote(s.LocalAddr(), req, &resp)
+	_ = s.Transport().RequestVote(context.Background(), s.LocalAddr(), req, &resp)
 	if resp.Term != 3 || resp.Granted {
 		t.Fatalf("Behind term should have been denied [%v/%v]", resp.Term, resp.Granted)
 	}
 
 	req = newVoteRequest(3, "foo", 3, 2)
 
-	_ = s.Transport().RequestVote(s.LocalAddr(), req, &resp)
+	_ = s.Transport().RequestVote(context.Background(), s.LocalAddr(), req, &resp)
 	if resp.Term != 3 || !resp.Granted {
 		t.Fatalf("Matching log vote should have been granted")
 	}
 
 	req = newVoteRequest(3, "foo", 4, 2)
 
-	_ = s.Transport().RequestVote(s.LocalAddr(), req, &resp)
+	_ = s.Transport().RequestVote(context.Background(), s.LocalAddr(), req, &resp)
 	if resp.Term != 3 || !resp.Granted {
 		t.Fatalf("Ahead log vote should have been granted")
 	}
@@ -221,7 +250,7 @@ func TestServerAppendEntries(t *testing.T) {
 	entries := []*Log{e1}
 	req := newAppendEntriesRequest(1, 0, 0, entries, "leader", 0)
 	var resp AppendEntryResponse
-	_ = s.Transport().AppendEntries(s.LocalAddr(), req, &resp)
+	_ = s.Transport().AppendEntries(context.Background(), s.LocalAddr(), req, &resp)
 
 	if resp.Term != 1 || !resp.Success {
 		t.Fatalf("AppendEntries failed: %v/%v", resp.Term, resp.Success)
@@ -237,7 +266,7 @@ func TestServerAppendEntries(t *testing.T) {
 	entries = []*Log{e2, e3}
 	req = newAppendEntriesRequest(1, 1, 1, entries, "leader", 1)
 
-	_ = s.Transport().AppendEntries(s.LocalAddr(), req, &resp)
+	_ = s.Transport().AppendEntries(context.Background(), s.LocalAddr(), req, &resp)
 	if resp.Term != 1 || !resp.Success {
 		t.Fatalf("AppendEntries failed: %v/%v", resp.Term, resp.Success)
 	}
@@ -252,7 +281,7 @@ func TestServerAppendEntries(t *testing.T) {
 	// send heartbeat and commit everything
 	req = newAppendEntriesRequest(2, 3, 1, []*Log{}, "leader", 3)
 
-	_ = s.Transport().AppendEntries(s.LocalAddr(), req, &resp)
+	_ = s.Transport().AppendEntries(context.Background(), s.LocalAddr(), req, &resp)
 	if resp.Term != 2 || !resp.Success {
 		t.Fatalf("AppendEntries failed: %v/%v", resp.Term, resp.Success)
 	}
@@ -273,7 +302,7 @@ func TestServerAppendEntriesStaleTermRejected(t *testing.T) {
 	req := newAppendEntriesRequest(1, 0, 0, entries, "leader", 0)
 	var resp AppendEntryResponse
 
-	_ = s.Transport().AppendEntries(s.LocalAddr(), req, &resp)
+	_ = s.Transport().AppendEntries(context.Background(), s.LocalAddr(), req, &resp)
 
 	if resp.Term != 2 || resp.Success {
 		t.Fatalf("AppendEntries should be failed: %v/%v", resp.Term, resp.Success)
@@ -295,13 +324,7 @@ func TestMultiNode(t *testing.T) {
 		}
 	}()
 
-	time.Sleep(2 * testElectionTimeout)
-	var leader *Server
-	for _, server := range cluster {
-		if server.State() == Leader {
-			leader = server
-		}
-	}
+	leader := waitForLeader(t, cluster)
 	e := &Log{
 		Command: []byte("a:b"),
 		errCh:   make(chan error),
@@ -314,14 +337,15 @@ func TestMultiNode(t *testing.T) {
 		}
 	}
 
-	if leader.CommitIndex() != 1 {
+	// Log is appended after leader's no-op and bootstrap configuration
+	if leader.CommitIndex() != 3 {
 		t.Fatalf("Failed to commit log. Current: %v", leader.CommitIndex())
 	}
 
 	time.Sleep(testElectionTimeout)
 
 	for _, s := range cluster {
-		if s.CommitIndex() != 1 {
+		if s.CommitIndex() != 3 {
 			t.Fatalf("wrong commit on server %v", s.LocalAddr())
 		}
 	}
@@ -350,14 +374,2729 @@ func TestMultiNode(t *testing.T) {
 		}
 	}
 
-	if leader.CommitIndex() != 3 {
+	if leader.CommitIndex() != 5 {
 		t.Fatalf("Failed to commit log. Current: %v", leader.CommitIndex())
 	}
 
 	time.Sleep(testElectionTimeout)
 	for _, s := range cluster {
-		if s.CommitIndex() != 3 {
+		if s.CommitIndex() != 5 {
 			t.Fatalf("wrong commit on server %v", s.LocalAddr())
 		}
 	}
 }
+
+// TestLeaderCommitOnlyCurrentTermLogs reproduces Figure 8 of Raft paper:
+// a leader of term 4 must not commit a log of term 2 by counting replicas,
+// the log is only committed once a log of term 4 is committed on top of it.
+func TestLeaderCommitOnlyCurrentTermLogs(t *testing.T) {
+	s := NewTestServer()
+	s.peers = []string{"s2", "s3"}
+
+	e1 := &Log{Index: 1, Term: 1, Command: []byte("a:1")}
+	e2 := &Log{Index: 2, Term: 2, Command: []byte("a:2")}
+	if err := s.logStore.SetLogs([]*Log{e1, e2}); err != nil {
+		t.Fatal(err)
+	}
+	s.setLastLogInfo(2, 2)
+	s.setCommitIndex(1)
+	s.setLastApplied(1)
+	s.setCurrentTerm(4)
+	s.setState(Leader)
+
+	f2 := &follower{peer: "s2", replicateCh: make(chan struct{}, 1)}
+	f3 := &follower{peer: "s3", replicateCh: make(chan struct{}, 1)}
+	s.followers = map[string]*follower{"s2": f2, "s3": f3}
+	s.applying = map[uint64]*Log{}
+
+	// Log of term 2 is now stored on majority (s1, s3)
+	s.updateLastAppend(f3, newAppendEntriesRequest(4, 1, 1, []*Log{e2}, s.LocalAddr(), 1), &AppendEntryResponse{Term: 4, LastLogIndex: 2, Success: true})
+	s.advanceCommit()
+	if s.CommitIndex() != 1 {
+		t.Fatalf("Log of previous term must not be committed by counting replicas: %v", s.CommitIndex())
+	}
+
+	// Log of current term committed on majority commits every previous log
+	e3 := &Log{Command: []byte("a:3"), errCh: make(chan error, 1)}
+	s.dispatchLog(e3)
+	if e3.Index != 3 || e3.Term != 4 {
+		t.Fatalf("Wrong dispatched log: %+v", e3)
+	}
+
+	s.updateLastAppend(f3, newAppendEntriesRequest(4, 1, 1, []*Log{e2, e3}, s.LocalAddr(), 1), &AppendEntryResponse{Term: 4, LastLogIndex: 3, Success: true})
+	select {
+	case <-s.commitCh:
+		s.advanceCommit()
+	default:
+		t.Fatalf("Advanced match index should notify leader")
+	}
+	// Server isn't started, apply what its apply loop would
+	s.applyLogs()
+
+	if err := <-e3.errCh; err != nil {
+		t.Fatal(err)
+	}
+	if s.CommitIndex() != 3 || s.LastApplied() != 3 {
+		t.Fatalf("Wrong commit info: commit %v applied %v", s.CommitIndex(), s.LastApplied())
+	}
+	if v := s.StateMachine().Get([]byte("a")); v != "3" {
+		t.Fatalf("Wrong state machine value: %v", v)
+	}
+}
+
+// newCommitTestLeader return a leader of term 1 with total logs of its term
+// dispatched and a follower for each peer
+func newCommitTestLeader(t *testing.T, peers []string, total int) *Server {
+	s := NewTestServer()
+	s.peers = peers
+	s.setCurrentTerm(1)
+	s.setState(Leader)
+	s.applying = map[uint64]*Log{}
+	s.followers = map[string]*follower{}
+	for _, peer := range peers {
+		s.followers[peer] = &follower{peer: peer, nextIndex: 1, replicateCh: make(chan struct{}, 1)}
+	}
+
+	for i := 0; i < total; i++ {
+		s.dispatchLog(&Log{Command: []byte(fmt.Sprintf("a:%d", i)), errCh: make(chan error, 1)})
+	}
+	if s.CommitIndex() != 0 {
+		t.Fatalf("Logs should not be committed without replication: %v", s.CommitIndex())
+	}
+	return s
+}
+
+func appendResponse(s *Server, peer string, prevLogIndex uint64, entries ...uint64) {
+	var logs []*Log
+	for _, idx := range entries {
+		logs = append(logs, &Log{Index: idx, Term: 1})
+	}
+	resp := &AppendEntryResponse{Term: 1, LastLogIndex: prevLogIndex + uint64(len(logs)), Success: true}
+	s.updateLastAppend(s.followers[peer], newAppendEntriesRequest(1, prevLogIndex, 1, logs, s.LocalAddr(), 0), resp)
+	s.advanceCommit()
+}
+
+func TestLeaderCommitDuplicatedResponses(t *testing.T) {
+	s := newCommitTestLeader(t, []string{"s2", "s3", "s4", "s5"}, 3)
+
+	// Same success delivered many times only counts s2 once
+	for i := 0; i < 3; i++ {
+		appendResponse(s, "s2", 0, 1, 2, 3)
+	}
+	if s.CommitIndex() != 0 {
+		t.Fatalf("Duplicated responses must not reach quorum: %v", s.CommitIndex())
+	}
+
+	appendResponse(s, "s3", 0, 1, 2)
+	if s.CommitIndex() != 2 {
+		t.Fatalf("Wrong commit index: %v", s.CommitIndex())
+	}
+	s.applyLogs()
+	if s.LastApplied() != 2 {
+		t.Fatalf("Committed logs should be applied: %v", s.LastApplied())
+	}
+}
+
+func TestLeaderCommitOutOfOrderResponses(t *testing.T) {
+	s := newCommitTestLeader(t, []string{"s2", "s3"}, 3)
+
+	// Response of later request arrives first
+	appendResponse(s, "s2", 2, 3)
+	appendResponse(s, "s2", 0, 1)
+	if match, next := s.followers["s2"].progress(); match != 3 || next != 4 {
+		t.Fatalf("Stale response should not move progress backward: match %v next %v", match, next)
+	}
+	if s.CommitIndex() != 3 {
+		t.Fatalf("Wrong commit index: %v", s.CommitIndex())
+	}
+
+	// Heartbeat without entries confirms logs up to previous index
+	s.dispatchLog(&Log{Command: []byte("a:4"), errCh: make(chan error, 1)})
+	appendResponse(s, "s3", 4)
+	if s.CommitIndex() != 4 {
+		t.Fatalf("Wrong commit index after heartbeat: %v", s.CommitIndex())
+	}
+}
+
+func TestBarrier(t *testing.T) {
+	sm := &recordStateMachine{InmemStateMachine: NewInMemStateMachine()}
+	s := mustNewServer(DefaultConfig(), NewInmemTransport(""), NewInmemLogStore(), sm)
+	s.Start()
+	defer s.Stop()
+
+	waitForLeader(t, []*Server{s})
+
+	for _, cmd := range []string{"a:b", "a:c"} {
+		if err := s.Do([]byte(cmd)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Barrier(time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// No-op of leader, 2 commands then barrier
+	if s.LastApplied() != 4 || s.CommitIndex() != 4 {
+		t.Fatalf("Barrier should be committed and applied: commit %v applied %v", s.CommitIndex(), s.LastApplied())
+	}
+	sm.Lock()
+	applied := sm.sets
+	for _, n := range sm.batches {
+		applied += n
+	}
+	sm.Unlock()
+	if applied != 2 {
+		t.Fatalf("Barrier should not be applied to state machine: %v", applied)
+	}
+}
+
+// gatedTransport holds AppendEntries until gate is closed, elections still
+// go through
+type gatedTransport struct {
+	*InmemTransport
+	gate chan struct{}
+}
+
+func (g *gatedTransport) AppendEntries(ctx context.Context, target string, req *AppendEntryRequest, resp *AppendEntryResponse) error {
+	select {
+	case <-g.gate:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return g.InmemTransport.AppendEntries(ctx, target, req, resp)
+}
+
+func TestLeaderCommitsNoopOnElection(t *testing.T) {
+	_, cluster := NewTestNetworkCluster(3)
+	gate := make(chan struct{})
+	for _, s := range cluster {
+		s.setTransport(&gatedTransport{InmemTransport: s.Transport().(*InmemTransport), gate: gate})
+		s.Start()
+		defer s.Stop()
+	}
+
+	// No-op can't reach followers, so it's not committed yet
+	leader := waitForLeader(t, cluster)
+	start := leader.TermStartIndex()
+	if start == 0 || leader.LastApplied() >= start {
+		t.Fatalf("New leader should wait for its no-op: start %v applied %v", start, leader.LastApplied())
+	}
+
+	close(gate)
+	if err := leader.WaitApplied(start, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	log, err := leader.logStore.GetLog(start)
+	if err != nil || log.Type != LogNoop || log.Term != leader.CurrentTerm() {
+		t.Fatalf("Leader should commit a no-op of its term: %+v %v", log, err)
+	}
+}
+
+func TestApplyNoopLog(t *testing.T) {
+	sm := &recordStateMachine{InmemStateMachine: NewInMemStateMachine()}
+	s := mustNewServer(DefaultConfig(), NewInmemTransport(""), NewInmemLogStore(), sm)
+	s.Start()
+	defer s.Stop()
+
+	waitForLeader(t, []*Server{s})
+
+	if err := s.dispatch(&Log{Type: LogNoop, errCh: make(chan error, 1)}, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if s.CommitIndex() != 2 || s.LastApplied() != 2 {
+		t.Fatalf("No-op should advance commit: commit %v applied %v", s.CommitIndex(), s.LastApplied())
+	}
+
+	sm.Lock()
+	defer sm.Unlock()
+	if sm.sets != 0 || len(sm.batches) != 0 {
+		t.Fatalf("No-op should not hit state machine: sets %v batches %v", sm.sets, sm.batches)
+	}
+}
+
+func TestFollowerApplyLogTypes(t *testing.T) {
+	sm := &recordStateMachine{InmemStateMachine: NewInMemStateMachine()}
+	s := mustNewServer(DefaultConfig(), NewInmemTransport(""), NewInmemLogStore(), sm)
+	s.transport.(*InmemTransport).AddPeer(s.transport.(*InmemTransport))
+	s.Start()
+	defer s.Stop()
+
+	config := []byte(fmt.Sprintf(`{"members":["leader","%s","s3"]}`, s.LocalAddr()))
+	entries := []*Log{
+		{Index: 1, Term: 1, Type: LogNoop},
+		{Index: 2, Term: 1, Type: LogCommand, Command: []byte("a:b")},
+		{Index: 3, Term: 1, Type: LogConfig, Command: config},
+		{Index: 4, Term: 1, Type: LogBarrier},
+	}
+	var resp AppendEntryResponse
+	req := newAppendEntriesRequest(1, 0, 0, entries, "leader", 4)
+	if err := s.Transport().AppendEntries(context.Background(), s.LocalAddr(), req, &resp); err != nil || !resp.Success {
+		t.Fatalf("AppendEntries failed: %+v %v", resp, err)
+	}
+
+	if err := s.WaitApplied(4, time.Second); err != nil {
+		t.Fatalf("Every log should be applied: %v", s.LastApplied())
+	}
+	sm.Lock()
+	applied := len(sm.batches)
+	if applied == 1 {
+		applied = sm.batches[0]
+	}
+	sm.Unlock()
+	if applied != 1 || s.StateMachine().Get([]byte("a")) != "b" {
+		t.Fatalf("Only command log should hit state machine: %v", applied)
+	}
+	if peers := s.Peers(); len(peers) != 2 || peers[0] != "leader" || peers[1] != "s3" {
+		t.Fatalf("Config log should update peers: %v", peers)
+	}
+}
+
+func TestFollowerStateMachineReflectsCommits(t *testing.T) {
+	network, cluster := NewTestNetworkCluster(3)
+	for _, s := range cluster {
+		s.Start()
+		defer s.Stop()
+	}
+	leader := waitForLeader(t, cluster)
+	for i := 0; i < 10; i++ {
+		if err := leader.Do([]byte(fmt.Sprintf("k%d:v%d", i, i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Followers apply what leader committed without any read reaching them
+	commitIndex := leader.CommitIndex()
+	for _, s := range cluster {
+		if err := s.WaitApplied(commitIndex, time.Second); err != nil {
+			t.Fatalf("Server %v should apply committed logs: %v", s.LocalAddr(), err)
+		}
+		if v := s.StateMachine().Get([]byte("k9")); v != "v9" {
+			t.Fatalf("Wrong value on %v: %v", s.LocalAddr(), v)
+		}
+	}
+
+	// Leader elected once the old one is gone starts from the same state
+	network.Isolate(leader.LocalAddr())
+	var rest []*Server
+	for _, s := range cluster {
+		if s != leader {
+			rest = append(rest, s)
+		}
+	}
+	newLeader := waitForLeader(t, rest)
+	for i := 0; i < 10; i++ {
+		if v := newLeader.StateMachine().Get([]byte(fmt.Sprintf("k%d", i))); v != fmt.Sprintf("v%d", i) {
+			t.Fatalf("New leader should hold every committed write: k%d = %v", i, v)
+		}
+	}
+}
+
+func TestApplyObserver(t *testing.T) {
+	s := NewTestServer()
+	type applied struct {
+		index, term uint64
+		logType     LogType
+		err         error
+	}
+	observedCh := make(chan applied, 10)
+	s.RegisterApplyObserver(func(index, term uint64, logType LogType, extensions map[string]string, err error) {
+		panic("observer bug")
+	})
+	s.RegisterApplyObserver(func(index, term uint64, logType LogType, extensions map[string]string, err error) {
+		observedCh <- applied{index, term, logType, err}
+	})
+	var observed []applied
+	observe := func(total int) {
+		for len(observed) < total {
+			select {
+			case o := <-observedCh:
+				observed = append(observed, o)
+			case <-time.After(time.Second):
+				return
+			}
+		}
+	}
+	s.Start()
+	defer s.Stop()
+
+	entries := []*Log{
+		{Index: 1, Term: 1, Type: LogNoop},
+		{Index: 2, Term: 1, Type: LogCommand, Command: []byte("a:b")},
+		{Index: 3, Term: 2, Type: LogType(99)},
+	}
+	var resp AppendEntryResponse
+	req := newAppendEntriesRequest(2, 0, 0, entries, "leader", 3)
+	if err := s.Transport().AppendEntries(context.Background(), s.LocalAddr(), req, &resp); err != nil || !resp.Success {
+		t.Fatalf("AppendEntries failed: %+v %v", resp, err)
+	}
+
+	observe(3)
+	if len(observed) != 3 {
+		t.Fatalf("Every applied log should be observed: %+v", observed)
+	}
+	for i, o := range observed {
+		if o.index != entries[i].Index || o.term != entries[i].Term || o.logType != entries[i].Type {
+			t.Fatalf("Wrong observed log %d: %+v", i, o)
+		}
+	}
+	if observed[0].err != nil || observed[1].err != nil || observed[2].err == nil {
+		t.Fatalf("Observer should receive apply results: %+v", observed)
+	}
+
+	// Server keeps applying after observer panicked
+	entries = []*Log{{Index: 4, Term: 2, Type: LogCommand, Command: []byte("c:d")}}
+	req = newAppendEntriesRequest(2, 3, 2, entries, "leader", 4)
+	if err := s.Transport().AppendEntries(context.Background(), s.LocalAddr(), req, &resp); err != nil || !resp.Success {
+		t.Fatalf("AppendEntries failed: %+v %v", resp, err)
+	}
+	observe(4)
+	if s.LastApplied() != 4 || len(observed) != 4 {
+		t.Fatalf("Apply loop should survive observer panic: %v %v", s.LastApplied(), len(observed))
+	}
+}
+
+func TestApplyChAcrossLeadershipChange(t *testing.T) {
+	_, cluster := NewTestNetworkCluster(3)
+	node := cluster[0]
+	applyCh := node.ApplyCh()
+	for _, s := range cluster {
+		s.Start()
+		defer s.Stop()
+	}
+
+	write := func(i int) {
+		for {
+			leader := waitForLeader(t, cluster)
+			if _, err := leader.Apply([]byte(fmt.Sprintf("k%d:v%d", i%4, i))); err == nil {
+				return
+			}
+		}
+	}
+	for i := 0; i < 10; i++ {
+		write(i)
+	}
+	if err := waitForLeader(t, cluster).TransferLeadership(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	for i := 10; i < 20; i++ {
+		write(i)
+	}
+
+	leader := waitForLeader(t, cluster)
+	if err := node.WaitApplied(leader.CommitIndex(), time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rebuild state from the stream, every index shows up once in order
+	data := map[string]string{}
+	var last uint64
+	timeout := time.After(time.Second)
+	for last < node.LastApplied() {
+		select {
+		case log := <-applyCh:
+			if log.Index != last+1 {
+				t.Fatalf("Log %d received after %d", log.Index, last)
+			}
+			last = log.Index
+			if log.Type == LogCommand {
+				kv := strings.Split(string(log.Command), ":")
+				data[kv[0]] = kv[1]
+			}
+		case <-timeout:
+			t.Fatalf("Applied logs missing from stream after %d", last)
+		}
+	}
+
+	sm := node.StateMachine().(*InmemStateMachine)
+	sm.Lock()
+	defer sm.Unlock()
+	if !reflect.DeepEqual(data, sm.data) {
+		t.Fatalf("Rebuilt state differs: %v (want %v)", data, sm.data)
+	}
+}
+
+func TestBarrierLeadershipLost(t *testing.T) {
+	network, cluster := NewTestNetworkCluster(3)
+	for _, s := range cluster {
+		s.Start()
+		defer s.Stop()
+	}
+
+	leader := waitForLeader(t, cluster)
+	network.Isolate(leader.LocalAddr())
+
+	if err := leader.Barrier(10 * time.Second); err != ErrLeadershipLost {
+		t.Fatalf("Barrier should fail when leader steps down: %v", err)
+	}
+}
+
+func TestBarrierTimeout(t *testing.T) {
+	s := NewTestServer()
+	if err := s.Barrier(10 * time.Millisecond); err != ErrTimeout {
+		t.Fatalf("Barrier should time out on stopped server: %v", err)
+	}
+}
+
+func TestQuorumSizeSingleNode(t *testing.T) {
+	s := NewTestServer()
+	if len(s.peers) != 0 {
+		t.Fatalf("Test server should not have any peer: %v", s.peers)
+	}
+	if s.QuorumSize() != 1 {
+		t.Fatalf("Wrong quorum size of single node: %v", s.QuorumSize())
+	}
+}
+
+func TestAddPeerIdempotent(t *testing.T) {
+	s := NewTestServer()
+	for i := 0; i < 2; i++ {
+		if err := s.AddPeer("peer", 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.AddPeer(s.LocalAddr(), 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Peers()) != 1 || s.MemberCount() != 2 || s.QuorumSize() != 2 {
+		t.Fatalf("Duplicate peer should be added once: peers %v quorum %v", s.Peers(), s.QuorumSize())
+	}
+
+	if err := s.RemovePeer("other", 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Peers()) != 1 || s.QuorumSize() != 2 {
+		t.Fatalf("Removing non-member should do nothing: peers %v quorum %v", s.Peers(), s.QuorumSize())
+	}
+}
+
+func TestAddLearnerIdempotent(t *testing.T) {
+	s := NewTestServer()
+	if err := s.AddPeer("peer", 0); err != nil {
+		t.Fatal(err)
+	}
+	for _, learner := range []string{"learner", "learner", "peer", s.LocalAddr()} {
+		if err := s.AddLearner(learner, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(s.Learners()) != 1 || len(s.Peers()) != 1 || s.QuorumSize() != 2 {
+		t.Fatalf("Learner should be added once and not over a member: learners %v peers %v", s.Learners(), s.Peers())
+	}
+}
+
+func TestRemovePeerStopsReplication(t *testing.T) {
+	cluster := NewTestCluster(3)
+	for _, s := range cluster {
+		s.Start()
+		defer s.Stop()
+	}
+	leader := waitForLeader(t, cluster)
+	transport := &sendTimesTransport{InmemTransport: leader.Transport().(*InmemTransport), sent: make(map[string][]time.Time)}
+	leader.setTransport(transport)
+
+	// Removed node is stopped so its elections don't disturb the leader,
+	// RPCs to it are still sent until it's removed
+	var removed string
+	for _, s := range cluster {
+		if s != leader {
+			removed = s.LocalAddr()
+			s.Stop()
+			break
+		}
+	}
+	sent := func() int {
+		transport.Lock()
+		defer transport.Unlock()
+		return len(transport.sent[removed])
+	}
+	deadline := time.Now().Add(10 * testElectionTimeout)
+	for sent() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Leader should replicate to %s", removed)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Changes are rejected until leader's bootstrap configuration commits
+	err := leader.RemovePeer(removed, time.Second)
+	for errors.Is(err, ErrConfigChangeInProgress) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+		err = leader.RemovePeer(removed, time.Second)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range leader.Progress() {
+		if p.Peer == removed {
+			t.Fatalf("Removed peer should have no replication progress")
+		}
+	}
+
+	// An RPC already in flight may still complete, none is sent after it
+	time.Sleep(time.Duration(leader.config.RPCTimeout) * time.Millisecond)
+	before := sent()
+	time.Sleep(5 * time.Duration(leader.config.MaxHeartbeatInterval) * time.Millisecond)
+	if after := sent(); after != before {
+		t.Fatalf("Leader should stop replicating to removed peer: %d RPCs after removal", after-before)
+	}
+	if err := leader.Do([]byte("a:b")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Removal is logged, the remaining follower applies it too
+	for _, s := range cluster {
+		if s != leader && s.LocalAddr() != removed {
+			if err := s.WaitApplied(leader.LastLogIndex(), time.Second); err != nil {
+				t.Fatal(err)
+			}
+			if contains(s.Configuration().Voters, removed) {
+				t.Fatalf("Follower should learn %s is removed: %v", removed, s.Configuration())
+			}
+		}
+	}
+}
+
+func TestQuorumSizeByClusterSize(t *testing.T) {
+	cases := []struct {
+		size   int
+		quorum int
+	}{
+		{1, 1}, {2, 2}, {3, 2}, {4, 3}, {5, 3}, {6, 4}, {7, 4},
+	}
+	for _, tc := range cases {
+		for _, s := range NewTestCluster(tc.size) {
+			if s.MemberCount() != tc.size || s.QuorumSize() != tc.quorum {
+				t.Fatalf("Wrong quorum of %d nodes: members %v quorum %v (want %v)",
+					tc.size, s.MemberCount(), s.QuorumSize(), tc.quorum)
+			}
+		}
+	}
+}
+
+func TestSingleNodeServeWrites(t *testing.T) {
+	s := NewTestServer()
+	s.Start()
+	defer s.Stop()
+
+	waitForLeader(t, []*Server{s})
+
+	for _, cmd := range []string{"a:b", "a:c", "b:d"} {
+		if err := s.Do([]byte(cmd)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if s.CommitIndex() != 4 || s.LastApplied() != 4 {
+		t.Fatalf("Wrong commit info: commit %v applied %v", s.CommitIndex(), s.LastApplied())
+	}
+	if v := s.StateMachine().Get([]byte("a")); v != "c" {
+		t.Fatalf("Wrong state machine value: %v", v)
+	}
+}
+
+func TestLeaderReplicationProgress(t *testing.T) {
+	cluster := NewTestCluster(3)
+	for _, server := range cluster {
+		server.Start()
+	}
+	defer func() {
+		for _, server := range cluster {
+			server.Stop()
+		}
+	}()
+
+	leader := waitForLeader(t, cluster)
+	for _, server := range cluster {
+		if server == leader {
+			continue
+		}
+		if progress := server.Progress(); len(progress) != 0 {
+			t.Fatalf("Non leader should not know replication progress: %+v", progress)
+		}
+	}
+
+	if err := leader.Do([]byte("a:b")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(testElectionTimeout)
+
+	progress := leader.Progress()
+	if len(progress) != len(leader.Peers()) {
+		t.Fatalf("Wrong number of peer progress: %+v", progress)
+	}
+	for _, p := range progress {
+		if p.MatchIndex != 3 || p.NextIndex != 4 {
+			t.Fatalf("Wrong progress of peer: %+v", p)
+		}
+	}
+}
+
+func TestReplicationLagOfPartitionedFollower(t *testing.T) {
+	network, cluster := NewTestNetworkCluster(3)
+	for _, s := range cluster {
+		s.Start()
+		defer s.Stop()
+	}
+	leader := waitForLeader(t, cluster)
+
+	var lagging *Server
+	for _, s := range cluster {
+		if s != leader {
+			lagging = s
+		}
+	}
+	peerProgress := func() PeerProgress {
+		for _, p := range leader.Stats().Replication {
+			if p.Peer == lagging.LocalAddr() {
+				return p
+			}
+		}
+		t.Fatalf("No progress of %v", lagging.LocalAddr())
+		return PeerProgress{}
+	}
+
+	if err := leader.Do([]byte("a:b")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(testElectionTimeout)
+	if p := peerProgress(); p.Lag != 0 || p.LastContactMs > leader.config.MaxHeartbeatInterval*2 {
+		t.Fatalf("Connected follower should not lag: %+v", p)
+	}
+
+	network.Isolate(lagging.LocalAddr())
+	var last PeerProgress
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 5; j++ {
+			if err := leader.Do([]byte(fmt.Sprintf("k%d:v%d", i, j))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		time.Sleep(testElectionTimeout / 2)
+		p := peerProgress()
+		if p.Lag <= last.Lag || p.LastContactMs <= last.LastContactMs {
+			t.Fatalf("Lag of partitioned follower should grow: %+v after %+v", p, last)
+		}
+		last = p
+	}
+}
+
+func TestSuspectedDownPeer(t *testing.T) {
+	network, cluster := NewTestNetworkCluster(3)
+	for _, s := range cluster {
+		s.config.MaxFailures = 3
+		s.Start()
+		defer s.Stop()
+	}
+	leader := waitForLeader(t, cluster)
+	var down, up *Server
+	for _, s := range cluster {
+		if s == leader {
+			continue
+		}
+		if down == nil {
+			down = s
+		} else {
+			up = s
+		}
+	}
+
+	network.Isolate(down.LocalAddr())
+	deadline := time.Now().Add(time.Second)
+	for {
+		suspected := map[string]PeerProgress{}
+		for _, p := range leader.Stats().Replication {
+			if p.SuspectedDown {
+				suspected[p.Peer] = p
+			}
+		}
+		if p, ok := suspected[down.LocalAddr()]; ok {
+			if len(suspected) != 1 || p.Failures < 3 {
+				t.Fatalf("Only the isolated peer should be suspected: %+v", suspected)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Non-responsive peer should be suspected down: %+v", leader.Stats().Replication)
+		}
+		time.Sleep(testElectionTimeout / 10)
+	}
+
+	// Peer suspected down isn't picked to take over leadership
+	if err := leader.TransferLeadership(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if newLeader := waitForLeader(t, []*Server{leader, up}); newLeader != up {
+		t.Fatalf("Leadership should move to the responsive peer: %v", newLeader.LocalAddr())
+	}
+}
+
+// flakyTransport fails the first given number of AppendEntries RPC
+type flakyTransport struct {
+	*InmemTransport
+	sync.Mutex
+	failures int
+	calls    []time.Time
+}
+
+func (f *flakyTransport) AppendEntries(ctx context.Context, target string, req *AppendEntryRequest, resp *AppendEntryResponse) error {
+	f.Lock()
+	f.calls = append(f.calls, time.Now())
+	if f.failures > 0 {
+		f.failures--
+		f.Unlock()
+		return errors.New("flaky transport failure")
+	}
+	f.Unlock()
+	return f.InmemTransport.AppendEntries(ctx, target, req, resp)
+}
+
+func TestHeartbeatSuppressedWhenCaughtUp(t *testing.T) {
+	cluster := NewTestCluster(2)
+	leader, peer := cluster[0], cluster[1]
+	peer.Start()
+	defer peer.Stop()
+
+	config := DefaultConfig()
+	config.HeartbeatInterval = 10
+	config.MaxHeartbeatInterval = 80
+	leader.config = config
+	transport := &flakyTransport{InmemTransport: leader.Transport().(*InmemTransport)}
+	leader.setTransport(transport)
+	leader.setCurrentTerm(1)
+	leader.setState(Leader)
+
+	f := &follower{
+		currentTerm: 1,
+		peer:        peer.LocalAddr(),
+		nextIndex:   1,
+		lastContact: time.Now(),
+		replicateCh: make(chan struct{}),
+		stopCh:      make(chan bool),
+	}
+	stopCh := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		leader.heartbeat(f, stopCh)
+	}()
+	time.Sleep(600 * time.Millisecond)
+	close(stopCh)
+	<-done
+
+	// Fixed interval would send 60 heartbeats, backing off to 80ms sends
+	// at most 10 + 20 + 40 then about one per 80ms
+	transport.Lock()
+	defer transport.Unlock()
+	if len(transport.calls) == 0 || len(transport.calls) > 12 {
+		t.Fatalf("Idle follower should get fewer heartbeats: %v", len(transport.calls))
+	}
+	for i := 1; i < len(transport.calls); i++ {
+		if gap := transport.calls[i].Sub(transport.calls[i-1]); gap >= 150*time.Millisecond {
+			t.Fatalf("Heartbeats should stay within election timeout: %v", gap)
+		}
+	}
+}
+
+func TestHeartbeatSkippedAfterAppendEntries(t *testing.T) {
+	cluster := NewTestCluster(2)
+	leader, peer := cluster[0], cluster[1]
+	peer.Start()
+	defer peer.Stop()
+
+	config := DefaultConfig()
+	config.HeartbeatInterval = 100
+	config.MaxHeartbeatInterval = 100
+	leader.config = config
+	transport := &flakyTransport{InmemTransport: leader.Transport().(*InmemTransport)}
+	leader.setTransport(transport)
+	leader.setCurrentTerm(1)
+	leader.setState(Leader)
+
+	f := &follower{
+		currentTerm: 1,
+		peer:        peer.LocalAddr(),
+		nextIndex:   1,
+		lastContact: time.Now(),
+		replicateCh: make(chan struct{}),
+		stopCh:      make(chan bool),
+	}
+	stopCh := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		leader.heartbeat(f, stopCh)
+	}()
+
+	// Replicating every 10ms keeps follower in contact, no heartbeat needed
+	for i := 0; i < 10; i++ {
+		time.Sleep(10 * time.Millisecond)
+		leader.replicateTo(f)
+	}
+	close(stopCh)
+	<-done
+
+	transport.Lock()
+	defer transport.Unlock()
+	if len(transport.calls) != 10 {
+		t.Fatalf("Heartbeats should be skipped after AppendEntries: %v calls", len(transport.calls))
+	}
+}
+
+// sendTimesTransport records when AppendEntries is sent to each target
+type sendTimesTransport struct {
+	*InmemTransport
+	sync.Mutex
+	sent map[string][]time.Time
+}
+
+func (s *sendTimesTransport) AppendEntries(ctx context.Context, target string, req *AppendEntryRequest, resp *AppendEntryResponse) error {
+	s.Lock()
+	s.sent[target] = append(s.sent[target], time.Now())
+	s.Unlock()
+	return s.InmemTransport.AppendEntries(ctx, target, req, resp)
+}
+
+func TestHeartbeatJitter(t *testing.T) {
+	cluster := NewTestCluster(3)
+	leader := cluster[0]
+	for _, peer := range cluster[1:] {
+		peer.Start()
+		defer peer.Stop()
+	}
+
+	config := DefaultConfig()
+	config.HeartbeatInterval = 20
+	config.MaxHeartbeatInterval = 20
+	config.HeartbeatJitter = 10
+	leader.config = config
+	transport := &sendTimesTransport{InmemTransport: leader.Transport().(*InmemTransport), sent: make(map[string][]time.Time)}
+	leader.setTransport(transport)
+	leader.setCurrentTerm(1)
+	leader.setState(Leader)
+
+	// Heartbeats to both followers start at the same time
+	stopCh := make(chan struct{})
+	var wg sync.WaitGroup
+	start := time.Now()
+	for _, peer := range cluster[1:] {
+		f := &follower{
+			currentTerm: 1,
+			peer:        peer.LocalAddr(),
+			nextIndex:   1,
+			lastContact: start,
+			replicateCh: make(chan struct{}),
+			stopCh:      make(chan bool),
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			leader.heartbeat(f, stopCh)
+		}()
+	}
+	time.Sleep(500 * time.Millisecond)
+	close(stopCh)
+	wg.Wait()
+
+	transport.Lock()
+	defer transport.Unlock()
+	a, b := transport.sent[cluster[1].LocalAddr()], transport.sent[cluster[2].LocalAddr()]
+	if len(a) < 5 || len(b) < 5 {
+		t.Fatalf("Heartbeats should be sent: %d and %d", len(a), len(b))
+	}
+	var spread time.Duration
+	for i := 0; i < len(a) && i < len(b); i++ {
+		gap := a[i].Sub(b[i])
+		if gap < 0 {
+			gap = -gap
+		}
+		if gap > spread {
+			spread = gap
+		}
+		if i > 0 && a[i].Sub(a[i-1]) >= time.Duration(config.ElectionTimeoutMin)*time.Millisecond {
+			t.Fatalf("Heartbeats should stay within election timeout: %v", a[i].Sub(a[i-1]))
+		}
+	}
+	if spread < 5*time.Millisecond {
+		t.Fatalf("Heartbeats to followers should spread out: %v apart at most", spread)
+	}
+}
+
+func TestReplicationBackoffOnFailures(t *testing.T) {
+	cluster := NewTestCluster(2)
+	leader, peer := cluster[0], cluster[1]
+	peer.Start()
+	defer peer.Stop()
+
+	config := DefaultConfig()
+	config.MaxRetryBackoff = 40
+	leader.config = config
+	transport := &flakyTransport{
+		InmemTransport: leader.Transport().(*InmemTransport),
+		failures:       3,
+	}
+	leader.setTransport(transport)
+	leader.setCurrentTerm(1)
+	leader.setState(Leader)
+
+	f := &follower{
+		currentTerm: 1,
+		peer:        peer.LocalAddr(),
+		nextIndex:   1,
+		replicateCh: make(chan struct{}),
+		stopCh:      make(chan bool),
+	}
+
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		leader.replicateTo(f)
+	}
+	elapsed := time.Since(start)
+
+	if len(transport.calls) != 4 {
+		t.Fatalf("Wrong number of RPC: %v", len(transport.calls))
+	}
+	if f.failures != 0 {
+		t.Fatalf("Failures should be reset after successful RPC: %v", f.failures)
+	}
+
+	// Backoff of 10ms, 20ms then 40ms, each with jitter of half
+	for i, want := range []time.Duration{10, 20, 40} {
+		want = want * time.Millisecond
+		if gap := transport.calls[i+1].Sub(transport.calls[i]); gap < want/2 {
+			t.Fatalf("Retry %d sent too early: %v (want at least %v)", i+1, gap, want/2)
+		}
+	}
+	if elapsed > 3*40*time.Millisecond+testElectionTimeout {
+		t.Fatalf("Retry backoff is not bounded: %v", elapsed)
+	}
+}
+
+func TestReplicationBacktrackConflictTerm(t *testing.T) {
+	cluster := NewTestCluster(2)
+	leader, peer := cluster[0], cluster[1]
+
+	// Both agree on 10 logs of term 1, then follower has 10 logs of each
+	// term 2 to 5 which leader of term 6 never had
+	var leaderLogs, peerLogs []*Log
+	for i := uint64(1); i <= 10; i++ {
+		leaderLogs = append(leaderLogs, &Log{Index: i, Term: 1})
+		peerLogs = append(peerLogs, &Log{Index: i, Term: 1})
+	}
+	for i := uint64(11); i <= 100; i++ {
+		leaderLogs = append(leaderLogs, &Log{Index: i, Term: 6})
+	}
+	for i := uint64(11); i <= 50; i++ {
+		peerLogs = append(peerLogs, &Log{Index: i, Term: 2 + (i-11)/10})
+	}
+	_ = leader.logStore.SetLogs(leaderLogs)
+	leader.setLastLogInfo(100, 6)
+	_ = peer.logStore.SetLogs(peerLogs)
+	peer.setLastLogInfo(50, 5)
+	peer.setCurrentTerm(5)
+
+	peer.Start()
+	defer peer.Stop()
+
+	transport := &flakyTransport{InmemTransport: leader.Transport().(*InmemTransport)}
+	leader.setTransport(transport)
+	leader.setCurrentTerm(6)
+	leader.setState(Leader)
+
+	f := &follower{
+		currentTerm: 6,
+		peer:        peer.LocalAddr(),
+		nextIndex:   101,
+		replicateCh: make(chan struct{}),
+		stopCh:      make(chan bool),
+	}
+	leader.replicateTo(f)
+
+	// Missing logs, then one round per conflicting term, then success
+	if len(transport.calls) > 7 {
+		t.Fatalf("Backtracking should skip conflicting terms: %v rounds", len(transport.calls))
+	}
+	if match, next := f.progress(); match != 100 || next != 101 {
+		t.Fatalf("Wrong progress: match %v next %v", match, next)
+	}
+	if index, term := peer.LastLogInfo(); index != 100 || term != 6 {
+		t.Fatalf("Follower log should match leader: %v %v", index, term)
+	}
+	if log, err := peer.logStore.GetLog(11); err != nil || log.Term != 6 {
+		t.Fatalf("Conflicting log should be replaced: %+v %v", log, err)
+	}
+}
+
+// batchTransport records number of entries of every AppendEntries RPC
+type batchTransport struct {
+	*InmemTransport
+	sync.Mutex
+	batches []int
+}
+
+func (b *batchTransport) AppendEntries(ctx context.Context, target string, req *AppendEntryRequest, resp *AppendEntryResponse) error {
+	b.Lock()
+	b.batches = append(b.batches, len(req.Entries))
+	b.Unlock()
+	return b.InmemTransport.AppendEntries(ctx, target, req, resp)
+}
+
+func TestReplicationMaxAppendEntries(t *testing.T) {
+	cluster := NewTestCluster(2)
+	leader, peer := cluster[0], cluster[1]
+
+	var logs []*Log
+	for i := uint64(1); i <= 10000; i++ {
+		logs = append(logs, &Log{Index: i, Term: 1})
+	}
+	_ = leader.logStore.SetLogs(logs)
+	leader.setLastLogInfo(10000, 1)
+
+	peer.Start()
+	defer peer.Stop()
+
+	config := DefaultConfig()
+	config.MaxAppendEntries = 500
+	leader.config = config
+	transport := &batchTransport{InmemTransport: leader.Transport().(*InmemTransport)}
+	leader.setTransport(transport)
+	leader.setCurrentTerm(1)
+	leader.setState(Leader)
+
+	f := &follower{
+		currentTerm: 1,
+		peer:        peer.LocalAddr(),
+		nextIndex:   1,
+		replicateCh: make(chan struct{}),
+		stopCh:      make(chan bool),
+	}
+	leader.replicateTo(f)
+
+	if len(transport.batches) != 20 {
+		t.Fatalf("Follower should catch up in 20 RPCs: %v", len(transport.batches))
+	}
+	for _, n := range transport.batches {
+		if n != 500 {
+			t.Fatalf("Wrong batch size: %v", n)
+		}
+	}
+	if match, next := f.progress(); match != 10000 || next != 10001 {
+		t.Fatalf("Wrong progress: match %v next %v", match, next)
+	}
+	if index, term := peer.LastLogInfo(); index != 10000 || term != 1 {
+		t.Fatalf("Follower log should match leader: %v %v", index, term)
+	}
+}
+
+// ackTransport caps last index reported by successful AppendEntries, as
+// if follower only acknowledged part of the entries sent
+type ackTransport struct {
+	*InmemTransport
+	sync.Mutex
+	limit uint64
+}
+
+func (a *ackTransport) setLimit(limit uint64) {
+	a.Lock()
+	defer a.Unlock()
+	a.limit = limit
+}
+
+func (a *ackTransport) AppendEntries(ctx context.Context, target string, req *AppendEntryRequest, resp *AppendEntryResponse) error {
+	if err := a.InmemTransport.AppendEntries(ctx, target, req, resp); err != nil {
+		return err
+	}
+	a.Lock()
+	defer a.Unlock()
+	if resp.Success && a.limit > 0 {
+		resp.LastLogIndex = min(resp.LastLogIndex, a.limit)
+	}
+	return nil
+}
+
+func TestReplicationPartialAcknowledgement(t *testing.T) {
+	cluster := NewTestCluster(2)
+	leader, peer := cluster[0], cluster[1]
+
+	var logs []*Log
+	for i := uint64(1); i <= 100; i++ {
+		logs = append(logs, &Log{Index: i, Term: 1})
+	}
+	_ = leader.logStore.SetLogs(logs)
+	leader.setLastLogInfo(100, 1)
+
+	peer.Start()
+	defer peer.Stop()
+
+	transport := &ackTransport{InmemTransport: leader.Transport().(*InmemTransport), limit: 40}
+	leader.setTransport(transport)
+	leader.setCurrentTerm(1)
+	leader.setState(Leader)
+
+	f := &follower{
+		currentTerm: 1,
+		peer:        peer.LocalAddr(),
+		nextIndex:   1,
+		replicateCh: make(chan struct{}),
+		stopCh:      make(chan bool),
+	}
+
+	// Only acknowledged logs match, the rest is sent again
+	leader.replicateTo(f)
+	if match, next := f.progress(); match != 40 || next != 41 {
+		t.Fatalf("Wrong progress after partial acknowledgement: match %v next %v", match, next)
+	}
+	select {
+	case <-leader.commitCh:
+	default:
+		t.Fatalf("Advanced match index should notify leader")
+	}
+
+	transport.setLimit(0)
+	leader.replicateTo(f)
+	if match, next := f.progress(); match != 100 || next != 101 {
+		t.Fatalf("Wrong progress: match %v next %v", match, next)
+	}
+}
+
+func TestReplicationStepDownOnNewerTerm(t *testing.T) {
+	cluster := NewTestCluster(2)
+	leader, peer := cluster[0], cluster[1]
+	peer.setCurrentTerm(5)
+	peer.Start()
+	defer peer.Stop()
+
+	leader.setCurrentTerm(1)
+	leader.becomeLeader()
+	f := &follower{
+		peer:        peer.LocalAddr(),
+		currentTerm: 1,
+		nextIndex:   1,
+		replicateCh: make(chan struct{}),
+		stopCh:      make(chan bool),
+	}
+
+	// Leader of the old term forgets it leads and wakes its run loop
+	leader.replicateTo(f)
+	if leader.State() != Follower || leader.Leader() != "" || leader.CurrentTerm() != 5 {
+		t.Fatalf("Leader should step down: %v leader %q term %v", leader.State(), leader.Leader(), leader.CurrentTerm())
+	}
+	select {
+	case <-leader.commitCh:
+	default:
+		t.Fatalf("Step down should wake run loop")
+	}
+}
+
+func TestDeposedLeaderStopsReplicating(t *testing.T) {
+	cluster := NewTestCluster(2)
+	leader, peer := cluster[0], cluster[1]
+	peer.Start()
+	defer peer.Stop()
+
+	file, err := ioutil.TempFile(t.TempDir(), "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	leader.setCurrentTerm(1)
+	leader.becomeLeader()
+	f := &follower{
+		peer:        peer.LocalAddr(),
+		currentTerm: 1,
+		nextIndex:   1,
+		replicateCh: make(chan struct{}),
+		stopCh:      make(chan bool),
+	}
+
+	// Newer term is seen before run loop leaves leader state, then leader
+	// steps down, neither may send at the term it never won
+	leader.setCurrentTerm(7)
+	leader.replicateTo(f)
+	if leader.sendSnapshotFile(f, SnapshotMeta{Index: 1, Term: 1}, file) {
+		t.Fatalf("Snapshot should not be sent once term changed")
+	}
+	leader.stepDown(7)
+	leader.replicateTo(f)
+	if leader.sendSnapshotFile(f, SnapshotMeta{Index: 1, Term: 1}, file) {
+		t.Fatalf("Snapshot should not be sent once stepped down")
+	}
+	if peer.CurrentTerm() != 0 || peer.Leader() != "" {
+		t.Fatalf("Peer should hear nothing from deposed leader: term %d leader %q", peer.CurrentTerm(), peer.Leader())
+	}
+}
+
+func TestServerAppendEntriesSetLogsFailure(t *testing.T) {
+	s := NewTestServer()
+	ls := NewFaultyLogStore(NewInmemLogStore())
+	ls.FailOn(OpSetLogs, 2)
+	s.logStore = ls
+	s.Start()
+	defer s.Stop()
+
+	send := func(req *AppendEntryRequest) AppendEntryResponse {
+		var resp AppendEntryResponse
+		if err := s.Transport().AppendEntries(context.Background(), s.LocalAddr(), req, &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	if resp := send(newAppendEntriesRequest(1, 0, 0, []*Log{{Index: 1, Term: 1}}, "leader", 1)); !resp.Success {
+		t.Fatalf("AppendEntries failed: %+v", resp)
+	}
+	if err := s.WaitApplied(1, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// Logs can't be stored, server must not claim or commit them
+	entries := []*Log{{Index: 2, Term: 1}, {Index: 3, Term: 1}}
+	resp := send(newAppendEntriesRequest(1, 1, 1, entries, "leader", 3))
+	if resp.Success || resp.LastLogIndex != 1 {
+		t.Fatalf("Failed append should be rejected: %+v", resp)
+	}
+	if index, term := s.LastLogInfo(); index != 1 || term != 1 {
+		t.Fatalf("Invalid last log [index %v term %v]", index, term)
+	}
+	if s.CommitIndex() != 1 || s.LastApplied() != 1 {
+		t.Fatalf("Logs not stored should not be committed: commit %v applied %v", s.CommitIndex(), s.LastApplied())
+	}
+
+	// Leader retries and storage recovered
+	if resp := send(newAppendEntriesRequest(1, 1, 1, entries, "leader", 3)); !resp.Success || resp.LastLogIndex != 3 {
+		t.Fatalf("Retried AppendEntries should succeed: %+v", resp)
+	}
+	_ = s.WaitApplied(3, time.Second)
+	if s.CommitIndex() != 3 || s.LastApplied() != 3 {
+		t.Fatalf("Wrong commit after retry: commit %v applied %v", s.CommitIndex(), s.LastApplied())
+	}
+}
+
+func TestServerAppendEntriesConflictTerm(t *testing.T) {
+	s := NewTestServer()
+	_ = s.logStore.SetLogs([]*Log{{Index: 1, Term: 1}, {Index: 2, Term: 2}, {Index: 3, Term: 2}, {Index: 4, Term: 2}})
+	s.setLastLogInfo(4, 2)
+	s.Start()
+	defer s.Stop()
+
+	var resp AppendEntryResponse
+	req := newAppendEntriesRequest(3, 4, 3, nil, "leader", 0)
+	_ = s.Transport().AppendEntries(context.Background(), s.LocalAddr(), req, &resp)
+	if resp.Success || resp.ConflictTerm != 2 || resp.ConflictIndex != 2 {
+		t.Fatalf("Wrong conflict: %+v", resp)
+	}
+
+	req = newAppendEntriesRequest(3, 9, 3, nil, "leader", 0)
+	_ = s.Transport().AppendEntries(context.Background(), s.LocalAddr(), req, &resp)
+	if resp.Success || resp.ConflictTerm != 0 || resp.ConflictIndex != 5 {
+		t.Fatalf("Wrong conflict for missing log: %+v", resp)
+	}
+}
+
+func TestServerAppendEntriesDelayed(t *testing.T) {
+	s := NewTestServer()
+	s.Start()
+	defer s.Stop()
+
+	entries := []*Log{{Index: 1, Term: 1}, {Index: 2, Term: 1}, {Index: 3, Term: 1}}
+	var resp AppendEntryResponse
+	req := newAppendEntriesRequest(1, 0, 0, entries, "leader", 0)
+	if err := s.Transport().AppendEntries(context.Background(), s.LocalAddr(), req, &resp); err != nil || !resp.Success {
+		t.Fatalf("AppendEntries failed: %+v %v", resp, err)
+	}
+
+	// Earlier request arriving late must not drop logs appended after it,
+	// nor commit logs it doesn't carry
+	req = newAppendEntriesRequest(1, 0, 0, entries[:1], "leader", 3)
+	if err := s.Transport().AppendEntries(context.Background(), s.LocalAddr(), req, &resp); err != nil || !resp.Success {
+		t.Fatalf("AppendEntries failed: %+v %v", resp, err)
+	}
+	if s.LastLogIndex() != 3 || s.CommitIndex() != 1 {
+		t.Fatalf("Delayed AppendEntries should not truncate: last %d commit %d", s.LastLogIndex(), s.CommitIndex())
+	}
+
+	// Conflicting entry still replaces the rest of log
+	req = newAppendEntriesRequest(2, 1, 1, []*Log{{Index: 2, Term: 2}}, "leader", 1)
+	if err := s.Transport().AppendEntries(context.Background(), s.LocalAddr(), req, &resp); err != nil || !resp.Success {
+		t.Fatalf("AppendEntries failed: %+v %v", resp, err)
+	}
+	if index, term := s.LastLogInfo(); index != 2 || term != 2 {
+		t.Fatalf("Conflicting logs should be replaced: last %d term %d", index, term)
+	}
+}
+
+// countGoroutines return number of goroutines running function fn
+func countGoroutines(fn string) int {
+	buf := make([]byte, 1<<20)
+	n := runtime.Stack(buf, true)
+	return strings.Count(string(buf[:n]), fn)
+}
+
+func sendRPC(t *testing.T, s *Server, req interface{}) interface{} {
+	respCh := make(chan RPCResponse, 1)
+	s.transport.(*InmemTransport).consumerCh <- RPC{Request: req, RespCh: respCh}
+	select {
+	case resp := <-respCh:
+		return resp.Response
+	case <-time.After(time.Second):
+		t.Fatalf("No response for %T", req)
+		return nil
+	}
+}
+
+func TestCandidateAbortVoteRequestsOnStepDown(t *testing.T) {
+	network, cluster := NewTestNetworkCluster(3)
+	s := cluster[0]
+	network.Isolate(s.LocalAddr())
+
+	// Server never times out by itself during the test
+	config := DefaultConfig()
+	config.ElectionTimeoutMin = 5000
+	config.ElectionTimeoutMax = 6000
+	s.config = config
+	s.Start()
+	defer s.Stop()
+
+	// Start election, vote requests to unreachable peers keep retrying
+	sendRPC(t, s, &TimeoutNowRequest{Term: 0, Leader: "test"})
+	time.Sleep(200 * time.Millisecond)
+	if s.State() != Candidate {
+		t.Fatalf("Server should be candidate: %v", s.State())
+	}
+	if n := countGoroutines("raft.(*Server).requestVote("); n != 2 {
+		t.Fatalf("Wrong number of vote requests: %v", n)
+	}
+
+	// Newer term discovered mid election
+	term := s.CurrentTerm()
+	resp := sendRPC(t, s, newVoteRequest(term+1, "other", 0, 0)).(*RequestVoteResponse)
+	if resp.Term != term+1 {
+		t.Fatalf("Wrong term: %v", resp.Term)
+	}
+
+	deadline := time.Now().Add(50 * time.Millisecond)
+	for countGoroutines("raft.(*Server).requestVote(") != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Vote requests should stop once election is aborted")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if s.State() != Follower {
+		t.Fatalf("Server should step down: %v", s.State())
+	}
+}
+
+func TestServerStartWithInvalidElectionTimeout(t *testing.T) {
+	s := NewTestServer()
+	s.config.ElectionTimeoutMin = 300
+	s.config.ElectionTimeoutMax = 300
+
+	if err := s.Start(); err == nil {
+		s.Stop()
+		t.Fatalf("Server should not start with empty election timeout window")
+	}
+	if s.State() != Stopped {
+		t.Fatalf("Server should stay stopped: %v", s.State())
+	}
+}
+
+func TestServerStartWithInvalidLeaderLeaseTimeout(t *testing.T) {
+	s := NewTestServer()
+	s.config.LeaderLeaseTimeout = 0
+
+	if err := s.Start(); err == nil {
+		s.Stop()
+		t.Fatalf("Server should not start without leader lease timeout")
+	}
+}
+
+func TestStatsConverge(t *testing.T) {
+	_, cluster := NewTestNetworkCluster(3)
+	for _, s := range cluster {
+		s.Start()
+		defer s.Stop()
+	}
+	leader := waitForLeader(t, cluster)
+	var followers []*Server
+	for _, s := range cluster {
+		if s != leader {
+			followers = append(followers, s)
+		}
+	}
+
+	for i := 0; i < 10; i++ {
+		if err := leader.Do([]byte(fmt.Sprintf("k%d:v", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Followers learn commit index with next heartbeat, leader's no-op and
+	// bootstrap configuration are the first logs
+	want := ServerStats{
+		Term:         leader.CurrentTerm(),
+		State:        Follower.String(),
+		Leader:       leader.LocalAddr(),
+		CommitIndex:  12,
+		LastApplied:  12,
+		LastLogIndex: 12,
+		LastLogTerm:  leader.CurrentTerm(),
+		Peers:        2,
+		Replication:  []PeerProgress{},
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		a, b := followers[0].Stats(), followers[1].Stats()
+		if reflect.DeepEqual(a, want) && reflect.DeepEqual(b, want) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Replicas should converge:\n%+v\n%+v\nwant %+v", a, b, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stats := leader.Stats()
+	if stats.State != Leader.String() || stats.CommitIndex != 12 || len(stats.Replication) != 2 {
+		t.Fatalf("Wrong leader stats: %+v", stats)
+	}
+}
+
+func TestServerStartWithInvalidMaxHeartbeatInterval(t *testing.T) {
+	s := NewTestServer()
+	s.config.MaxHeartbeatInterval = s.config.ElectionTimeoutMin
+
+	if err := s.Start(); err == nil {
+		s.Stop()
+		t.Fatalf("Server should not start if heartbeats can miss election timeout")
+	}
+}
+
+func TestLeaderStepDownWhenPartitioned(t *testing.T) {
+	network, cluster := NewTestNetworkCluster(3)
+	for _, s := range cluster {
+		s.Start()
+		defer s.Stop()
+	}
+
+	leader := waitForLeader(t, cluster)
+
+	// Isolate leader from the rest of cluster
+	network.Isolate(leader.LocalAddr())
+
+	deadline := time.Now().Add(4 * time.Duration(leader.config.LeaderLeaseTimeout) * time.Millisecond)
+	for leader.State() == Leader {
+		if time.Now().After(deadline) {
+			t.Fatalf("Partitioned leader should step down")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if leader.Leader() != "" {
+		t.Fatalf("Partitioned leader should forget leader: %v", leader.Leader())
+	}
+
+	// Majority side elects a new leader
+	var rest []*Server
+	for _, s := range cluster {
+		if s != leader {
+			rest = append(rest, s)
+		}
+	}
+	waitForLeader(t, rest)
+}
+
+func TestServerAppendEntriesRejectedLastLogIndex(t *testing.T) {
+	s := NewTestServer()
+	// Appending logs fails, DeleteRange still works
+	ls := NewFaultyLogStore(NewInmemLogStore())
+	ls.FailOn(OpSetLogs, 2)
+	s.logStore = ls
+	if err := ls.SetLogs([]*Log{{Index: 1, Term: 1}, {Index: 2, Term: 1}, {Index: 3, Term: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	s.setLastLogInfo(3, 1)
+	s.setCurrentTerm(1)
+
+	s.Start()
+	defer s.Stop()
+
+	send := func(req *AppendEntryRequest) AppendEntryResponse {
+		var resp AppendEntryResponse
+		if err := s.Transport().AppendEntries(context.Background(), s.LocalAddr(), req, &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// Leader of newer term is ahead of follower
+	resp := send(newAppendEntriesRequest(2, 5, 2, nil, "leader", 0))
+	if resp.Success || resp.Term != 2 || resp.LastLogIndex != 3 {
+		t.Fatalf("Wrong response for missing previous log: %+v", resp)
+	}
+
+	// Previous log term mismatch
+	resp = send(newAppendEntriesRequest(2, 3, 2, nil, "leader", 0))
+	if resp.Success || resp.LastLogIndex != 3 {
+		t.Fatalf("Wrong response for mismatched previous log: %+v", resp)
+	}
+
+	// Conflicting logs are truncated but new ones can't be stored
+	resp = send(newAppendEntriesRequest(2, 1, 1, []*Log{{Index: 2, Term: 2}}, "leader", 0))
+	if resp.Success || resp.LastLogIndex != 1 {
+		t.Fatalf("Rejected response should report truncated log: %+v", resp)
+	}
+	if index, term := s.LastLogInfo(); index != 1 || term != 1 {
+		t.Fatalf("Invalid last log [index %v term %v]", index, term)
+	}
+}
+
+func TestServerAppendEntriesPrevLogInSnapshot(t *testing.T) {
+	s := NewTestServer()
+
+	// Logs up to 5 are compacted into snapshot, only 6 and 7 are kept
+	e6 := &Log{Index: 6, Term: 2}
+	e7 := &Log{Index: 7, Term: 2}
+	if err := s.logStore.SetLogs([]*Log{e6, e7}); err != nil {
+		t.Fatal(err)
+	}
+	s.setLastSnapshotInfo(5, 2)
+	s.setLastLogInfo(7, 2)
+	s.setCommitIndex(5)
+	s.setLastApplied(5)
+
+	s.Start()
+	defer s.Stop()
+
+	// New leader overwrites logs right after snapshot
+	entries := []*Log{{Index: 6, Term: 3}}
+	req := newAppendEntriesRequest(3, 5, 2, entries, "leader", 5)
+	var resp AppendEntryResponse
+	if err := s.Transport().AppendEntries(context.Background(), s.LocalAddr(), req, &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.Term != 3 || !resp.Success {
+		t.Fatalf("AppendEntries after snapshot should succeed: %v/%v", resp.Term, resp.Success)
+	}
+	if index, term := s.LastLogInfo(); index != 6 || term != 3 {
+		t.Fatalf("Invalid last log [index %v term %v]", index, term)
+	}
+	if _, err := s.logStore.GetLog(7); err == nil {
+		t.Fatalf("Conflicting log should be deleted")
+	}
+
+	// Mismatched term of snapshot is still rejected
+	req = newAppendEntriesRequest(3, 5, 1, entries, "leader", 5)
+	_ = s.Transport().AppendEntries(context.Background(), s.LocalAddr(), req, &resp)
+	if resp.Success {
+		t.Fatalf("AppendEntries with wrong previous term should be rejected")
+	}
+}
+
+func TestReplicationToHungPeerTimeout(t *testing.T) {
+	leader := NewTestServer()
+	leader.config.RPCTimeout = 50
+	leader.config.MaxRetryBackoff = 10
+	leader.setCurrentTerm(1)
+	leader.setState(Leader)
+
+	// Peer never consumes its RPC
+	hung := NewInmemTransport("")
+	transport := leader.Transport().(*InmemTransport)
+	transport.timeout = time.Hour
+	transport.AddPeer(hung)
+
+	f := &follower{
+		currentTerm: 1,
+		peer:        hung.LocalAddr(),
+		nextIndex:   1,
+		replicateCh: make(chan struct{}),
+		stopCh:      make(chan bool),
+	}
+
+	start := time.Now()
+	leader.replicateTo(f)
+	if elapsed := time.Since(start); elapsed > 4*50*time.Millisecond {
+		t.Fatalf("Replication to hung peer should time out: %v", elapsed)
+	}
+	if f.failures != 1 {
+		t.Fatalf("Timeout should be counted as failed RPC: %v", f.failures)
+	}
+
+	ctx, cancel := leader.rpcContext()
+	defer cancel()
+	var resp RequestVoteResponse
+	err := transport.RequestVote(ctx, hung.LocalAddr(), newVoteRequest(1, leader.LocalAddr(), 0, 0), &resp)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("RequestVote to hung peer should exceed deadline: %v", err)
+	}
+}
+
+func TestLearnerNotCountedInQuorum(t *testing.T) {
+	network, cluster := NewTestNetworkCluster(2)
+	for _, server := range cluster {
+		server.Start()
+	}
+	defer func() {
+		for _, server := range cluster {
+			server.Stop()
+		}
+	}()
+	leader := waitForLeader(t, cluster)
+	// Bootstrap configuration is applied before learner is added
+	if err := leader.WaitApplied(2, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// Learner joins running cluster
+	transport := network.NewTransport("")
+	learner := mustNewServer(DefaultConfig(), transport, NewInmemLogStore(), NewInMemStateMachine())
+	learner.Start()
+	defer learner.Stop()
+	for i := 0; i < 2; i++ {
+		if err := leader.AddLearner(learner.LocalAddr(), time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if leader.QuorumSize() != 2 || len(leader.Learners()) != 1 {
+		t.Fatalf("Learner should not count in quorum: %v", leader.QuorumSize())
+	}
+	if len(leader.Progress()) != 2 {
+		t.Fatalf("Learner added twice should be replicated to once: %v", leader.Progress())
+	}
+
+	if err := leader.Do([]byte("a:b")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(testElectionTimeout)
+	// Leader's no-op, bootstrap and learner configurations then the command
+	if learner.LastLogIndex() != 4 || learner.CommitIndex() != 4 {
+		t.Fatalf("Learner should receive logs: last %v commit %v", learner.LastLogIndex(), learner.CommitIndex())
+	}
+
+	// Without the other voter, learner's copy is not enough to commit
+	var voter *Server
+	for _, server := range cluster {
+		if server != leader {
+			voter = server
+		}
+	}
+	network.Disconnect(leader.LocalAddr(), voter.LocalAddr())
+	done := make(chan error, 1)
+	go func() {
+		done <- leader.Do([]byte("a:c"))
+	}()
+	// Partition stays shorter than leader's lease, it would step down
+	deadline := time.Now().Add(testElectionTimeout / 2)
+	for learner.LastLogIndex() != 5 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Learner should receive logs: %v", learner.LastLogIndex())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if leader.CommitIndex() != 4 {
+		t.Fatalf("Log should not be committed by learner: %v", leader.CommitIndex())
+	}
+	network.Reconnect(leader.LocalAddr(), voter.LocalAddr())
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := leader.PromotePeer(learner.LocalAddr(), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if leader.QuorumSize() != 2 || len(leader.Peers()) != 2 || len(leader.Learners()) != 0 {
+		t.Fatalf("Promoted learner should be a voter: peers %v learners %v", leader.Peers(), leader.Learners())
+	}
+	if err := leader.PromotePeer(learner.LocalAddr(), time.Second); err == nil {
+		t.Fatalf("Voter should not be promoted again")
+	}
+	if err := learner.WaitApplied(leader.LastLogIndex(), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if len(learner.Peers()) != 2 {
+		t.Fatalf("Promotion should be replicated to the learner: %v", learner.Peers())
+	}
+}
+
+// recordStateMachine count how many times logs are applied to it
+type recordStateMachine struct {
+	*InmemStateMachine
+	sync.Mutex
+	sets    int
+	batches []int
+}
+
+func (sm *recordStateMachine) Set(data interface{}) error {
+	sm.Lock()
+	sm.sets++
+	sm.Unlock()
+	return sm.InmemStateMachine.Set(data)
+}
+
+func (sm *recordStateMachine) SetBatch(data []interface{}) []error {
+	sm.Lock()
+	sm.batches = append(sm.batches, len(data))
+	sm.Unlock()
+	return sm.InmemStateMachine.SetBatch(data)
+}
+
+// perEntryStateMachine hides SetBatch so logs are applied one by one
+type perEntryStateMachine struct {
+	sm *InmemStateMachine
+}
+
+func (p *perEntryStateMachine) Set(data interface{}) error       { return p.sm.Set(data) }
+func (p *perEntryStateMachine) Get(data interface{}) interface{} { return p.sm.Get(data) }
+
+func newApplyTestServer(sm StateMachine, total int) *Server {
+	s := mustNewServer(DefaultConfig(), NewInmemTransport(""), NewInmemLogStore(), sm)
+	logs := make([]*Log, total)
+	for i := range logs {
+		logs[i] = &Log{Index: uint64(i + 1), Term: 1, Command: []byte(fmt.Sprintf("k%d:%d", i%100, i))}
+	}
+	_ = s.logStore.SetLogs(logs)
+	s.setLastLogInfo(uint64(total), 1)
+	return s
+}
+
+func TestApplyLogsGrouped(t *testing.T) {
+	sm := &recordStateMachine{InmemStateMachine: NewInMemStateMachine()}
+	s := newApplyTestServer(sm, 10)
+
+	e := &Log{Index: 10, Term: 1, Command: []byte("k9:9"), errCh: make(chan error, 1)}
+	s.applying = map[uint64]*Log{10: e}
+
+	s.commitLog(10)
+	s.applyLogs()
+
+	if s.LastApplied() != 10 {
+		t.Fatalf("Wrong last applied: %v", s.LastApplied())
+	}
+	if sm.sets != 0 || len(sm.batches) != 1 || sm.batches[0] != 10 {
+		t.Fatalf("Committed logs should be applied in one batch: sets %v batches %v", sm.sets, sm.batches)
+	}
+	if err := <-e.errCh; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func benchmarkApplyLogs(b *testing.B, sm StateMachine) {
+	total := 100000
+	s := mustNewServer(DefaultConfig(), NewInmemTransport(""), NewInmemLogStore(), sm)
+	logs := make([]*Log, total)
+	for i := range logs {
+		logs[i] = &Log{Index: uint64(i + 1), Term: 1, Command: []byte(fmt.Sprintf("k%d:%d", i%100, i))}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// Logs are read from applying map so only apply is measured
+		b.StopTimer()
+		s.applying = make(map[uint64]*Log, total)
+		for _, log := range logs {
+			s.applying[log.Index] = log
+		}
+		s.setLastApplied(0)
+		s.setCommitIndex(uint64(total))
+		b.StartTimer()
+
+		s.applyLogs()
+	}
+}
+
+func BenchmarkApplyLogsPerEntry(b *testing.B) {
+	benchmarkApplyLogs(b, &perEntryStateMachine{sm: NewInMemStateMachine()})
+}
+
+func BenchmarkApplyLogsGrouped(b *testing.B) {
+	benchmarkApplyLogs(b, NewInMemStateMachine())
+}
+
+func TestStopDrainsInflightWrites(t *testing.T) {
+	_, cluster := NewTestNetworkCluster(3)
+	for _, s := range cluster {
+		s.Start()
+		defer s.Stop()
+	}
+	leader := waitForLeader(t, cluster)
+
+	// Every write either commits or fails with shutdown, none hangs
+	results := make(chan error, 50)
+	for i := 0; i < cap(results); i++ {
+		go func(i int) {
+			results <- leader.Do([]byte(fmt.Sprintf("k%d:v", i)))
+		}(i)
+	}
+	time.Sleep(5 * time.Millisecond)
+	leader.Stop()
+
+	timeout := time.After(2 * time.Second)
+	for i := 0; i < cap(results); i++ {
+		select {
+		case err := <-results:
+			if err != nil && err != ErrServerShutdown {
+				t.Fatalf("Unexpected write result: %v", err)
+			}
+		case <-timeout:
+			t.Fatalf("Write got no response after Stop")
+		}
+	}
+
+	if err := leader.Do([]byte("a:b")); err != ErrServerShutdown {
+		t.Fatalf("Write after Stop should be refused: %v", err)
+	}
+}
+
+func TestMaxLogEntrySize(t *testing.T) {
+	s := NewTestServer()
+	s.config.MaxLogEntrySize = 10
+	s.Start()
+	defer s.Stop()
+	waitForLeader(t, []*Server{s})
+
+	if err := s.Do([]byte("a:12345678")); err != nil {
+		t.Fatalf("Command at the limit should be applied: %v", err)
+	}
+	lastIndex := s.LastLogIndex()
+	if err := s.Do([]byte("a:123456789")); !errors.Is(err, ErrLogEntryTooLarge) {
+		t.Fatalf("Command over the limit should be refused: %v", err)
+	}
+	if s.LastLogIndex() != lastIndex {
+		t.Fatalf("Refused command should not be logged: %v", s.LastLogIndex())
+	}
+}
+
+func TestMaxInflightWrites(t *testing.T) {
+	network, cluster := NewTestNetworkCluster(3)
+	for _, s := range cluster {
+		s.config.MaxInflightWrites = 4
+		s.Start()
+		defer s.Stop()
+	}
+	leader := waitForLeader(t, cluster)
+
+	// Writes take a round trip to commit, the flood exceeds the limit
+	// meanwhile and excess writes are refused right away
+	network.SetLatency(testElectionTimeout / 10)
+	results := make(chan error, 50)
+	for i := 0; i < cap(results); i++ {
+		go func(i int) {
+			results <- leader.Do([]byte(fmt.Sprintf("k%d:v", i)))
+		}(i)
+	}
+	var committed, refused int
+	for i := 0; i < cap(results); i++ {
+		switch err := <-results; {
+		case err == nil:
+			committed++
+		case errors.Is(err, ErrQueueFull):
+			refused++
+		default:
+			t.Fatalf("Unexpected write result: %v", err)
+		}
+	}
+	if committed == 0 || refused == 0 {
+		t.Fatalf("Flood should be partly refused: committed %d refused %d", committed, refused)
+	}
+
+	// Slots are released once writes are applied
+	leader.Lock()
+	inflight := leader.inflightWrites
+	leader.Unlock()
+	if inflight != 0 {
+		t.Fatalf("Every write should be released: %d", inflight)
+	}
+	network.SetLatency(0)
+	if err := leader.Do([]byte("a:b")); err != nil {
+		t.Fatalf("Write should be accepted once queue drains: %v", err)
+	}
+}
+
+func TestStopFailsUncommittedWrites(t *testing.T) {
+	_, cluster := NewTestNetworkCluster(3)
+	for _, s := range cluster {
+		s.config.ShutdownTimeout = 50
+		s.Start()
+		defer s.Stop()
+	}
+	leader := waitForLeader(t, cluster)
+
+	// Without followers the write can't be committed
+	for _, s := range cluster {
+		if s != leader {
+			s.Stop()
+		}
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- leader.Do([]byte("a:b"))
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	start := time.Now()
+	leader.Stop()
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("Stop should wait for in-flight write: %v", elapsed)
+	}
+	if err := <-errCh; err != ErrServerShutdown {
+		t.Fatalf("Uncommitted write should fail with shutdown: %v", err)
+	}
+}
+
+func TestRestartedNodeRejoinsFromLog(t *testing.T) {
+	dir := t.TempDir()
+	cluster := NewTestCluster(3)
+	for i, s := range cluster {
+		store, err := NewFileLogStore(fmt.Sprintf("%s/%d.log", dir, i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer store.Close()
+		s.logStore = store
+		s.Start()
+		defer s.Stop()
+	}
+	leader := waitForLeader(t, cluster)
+	if err := leader.Do([]byte("a:b")); err != nil {
+		t.Fatal(err)
+	}
+
+	var stopped *Server
+	for _, s := range cluster {
+		if s != leader {
+			stopped = s
+		}
+	}
+	if err := stopped.WaitApplied(leader.CommitIndex(), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	stopped.Stop()
+	term, vote := stopped.CurrentTerm(), stopped.VotedFor()
+	stopped.logStore.(*FileLogStore).Close()
+	if err := leader.Do([]byte("a:c")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Store is opened again from its file, no peers are given
+	store, err := NewFileLogStore(stopped.logStore.(*FileLogStore).path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	restarted := mustNewServer(DefaultConfig(), stopped.Transport(), store, NewInMemStateMachine())
+	if restarted.CurrentTerm() != term || restarted.VotedFor() != vote {
+		t.Fatalf("Restarted node should resume term %d and vote %q: %d %q", term, vote, restarted.CurrentTerm(), restarted.VotedFor())
+	}
+	restarted.Start()
+	defer restarted.Stop()
+	if len(restarted.Peers()) != 2 {
+		t.Fatalf("Restarted node should recover peers from log: %v", restarted.Peers())
+	}
+
+	if err := restarted.WaitApplied(leader.CommitIndex(), 10*testElectionTimeout); err != nil {
+		t.Fatalf("Restarted node should catch up: %v", err)
+	}
+	if v := restarted.StateMachine().Get([]byte("a")); v != "c" {
+		t.Fatalf("Restarted node should apply new writes: %v", v)
+	}
+}
+
+func TestLogExtensionsReplicated(t *testing.T) {
+	cluster := NewTestCluster(3)
+	observedCh := make(chan map[string]string, 30)
+	for _, s := range cluster {
+		s.RegisterApplyObserver(func(index, term uint64, logType LogType, extensions map[string]string, err error) {
+			if logType == LogCommand {
+				observedCh <- extensions
+			}
+		})
+		s.Start()
+		defer s.Stop()
+	}
+	leader := waitForLeader(t, cluster)
+
+	extensions := map[string]string{"trace": "abc"}
+	index, _, err := leader.ApplyResult(WithExtensions(context.Background(), extensions), []byte("a:b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range cluster {
+		if err := s.WaitApplied(index, time.Second); err != nil {
+			t.Fatal(err)
+		}
+		log, err := s.logStore.GetLog(index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := log.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded Log
+		if err := decoded.Unmarshal(data); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(decoded.Extensions, extensions) {
+			t.Fatalf("Wrong extensions stored on %v: %v", s.LocalAddr(), decoded.Extensions)
+		}
+		if v := s.StateMachine().Get([]byte("a")); v != "b" {
+			t.Fatalf("Extensions should not reach state machine: %v", v)
+		}
+	}
+	for range cluster {
+		select {
+		case observed := <-observedCh:
+			if !reflect.DeepEqual(observed, extensions) {
+				t.Fatalf("Wrong extensions observed: %v", observed)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Every node should observe the log")
+		}
+	}
+}
+
+func TestRestartedNodeCaughtUp(t *testing.T) {
+	cluster := NewTestCluster(3)
+	for _, s := range cluster {
+		s.Start()
+		defer s.Stop()
+	}
+	leader := waitForLeader(t, cluster)
+
+	var stopped *Server
+	for _, s := range cluster {
+		if s != leader {
+			stopped = s
+		}
+	}
+	if err := stopped.WaitApplied(leader.CommitIndex(), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	stopped.Stop()
+	for i := 0; i < 5; i++ {
+		if err := leader.Do([]byte(fmt.Sprintf("k%d:v", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !leader.CaughtUp() {
+		t.Fatalf("Leader should be caught up once its writes are applied")
+	}
+
+	// Restarted node learns leader's commit index but can't replay logs
+	gate := &gatedStateMachine{sm: NewInMemStateMachine(), release: make(chan struct{})}
+	restarted := mustNewServer(DefaultConfig(), stopped.Transport(), stopped.logStore, gate)
+	restarted.Start()
+	defer restarted.Stop()
+	released := false
+	release := func() {
+		if !released {
+			released = true
+			close(gate.release)
+		}
+	}
+	defer release()
+
+	deadline := time.Now().Add(10 * testElectionTimeout)
+	for restarted.LastLogIndex() < leader.CommitIndex() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Restarted node should receive logs: %+v", restarted.Stats())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if restarted.CaughtUp() {
+		t.Fatalf("Lagging node should not be caught up: applied %v", restarted.LastApplied())
+	}
+
+	release()
+	if err := restarted.WaitApplied(leader.CommitIndex(), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if !restarted.CaughtUp() {
+		t.Fatalf("Node should be caught up once it applied start commit index")
+	}
+}
+
+func TestLeaderApplyingDrainedOnCommit(t *testing.T) {
+	cluster := NewTestCluster(3)
+	for _, s := range cluster {
+		s.Start()
+		defer s.Stop()
+	}
+	leader := waitForLeader(t, cluster)
+
+	var wg sync.WaitGroup
+	errCh := make(chan error, 16)
+	for w := 0; w < 16; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < 10000; i += 16 {
+				if err := leader.Do([]byte(fmt.Sprintf("k%d:v", i))); err != nil {
+					errCh <- err
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errCh)
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+
+	// Every write returned, so its log was committed and dropped
+	leader.Lock()
+	pending := len(leader.applying)
+	leader.Unlock()
+	if pending != 0 {
+		t.Fatalf("Committed logs should be removed from applying: %d left", pending)
+	}
+
+	leader.Stop()
+	leader.Lock()
+	defer leader.Unlock()
+	if leader.applying != nil {
+		t.Fatalf("Applying should be reset once leadership is lost")
+	}
+}
+
+// gatedStateMachine blocks applying commands until it's released
+type gatedStateMachine struct {
+	sm      *InmemStateMachine
+	release chan struct{}
+}
+
+func (g *gatedStateMachine) Set(data interface{}) error {
+	<-g.release
+	return g.sm.Set(data)
+}
+
+func (g *gatedStateMachine) Get(data interface{}) interface{} { return g.sm.Get(data) }
+
+func TestSlowApplyDoesNotStallReplication(t *testing.T) {
+	cluster := NewTestCluster(3)
+	for _, s := range cluster {
+		s.config.ApplyTimeout = 20
+		s.Start()
+		defer s.Stop()
+	}
+	leader := waitForLeader(t, cluster)
+	term := leader.CurrentTerm()
+
+	var follower *Server
+	for _, s := range cluster {
+		if s != leader {
+			follower = s
+		}
+	}
+	gate := &gatedStateMachine{sm: NewInMemStateMachine(), release: make(chan struct{})}
+	follower.Lock()
+	follower.stateMachine = gate
+	follower.Unlock()
+	released := false
+	release := func() {
+		if !released {
+			released = true
+			close(gate.release)
+		}
+	}
+	defer release()
+
+	for i := 0; i < 10; i++ {
+		if err := leader.Do([]byte(fmt.Sprintf("k%d:v", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Follower keeps storing and committing logs while its apply is stuck
+	deadline := time.Now().Add(time.Second)
+	for follower.CommitIndex() < leader.CommitIndex() || follower.LastLogIndex() < leader.LastLogIndex() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Replication should continue: follower %+v leader %+v", follower.Stats(), leader.Stats())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if follower.LastApplied() >= leader.CommitIndex() {
+		t.Fatalf("Gated follower should not apply every log: %v", follower.LastApplied())
+	}
+	if leader.State() != Leader || leader.CurrentTerm() != term {
+		t.Fatalf("Slow apply should not cause election: %v term %v", leader.State(), leader.CurrentTerm())
+	}
+	for follower.Stats().SlowApplies == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Slow apply should be reported: %+v", follower.Stats())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	release()
+	if err := follower.WaitApplied(leader.CommitIndex(), time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRPCsDuringElectionCycles(t *testing.T) {
+	network, cluster := NewTestNetworkCluster(3)
+	for _, s := range cluster {
+		s.Start()
+		defer s.Stop()
+	}
+	waitForLeader(t, cluster)
+
+	// Every node is hammered with RPCs which keep bumping its term or
+	// forcing an election, so it changes state while RPCs are in flight
+	attacker := network.NewTransport("")
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, s := range cluster {
+		for i := 0; i < 3; i++ {
+			wg.Add(1)
+			go func(s *Server, i int) {
+				defer wg.Done()
+				for n := 0; ; n++ {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+
+					ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+					term := s.CurrentTerm()
+					switch (n + i) % 3 {
+					case 0:
+						_ = attacker.RequestVote(ctx, s.LocalAddr(), &RequestVoteRequest{Term: term + 1, Candidate: attacker.LocalAddr()}, &RequestVoteResponse{})
+					case 1:
+						_ = attacker.TimeoutNow(ctx, s.LocalAddr(), &TimeoutNowRequest{Term: term, Leader: attacker.LocalAddr()}, &TimeoutNowResponse{})
+					case 2:
+						_ = attacker.AppendEntries(ctx, s.LocalAddr(), &AppendEntryRequest{Term: term, Leader: attacker.LocalAddr()}, &AppendEntryResponse{})
+					}
+					cancel()
+				}
+			}(s, i)
+		}
+	}
+	time.Sleep(10 * testElectionTimeout)
+	close(stop)
+	wg.Wait()
+
+	// Every node is still responsive once the load is gone, even after a
+	// response nobody waits for
+	for _, s := range cluster {
+		network.Transport(s.LocalAddr()).consumerCh <- RPC{Request: &AppendEntryRequest{}, RespCh: make(chan RPCResponse)}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		err := attacker.AppendEntries(ctx, s.LocalAddr(), &AppendEntryRequest{}, &AppendEntryResponse{})
+		cancel()
+		if err != nil {
+			t.Fatalf("Node %v stuck after election cycles: %v", s.LocalAddr(), err)
+		}
+	}
+	// Cluster may still be settling on a leader
+	deadline := time.Now().Add(20 * testElectionTimeout)
+	for {
+		err := waitForLeader(t, cluster).Do([]byte("a:b"))
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Cluster should serve writes after election cycles: %v", err)
+		}
+	}
+}
+
+func TestDisableElection(t *testing.T) {
+	network, cluster := NewTestNetworkCluster(3)
+	witness := cluster[0]
+	witness.config.DisableElection = true
+	for _, s := range cluster {
+		s.Start()
+		defer s.Stop()
+	}
+
+	var candidate int32
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if witness.State() != Follower {
+				atomic.StoreInt32(&candidate, 1)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	leader := waitForLeader(t, cluster)
+	// Remaining node can only win with witness's vote
+	network.Isolate(leader.LocalAddr())
+	var next *Server
+	deadline := time.Now().Add(20 * testElectionTimeout)
+	for next == nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("Cluster with a witness should elect a leader")
+		}
+		for _, s := range cluster {
+			if s != leader && s.State() == Leader {
+				next = s
+			}
+		}
+		time.Sleep(testElectionTimeout / 10)
+	}
+
+	if next == witness || leader == witness || atomic.LoadInt32(&candidate) == 1 {
+		t.Fatalf("Witness should never start an election")
+	}
+	if err := next.Do([]byte("a:b")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStartupGracePeriod(t *testing.T) {
+	_, cluster := NewTestNetworkCluster(3)
+	s := cluster[0]
+	s.config.StartupGracePeriod = int64(40 * testElectionTimeout / time.Millisecond)
+	s.Start()
+	defer s.Stop()
+
+	// Node started before its peers waits for them instead of electing
+	deadline := time.Now().Add(8 * testElectionTimeout)
+	for time.Now().Before(deadline) {
+		if term, state := s.CurrentTerm(), s.State(); term != 0 || state != Follower {
+			t.Fatalf("Node should stay follower in term 0 within grace period: %v in term %d", state, term)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Once quorum is up it elects normally, without waiting the grace out
+	for _, peer := range cluster[1:] {
+		peer.Start()
+		defer peer.Stop()
+	}
+	leader := waitForLeader(t, cluster)
+	if err := leader.Do([]byte("a:b")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCandidateStepsDownOnHigherTermVote(t *testing.T) {
+	network, cluster := NewTestNetworkCluster(3)
+	s := cluster[0]
+
+	// Peers aren't started, they answer every vote request with a newer
+	// term and report terms they're asked for
+	const ahead = 5
+	termCh := make(chan uint64, 100)
+	stop := make(chan struct{})
+	defer close(stop)
+	for _, peer := range cluster[1:] {
+		go func(consumer <-chan RPC) {
+			for {
+				select {
+				case rpc := <-consumer:
+					if req, ok := rpc.Request.(*RequestVoteRequest); ok {
+						termCh <- req.Term
+						rpc.Response(&RequestVoteResponse{Term: req.Term + ahead}, nil)
+					}
+				case <-stop:
+					return
+				}
+			}
+		}(network.Transport(peer.LocalAddr()).Consumer())
+	}
+
+	s.Start()
+	defer s.Stop()
+
+	first := <-termCh
+	deadline := time.Now().Add(testElectionTimeout / 2)
+	for s.CurrentTerm() != first+ahead {
+		if time.Now().After(deadline) {
+			t.Fatalf("Candidate should move to newer term %d: %d", first+ahead, s.CurrentTerm())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if state, voted := s.State(), s.VotedFor(); state != Follower || voted != "" {
+		t.Fatalf("Candidate should step down without a vote in new term: %v %q", state, voted)
+	}
+
+	// No other round is started in the term the election was lost in, the
+	// next election is after the newer term
+	timeout := time.After(3 * testElectionTimeout)
+	for {
+		select {
+		case term := <-termCh:
+			if term == first {
+				continue
+			}
+			if term != first+ahead+1 {
+				t.Fatalf("Next election should be in term %d: %d", first+ahead+1, term)
+			}
+			return
+		case <-timeout:
+			t.Fatalf("Follower should start next election once it times out")
+		}
+	}
+}
+
+// BenchmarkCommitWakeups writes from many clients at once, logs committed
+// in quick succession should be applied in shared wakeups
+func BenchmarkCommitWakeups(b *testing.B) {
+	cluster := NewTestCluster(3)
+	for _, s := range cluster {
+		s.config.Logger = log.New(ioutil.Discard, "", 0)
+		s.Start()
+		defer s.Stop()
+	}
+	var leader *Server
+	for leader == nil {
+		for _, s := range cluster {
+			if s.State() == Leader {
+				leader = s
+			}
+		}
+		time.Sleep(testElectionTimeout / 10)
+	}
+
+	leader.Lock()
+	start := leader.applyWakeups
+	leader.Unlock()
+	b.ResetTimer()
+	b.SetParallelism(16)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if err := leader.Do([]byte("a:b")); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+	b.StopTimer()
+
+	leader.Lock()
+	wakeups := leader.applyWakeups - start
+	leader.Unlock()
+	b.ReportMetric(float64(wakeups)/float64(b.N), "wakeups/op")
+}
+
+func TestMockClockElection(t *testing.T) {
+	cluster := NewTestCluster(3)
+	clocks := make([]*MockClock, len(cluster))
+	for i, s := range cluster {
+		clocks[i] = NewMockClock()
+		s.config.Clock = clocks[i]
+		s.Start()
+		defer s.Stop()
+	}
+	for _, clock := range clocks {
+		clock.BlockUntil(1)
+	}
+
+	// No time passes for followers, only the first one can time out
+	for _, s := range cluster {
+		if s.State() != Follower {
+			t.Fatalf("Server should wait for election timeout: %v", s.State())
+		}
+	}
+	clocks[0].Advance(time.Duration(cluster[0].config.ElectionTimeoutMax) * time.Millisecond)
+
+	if leader := waitForLeader(t, cluster); leader != cluster[0] || leader.CurrentTerm() != 1 {
+		t.Fatalf("First server should win term 1: %v term %d", leader.LocalAddr(), leader.CurrentTerm())
+	}
+	// Lease and heartbeat timers of both followers, the first heartbeat is
+	// due before lease is checked
+	clocks[0].BlockUntil(3)
+	clocks[0].Advance(time.Duration(cluster[0].config.HeartbeatInterval) * time.Millisecond)
+	for _, s := range cluster[1:] {
+		deadline := time.Now().Add(testElectionTimeout)
+		for s.Leader() != cluster[0].LocalAddr() {
+			if time.Now().After(deadline) {
+				t.Fatalf("Server should follow first server: %v term %d", s.State(), s.CurrentTerm())
+			}
+			time.Sleep(time.Millisecond)
+		}
+		if s.State() != Follower || s.CurrentTerm() != 1 {
+			t.Fatalf("Server should follow term 1: %v term %d", s.State(), s.CurrentTerm())
+		}
+	}
+}
+
+func TestFlexibleWriteQuorum(t *testing.T) {
+	network, cluster := NewTestNetworkCluster(5)
+	for _, s := range cluster {
+		s.config.WriteQuorum, s.config.ReadQuorum = 2, 4
+		s.Start()
+		defer s.Stop()
+	}
+	leader := waitForLeader(t, cluster)
+	if err := leader.Reconfigure(leader.configuration().Members[:3], time.Second); err == nil {
+		t.Fatalf("Quorums which don't intersect should be rejected")
+	}
+
+	// Leader and one follower are a write quorum, majority is not reachable
+	var reachable *Server
+	for _, s := range cluster {
+		if s == leader {
+			continue
+		}
+		if reachable == nil {
+			reachable = s
+			continue
+		}
+		network.Isolate(s.LocalAddr())
+	}
+	index := leader.LastLogIndex()
+	if err := leader.Do([]byte("a:b")); err != nil {
+		t.Fatalf("Write should commit on write quorum: %v", err)
+	}
+	if leader.CommitIndex() <= index {
+		t.Fatalf("Commit index should advance past %d: %d", index, leader.CommitIndex())
+	}
+	if err := reachable.WaitApplied(leader.CommitIndex(), time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestConcurrentStateAccess is meant for -race, accessors are read from
+// many goroutines while the run loop handles RPCs and elections
+func TestConcurrentStateAccess(t *testing.T) {
+	_, cluster := NewTestNetworkCluster(3)
+	for _, s := range cluster {
+		s.Start()
+		defer s.Stop()
+	}
+	waitForLeader(t, cluster)
+
+	stop := make(chan struct{})
+	errCh := make(chan error, len(cluster))
+	var wg sync.WaitGroup
+	for _, s := range cluster {
+		wg.Add(1)
+		go func(s *Server) {
+			defer wg.Done()
+			var term uint64
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				stats := s.Stats()
+				if stats.Term < term {
+					errCh <- fmt.Errorf("term of %v went back from %d to %d", s.LocalAddr(), term, stats.Term)
+					return
+				}
+				term = stats.Term
+				if stats.State == Leader.String() && stats.Leader != s.LocalAddr() {
+					errCh <- fmt.Errorf("leader %v reports leader %q", s.LocalAddr(), stats.Leader)
+					return
+				}
+				s.State()
+				s.CurrentTerm()
+				s.VotedFor()
+				s.Leader()
+				s.CommitIndex()
+				s.LastApplied()
+				s.LastLogInfo()
+				s.Progress()
+			}
+		}(s)
+	}
+
+	// Writes keep followers appending while step downs keep forcing
+	// elections
+	deadline := time.Now().Add(10 * testElectionTimeout)
+	for i := 0; time.Now().Before(deadline); i++ {
+		for _, s := range cluster {
+			if s.State() != Leader {
+				continue
+			}
+			_ = s.Do([]byte(fmt.Sprintf("k%d:v", i)))
+			if i%10 == 0 {
+				_ = s.StepDown()
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(stop)
+	wg.Wait()
+
+	select {
+	case err := <-errCh:
+		t.Fatal(err)
+	default:
+	}
+	waitForLeader(t, cluster)
+}
+
+func TestElectionPriority(t *testing.T) {
+	// Preferred node is started last so start order doesn't favor it
+	cluster := NewTestCluster(3)
+	clock := NewMockClock()
+	for i, s := range cluster {
+		s.config.Clock = clock
+		s.config.ElectionPriority, s.config.MaxElectionPriority = i, len(cluster)-1
+		s.Start()
+		defer s.Stop()
+	}
+	clock.BlockUntil(len(cluster))
+
+	// Only the window of the highest priority has passed
+	clock.Advance(time.Duration(cluster[0].config.ElectionTimeoutMax-1) * time.Millisecond)
+	if leader := waitForLeader(t, cluster); leader != cluster[2] {
+		t.Fatalf("Highest priority node should win: %v", leader.LocalAddr())
+	}
+}
+
+func TestElectionPriorityBehindNode(t *testing.T) {
+	network, cluster := NewTestNetworkCluster(3)
+	clock := NewMockClock()
+	for i, s := range cluster {
+		s.config.Clock = clock
+		s.config.ElectionPriority, s.config.MaxElectionPriority = i, len(cluster)-1
+		s.Start()
+		defer s.Stop()
+	}
+	clock.BlockUntil(len(cluster))
+
+	// Highest priority node misses the writes of the next one
+	behind := cluster[2]
+	network.Isolate(behind.LocalAddr())
+	window := cluster[0].config.ElectionTimeoutMax - cluster[0].config.ElectionTimeoutMin
+	clock.Advance(time.Duration(cluster[0].config.ElectionTimeoutMax+window-1) * time.Millisecond)
+	leader := waitForLeader(t, cluster)
+	if leader != cluster[1] {
+		t.Fatalf("Second priority node should win: %v", leader.LocalAddr())
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := leader.Apply([]byte(fmt.Sprintf("k%d:v%d", i, i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	leader.Stop()
+	network.Reconnect(behind.LocalAddr(), cluster[0].LocalAddr())
+	if behind.State() != Candidate {
+		t.Fatalf("Behind node should keep starting elections: %v", behind.State())
+	}
+
+	// Behind node times out first every time but it's refused, the lowest
+	// priority node must still time out and win
+	for step := int64(0); cluster[0].State() != Leader; step++ {
+		if behind.State() == Leader {
+			t.Fatalf("Behind node should not win")
+		}
+		if step > 20*cluster[0].config.ElectionTimeoutMax {
+			t.Fatalf("Lowest priority node should win: %v term %d", cluster[0].State(), cluster[0].CurrentTerm())
+		}
+		clock.Advance(time.Millisecond)
+		time.Sleep(time.Millisecond)
+	}
+	if index, _ := cluster[0].LastLogInfo(); index < 3 {
+		t.Fatalf("Leader should have every write: %d", index)
+	}
+}
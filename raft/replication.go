@@ -1,21 +1,37 @@
 package raft
 
 import (
+	"errors"
 	"sync"
 	"time"
 )
 
+const (
+	// retryBackoffBase is the time to wait after the first failed RPC,
+	// it's doubled for every consecutive failure
+	retryBackoffBase = 10 * time.Millisecond
+)
+
 type follower struct {
 	peer string
+	// learner receives logs but is not counted for commit
+	learner bool
 
 	currentTerm uint64
 	matchIndex  uint64
 	nextIndex   uint64
 
+	// lastContact is when follower last responded successfully, or when
+	// replication started if it never did
 	lastContact     time.Time
 	lastContactLock sync.RWMutex
 
 	replicateCh chan struct{}
+	// replicateLock ensure only one AppendEntries is in flight, failures is
+	// number of consecutive failed RPC, both are used to back off. failures
+	// is also guarded by the follower lock so it can be read meanwhile
+	replicateLock sync.Mutex
+	failures      uint64
 
 	stopCh chan bool
 	sync.Mutex
@@ -27,6 +43,43 @@ func (f *follower) LastContact() time.Time {
 	return f.lastContact
 }
 
+func (f *follower) setLastContact(now time.Time) {
+	f.lastContactLock.Lock()
+	defer f.lastContactLock.Unlock()
+	f.lastContact = now
+}
+
+// noteFailure is used to count a failed RPC, it returns consecutive
+// failures so far
+func (f *follower) noteFailure() uint64 {
+	f.Lock()
+	defer f.Unlock()
+	f.failures++
+	return f.failures
+}
+
+// noteSuccess is used to reset consecutive failures once an RPC succeeds,
+// and record contact at now
+func (f *follower) noteSuccess(now time.Time) {
+	f.Lock()
+	f.failures = 0
+	f.Unlock()
+	f.setLastContact(now)
+}
+
+// consecutiveFailures ...
+func (f *follower) consecutiveFailures() uint64 {
+	f.Lock()
+	defer f.Unlock()
+	return f.failures
+}
+
+func (f *follower) progress() (uint64, uint64) {
+	f.Lock()
+	defer f.Unlock()
+	return f.matchIndex, f.nextIndex
+}
+
 func (s *Server) replicate(f *follower) {
 	stopHeartbeat := make(chan struct{})
 	defer close(stopHeartbeat)
@@ -49,93 +102,225 @@ func (s *Server) replicate(f *follower) {
 }
 
 func (s *Server) replicateTo(f *follower) {
-	lastLogIndex := s.LastLogIndex()
-	req := &AppendEntryRequest{
-		Term:              s.CurrentTerm(),
-		Leader:            s.LocalAddr(),
-		LeaderCommitIndex: s.CommitIndex(),
-	}
+	f.replicateLock.Lock()
+	defer f.replicateLock.Unlock()
 
-	if f.nextIndex == 1 {
-		req.PrevLogTerm = 0
-		req.PrevLogIndex = 0
-	} else {
-		log, err := s.logStore.GetLog(f.nextIndex - 1)
-		if err != nil {
+	for {
+		if !s.leading(f) {
 			return
 		}
-		req.PrevLogIndex = log.Index
-		req.PrevLogTerm = log.Term
-	}
+		lastLogIndex := s.LastLogIndex()
+		req := &AppendEntryRequest{
+			Term:              f.currentTerm,
+			Leader:            s.LocalAddr(),
+			LeaderCommitIndex: s.CommitIndex(),
+		}
+
+		_, nextIndex := f.progress()
+		lastSnapshotIndex, lastSnapshotTerm := s.LastSnapshotInfo()
+		if nextIndex <= lastSnapshotIndex {
+			// Logs follower needs are compacted, it catches up from snapshot
+			if !s.sendSnapshot(f) {
+				return
+			}
+			continue
+		}
+
+		if nextIndex == 1 {
+			req.PrevLogTerm = 0
+			req.PrevLogIndex = 0
+		} else if nextIndex-1 == lastSnapshotIndex {
+			req.PrevLogIndex = lastSnapshotIndex
+			req.PrevLogTerm = lastSnapshotTerm
+		} else {
+			log, err := s.logStore.GetLog(nextIndex - 1)
+			if err != nil {
+				if s.snapshotCompacted(f, err) {
+					continue
+				}
+				return
+			}
+			req.PrevLogIndex = log.Index
+			req.PrevLogTerm = log.Term
+		}
+
+		if limit := uint64(s.config.MaxAppendEntries); limit > 0 && nextIndex+limit <= lastLogIndex {
+			lastLogIndex = nextIndex + limit - 1
+		}
+
+		req.Entries = []*Log{}
+		for i := nextIndex; i <= lastLogIndex; i++ {
+			log, err := s.logStore.GetLog(i)
+			if err != nil {
+				return
+			}
+			req.Entries = append(req.Entries, log)
+		}
 
-	req.Entries = []*Log{}
-	for i := f.nextIndex; i <= lastLogIndex; i++ {
-		log, err := s.logStore.GetLog(i)
+		var resp AppendEntryResponse
+		ctx, cancel := s.rpcContext()
+		ctx, span := s.Tracer().StartSpan(ctx, "raft.AppendEntries")
+		span.SetAttribute("peer", f.peer)
+		span.SetAttribute("entries", len(req.Entries))
+		err := s.Transport().AppendEntries(ctx, f.peer, req, &resp)
+		span.End(err)
+		cancel()
 		if err != nil {
+			// s.err("Failed to AppendEntries to %v: %v", f.peer, err)
+			failures := f.noteFailure()
+			if limit := uint64(s.config.MaxFailures); limit > 0 && failures == limit {
+				s.warn("Peer %v failed %d RPCs in a row, suspected down: %v", f.peer, failures, err)
+			}
+			select {
+			case <-s.clock().After(s.retryBackoff(failures)):
+			case <-f.stopCh:
+			}
+			return
+		}
+		f.noteSuccess(s.clock().Now())
+
+		if resp.Term > req.Term {
+			s.debug("Newer term discoverd from %v, stepdown", f.peer)
+			s.stepDown(resp.Term)
+			// Run loop only leaves leader state, stopping heartbeats, once woken
+			asyncNotifyCh(s.commitCh)
 			return
 		}
-		req.Entries = append(req.Entries, log)
+
+		if resp.Success {
+			// keep sending the rest of logs if batch was capped or only
+			// partly acknowledged, unless follower acknowledged nothing new
+			if !s.updateLastAppend(f, req, &resp) && len(req.Entries) > 0 {
+				return
+			}
+			if _, nextIndex = f.progress(); nextIndex > s.LastLogIndex() {
+				return
+			}
+			select {
+			case <-f.stopCh:
+				return
+			default:
+			}
+			continue
+		}
+
+		// matchIndex is only advanced by successful responses, follower may
+		// hold conflicting logs below nextIndex
+		next := s.backtrackIndex(req, &resp)
+		f.Lock()
+		f.nextIndex = max(min(f.nextIndex-1, next), 1)
+		nextIndex = f.nextIndex
+		f.Unlock()
+
+		s.debug("AppendEntries to %v rejected, sending older logs (next :%d)", f.peer, nextIndex)
 	}
+}
 
-	var resp AppendEntryResponse
-	if err := s.Transport().AppendEntries(f.peer, req, &resp); err != nil {
-		// s.err("Failed to AppendEntries to %v: %v", f.peer, err)
-		return
+// backtrackIndex return next index to try after a rejected AppendEntries.
+// If follower reported a conflicting term, leader skips to right after its
+// own last log of that term, or to the first follower log of that term if
+// it has none.
+func (s *Server) backtrackIndex(req *AppendEntryRequest, resp *AppendEntryResponse) uint64 {
+	if resp.ConflictIndex == 0 {
+		return resp.LastLogIndex + 1
+	}
+	if resp.ConflictTerm == 0 {
+		return resp.ConflictIndex
 	}
 
-	if resp.Success {
-		s.updateLastAppend(f, req)
-	} else {
-		f.nextIndex = max(min(f.nextIndex-1, resp.LastLogIndex+1), 1)
-		f.matchIndex = f.nextIndex - 1
+	for idx := req.PrevLogIndex; idx > 0; idx-- {
+		log, err := s.logStore.GetLog(idx)
+		if err != nil || log.Term < resp.ConflictTerm {
+			break
+		}
+		if log.Term == resp.ConflictTerm {
+			return idx + 1
+		}
+	}
+	return resp.ConflictIndex
+}
 
-		s.debug("AppendEntries to %v rejected, sending older logs (next :%d)", f.peer, f.nextIndex)
-		s.replicateTo(f)
+// leading return whether server still leads the term replication to
+// follower started in, once deposed it must not send at a term it never won
+func (s *Server) leading(f *follower) bool {
+	return s.State() == Leader && s.CurrentTerm() == f.currentTerm
+}
+
+// snapshotCompacted is used to send the snapshot to follower once logs it
+// needs turn out to be compacted meanwhile, it returns whether follower
+// installed it
+func (s *Server) snapshotCompacted(f *follower, err error) bool {
+	if !errors.Is(err, ErrCompacted) || s.snapshots == nil {
+		return false
 	}
+	return s.sendSnapshot(f)
+}
+
+// suspectedDown return whether follower failed MaxFailures RPCs in a row
+func (s *Server) suspectedDown(f *follower) bool {
+	limit := uint64(s.config.MaxFailures)
+	return limit > 0 && f.consecutiveFailures() >= limit
 }
 
+func (s *Server) retryBackoff(failures uint64) time.Duration {
+	return backoff(retryBackoffBase, time.Duration(s.config.MaxRetryBackoff)*time.Millisecond, failures)
+}
+
+// heartbeat is used to keep follower from starting election. Heartbeats
+// to a caught up follower are sent less and less often, up to
+// MaxHeartbeatInterval, and skipped if any AppendEntries succeeded within
+// the interval. Each interval is lengthened by up to HeartbeatJitter.
 func (s *Server) heartbeat(f *follower, stopCh chan struct{}) {
-	ticker := time.NewTicker(time.Duration(s.config.HeartbeatInterval) * time.Millisecond)
+	minInterval := time.Duration(s.config.HeartbeatInterval) * time.Millisecond
+	maxInterval := time.Duration(s.config.MaxHeartbeatInterval) * time.Millisecond
+	maxJitter := time.Duration(s.config.HeartbeatJitter) * time.Millisecond
+	interval := minInterval
+	timer := s.clock().NewTimer(interval)
+	defer timer.Stop()
 
 	for {
 		select {
 		case <-stopCh:
 			// s.debug("Heartbeat Stop: %s -> %s", s.LocalAddr(), f.peer)
-			ticker.Stop()
 			return
-		case <-ticker.C:
-			// s.debug("Heartbeat Start: %s -> %s", s.LocalAddr(), f.peer)
-			s.replicateTo(f)
+		case <-timer.C():
 		}
-	}
-}
 
-func (s *Server) updateLastAppend(f *follower, req *AppendEntryRequest) {
-	f.Lock()
-	defer f.Unlock()
-	for _, log := range req.Entries {
-		s.commit(log.Index)
-		f.matchIndex = log.Index
-		f.nextIndex = log.Index + 1
-	}
-}
+		if wait := interval - s.clock().Now().Sub(f.LastContact()); wait > 0 {
+			timer.Reset(wait)
+			continue
+		}
 
-func (s *Server) commit(index uint64) {
-	log, ok := s.applying[index]
-	if !ok {
-		return
+		// s.debug("Heartbeat Start: %s -> %s", s.LocalAddr(), f.peer)
+		s.replicateTo(f)
+		if matchIndex, _ := f.progress(); matchIndex == s.LastLogIndex() {
+			interval = time.Duration(min(uint64(interval*2), uint64(maxInterval)))
+		} else {
+			interval = minInterval
+		}
+		timer.Reset(interval + jitter(maxJitter))
 	}
+}
 
-	log.count++
+// updateLastAppend is used to record logs follower stored after a
+// successful AppendEntries, it returns whether match index advanced. Only
+// logs both sent and acknowledged by follower's last index are known to
+// match, follower may hold stale logs past the sent ones. Match index never
+// goes backward so duplicated or reordered responses are harmless.
+func (s *Server) updateLastAppend(f *follower, req *AppendEntryRequest, resp *AppendEntryResponse) bool {
+	matchIndex := min(req.PrevLogIndex+uint64(len(req.Entries)), resp.LastLogIndex)
 
-	if log.count < log.majorityQuorum {
-		return
+	f.Lock()
+	advanced := matchIndex > f.matchIndex
+	if advanced {
+		f.matchIndex = matchIndex
 	}
+	f.nextIndex = max(f.nextIndex, f.matchIndex+1)
+	learner := f.learner
+	f.Unlock()
 
-	s.Lock()
-	delete(s.applying, index)
-	s.Unlock()
-
-	// s.setCommitIndex(log.Index)
-	s.commitCh <- log
+	if advanced && !learner {
+		asyncNotifyCh(s.commitCh)
+	}
+	return advanced
 }
@@ -0,0 +1,135 @@
+package raft
+
+import (
+	"fmt"
+	"sync"
+)
+
+// RingLogStore is an in-memory LogStore keeping logs in a ring buffer
+// indexed by offset from the first log, so GetLog is O(1) and compacting a
+// prefix only moves the head. Logs must be appended in index order, only a
+// prefix or a suffix of them can be deleted.
+type RingLogStore struct {
+	// buf holds count logs from head, its size is a power of two
+	buf   []*Log
+	head  int
+	count int
+	first uint64
+	sync.Mutex
+}
+
+// NewRingLogStore ...
+func NewRingLogStore() *RingLogStore {
+	return &RingLogStore{buf: make([]*Log, 16)}
+}
+
+// FirstIndex return index of the first log, it's 0 if store is empty
+func (r *RingLogStore) FirstIndex() (uint64, error) {
+	r.Lock()
+	defer r.Unlock()
+	if r.count == 0 {
+		return 0, nil
+	}
+	return r.first, nil
+}
+
+// LastIndex ...
+func (r *RingLogStore) LastIndex() (uint64, error) {
+	r.Lock()
+	defer r.Unlock()
+	if r.count == 0 {
+		return 0, nil
+	}
+	return r.first + uint64(r.count) - 1, nil
+}
+
+// GetLog ...
+func (r *RingLogStore) GetLog(idx uint64) (*Log, error) {
+	r.Lock()
+	defer r.Unlock()
+	if r.count > 0 && idx < r.first {
+		return nil, fmt.Errorf("log %d: %w", idx, ErrCompacted)
+	}
+	if r.count == 0 || idx-r.first >= uint64(r.count) {
+		return nil, fmt.Errorf("log %d: %w", idx, ErrLogNotFound)
+	}
+	return r.buf[r.slot(idx-r.first)], nil
+}
+
+// SetLog ...
+func (r *RingLogStore) SetLog(entry *Log) error {
+	return r.SetLogs([]*Log{entry})
+}
+
+// SetLogs is used to append logs, the first one must follow the last log
+// stored unless store is empty
+func (r *RingLogStore) SetLogs(entries []*Log) error {
+	r.Lock()
+	defer r.Unlock()
+	for _, entry := range entries {
+		if r.count == 0 {
+			r.head, r.first = 0, entry.Index
+		} else if last := r.first + uint64(r.count) - 1; entry.Index != last+1 {
+			return fmt.Errorf("log %d doesn't follow last log %d", entry.Index, last)
+		}
+		if r.count == len(r.buf) {
+			r.grow()
+		}
+		r.buf[r.slot(uint64(r.count))] = entry
+		r.count++
+	}
+	return nil
+}
+
+// DeleteRange is used to delete logs with index in [min, max], the range
+// must cover either the first or the last log
+func (r *RingLogStore) DeleteRange(min, max uint64) error {
+	r.Lock()
+	defer r.Unlock()
+	if r.count == 0 || min > max {
+		return nil
+	}
+	last := r.first + uint64(r.count) - 1
+	if max < r.first || min > last {
+		return nil
+	}
+
+	switch {
+	case min <= r.first:
+		// Compaction, head moves past the deleted prefix
+		if max > last {
+			max = last
+		}
+		n := int(max - r.first + 1)
+		for i := 0; i < n; i++ {
+			r.buf[r.slot(uint64(i))] = nil
+		}
+		r.head = r.slot(uint64(n))
+		r.count -= n
+		r.first += uint64(n)
+	case max >= last:
+		// Truncation of conflicting logs
+		n := int(last - min + 1)
+		for i := r.count - n; i < r.count; i++ {
+			r.buf[r.slot(uint64(i))] = nil
+		}
+		r.count -= n
+	default:
+		return fmt.Errorf("logs %d to %d are not a prefix or suffix of %d to %d", min, max, r.first, last)
+	}
+	return nil
+}
+
+// slot return position in buf of the log at offset from head
+func (r *RingLogStore) slot(offset uint64) int {
+	return (r.head + int(offset)) & (len(r.buf) - 1)
+}
+
+// grow is used to double buf, logs are moved to its start in order
+func (r *RingLogStore) grow() {
+	buf := make([]*Log, 2*len(r.buf))
+	for i := 0; i < r.count; i++ {
+		buf[i] = r.buf[r.slot(uint64(i))]
+	}
+	r.buf, r.head = buf, 0
+}
@@ -0,0 +1,130 @@
+package raft
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRingLogStoreCompactionWrapsAround(t *testing.T) {
+	store := NewRingLogStore()
+	next := uint64(1)
+	appendLogs := func(n int) {
+		for i := 0; i < n; i++ {
+			if err := store.SetLog(&Log{Index: next, Term: 1}); err != nil {
+				t.Fatal(err)
+			}
+			next++
+		}
+	}
+
+	// Compacting behind appends keeps reusing the same slots, growing only
+	// once the logs kept outnumber them
+	for round := 0; round < 10; round++ {
+		appendLogs(10)
+		first, _ := store.FirstIndex()
+		if err := store.DeleteRange(first, next-6); err != nil {
+			t.Fatal(err)
+		}
+	}
+	appendLogs(30)
+
+	first, _ := store.FirstIndex()
+	last, _ := store.LastIndex()
+	if first != 96 || last != next-1 {
+		t.Fatalf("Wrong range of logs: %d to %d", first, last)
+	}
+	for idx := first; idx <= last; idx++ {
+		if log, err := store.GetLog(idx); err != nil || log.Index != idx {
+			t.Fatalf("Wrong log at %d: %+v %v", idx, log, err)
+		}
+	}
+	if _, err := store.GetLog(first - 1); !errors.Is(err, ErrCompacted) {
+		t.Fatalf("Log below first index should be compacted: %v", err)
+	}
+	if _, err := store.GetLog(last + 1); !errors.Is(err, ErrLogNotFound) {
+		t.Fatalf("Log above last index should not be found: %v", err)
+	}
+}
+
+func TestRingLogStoreTruncate(t *testing.T) {
+	store := NewRingLogStore()
+	if err := store.SetLogs([]*Log{{Index: 3, Term: 1}, {Index: 4, Term: 1}, {Index: 5, Term: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetLog(&Log{Index: 7, Term: 1}); err == nil {
+		t.Fatalf("Log leaving a gap should be rejected")
+	}
+	if err := store.DeleteRange(4, 4); err == nil {
+		t.Fatalf("Deleting logs in the middle should be rejected")
+	}
+
+	// Conflicting suffix is replaced by leader's logs
+	if err := store.DeleteRange(4, 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetLog(&Log{Index: 4, Term: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if log, err := store.GetLog(4); err != nil || log.Term != 2 {
+		t.Fatalf("Wrong log after truncation: %+v %v", log, err)
+	}
+
+	// Emptied store starts again from any index, e.g. after a snapshot
+	if err := store.DeleteRange(3, 4); err != nil {
+		t.Fatal(err)
+	}
+	if first, _ := store.FirstIndex(); first != 0 {
+		t.Fatalf("Emptied store should have first index 0: %d", first)
+	}
+	if err := store.SetLog(&Log{Index: 10, Term: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if first, _ := store.FirstIndex(); first != 10 {
+		t.Fatalf("Wrong first index: %d", first)
+	}
+}
+
+func TestRingLogStoreServer(t *testing.T) {
+	s := mustNewServer(DefaultConfig(), NewInmemTransport(""), NewRingLogStore(), NewInMemStateMachine())
+	s.snapshots = newSnapshotStore(t.TempDir())
+	s.Start()
+	defer s.Stop()
+	waitForLeader(t, []*Server{s})
+
+	for i := 0; i < 50; i++ {
+		if err := s.Do([]byte("a:b")); err != nil {
+			t.Fatal(err)
+		}
+		if i%20 == 0 {
+			if err := s.Snapshot(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if v := s.StateMachine().Get([]byte("a")); v != "b" {
+		t.Fatalf("Wrong state machine value: %v", v)
+	}
+}
+
+func benchmarkGetLog(b *testing.B, store LogStore) {
+	const total = 10000
+	for i := uint64(1); i <= total; i++ {
+		if err := store.SetLog(&Log{Index: i, Term: 1}); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := store.GetLog(uint64(i%total) + 1); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetLogInmem(b *testing.B) {
+	benchmarkGetLog(b, NewInmemLogStore())
+}
+
+func BenchmarkGetLogRing(b *testing.B) {
+	benchmarkGetLog(b, NewRingLogStore())
+}
@@ -1,20 +1,30 @@
 package raft
 
+import "context"
+
 // RPCResponse provide response message
 type RPCResponse struct {
 	Response interface{}
 	Error    error
 }
 
-// RPC provide request message
+// RPC provide request message. RespCh must have room for the response,
+// transports make it with a buffer of one. Ctx is the context of the
+// request if transport has one, spans of handling it are its children.
 type RPC struct {
 	Request interface{}
 	RespCh  chan<- RPCResponse
+	Ctx     context.Context
 }
 
-// Response is used to respond with a response or error or both
+// Response is used to respond with a response or error or both. It's
+// called from run loop so it never blocks, a response nobody has room for
+// is dropped and the caller times out instead of stalling the server.
 func (rpc *RPC) Response(resp interface{}, err error) {
-	rpc.RespCh <- RPCResponse{resp, err}
+	select {
+	case rpc.RespCh <- RPCResponse{resp, err}:
+	default:
+	}
 }
 
 // RequestVoteRequest is used to make request vote message
@@ -51,11 +61,16 @@ type AppendEntryRequest struct {
 	LeaderCommitIndex uint64 `json:"leaderCommitIndex,string"`
 }
 
-// AppendEntryResponse is response returned from an AppendEntryRequest
+// AppendEntryResponse is response returned from an AppendEntryRequest.
+// On rejection ConflictTerm is the term of follower's log at PrevLogIndex
+// (0 if it has no such log) and ConflictIndex the first index it has for
+// that term, so leader can skip the whole term at once.
 type AppendEntryResponse struct {
-	Term         uint64 `json:"term,string"`
-	LastLogIndex uint64 `json:"lastLogIndex,string"`
-	Success      bool   `json:"success"`
+	Term          uint64 `json:"term,string"`
+	LastLogIndex  uint64 `json:"lastLogIndex,string"`
+	Success       bool   `json:"success"`
+	ConflictTerm  uint64 `json:"conflictTerm,string"`
+	ConflictIndex uint64 `json:"conflictIndex,string"`
 }
 
 func newAppendEntriesRequest(
@@ -73,3 +88,38 @@ func newAppendEntriesRequest(
 		LeaderCommitIndex: leaderCommitIndex,
 	}
 }
+
+// TimeoutNowRequest is sent by leader to make target start an election
+// right away, it's used to transfer leadership
+type TimeoutNowRequest struct {
+	Term   uint64 `json:"term,string"`
+	Leader string `json:"leader"`
+}
+
+// TimeoutNowResponse is response returned from a TimeoutNowRequest
+type TimeoutNowResponse struct {
+	Term uint64 `json:"term,string"`
+}
+
+// InstallSnapshotRequest carry a chunk of leader's snapshot, which covers
+// logs up to LastIndex. Data is written at Offset of the snapshot, Done is
+// set on the last chunk which also carries the configuration at LastIndex
+// and whether the snapshot is gzipped. Base is set on every chunk of a
+// delta snapshot, it's the index of the snapshot the delta applies on.
+type InstallSnapshotRequest struct {
+	Term          uint64 `json:"term,string"`
+	Leader        string `json:"leader"`
+	LastIndex     uint64 `json:"lastIndex,string"`
+	LastTerm      uint64 `json:"lastTerm,string"`
+	Configuration []byte `json:"configuration,omitempty"`
+	Offset        int64  `json:"offset,string"`
+	Data          []byte `json:"data"`
+	Done          bool   `json:"done"`
+	Compressed    bool   `json:"compressed,omitempty"`
+	Base          uint64 `json:"base,string,omitempty"`
+}
+
+// InstallSnapshotResponse is response returned from an InstallSnapshotRequest
+type InstallSnapshotResponse struct {
+	Term uint64 `json:"term,string"`
+}
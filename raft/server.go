@@ -1,6 +1,13 @@
 package raft
 
-import "sync"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
 
 // Server provide Raft node informations
 type Server struct {
@@ -18,38 +25,139 @@ type Server struct {
 	lastLogIndex uint64
 	lastLogTerm  uint64
 	commitIndex  uint64
+	lastApplied  uint64
+	// leaderCommitIndex is commit index reported by leader in its last
+	// AppendEntries, received at leaderContact
+	leaderCommitIndex uint64
+	leaderContact     time.Time
+	// termStartIndex is index of the no-op appended when server last
+	// became leader
+	termStartIndex uint64
+	// startCommitIndex is the first commit index server learned since it
+	// started, from leader or as leader. It's caughtUp once it applied it.
+	startCommitIndex uint64
+	startCommitKnown bool
+	caughtUp         bool
+	// drained server never becomes leader, see Drain
+	drained bool
+	// leadershipTransfer is set while TransferLeadership runs, leader
+	// refuses new logs meanwhile so target stays caught up
+	leadershipTransfer bool
+	// campaignAfter is the time server doesn't start elections before,
+	// once it handed leadership away the target gets to win first
+	campaignAfter time.Time
+	// startedAt is when server last started, it doesn't start an election
+	// without reaching quorum within StartupGracePeriod of it
+	startedAt time.Time
+	// appliedCh is closed and replaced whenever lastApplied advances
+	appliedCh chan struct{}
+	// commitNotifyCh is notified when commit index advances, committed logs
+	// are applied by their own goroutine. It holds one notification so
+	// commits in quick succession coalesce into one wakeup, which applies
+	// the whole committed range. applyWakeups counts these wakeups.
+	commitNotifyCh chan struct{}
+	applyWakeups   uint64
+	// slowApplies is the number of applies which took over ApplyTimeout
+	slowApplies uint64
+	// inflightWrites is the number of writes accepted by Apply which
+	// weren't responded yet
+	inflightWrites int
+
+	// index and term of the last log included in latest snapshot,
+	// logs up to this index may already be compacted from logStore
+	lastSnapshotIndex uint64
+	lastSnapshotTerm  uint64
+	// logs applied, and bytes of their commands, since latest snapshot
+	appliedSinceSnapshot uint64
+	bytesSinceSnapshot   uint64
 
 	stateMachine StateMachine
-
-	peers     []string
-	followers map[string]*follower
+	// applyLock is held while logs are applied to state machine and while
+	// it's saved to or restored from snapshot
+	applyLock sync.Mutex
+	snapshots *snapshotStore
+	// deltaBase is set while state machine was last saved to or restored
+	// from the latest snapshot, so a delta can follow it. It's guarded by
+	// applyLock.
+	deltaBase bool
+	// pendingSnapshot is the snapshot being received from leader, it's
+	// only used by run loop
+	pendingSnapshot *snapshotSink
+	// observers are notified of every applied log
+	observers []ApplyObserver
+	// applyStream feeds ApplyCh, it's nil until ApplyCh is called
+	applyStream *logStream
+
+	peers []string
+	// oldPeers are peers of previous configuration while membership change
+	// is in joint phase, decisions need majority of both peers and oldPeers.
+	// It's nil outside joint phase
+	oldPeers []string
+	// learners receive replicated logs but don't vote and aren't counted
+	// in quorum until they're promoted
+	learners []string
+	// nonVoter is set once the latest configuration applied leaves this
+	// server out of voters, as a learner or a removed member. It never
+	// starts an election then.
+	nonVoter bool
+	// configIndex is the index of the latest configuration in log or
+	// snapshot, it's 0 if cluster configuration was never logged
+	configIndex uint64
+	followers   map[string]*follower
 	// apply log channel
 	applyCh chan *Log
-	// leader working channel
+	// applying is logs dispatched by leader waiting to be committed, each
+	// is removed once it's applied and the map is dropped when leadership
+	// is lost
 	applying map[uint64]*Log
-	commitCh chan *Log
+	// commitCh is notified when match index of a voting follower advances
+	commitCh chan struct{}
 
 	stopCh chan struct{}
+	// shutdownCh is closed once Stop is called, new logs are refused while
+	// dispatched ones drain
+	shutdownCh chan struct{}
 
 	wg sync.WaitGroup
 	sync.Mutex
 }
 
-// NewServer is used to create new raft node
-func NewServer(config *Config, transport Transport, ls LogStore, sm StateMachine) *Server {
+// NewServer is used to create new raft node, it fails if config is invalid
+// or transport, log store or state machine is missing
+func NewServer(config *Config, transport Transport, ls LogStore, sm StateMachine) (*Server, error) {
+	if config == nil {
+		return nil, errors.New("config must be set")
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	if transport == nil {
+		return nil, errors.New("transport must be set")
+	}
+	if ls == nil {
+		return nil, errors.New("log store must be set")
+	}
+	if sm == nil {
+		return nil, errors.New("state machine must be set")
+	}
+
 	s := &Server{
-		localAddr:    transport.LocalAddr(),
-		currentTerm:  0,
-		state:        Stopped,
-		votedFor:     "",
-		leader:       "",
-		config:       config,
-		transport:    transport,
-		rpcCh:        transport.Consumer(),
-		applyCh:      make(chan *Log),
-		logStore:     ls,
-		stateMachine: sm,
-		peers:        []string{},
+		localAddr:      transport.LocalAddr(),
+		currentTerm:    0,
+		state:          Stopped,
+		votedFor:       "",
+		leader:         "",
+		config:         config,
+		transport:      transport,
+		rpcCh:          transport.Consumer(),
+		applyCh:        make(chan *Log),
+		commitCh:       make(chan struct{}, 1),
+		logStore:       ls,
+		stateMachine:   sm,
+		peers:          []string{},
+		appliedCh:      make(chan struct{}),
+		commitNotifyCh: make(chan struct{}, 1),
+		snapshots:      newSnapshotStore(config.SnapshotDir),
 	}
 
 	lastIndex, _ := s.logStore.LastIndex()
@@ -57,8 +165,15 @@ func NewServer(config *Config, transport Transport, ls LogStore, sm StateMachine
 		lastLog, _ := s.logStore.GetLog(lastIndex)
 		s.setLastLogInfo(lastLog.Index, lastLog.Term)
 	}
+	if ss, ok := ls.(StableStore); ok {
+		term, vote, err := ss.State()
+		if err != nil {
+			return nil, err
+		}
+		s.currentTerm, s.votedFor = term, vote
+	}
 
-	return s
+	return s, nil
 }
 
 // LocalAddr return server local address
@@ -75,11 +190,55 @@ func (s *Server) CurrentTerm() uint64 {
 	return s.currentTerm
 }
 
+// setCurrentTerm is used to move to term, vote of an older term doesn't
+// count in a newer one
 func (s *Server) setCurrentTerm(term uint64) {
 	s.Lock()
 	defer s.Unlock()
+	if term > s.currentTerm {
+		s.votedFor = ""
+	}
 	s.currentTerm = term
+	s.saveState()
+}
+
+// stepDown is used to become follower of term with no known leader yet,
+// term and state change at once so nothing sees a follower of old term.
+// Term of a stale response never moves current term backward.
+func (s *Server) stepDown(term uint64) {
+	s.Lock()
+	defer s.Unlock()
+	if term > s.currentTerm {
+		s.votedFor = ""
+		s.currentTerm = term
+		s.saveState()
+	}
+	s.state = Follower
+	s.leader = ""
+}
 
+// saveState is used to persist current term and vote if log store keeps
+// them, a vote is only granted once it's persisted. A term which fails to
+// persist is learned again from peers. Lock must be held.
+func (s *Server) saveState() error {
+	ss, ok := s.logStore.(StableStore)
+	if !ok {
+		return nil
+	}
+	err := ss.SetState(s.currentTerm, s.votedFor)
+	if err != nil {
+		s.err("Failed to persist term %d and vote %q: %v", s.currentTerm, s.votedFor, err)
+	}
+	return err
+}
+
+// becomeLeader is used to lead current term, state and leader change at
+// once so nothing sees a leader which doesn't know it leads
+func (s *Server) becomeLeader() {
+	s.Lock()
+	defer s.Unlock()
+	s.state = Leader
+	s.leader = s.localAddr
 }
 
 // State return current state of server
@@ -115,6 +274,54 @@ func (s *Server) setLeader(leader string) {
 	s.leader = leader
 }
 
+// HasLeader return whether server currently knows the leader
+func (s *Server) HasLeader() bool {
+	return s.Leader() != ""
+}
+
+func (s *Server) setLeaderCommitIndex(idx uint64) {
+	s.Lock()
+	defer s.Unlock()
+	s.leaderCommitIndex = idx
+	s.leaderContact = s.clock().Now()
+	s.noteStartCommitIndex(idx)
+}
+
+// noteStartCommitIndex is used to keep the first commit index learned
+// since start, lock must be held. Index 0 is skipped, a delayed
+// AppendEntries may carry it long after leader committed its no-op.
+func (s *Server) noteStartCommitIndex(idx uint64) {
+	if !s.startCommitKnown && idx > 0 {
+		s.startCommitIndex, s.startCommitKnown = idx, true
+	}
+}
+
+// CaughtUp return whether server applied every log committed when it
+// started, e.g. replayed the logs after its restored snapshot. It's false
+// until server learns a commit index, and stays true once it's reached.
+func (s *Server) CaughtUp() bool {
+	s.Lock()
+	defer s.Unlock()
+	if !s.caughtUp && s.startCommitKnown && s.lastApplied >= s.startCommitIndex {
+		s.caughtUp = true
+	}
+	return s.caughtUp
+}
+
+// LeaderCommitIndex return leader's commit index as server last learned it
+// and whether it was learned within LeaderLeaseTimeout, leader returns its
+// own commit index. Leader sends it with every heartbeat so a follower
+// within lease knows how far behind it is.
+func (s *Server) LeaderCommitIndex() (uint64, bool) {
+	s.Lock()
+	defer s.Unlock()
+	if s.state == Leader {
+		return s.commitIndex, true
+	}
+	lease := time.Duration(s.config.LeaderLeaseTimeout) * time.Millisecond
+	return s.leaderCommitIndex, s.clock().Now().Sub(s.leaderContact) <= lease
+}
+
 // Transport ...
 func (s *Server) Transport() Transport {
 	s.Lock()
@@ -149,6 +356,22 @@ func (s *Server) setLastLogInfo(idx uint64, term uint64) {
 	s.lastLogTerm = term
 }
 
+// LastSnapshotInfo return index and term of the last log included in
+// latest snapshot
+func (s *Server) LastSnapshotInfo() (uint64, uint64) {
+	s.Lock()
+	defer s.Unlock()
+	return s.lastSnapshotIndex, s.lastSnapshotTerm
+}
+
+func (s *Server) setLastSnapshotInfo(idx uint64, term uint64) {
+	s.Lock()
+	defer s.Unlock()
+	s.lastSnapshotIndex = idx
+	s.lastSnapshotTerm = term
+	s.appliedSinceSnapshot, s.bytesSinceSnapshot = 0, 0
+}
+
 // CommitIndex ...
 func (s *Server) CommitIndex() uint64 {
 	s.Lock()
@@ -160,6 +383,72 @@ func (s *Server) setCommitIndex(idx uint64) {
 	s.Lock()
 	defer s.Unlock()
 	s.commitIndex = idx
+	if s.state == Leader {
+		s.noteStartCommitIndex(idx)
+	}
+}
+
+// LastApplied return index of the last log applied to state machine
+func (s *Server) LastApplied() uint64 {
+	s.Lock()
+	defer s.Unlock()
+	return s.lastApplied
+}
+
+func (s *Server) setLastApplied(idx uint64) {
+	s.Lock()
+	defer s.Unlock()
+	s.lastApplied = idx
+	close(s.appliedCh)
+	s.appliedCh = make(chan struct{})
+}
+
+// TermStartIndex return index of the no-op log leader appends as soon as
+// it's elected. Logs of previous terms may not be committed, and reads may
+// be stale, until it's applied.
+func (s *Server) TermStartIndex() uint64 {
+	s.Lock()
+	defer s.Unlock()
+	return s.termStartIndex
+}
+
+// ApplyLag return number of logs committed by leader that server hasn't
+// applied yet. Followers learn leader's commit index from AppendEntries so
+// it may be slightly stale.
+func (s *Server) ApplyLag() uint64 {
+	s.Lock()
+	defer s.Unlock()
+	commitIndex := s.leaderCommitIndex
+	if s.state == Leader {
+		commitIndex = s.commitIndex
+	}
+	if commitIndex <= s.lastApplied {
+		return 0
+	}
+	return commitIndex - s.lastApplied
+}
+
+// WaitApplied is used to wait until log at index is applied to state
+// machine, it returns ErrTimeout if that doesn't happen within timeout
+func (s *Server) WaitApplied(index uint64, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		s.Lock()
+		if s.lastApplied >= index {
+			s.Unlock()
+			return nil
+		}
+		appliedCh := s.appliedCh
+		s.Unlock()
+
+		select {
+		case <-appliedCh:
+		case <-timer.C:
+			return ErrTimeout
+		}
+	}
 }
 
 // StateMachine ...
@@ -169,21 +458,243 @@ func (s *Server) StateMachine() StateMachine {
 	return s.stateMachine
 }
 
-// MemberCount is used to get total member in cluster
+// LogStore ...
+func (s *Server) LogStore() LogStore {
+	s.Lock()
+	defer s.Unlock()
+	return s.logStore
+}
+
+// MemberCount is used to get total member in cluster, members of both
+// configurations are counted in joint phase
 func (s *Server) MemberCount() int {
-	return len(s.peers) + 1
+	return len(s.voters()) + 1
 }
 
-// QuorumSize is used to get number of major server
+// QuorumSize is used to get number of major server, local server is
+// counted along its peers so it's 1 for a single node, and an even sized
+// cluster needs one more than half, e.g. 3 of 4. In joint phase it's the
+// larger majority of both configurations, the votes must still form a
+// majority of each one, see hasQuorum. WriteQuorum and ReadQuorum override
+// it for writes and reads.
 func (s *Server) QuorumSize() int {
-	return (s.MemberCount() / 2) + 1
+	s.Lock()
+	defer s.Unlock()
+	quorum := majority(len(s.peers) + 1)
+	if old := majority(len(s.oldPeers) + 1); s.oldPeers != nil && old > quorum {
+		quorum = old
+	}
+	return quorum
+}
+
+// voters return every voting peer, peers of previous configuration
+// included in joint phase
+func (s *Server) voters() []string {
+	s.Lock()
+	defer s.Unlock()
+	voters := make([]string, len(s.peers), len(s.peers)+len(s.oldPeers))
+	copy(voters, s.peers)
+	for _, peer := range s.oldPeers {
+		if !contains(s.peers, peer) {
+			voters = append(voters, peer)
+		}
+	}
+	return voters
 }
 
-// AddPeer is used to add peer
-func (s *Server) AddPeer(peer string) {
+// Peers return address of other members in cluster
+func (s *Server) Peers() []string {
 	s.Lock()
 	defer s.Unlock()
-	s.peers = append(s.peers, peer)
+	peers := make([]string, len(s.peers))
+	copy(peers, s.peers)
+	return peers
+}
+
+// Learners return address of non-voting members in cluster
+func (s *Server) Learners() []string {
+	s.Lock()
+	defer s.Unlock()
+	learners := make([]string, len(s.learners))
+	copy(learners, s.learners)
+	return learners
+}
+
+// PeerProgress describe how far the log is replicated to a peer. Lag is
+// the number of leader's logs peer doesn't have yet, LastContactMs the
+// milliseconds since peer last responded to a RPC successfully.
+type PeerProgress struct {
+	Peer          string `json:"peer"`
+	Learner       bool   `json:"learner,omitempty"`
+	MatchIndex    uint64 `json:"matchIndex"`
+	NextIndex     uint64 `json:"nextIndex"`
+	Lag           uint64 `json:"lag"`
+	LastContactMs int64  `json:"lastContactMs"`
+	// Failures is the number of consecutive failed RPCs to peer, it's
+	// SuspectedDown once they reach MaxFailures
+	Failures      uint64 `json:"failures"`
+	SuspectedDown bool   `json:"suspectedDown,omitempty"`
+}
+
+// Progress return replication progress of every peer, it's only known
+// by leader so it's empty for other states
+func (s *Server) Progress() []PeerProgress {
+	s.Lock()
+	if s.state != Leader {
+		s.Unlock()
+		return []PeerProgress{}
+	}
+	followers := make([]*follower, 0, len(s.followers))
+	for _, f := range s.followers {
+		followers = append(followers, f)
+	}
+	lastLogIndex := s.lastLogIndex
+	s.Unlock()
+
+	now := s.clock().Now()
+	progress := make([]PeerProgress, 0, len(followers))
+	for _, f := range followers {
+		matchIndex, nextIndex := f.progress()
+		f.Lock()
+		learner := f.learner
+		f.Unlock()
+		var lag uint64
+		if lastLogIndex > matchIndex {
+			lag = lastLogIndex - matchIndex
+		}
+		progress = append(progress, PeerProgress{
+			Peer:          f.peer,
+			Learner:       learner,
+			MatchIndex:    matchIndex,
+			NextIndex:     nextIndex,
+			Lag:           lag,
+			LastContactMs: int64(now.Sub(f.LastContact()) / time.Millisecond),
+			Failures:      f.consecutiveFailures(),
+			SuspectedDown: s.suspectedDown(f),
+		})
+	}
+	sort.Slice(progress, func(i, j int) bool {
+		return progress[i].Peer < progress[j].Peer
+	})
+	return progress
+}
+
+// ServerStats is a consistent snapshot of server status
+type ServerStats struct {
+	Term         uint64         `json:"term"`
+	State        string         `json:"state"`
+	Leader       string         `json:"leader"`
+	CommitIndex  uint64         `json:"commitIndex"`
+	LastApplied  uint64         `json:"lastApplied"`
+	LastLogIndex uint64         `json:"lastLogIndex"`
+	LastLogTerm  uint64         `json:"lastLogTerm"`
+	Peers        int            `json:"peers"`
+	SlowApplies  uint64         `json:"slowApplies"`
+	Replication  []PeerProgress `json:"replication,omitempty"`
+}
+
+// Stats return status of server, every field but replication progress is
+// read at once so they're consistent with each other
+func (s *Server) Stats() ServerStats {
+	s.Lock()
+	stats := ServerStats{
+		Term:         s.currentTerm,
+		State:        s.state.String(),
+		Leader:       s.leader,
+		CommitIndex:  s.commitIndex,
+		LastApplied:  s.lastApplied,
+		LastLogIndex: s.lastLogIndex,
+		LastLogTerm:  s.lastLogTerm,
+		Peers:        len(s.peers),
+		SlowApplies:  s.slowApplies,
+	}
+	s.Unlock()
+
+	// Progress takes followers lock, it can't be called under server lock
+	stats.Replication = s.Progress()
+	return stats
+}
+
+// AddPeer is used to add voting peer. Before Start it only sets peers
+// server starts with, a running leader commits the configuration with peer
+// through the log and other running servers return ErrNotLeader. Adding a
+// member again does nothing.
+func (s *Server) AddPeer(peer string, timeout time.Duration) error {
+	return s.changeMembers(func(c *configuration) (bool, error) {
+		if contains(c.Members, peer) || contains(c.Learners, peer) {
+			return false, nil
+		}
+		c.Members = append(c.Members, peer)
+		return true, nil
+	}, timeout)
+}
+
+// RemovePeer is used to remove voting peer or learner like AddPeer, leader
+// stops replicating to it once the configuration is applied. Removing a
+// non-member does nothing, use Leave to remove this server.
+func (s *Server) RemovePeer(peer string, timeout time.Duration) error {
+	if peer == s.LocalAddr() {
+		return fmt.Errorf("%s can't remove itself, use Leave", peer)
+	}
+	return s.changeMembers(func(c *configuration) (bool, error) {
+		if !contains(c.Members, peer) && !contains(c.Learners, peer) {
+			return false, nil
+		}
+		c.Members, c.Learners = without(c.Members, peer), without(c.Learners, peer)
+		return true, nil
+	}, timeout)
+}
+
+// AddLearner is used to add non-voting peer like AddPeer, leader
+// replicates logs to it so it can catch up before being promoted. Adding a
+// member again does nothing.
+func (s *Server) AddLearner(learner string, timeout time.Duration) error {
+	return s.changeMembers(func(c *configuration) (bool, error) {
+		if contains(c.Members, learner) || contains(c.Learners, learner) {
+			return false, nil
+		}
+		c.Learners = append(c.Learners, learner)
+		return true, nil
+	}, timeout)
+}
+
+// PromotePeer is used to promote learner to voting peer like AddPeer
+func (s *Server) PromotePeer(learner string, timeout time.Duration) error {
+	return s.changeMembers(func(c *configuration) (bool, error) {
+		if !contains(c.Learners, learner) {
+			return false, fmt.Errorf("%s is not a learner", learner)
+		}
+		c.Learners = without(c.Learners, learner)
+		c.Members = append(c.Members, learner)
+		return true, nil
+	}, timeout)
+}
+
+// DemotePeer is used to turn voting peer into learner like AddPeer, it
+// keeps receiving logs but no longer counts in quorum, e.g. before it's
+// Reset. Leader can't demote itself, use Leave.
+func (s *Server) DemotePeer(peer string, timeout time.Duration) error {
+	if peer == s.LocalAddr() {
+		return fmt.Errorf("%s can't demote itself, use Leave", peer)
+	}
+	return s.changeMembers(func(c *configuration) (bool, error) {
+		if !contains(c.Members, peer) {
+			return false, fmt.Errorf("%s is not a voter", peer)
+		}
+		c.Members = without(c.Members, peer)
+		c.Learners = append(c.Learners, peer)
+		return true, nil
+	}, timeout)
+}
+
+// rpcContext return context bounding an outgoing RPC by RPCTimeout
+func (s *Server) rpcContext() (context.Context, context.CancelFunc) {
+	return s.rpcContextFrom(context.Background())
+}
+
+// rpcContextFrom return rpcContext which is also done once parent is done
+func (s *Server) rpcContextFrom(parent context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(parent, time.Duration(s.config.RPCTimeout)*time.Millisecond)
 }
 
 func (s *Server) debug(format string, v ...interface{}) {
@@ -0,0 +1,625 @@
+package raft
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	snapshotDataFile    = "snapshot.data"
+	snapshotMetaFile    = "snapshot.meta"
+	snapshotDeltaPrefix = "delta-"
+)
+
+var (
+	// ErrSnapshotUnsupported is returned when SnapshotDir is not set or
+	// state machine doesn't implement SnapshotStateMachine
+	ErrSnapshotUnsupported = errors.New("snapshot is not supported")
+	// ErrNoSnapshot is returned when no snapshot is taken yet
+	ErrNoSnapshot = errors.New("no snapshot")
+)
+
+// SnapshotMeta describe a snapshot of state machine after applying log at
+// Index. Configuration is the cluster configuration at Index, so a node
+// restored from it knows its peers. Size is the number of bytes stored,
+// gzipped if Compressed is set. Base is set on a delta snapshot, it's the
+// index of the snapshot it applies on.
+type SnapshotMeta struct {
+	Index         uint64 `json:"index"`
+	Term          uint64 `json:"term"`
+	Configuration []byte `json:"configuration"`
+	Size          int64  `json:"size"`
+	Compressed    bool   `json:"compressed,omitempty"`
+	Base          uint64 `json:"base,omitempty"`
+}
+
+// snapshotStore keep the latest full snapshot in dir with the deltas
+// taken on it, named after their index. A new snapshot is written to a
+// temp file first so the latest one is never partially overwritten.
+type snapshotStore struct {
+	dir string
+}
+
+func newSnapshotStore(dir string) *snapshotStore {
+	if dir == "" {
+		return nil
+	}
+	return &snapshotStore{dir: dir}
+}
+
+// create is used to start writing a new snapshot
+func (st *snapshotStore) create(meta SnapshotMeta) (*snapshotSink, error) {
+	if err := os.MkdirAll(st.dir, 0755); err != nil {
+		return nil, err
+	}
+	file, err := ioutil.TempFile(st.dir, "snapshot-*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	return &snapshotSink{store: st, meta: meta, file: file}, nil
+}
+
+// paths return data and meta file of snapshot
+func (st *snapshotStore) paths(meta SnapshotMeta) (string, string) {
+	if meta.Base == 0 {
+		return filepath.Join(st.dir, snapshotDataFile), filepath.Join(st.dir, snapshotMetaFile)
+	}
+	name := filepath.Join(st.dir, fmt.Sprintf("%s%020d", snapshotDeltaPrefix, meta.Index))
+	return name + ".data", name + ".meta"
+}
+
+// open return the latest full snapshot, ErrNoSnapshot if there is none
+func (st *snapshotStore) open() (*SnapshotMeta, *os.File, error) {
+	chain, err := st.chain()
+	if err != nil {
+		return nil, nil, err
+	}
+	file, err := st.openData(chain[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	return &chain[0], file, nil
+}
+
+// openData is used to read data of snapshot
+func (st *snapshotStore) openData(meta SnapshotMeta) (*os.File, error) {
+	data, _ := st.paths(meta)
+	return os.Open(data)
+}
+
+// chain return the latest full snapshot followed by the deltas taken on
+// it in order, ErrNoSnapshot if there is none
+func (st *snapshotStore) chain() ([]SnapshotMeta, error) {
+	data, err := ioutil.ReadFile(filepath.Join(st.dir, snapshotMetaFile))
+	if os.IsNotExist(err) {
+		return nil, ErrNoSnapshot
+	}
+	if err != nil {
+		return nil, err
+	}
+	var meta SnapshotMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, err
+	}
+
+	names, err := filepath.Glob(filepath.Join(st.dir, snapshotDeltaPrefix+"*.meta"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	chain := []SnapshotMeta{meta}
+	for _, name := range names {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		var delta SnapshotMeta
+		if err := json.Unmarshal(data, &delta); err != nil {
+			return nil, err
+		}
+		// Deltas of an older full snapshot are left over from a crash
+		if delta.Base == chain[len(chain)-1].Index {
+			chain = append(chain, delta)
+		}
+	}
+	return chain, nil
+}
+
+// remove is used to delete the latest snapshot and its deltas
+func (st *snapshotStore) remove() error {
+	for _, name := range []string{snapshotMetaFile, snapshotDataFile} {
+		if err := os.Remove(filepath.Join(st.dir, name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return st.removeDeltas()
+}
+
+// removeDeltas is used to delete every delta snapshot
+func (st *snapshotStore) removeDeltas() error {
+	names, err := filepath.Glob(filepath.Join(st.dir, snapshotDeltaPrefix+"*"))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// snapshotSink is a snapshot being written, it becomes the latest snapshot
+// once it's finalized
+type snapshotSink struct {
+	store   *snapshotStore
+	meta    SnapshotMeta
+	file    *os.File
+	written int64
+}
+
+// Write ...
+func (sk *snapshotSink) Write(p []byte) (int, error) {
+	n, err := sk.file.Write(p)
+	sk.written += int64(n)
+	return n, err
+}
+
+// finalize is used to replace the latest snapshot with this one, a full
+// snapshot drops deltas of the previous one and a delta is added to them
+func (sk *snapshotSink) finalize() error {
+	if err := sk.file.Sync(); err != nil {
+		sk.cancel()
+		return err
+	}
+	if err := sk.file.Close(); err != nil {
+		_ = os.Remove(sk.file.Name())
+		return err
+	}
+
+	sk.meta.Size = sk.written
+	data, err := json.Marshal(&sk.meta)
+	if err != nil {
+		_ = os.Remove(sk.file.Name())
+		return err
+	}
+
+	dataFile, metaFile := sk.store.paths(sk.meta)
+	if err := os.Rename(sk.file.Name(), dataFile); err != nil {
+		_ = os.Remove(sk.file.Name())
+		return err
+	}
+	if err := ioutil.WriteFile(metaFile+".tmp", data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(metaFile+".tmp", metaFile); err != nil {
+		return err
+	}
+	if sk.meta.Base == 0 {
+		return sk.store.removeDeltas()
+	}
+	return nil
+}
+
+// cancel is used to discard the snapshot
+func (sk *snapshotSink) cancel() {
+	_ = sk.file.Close()
+	_ = os.Remove(sk.file.Name())
+}
+
+// Snapshot is used to save state machine at the last applied log and drop
+// logs up to it. Followers missing these logs are sent the snapshot. It's
+// a delta of the latest snapshot while SnapshotDeltas allows it.
+func (s *Server) Snapshot() error {
+	sm, ok := s.StateMachine().(SnapshotStateMachine)
+	if !ok || s.snapshots == nil {
+		return ErrSnapshotUnsupported
+	}
+
+	// Nothing is applied while state machine is saved, so the snapshot is
+	// exactly the state at index
+	s.applyLock.Lock()
+	defer s.applyLock.Unlock()
+
+	index := s.LastApplied()
+	if lastSnapshotIndex, _ := s.LastSnapshotInfo(); index == 0 || index <= lastSnapshotIndex {
+		return nil
+	}
+	log, err := s.logStore.GetLog(index)
+	if err != nil {
+		return err
+	}
+	configuration, err := json.Marshal(s.configuration())
+	if err != nil {
+		return err
+	}
+
+	meta := SnapshotMeta{Index: index, Term: log.Term, Configuration: configuration, Compressed: s.config.SnapshotCompression}
+	meta.Base = s.deltaSnapshotBase(sm)
+	sink, err := s.snapshots.create(meta)
+	if err != nil {
+		return err
+	}
+	// State machine may forget changes once it's saved, the next snapshot
+	// must be full unless this one is stored
+	s.deltaBase = false
+	if err := s.saveSnapshot(sm, sink); err != nil {
+		sink.cancel()
+		return err
+	}
+	if err := sink.finalize(); err != nil {
+		return err
+	}
+	s.deltaBase = true
+	s.setLastSnapshotInfo(index, log.Term)
+
+	first, err := s.logStore.FirstIndex()
+	if err != nil {
+		return err
+	}
+	s.debug("Snapshot taken at %d, compacting logs from %d", index, first)
+	return s.logStore.DeleteRange(first, index)
+}
+
+// snapshotOnThreshold is used to take a snapshot once logs applied since
+// the latest one reach SnapshotThreshold or SnapshotSizeThreshold
+func (s *Server) snapshotOnThreshold() {
+	if s.snapshots == nil {
+		return
+	}
+	s.Lock()
+	count, size := s.appliedSinceSnapshot, s.bytesSinceSnapshot
+	s.Unlock()
+
+	countHit := s.config.SnapshotThreshold > 0 && count >= s.config.SnapshotThreshold
+	sizeHit := s.config.SnapshotSizeThreshold > 0 && size >= s.config.SnapshotSizeThreshold
+	if !countHit && !sizeHit {
+		return
+	}
+	s.debug("Snapshot threshold reached by %d logs of %d bytes", count, size)
+	if err := s.Snapshot(); err != nil && err != ErrSnapshotUnsupported {
+		s.err("Failed to take snapshot: %v", err)
+	}
+}
+
+// deltaSnapshotBase return index of the latest snapshot if the next one
+// can be a delta of it, 0 if it must be full. applyLock must be held.
+func (s *Server) deltaSnapshotBase(sm SnapshotStateMachine) uint64 {
+	if _, ok := sm.(DeltaSnapshotStateMachine); !ok || s.config.SnapshotDeltas == 0 || !s.deltaBase {
+		return 0
+	}
+	chain, err := s.snapshots.chain()
+	if err != nil || len(chain) > s.config.SnapshotDeltas {
+		return 0
+	}
+	latest := chain[len(chain)-1].Index
+	if lastSnapshotIndex, _ := s.LastSnapshotInfo(); latest != lastSnapshotIndex {
+		return 0
+	}
+	return latest
+}
+
+// saveSnapshot is used to write state machine, or its changes since base
+// of a delta, to sink through gzip if snapshot is compressed
+func (s *Server) saveSnapshot(sm SnapshotStateMachine, sink *snapshotSink) error {
+	var w io.Writer = sink
+	var zw *gzip.Writer
+	if sink.meta.Compressed {
+		zw = gzip.NewWriter(sink)
+		w = zw
+	}
+
+	var err error
+	if sink.meta.Base > 0 {
+		err = sm.(DeltaSnapshotStateMachine).SnapshotDelta(w, sink.meta.Base)
+	} else {
+		err = sm.Snapshot(w)
+	}
+	if err != nil || zw == nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// sendSnapshot is used to stream the latest snapshot to follower in chunks
+// of SnapshotChunkSize, it returns whether follower installed it
+func (s *Server) sendSnapshot(f *follower) bool {
+	// Every file is opened first, a snapshot taken meanwhile doesn't leave
+	// the chain sent partly replaced
+	chain, err := s.snapshots.chain()
+	if err != nil {
+		s.err("Failed to open snapshot for %v: %v", f.peer, err)
+		return false
+	}
+	files := make([]*os.File, 0, len(chain))
+	defer func() {
+		for _, file := range files {
+			_ = file.Close()
+		}
+	}()
+	for _, meta := range chain {
+		file, err := s.snapshots.openData(meta)
+		if err != nil {
+			s.err("Failed to open snapshot for %v: %v", f.peer, err)
+			return false
+		}
+		files = append(files, file)
+	}
+
+	for i, meta := range chain {
+		if !s.sendSnapshotFile(f, meta, files[i]) {
+			return false
+		}
+	}
+	meta := chain[len(chain)-1]
+
+	f.Lock()
+	advanced := meta.Index > f.matchIndex
+	if advanced {
+		f.matchIndex = meta.Index
+	}
+	f.nextIndex = max(f.nextIndex, f.matchIndex+1)
+	learner := f.learner
+	f.Unlock()
+
+	if advanced && !learner {
+		asyncNotifyCh(s.commitCh)
+	}
+	s.debug("Snapshot at %d installed on %v", meta.Index, f.peer)
+	return true
+}
+
+// sendSnapshotFile is used to stream one snapshot of the chain, the full
+// one or a delta, it returns whether follower stored it
+func (s *Server) sendSnapshotFile(f *follower, meta SnapshotMeta, file *os.File) bool {
+	buf := make([]byte, s.config.SnapshotChunkSize)
+	var offset int64
+	for {
+		if !s.leading(f) {
+			return false
+		}
+		n, err := io.ReadFull(file, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			s.err("Failed to read snapshot for %v: %v", f.peer, err)
+			return false
+		}
+
+		req := &InstallSnapshotRequest{
+			Term:      f.currentTerm,
+			Leader:    s.LocalAddr(),
+			LastIndex: meta.Index,
+			LastTerm:  meta.Term,
+			Base:      meta.Base,
+			Offset:    offset,
+			Data:      buf[:n],
+			Done:      offset+int64(n) >= meta.Size,
+		}
+		if req.Done {
+			req.Configuration = meta.Configuration
+			req.Compressed = meta.Compressed
+		}
+
+		var resp InstallSnapshotResponse
+		ctx, cancel := s.rpcContext()
+		err = s.Transport().InstallSnapshot(ctx, f.peer, req, &resp)
+		cancel()
+		if err != nil {
+			failures := f.noteFailure()
+			select {
+			case <-s.clock().After(s.retryBackoff(failures)):
+			case <-f.stopCh:
+			}
+			return false
+		}
+		f.noteSuccess(s.clock().Now())
+
+		if resp.Term > req.Term {
+			s.debug("Newer term discoverd from %v, stepdown", f.peer)
+			s.stepDown(resp.Term)
+			// Run loop only leaves leader state, stopping heartbeats, once woken
+			asyncNotifyCh(s.commitCh)
+			return false
+		}
+		if req.Done {
+			break
+		}
+		offset += int64(n)
+
+		select {
+		case <-f.stopCh:
+			return false
+		default:
+		}
+	}
+	return true
+}
+
+// handleInstallSnapshot is used to write a chunk of leader's snapshot to
+// a temp file, the snapshot is restored once its last chunk arrives
+func (s *Server) handleInstallSnapshot(rpc RPC, req *InstallSnapshotRequest) {
+	resp := &InstallSnapshotResponse{
+		Term: s.CurrentTerm(),
+	}
+
+	var err error
+	defer func() {
+		rpc.Response(resp, err)
+	}()
+
+	if req.Term < s.CurrentTerm() {
+		return
+	}
+
+	if req.Term > s.CurrentTerm() || s.State() != Follower {
+		s.stepDown(req.Term)
+		asyncNotifyCh(s.commitCh)
+		resp.Term = req.Term
+	}
+	s.setLeader(req.Leader)
+
+	if s.snapshots == nil {
+		err = ErrSnapshotUnsupported
+		return
+	}
+
+	// A new snapshot from offset 0 replaces any partially received one. A
+	// delta must follow the latest snapshot stored.
+	if req.Offset == 0 {
+		if s.pendingSnapshot != nil {
+			s.pendingSnapshot.cancel()
+			s.pendingSnapshot = nil
+		}
+		if req.Base > 0 {
+			chain, chainErr := s.snapshots.chain()
+			if chainErr != nil || chain[len(chain)-1].Index != req.Base {
+				err = fmt.Errorf("delta snapshot %d doesn't follow latest snapshot", req.LastIndex)
+				return
+			}
+		}
+		s.pendingSnapshot, err = s.snapshots.create(SnapshotMeta{Index: req.LastIndex, Term: req.LastTerm, Base: req.Base})
+		if err != nil {
+			return
+		}
+	}
+
+	sink := s.pendingSnapshot
+	if sink == nil || sink.meta.Index != req.LastIndex || sink.meta.Term != req.LastTerm || sink.meta.Base != req.Base || sink.written != req.Offset {
+		err = fmt.Errorf("unexpected snapshot chunk %d at offset %d", req.LastIndex, req.Offset)
+		return
+	}
+	if _, err = sink.Write(req.Data); err != nil {
+		sink.cancel()
+		s.pendingSnapshot = nil
+		return
+	}
+	if !req.Done {
+		return
+	}
+
+	s.pendingSnapshot = nil
+	sink.meta.Configuration = req.Configuration
+	sink.meta.Compressed = req.Compressed
+	if err = sink.finalize(); err != nil {
+		return
+	}
+	err = s.restoreSnapshot()
+}
+
+// restoreSnapshot is used to replace state machine with the latest
+// snapshot, the full one then each delta on it. State machine already at a
+// snapshot of the chain only restores deltas after it. Logs after the
+// snapshot are kept if they follow on from it, otherwise the whole log is
+// dropped (§7).
+func (s *Server) restoreSnapshot() error {
+	sm, ok := s.StateMachine().(SnapshotStateMachine)
+	if !ok {
+		return ErrSnapshotUnsupported
+	}
+
+	chain, err := s.snapshots.chain()
+	if err != nil {
+		return err
+	}
+	meta := &chain[len(chain)-1]
+
+	s.applyLock.Lock()
+	defer s.applyLock.Unlock()
+
+	applied := s.LastApplied()
+	if meta.Index <= applied {
+		return nil
+	}
+	for i := range chain {
+		if chain[i].Index == applied {
+			chain = chain[i+1:]
+			break
+		}
+	}
+	// State machine can't tell log index a delta is based on, it only
+	// counts the logs it applies
+	restored := applied
+	s.deltaBase = false
+	for _, m := range chain {
+		if m.Base > 0 && m.Base != restored {
+			return fmt.Errorf("delta snapshot %d on %d doesn't follow state at %d", m.Index, m.Base, restored)
+		}
+		if err := s.restoreSnapshotFile(sm, m); err != nil {
+			return err
+		}
+		restored = m.Index
+	}
+	s.deltaBase = true
+	if len(meta.Configuration) > 0 {
+		if err := s.applyConfiguration(meta.Configuration); err != nil {
+			return err
+		}
+		s.Lock()
+		s.configIndex = max(s.configIndex, meta.Index)
+		s.Unlock()
+	}
+
+	first, err := s.logStore.FirstIndex()
+	if err != nil {
+		return err
+	}
+	// Logs right after snapshot are ours if they were compacted into a
+	// snapshot at the same index, e.g. on restart
+	if log, err := s.logStore.GetLog(meta.Index); (err == nil && log.Term == meta.Term) || first == meta.Index+1 {
+		err = s.logStore.DeleteRange(first, meta.Index)
+		if err != nil {
+			return err
+		}
+	} else {
+		if first > 0 {
+			if err := s.logStore.DeleteRange(first, s.LastLogIndex()); err != nil {
+				return err
+			}
+		}
+		s.setLastLogInfo(meta.Index, meta.Term)
+	}
+
+	s.setLastSnapshotInfo(meta.Index, meta.Term)
+	if meta.Index > s.CommitIndex() {
+		s.setCommitIndex(meta.Index)
+	}
+	s.setLastApplied(meta.Index)
+	s.debug("Snapshot at %d restored", meta.Index)
+	return nil
+}
+
+// restoreSnapshotFile is used to restore state machine from one snapshot
+// of the chain, through gzip if it's compressed
+func (s *Server) restoreSnapshotFile(sm SnapshotStateMachine, meta SnapshotMeta) error {
+	file, err := s.snapshots.openData(meta)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	var r io.Reader = file
+	if meta.Compressed {
+		zr, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	}
+	if meta.Base == 0 {
+		return sm.Restore(r)
+	}
+	delta, ok := sm.(DeltaSnapshotStateMachine)
+	if !ok {
+		return ErrSnapshotUnsupported
+	}
+	return delta.RestoreDelta(r)
+}
@@ -0,0 +1,202 @@
+package raft
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSnapshotCompactsLogs(t *testing.T) {
+	s := mustNewServer(DefaultConfig(), NewInmemTransport(""), NewInmemLogStore(), NewInMemStateMachine())
+	if err := s.Snapshot(); err != ErrSnapshotUnsupported {
+		t.Fatalf("Snapshot without dir should be unsupported: %v", err)
+	}
+
+	s.snapshots = newSnapshotStore(t.TempDir())
+	s.Start()
+	defer s.Stop()
+	waitForLeader(t, []*Server{s})
+
+	for i := 0; i < 5; i++ {
+		if err := s.Do([]byte(fmt.Sprintf("k%d:v%d", i, i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+
+	index, term := s.LastSnapshotInfo()
+	if index != s.LastApplied() || term != s.CurrentTerm() {
+		t.Fatalf("Wrong snapshot info: index %d term %d", index, term)
+	}
+	if _, err := s.logStore.GetLog(index); err == nil {
+		t.Fatalf("Logs covered by snapshot should be compacted")
+	}
+	if err := s.ReplayLogs(NewInMemStateMachine(), index); err != ErrCompacted {
+		t.Fatalf("Compacted logs should not be replayed: %v", err)
+	}
+
+	// Logs after snapshot follow on from it
+	if err := s.Do([]byte("a:b")); err != nil {
+		t.Fatal(err)
+	}
+	if first, _ := s.logStore.FirstIndex(); first != index+1 {
+		t.Fatalf("Log after snapshot should be at %d: %d", index+1, first)
+	}
+}
+
+func TestSnapshotSizeThreshold(t *testing.T) {
+	config := DefaultConfig()
+	config.SnapshotThreshold = 100
+	config.SnapshotSizeThreshold = 1000
+	s := mustNewServer(config, NewInmemTransport(""), NewInmemLogStore(), NewInMemStateMachine())
+	s.snapshots = newSnapshotStore(t.TempDir())
+	s.Start()
+	defer s.Stop()
+	waitForLeader(t, []*Server{s})
+
+	// A few large logs reach the size threshold long before the count one
+	value := strings.Repeat("v", 400)
+	for i := 0; i < 3; i++ {
+		if index, _ := s.LastSnapshotInfo(); index != 0 {
+			t.Fatalf("Snapshot should not be taken below thresholds: %d", index)
+		}
+		if err := s.Do([]byte(fmt.Sprintf("k%d:%s", i, value))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadline := time.Now().Add(testElectionTimeout)
+	for {
+		if index, _ := s.LastSnapshotInfo(); index == s.LastApplied() {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Snapshot should be taken once size threshold is hit")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if first, _ := s.logStore.FirstIndex(); first != 0 {
+		t.Fatalf("Logs covered by snapshot should be compacted: first index %d", first)
+	}
+}
+
+func TestInstallSnapshotInChunks(t *testing.T) {
+	network, cluster := NewTestNetworkCluster(3)
+	for _, s := range cluster {
+		s.snapshots = newSnapshotStore(t.TempDir())
+		s.config.SnapshotChunkSize = 16
+		s.Start()
+		defer s.Stop()
+	}
+	leader := waitForLeader(t, cluster)
+
+	var lagging *Server
+	for _, s := range cluster {
+		if s != leader {
+			lagging = s
+		}
+	}
+	network.Isolate(lagging.LocalAddr())
+
+	for i := 0; i < 20; i++ {
+		if err := leader.Do([]byte(fmt.Sprintf("k%d:v%d", i, i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Whoever leads once lagging node is back only has the snapshot
+	for _, s := range cluster {
+		if s == lagging {
+			continue
+		}
+		if err := s.WaitApplied(leader.CommitIndex(), time.Second); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Snapshot(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	meta, file, err := leader.snapshots.open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	if meta.Size <= 2*int64(leader.config.SnapshotChunkSize) {
+		t.Fatalf("Snapshot should take several chunks: %d bytes", meta.Size)
+	}
+
+	for _, s := range cluster {
+		if s != lagging {
+			network.Reconnect(lagging.LocalAddr(), s.LocalAddr())
+		}
+	}
+	if err := lagging.WaitApplied(meta.Index, 20*testElectionTimeout); err != nil {
+		t.Fatalf("Lagging node should catch up from snapshot: %v", err)
+	}
+
+	if index, _ := lagging.LastSnapshotInfo(); index < meta.Index {
+		t.Fatalf("Lagging node should install snapshot at %d: %d", meta.Index, index)
+	}
+	want := leader.StateMachine().(*InmemStateMachine)
+	got := lagging.StateMachine().(*InmemStateMachine)
+	want.Lock()
+	got.Lock()
+	defer want.Unlock()
+	defer got.Unlock()
+	if !reflect.DeepEqual(want.data, got.data) {
+		t.Fatalf("Restored state differs: %v (want %v)", got.data, want.data)
+	}
+}
+
+func TestSnapshotCompression(t *testing.T) {
+	value := strings.Repeat("v", 256)
+	sizes := map[bool]int64{}
+	for _, compressed := range []bool{false, true} {
+		dir := t.TempDir()
+		config := DefaultConfig()
+		config.SnapshotCompression = compressed
+		s := mustNewServer(config, NewInmemTransport(""), NewInmemLogStore(), NewInMemStateMachine())
+		s.snapshots = newSnapshotStore(dir)
+		s.Start()
+		waitForLeader(t, []*Server{s})
+		for i := 0; i < 50; i++ {
+			if err := s.Do([]byte(fmt.Sprintf("k%d:%s", i, value))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := s.Snapshot(); err != nil {
+			t.Fatal(err)
+		}
+		s.Stop()
+
+		meta, file, err := s.snapshots.open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := file.Stat()
+		file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if meta.Compressed != compressed || meta.Size != info.Size() {
+			t.Fatalf("Wrong snapshot meta: %+v (%d bytes on disk)", meta, info.Size())
+		}
+		sizes[compressed] = info.Size()
+
+		// State machine restores the same state whatever the encoding
+		restored := mustNewServer(DefaultConfig(), NewInmemTransport(""), NewInmemLogStore(), NewInMemStateMachine())
+		restored.snapshots = newSnapshotStore(dir)
+		if err := restored.restoreSnapshot(); err != nil {
+			t.Fatal(err)
+		}
+		if v := restored.StateMachine().Get([]byte("k49")); v != value {
+			t.Fatalf("Wrong restored value (compressed %v): %v", compressed, v)
+		}
+	}
+	if sizes[true] >= sizes[false] {
+		t.Fatalf("Compressed snapshot should be smaller: %d vs %d bytes", sizes[true], sizes[false])
+	}
+}
@@ -1,8 +1,56 @@
 package raft
 
+import "io"
+
 // StateMachine is interface that can be implemented by client
 // to commit replicated log
 type StateMachine interface {
 	Set(data interface{}) error
 	Get(data interface{}) interface{}
 }
+
+// BatchStateMachine can be implemented by StateMachine to apply a run of
+// committed logs at once, e.g. under a single lock acquisition. Result of
+// each command is returned in the same order.
+type BatchStateMachine interface {
+	StateMachine
+	SetBatch(data []interface{}) []error
+}
+
+// LogStateMachine can be implemented by StateMachine to receive committed
+// command logs rather than their data, e.g. to version keys by index of
+// the log that wrote them. It's preferred over SetBatch and Set. Result of
+// a command can be handed to its caller with SetResult.
+type LogStateMachine interface {
+	StateMachine
+	ApplyLogs(logs []*Log) []error
+}
+
+// ResetStateMachine can be implemented by StateMachine to be emptied, so
+// a corrupted node can be rebuilt from leader with Server.Reset
+type ResetStateMachine interface {
+	StateMachine
+	Reset() error
+}
+
+// SnapshotStateMachine can be implemented by StateMachine to support
+// snapshots, logs covered by a snapshot are compacted and followers too far
+// behind are restored from it
+type SnapshotStateMachine interface {
+	StateMachine
+	Snapshot(w io.Writer) error
+	Restore(r io.Reader) error
+}
+
+// DeltaSnapshotStateMachine can be implemented by SnapshotStateMachine to
+// take delta snapshots, only holding changes since a base, when
+// Config.SnapshotDeltas is set. SnapshotDelta is used to write changes
+// applied after base, which is the log index of the latest snapshot taken
+// or restored. RestoreDelta is used to apply changes written by
+// SnapshotDelta on top of state at their base, raft only calls it once
+// state is restored up to base.
+type DeltaSnapshotStateMachine interface {
+	SnapshotStateMachine
+	SnapshotDelta(w io.Writer, base uint64) error
+	RestoreDelta(r io.Reader) error
+}
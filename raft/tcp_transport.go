@@ -0,0 +1,446 @@
+package raft
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	rpcRequestVote uint8 = iota + 1
+	rpcAppendEntries
+	rpcResponse
+	rpcTimeoutNow
+	rpcInstallSnapshot
+)
+
+const (
+	// frameHeaderSize is the size of type byte and request id
+	frameHeaderSize = 1 + 8
+	// maxFrameSize guards against allocating huge buffer for corrupted frame
+	maxFrameSize = 64 << 20
+)
+
+var (
+	// ErrTransportShutdown is returned when transport is already closed
+	ErrTransportShutdown = errors.New("transport shutdown")
+)
+
+// frame is the unit sent over TCP connection. It's encoded as 4 bytes
+// length of the rest, 1 byte type, 8 bytes request id then payload.
+type frame struct {
+	rpcType uint8
+	id      uint64
+	payload []byte
+}
+
+type tcpResponse struct {
+	Response json.RawMessage `json:"response"`
+	Error    string          `json:"error,omitempty"`
+}
+
+func writeFrame(w io.Writer, f *frame) error {
+	buf := make([]byte, 4+frameHeaderSize+len(f.payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(frameHeaderSize+len(f.payload)))
+	buf[4] = f.rpcType
+	binary.BigEndian.PutUint64(buf[5:13], f.id)
+	copy(buf[13:], f.payload)
+	_, err := w.Write(buf)
+	return err
+}
+
+func readFrame(r io.Reader) (*frame, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+
+	n := binary.BigEndian.Uint32(size[:])
+	if n < frameHeaderSize || n > maxFrameSize {
+		return nil, fmt.Errorf("invalid frame size: %d", n)
+	}
+
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+
+	return &frame{
+		rpcType: buf[0],
+		id:      binary.BigEndian.Uint64(buf[1:9]),
+		payload: buf[9:],
+	}, nil
+}
+
+// TCPTransport send RPC over persistent TCP connections, concurrent RPC to
+// the same peer are multiplexed on one connection
+type TCPTransport struct {
+	sync.Mutex
+	consumerCh chan RPC
+	listener   net.Listener
+	timeout    time.Duration
+
+	conns      map[string]*tcpConn
+	accepted   map[net.Conn]struct{}
+	shutdown   bool
+	shutdownCh chan struct{}
+}
+
+// NewTCPTransport is used to create transport listening on bindAddr, timeout
+// is used to dial peers
+func NewTCPTransport(bindAddr string, timeout time.Duration) (*TCPTransport, error) {
+	listener, err := net.Listen("tcp", bindAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &TCPTransport{
+		consumerCh: make(chan RPC),
+		listener:   listener,
+		timeout:    timeout,
+		conns:      make(map[string]*tcpConn),
+		accepted:   make(map[net.Conn]struct{}),
+		shutdownCh: make(chan struct{}),
+	}
+	go t.listen()
+
+	return t, nil
+}
+
+// Consumer ...
+func (t *TCPTransport) Consumer() <-chan RPC {
+	return t.consumerCh
+}
+
+// LocalAddr ...
+func (t *TCPTransport) LocalAddr() string {
+	return t.listener.Addr().String()
+}
+
+// Close is used to stop listening and close every connection
+func (t *TCPTransport) Close() error {
+	t.Lock()
+	if t.shutdown {
+		t.Unlock()
+		return nil
+	}
+	t.shutdown = true
+	close(t.shutdownCh)
+	conns := t.conns
+	t.conns = make(map[string]*tcpConn)
+	accepted := t.accepted
+	t.accepted = make(map[net.Conn]struct{})
+	t.Unlock()
+
+	err := t.listener.Close()
+	for _, c := range conns {
+		c.close(ErrTransportShutdown)
+	}
+	for conn := range accepted {
+		_ = conn.Close()
+	}
+	return err
+}
+
+// RequestVote ...
+func (t *TCPTransport) RequestVote(ctx context.Context, target string, req *RequestVoteRequest, resp *RequestVoteResponse) error {
+	return t.sendRPC(ctx, target, rpcRequestVote, req, resp)
+}
+
+// AppendEntries ...
+func (t *TCPTransport) AppendEntries(ctx context.Context, target string, req *AppendEntryRequest, resp *AppendEntryResponse) error {
+	return t.sendRPC(ctx, target, rpcAppendEntries, req, resp)
+}
+
+// TimeoutNow ...
+func (t *TCPTransport) TimeoutNow(ctx context.Context, target string, req *TimeoutNowRequest, resp *TimeoutNowResponse) error {
+	return t.sendRPC(ctx, target, rpcTimeoutNow, req, resp)
+}
+
+// InstallSnapshot ...
+func (t *TCPTransport) InstallSnapshot(ctx context.Context, target string, req *InstallSnapshotRequest, resp *InstallSnapshotResponse) error {
+	return t.sendRPC(ctx, target, rpcInstallSnapshot, req, resp)
+}
+
+func (t *TCPTransport) sendRPC(ctx context.Context, target string, rpcType uint8, req interface{}, resp interface{}) error {
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	c, err := t.getConn(target)
+	if err != nil {
+		return err
+	}
+
+	respFrame, err := c.call(ctx, rpcType, payload)
+	if err != nil {
+		return err
+	}
+
+	var out tcpResponse
+	if err := json.Unmarshal(respFrame.payload, &out); err != nil {
+		return err
+	}
+	if out.Error != "" {
+		return DecodeError(out.Error)
+	}
+	return json.Unmarshal(out.Response, resp)
+}
+
+// getConn return the connection to target, dialing a new one if there is
+// none or the last one failed
+func (t *TCPTransport) getConn(target string) (*tcpConn, error) {
+	t.Lock()
+	if t.shutdown {
+		t.Unlock()
+		return nil, ErrTransportShutdown
+	}
+	if c, ok := t.conns[target]; ok {
+		t.Unlock()
+		return c, nil
+	}
+	t.Unlock()
+
+	conn, err := net.DialTimeout("tcp", target, t.timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &tcpConn{
+		conn:    conn,
+		pending: make(map[uint64]chan *frame),
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	if t.shutdown {
+		_ = conn.Close()
+		return nil, ErrTransportShutdown
+	}
+	if existing, ok := t.conns[target]; ok {
+		// Another RPC dialed concurrently, keep only one connection
+		_ = conn.Close()
+		return existing, nil
+	}
+	t.conns[target] = c
+
+	go func() {
+		err := c.readResponses()
+		t.Lock()
+		if t.conns[target] == c {
+			delete(t.conns, target)
+		}
+		t.Unlock()
+		c.close(err)
+	}()
+
+	return c, nil
+}
+
+func (t *TCPTransport) listen() {
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			t.Lock()
+			shutdown := t.shutdown
+			t.Unlock()
+			if shutdown {
+				return
+			}
+			continue
+		}
+
+		t.Lock()
+		if t.shutdown {
+			t.Unlock()
+			_ = conn.Close()
+			return
+		}
+		t.accepted[conn] = struct{}{}
+		t.Unlock()
+
+		go t.handleConn(conn)
+	}
+}
+
+// handleConn is used to read requests from a connection and dispatch them
+// to consumer, responses are written back as soon as they're ready
+func (t *TCPTransport) handleConn(conn net.Conn) {
+	defer func() {
+		t.Lock()
+		delete(t.accepted, conn)
+		t.Unlock()
+		_ = conn.Close()
+	}()
+
+	var writeLock sync.Mutex
+	r := bufio.NewReader(conn)
+	for {
+		f, err := readFrame(r)
+		if err != nil {
+			return
+		}
+
+		go func(f *frame) {
+			resp := t.dispatch(f)
+			payload, err := json.Marshal(resp)
+			if err != nil {
+				return
+			}
+
+			writeLock.Lock()
+			defer writeLock.Unlock()
+			_ = writeFrame(conn, &frame{rpcType: rpcResponse, id: f.id, payload: payload})
+		}(f)
+	}
+}
+
+func (t *TCPTransport) dispatch(f *frame) *tcpResponse {
+	var req interface{}
+	switch f.rpcType {
+	case rpcRequestVote:
+		req = &RequestVoteRequest{}
+	case rpcAppendEntries:
+		req = &AppendEntryRequest{}
+	case rpcTimeoutNow:
+		req = &TimeoutNowRequest{}
+	case rpcInstallSnapshot:
+		req = &InstallSnapshotRequest{}
+	default:
+		return &tcpResponse{Error: fmt.Sprintf("rpc type %d: %v", f.rpcType, ErrUnknownCommand)}
+	}
+
+	if err := json.Unmarshal(f.payload, req); err != nil {
+		return &tcpResponse{Error: err.Error()}
+	}
+
+	respCh := make(chan RPCResponse, 1)
+	select {
+	case t.consumerCh <- RPC{
+		Request: req,
+		RespCh:  respCh,
+	}:
+	case <-t.shutdownCh:
+		return &tcpResponse{Error: ErrTransportShutdown.Error()}
+	}
+
+	var rpcResp RPCResponse
+	select {
+	case rpcResp = <-respCh:
+	case <-t.shutdownCh:
+		return &tcpResponse{Error: ErrTransportShutdown.Error()}
+	}
+
+	out := &tcpResponse{}
+	if rpcResp.Error != nil {
+		out.Error = rpcResp.Error.Error()
+	}
+	data, err := json.Marshal(rpcResp.Response)
+	if err != nil {
+		return &tcpResponse{Error: err.Error()}
+	}
+	out.Response = data
+	return out
+}
+
+// tcpConn is an outgoing connection, responses are matched to their
+// requests by id so many RPC can be in flight at once
+type tcpConn struct {
+	conn      net.Conn
+	writeLock sync.Mutex
+
+	sync.Mutex
+	nextID  uint64
+	pending map[uint64]chan *frame
+	err     error
+}
+
+func (c *tcpConn) call(ctx context.Context, rpcType uint8, payload []byte) (*frame, error) {
+	respCh := make(chan *frame, 1)
+
+	c.Lock()
+	if c.err != nil {
+		c.Unlock()
+		return nil, c.err
+	}
+	c.nextID++
+	id := c.nextID
+	c.pending[id] = respCh
+	c.Unlock()
+
+	defer func() {
+		c.Lock()
+		delete(c.pending, id)
+		c.Unlock()
+	}()
+
+	c.writeLock.Lock()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = c.conn.SetWriteDeadline(deadline)
+	}
+	err := writeFrame(c.conn, &frame{rpcType: rpcType, id: id, payload: payload})
+	c.writeLock.Unlock()
+	if err != nil {
+		// Connection is broken, let reader drop it so next RPC reconnects
+		_ = c.conn.Close()
+		return nil, err
+	}
+
+	select {
+	case f, ok := <-respCh:
+		if !ok {
+			c.Lock()
+			err := c.err
+			c.Unlock()
+			return nil, err
+		}
+		return f, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *tcpConn) readResponses() error {
+	r := bufio.NewReader(c.conn)
+	for {
+		f, err := readFrame(r)
+		if err != nil {
+			return err
+		}
+
+		c.Lock()
+		respCh, ok := c.pending[f.id]
+		delete(c.pending, f.id)
+		c.Unlock()
+		if ok {
+			respCh <- f
+		}
+	}
+}
+
+// close is used to fail every pending RPC with err
+func (c *tcpConn) close(err error) {
+	_ = c.conn.Close()
+
+	c.Lock()
+	defer c.Unlock()
+	if c.err != nil {
+		return
+	}
+	if err == nil {
+		err = io.EOF
+	}
+	c.err = err
+	for id, respCh := range c.pending {
+		close(respCh)
+		delete(c.pending, id)
+	}
+}
@@ -0,0 +1,244 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestTCPTransport(t *testing.T, addr string) *TCPTransport {
+	transport, err := NewTCPTransport(addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return transport
+}
+
+// serveAppendEntries answer every AppendEntries with the index of last entry
+func serveAppendEntries(transport *TCPTransport, stopCh chan struct{}) {
+	for {
+		select {
+		case rpc := <-transport.Consumer():
+			req := rpc.Request.(*AppendEntryRequest)
+			resp := &AppendEntryResponse{Term: req.Term, Success: true}
+			if n := len(req.Entries); n > 0 {
+				resp.LastLogIndex = req.Entries[n-1].Index
+			}
+			rpc.Response(resp, nil)
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+func TestTCPFrameRoundTrip(t *testing.T) {
+	frames := []*frame{
+		{rpcType: rpcRequestVote, id: 1, payload: []byte(`{"term":"1"}`)},
+		{rpcType: rpcAppendEntries, id: 1 << 40, payload: []byte{}},
+		{rpcType: rpcResponse, id: 42, payload: bytes.Repeat([]byte{0, 1, 2}, 1000)},
+	}
+
+	var buf bytes.Buffer
+	for _, f := range frames {
+		if err := writeFrame(&buf, f); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, want := range frames {
+		got, err := readFrame(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.rpcType != want.rpcType || got.id != want.id || !bytes.Equal(got.payload, want.payload) {
+			t.Fatalf("Wrong frame: %+v (want %+v)", got, want)
+		}
+	}
+
+	// Corrupted size should be rejected
+	if _, err := readFrame(bytes.NewReader([]byte{0, 0, 0, 1, 0})); err == nil {
+		t.Fatalf("Frame smaller than header should be rejected")
+	}
+}
+
+func TestTCPTransportRPC(t *testing.T) {
+	t1 := newTestTCPTransport(t, "127.0.0.1:0")
+	defer t1.Close()
+	t2 := newTestTCPTransport(t, "127.0.0.1:0")
+	defer t2.Close()
+
+	go func() {
+		rpc := <-t2.Consumer()
+		req := rpc.Request.(*RequestVoteRequest)
+		rpc.Response(&RequestVoteResponse{Term: req.Term, Granted: true}, nil)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	var resp RequestVoteResponse
+	if err := t1.RequestVote(ctx, t2.LocalAddr(), newVoteRequest(3, "foo", 1, 1), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Term != 3 || !resp.Granted {
+		t.Fatalf("Wrong vote response: %+v", resp)
+	}
+
+	go func() {
+		rpc := <-t2.Consumer()
+		rpc.Response(&AppendEntryResponse{}, fmt.Errorf("rejected"))
+	}()
+	var aeResp AppendEntryResponse
+	if err := t1.AppendEntries(ctx, t2.LocalAddr(), &AppendEntryRequest{}, &aeResp); err == nil || err.Error() != "rejected" {
+		t.Fatalf("RPC error should be returned: %v", err)
+	}
+
+	go func() {
+		rpc := <-t2.Consumer()
+		req := rpc.Request.(*TimeoutNowRequest)
+		rpc.Response(&TimeoutNowResponse{Term: req.Term}, nil)
+	}()
+	var tnResp TimeoutNowResponse
+	if err := t1.TimeoutNow(ctx, t2.LocalAddr(), &TimeoutNowRequest{Term: 5}, &tnResp); err != nil || tnResp.Term != 5 {
+		t.Fatalf("Wrong TimeoutNow response: %+v %v", tnResp, err)
+	}
+}
+
+func TestTCPTransportMultiplexRPC(t *testing.T) {
+	t1 := newTestTCPTransport(t, "127.0.0.1:0")
+	defer t1.Close()
+	t2 := newTestTCPTransport(t, "127.0.0.1:0")
+	defer t2.Close()
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go serveAppendEntries(t2, stopCh)
+
+	var wg sync.WaitGroup
+	errCh := make(chan error, 50)
+	for i := 1; i <= 50; i++ {
+		wg.Add(1)
+		go func(i uint64) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			req := &AppendEntryRequest{
+				Term:    1,
+				Entries: []*Log{{Index: i, Term: 1, Command: []byte("a:b")}},
+			}
+			var resp AppendEntryResponse
+			if err := t1.AppendEntries(ctx, t2.LocalAddr(), req, &resp); err != nil {
+				errCh <- err
+				return
+			}
+			if resp.LastLogIndex != i {
+				errCh <- fmt.Errorf("response of %d is matched to wrong request: %+v", i, resp)
+			}
+		}(uint64(i))
+	}
+	wg.Wait()
+	close(errCh)
+
+	for err := range errCh {
+		t.Fatal(err)
+	}
+
+	t1.Lock()
+	conns := len(t1.conns)
+	t1.Unlock()
+	if conns != 1 {
+		t.Fatalf("Concurrent RPC should share one connection: %v", conns)
+	}
+}
+
+func TestTCPTransportReconnect(t *testing.T) {
+	t1 := newTestTCPTransport(t, "127.0.0.1:0")
+	defer t1.Close()
+	t2 := newTestTCPTransport(t, "127.0.0.1:0")
+	addr := t2.LocalAddr()
+
+	stopCh := make(chan struct{})
+	go serveAppendEntries(t2, stopCh)
+
+	send := func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		var resp AppendEntryResponse
+		return t1.AppendEntries(ctx, addr, &AppendEntryRequest{Term: 1}, &resp)
+	}
+
+	if err := send(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Peer restarts on the same address
+	close(stopCh)
+	t2.Close()
+	t2 = newTestTCPTransport(t, addr)
+	defer t2.Close()
+	stopCh = make(chan struct{})
+	defer close(stopCh)
+	go serveAppendEntries(t2, stopCh)
+
+	// Broken connection is dropped, following RPC reconnects
+	deadline := time.Now().Add(time.Second)
+	for {
+		err := send()
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Failed to reconnect: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTCPTransportServer(t *testing.T) {
+	var transports []*TCPTransport
+	for i := 0; i < 3; i++ {
+		transport := newTestTCPTransport(t, "127.0.0.1:0")
+		defer transport.Close()
+		transports = append(transports, transport)
+	}
+
+	var cluster []*Server
+	for _, transport := range transports {
+		s := mustNewServer(DefaultConfig(), transport, NewInmemLogStore(), NewInMemStateMachine())
+		for _, peer := range transports {
+			if peer != transport {
+				s.AddPeer(peer.LocalAddr(), 0)
+			}
+		}
+		cluster = append(cluster, s)
+	}
+	for _, s := range cluster {
+		s.Start()
+	}
+	defer func() {
+		for _, s := range cluster {
+			s.Stop()
+		}
+	}()
+
+	leader := waitForLeader(t, cluster)
+	if err := leader.Do([]byte("a:b")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Command is committed after leader's no-op and bootstrap configuration
+	time.Sleep(testElectionTimeout)
+	for _, s := range cluster {
+		if s.CommitIndex() != 3 {
+			t.Fatalf("Wrong commit on server %v: %v", s.LocalAddr(), s.CommitIndex())
+		}
+		if v := s.StateMachine().Get([]byte("a")); !reflect.DeepEqual(v, "b") {
+			t.Fatalf("Wrong value on server %v: %v", s.LocalAddr(), v)
+		}
+	}
+}
@@ -1,11 +1,20 @@
 package raft
 
+// mustNewServer is used to create server with a config known to be valid
+func mustNewServer(config *Config, transport Transport, ls LogStore, sm StateMachine) *Server {
+	s, err := NewServer(config, transport, ls, sm)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
 // NewTestServer ...
 func NewTestServer() *Server {
 	transport := NewInmemTransport("")
 	logstore := NewInmemLogStore()
 	sm := NewInMemStateMachine()
-	s := NewServer(DefaultConfig(), transport, logstore, sm)
+	s := mustNewServer(DefaultConfig(), transport, logstore, sm)
 	transport.AddPeer(transport)
 	s.setTransport(transport)
 	return s
@@ -31,7 +40,7 @@ func NewTestCluster(total int) []*Server {
 	for _, transport := range transports {
 		logStore := NewInmemLogStore()
 		sm := NewInMemStateMachine()
-		s := NewServer(DefaultConfig(), transport, logStore, sm)
+		s := mustNewServer(DefaultConfig(), transport, logStore, sm)
 		cluster = append(cluster, s)
 		for _, peer := range transports {
 			if s.LocalAddr() != peer.LocalAddr() {
@@ -42,3 +51,26 @@ func NewTestCluster(total int) []*Server {
 
 	return cluster
 }
+
+// NewTestNetworkCluster is used to create cluster wired through network,
+// partitions and latency can be injected via the returned network
+func NewTestNetworkCluster(total int) (*InmemNetwork, []*Server) {
+	network := NewInmemNetwork()
+	transports := []*InmemTransport{}
+	for i := 1; i <= total; i++ {
+		transports = append(transports, network.NewTransport(""))
+	}
+
+	cluster := []*Server{}
+	for _, transport := range transports {
+		s := mustNewServer(DefaultConfig(), transport, NewInmemLogStore(), NewInMemStateMachine())
+		for _, peer := range transports {
+			if s.LocalAddr() != peer.LocalAddr() {
+				s.peers = append(s.peers, peer.LocalAddr())
+			}
+		}
+		cluster = append(cluster, s)
+	}
+
+	return network, cluster
+}
@@ -0,0 +1,40 @@
+package raft
+
+import "context"
+
+// Tracer is used to trace RPC handling and writes, e.g. by an adapter to
+// OpenTelemetry. A span started from ctx is a child of the span ctx
+// carries, if any.
+type Tracer interface {
+	StartSpan(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is the trace of one operation, it's ended with the error the
+// operation failed with
+type Span interface {
+	SetAttribute(key string, value interface{})
+	End(err error)
+}
+
+type noopTracer struct{}
+
+// StartSpan ...
+func (noopTracer) StartSpan(ctx context.Context, name string) (context.Context, Span) {
+	return ctx, noopSpan{}
+}
+
+type noopSpan struct{}
+
+// SetAttribute ...
+func (noopSpan) SetAttribute(key string, value interface{}) {}
+
+// End ...
+func (noopSpan) End(err error) {}
+
+// Tracer return Config.Tracer, one doing nothing if it's not set
+func (s *Server) Tracer() Tracer {
+	if s.config.Tracer == nil {
+		return noopTracer{}
+	}
+	return s.config.Tracer
+}
@@ -0,0 +1,84 @@
+package raft
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingTracer keep name and parent of every ended span
+type recordingTracer struct {
+	sync.Mutex
+	spans map[string]string
+}
+
+type spanKey struct{}
+
+type recordingSpan struct {
+	tracer *recordingTracer
+	name   string
+	parent string
+}
+
+func (t *recordingTracer) StartSpan(ctx context.Context, name string) (context.Context, Span) {
+	parent, _ := ctx.Value(spanKey{}).(string)
+	return context.WithValue(ctx, spanKey{}, name), &recordingSpan{tracer: t, name: name, parent: parent}
+}
+
+func (sp *recordingSpan) SetAttribute(key string, value interface{}) {}
+
+func (sp *recordingSpan) End(err error) {
+	sp.tracer.Lock()
+	defer sp.tracer.Unlock()
+	sp.tracer.spans[sp.name] = sp.parent
+}
+
+func (t *recordingTracer) ended(name string) (string, bool) {
+	t.Lock()
+	defer t.Unlock()
+	parent, ok := t.spans[name]
+	return parent, ok
+}
+
+func TestTracerSpansOfWrite(t *testing.T) {
+	cluster := NewTestCluster(3)
+	tracers := make([]*recordingTracer, len(cluster))
+	for i, s := range cluster {
+		tracers[i] = &recordingTracer{spans: map[string]string{}}
+		s.config.Tracer = tracers[i]
+		s.Start()
+		defer s.Stop()
+	}
+	leader := waitForLeader(t, cluster)
+
+	ctx, span := leader.Tracer().StartSpan(context.Background(), "client")
+	index, _, err := leader.ApplyResult(ctx, []byte("a:b"))
+	span.End(err)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, s := range cluster {
+		if err := s.WaitApplied(index, time.Second); err != nil {
+			t.Fatal(err)
+		}
+		tracer := tracers[i]
+		if s != leader {
+			if _, ok := tracer.ended("raft.HandleAppendEntries"); !ok {
+				t.Fatalf("Follower %v should trace AppendEntries", s.LocalAddr())
+			}
+			continue
+		}
+
+		if parent, ok := tracer.ended("raft.Apply"); !ok || parent != "client" {
+			t.Fatalf("Write should be traced under caller's span: %v %q", ok, parent)
+		}
+		if parent, ok := tracer.ended("raft.ApplyLog"); !ok || parent != "raft.Apply" {
+			t.Fatalf("Applying log should be traced under write: %v %q", ok, parent)
+		}
+		if _, ok := tracer.ended("raft.AppendEntries"); !ok {
+			t.Fatalf("Leader should trace replication")
+		}
+	}
+}
@@ -1,5 +1,7 @@
 package raft
 
+import "context"
+
 // Transport provide interface for network transport
 type Transport interface {
 	// Consumer return channel used to handle rpc
@@ -8,9 +10,15 @@ type Transport interface {
 	// LocalAddr is used to return local address
 	LocalAddr() string
 
-	// RequestVote used to send RPC to target node
-	RequestVote(target string, req *RequestVoteRequest, resp *RequestVoteResponse) error
+	// RequestVote used to send RPC to target node, it returns once ctx is done
+	RequestVote(ctx context.Context, target string, req *RequestVoteRequest, resp *RequestVoteResponse) error
+
+	// AppendEntries used to send RPC to target node, it returns once ctx is done
+	AppendEntries(ctx context.Context, target string, req *AppendEntryRequest, resp *AppendEntryResponse) error
+
+	// TimeoutNow used to send RPC to target node, it returns once ctx is done
+	TimeoutNow(ctx context.Context, target string, req *TimeoutNowRequest, resp *TimeoutNowResponse) error
 
-	// AppendEntries used to send RPC to target node
-	AppendEntries(target string, req *AppendEntryRequest, resp *AppendEntryResponse) error
+	// InstallSnapshot used to send RPC to target node, it returns once ctx is done
+	InstallSnapshot(ctx context.Context, target string, req *InstallSnapshotRequest, resp *InstallSnapshotResponse) error
 }
@@ -5,13 +5,34 @@ import (
 	"time"
 )
 
-func randomDuration(min int64) time.Duration {
-	max := min * 2
+// randomDuration return random duration in [min, max) milliseconds
+func randomDuration(min, max int64) time.Duration {
 	rand := rand.New(rand.NewSource(time.Now().UnixNano()))
 	duration := time.Duration(rand.Int63n(max-min) + min)
 	return duration * time.Millisecond
 }
 
+// backoff return exponential duration to wait after given number of
+// consecutive failures, capped at max. A random jitter is applied so peers
+// don't retry all at once.
+func backoff(base, max time.Duration, failures uint64) time.Duration {
+	d := max
+	if failures < 32 && base<<(failures-1) < max {
+		d = base << (failures - 1)
+	}
+	rand := rand.New(rand.NewSource(time.Now().UnixNano()))
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// jitter return random duration in [0, max], it's drawn from the shared
+// source so callers at the same instant still get different durations
+func jitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max) + 1))
+}
+
 func min(a, b uint64) uint64 {
 	if a > b {
 		return b
@@ -26,6 +47,15 @@ func max(a, b uint64) uint64 {
 	return b
 }
 
+func contains(addrs []string, addr string) bool {
+	for _, a := range addrs {
+		if a == addr {
+			return true
+		}
+	}
+	return false
+}
+
 func asyncNotifyCh(ch chan struct{}) {
 	select {
 	case ch <- struct{}{}:
@@ -1,13 +1,23 @@
 package raft
 
-import "testing"
+import (
+	"testing"
+	"time"
+)
 
 func TestRandomDuration(t *testing.T) {
-	d1 := randomDuration(150)
-	d2 := randomDuration(150)
+	d1 := randomDuration(150, 300)
+	d2 := randomDuration(150, 300)
 	if d1 == d2 {
 		t.Fatalf("failed to get random duration: %v %v", d1, d2)
 	}
+
+	for i := 0; i < 100; i++ {
+		d := randomDuration(150, 160)
+		if d < 150*time.Millisecond || d >= 160*time.Millisecond {
+			t.Fatalf("random duration out of range: %v", d)
+		}
+	}
 }
 
 func TestMin(t *testing.T) {
@@ -25,3 +35,17 @@ func TestMax(t *testing.T) {
 		t.Fatalf("Wrong max")
 	}
 }
+
+func TestBackoff(t *testing.T) {
+	base, max := 10*time.Millisecond, 100*time.Millisecond
+	for failures := uint64(1); failures < 100; failures++ {
+		want := max
+		if failures < 5 {
+			want = base << (failures - 1)
+		}
+		d := backoff(base, max, failures)
+		if d < want/2 || d > want {
+			t.Fatalf("Wrong backoff for %d failures: %v (want %v/2..%v)", failures, d, want, want)
+		}
+	}
+}
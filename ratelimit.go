@@ -0,0 +1,46 @@
+package dkvs
+
+import (
+	"sync"
+	"time"
+)
+
+// tokenBucket allow rate operations per second on average, with bursts of
+// up to one second worth of them
+type tokenBucket struct {
+	sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket return a bucket allowing rate operations per second, nil
+// if rate is not positive which allows everything
+func newTokenBucket(rate int) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &tokenBucket{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// allow is used to take a token, it returns false if there is none left
+func (b *tokenBucket) allow() bool {
+	if b == nil {
+		return true
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
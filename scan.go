@@ -0,0 +1,79 @@
+package dkvs
+
+import (
+	"sort"
+	"strings"
+)
+
+// Iterator is used to read keys as of the applied index it was created at,
+// writes applied after that aren't seen by it
+type Iterator struct {
+	keys     []string
+	data     map[string][]byte
+	expireAt map[string]int64
+	now      int64
+	index    uint64
+	pos      int
+}
+
+// Scan return an iterator over keys with prefix in key order. It shares
+// data with StateMachine, which copies it before the next write instead,
+// so a long scan doesn't hold the lock and block apply.
+func (s *StateMachine) Scan(prefix string) *Iterator {
+	s.Lock()
+	it := &Iterator{data: s.data, expireAt: s.expireAt, now: s.now, index: s.index, pos: -1}
+	s.shared = true
+	s.Unlock()
+
+	for key := range it.data {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if expireAt, ok := it.expireAt[key]; ok && expireAt <= it.now {
+			continue
+		}
+		it.keys = append(it.keys, key)
+	}
+	sort.Strings(it.keys)
+	return it
+}
+
+// Next is used to move to the next key, it return false once there's none
+func (it *Iterator) Next() bool {
+	if it.pos < len(it.keys) {
+		it.pos++
+	}
+	return it.pos < len(it.keys)
+}
+
+// Key ...
+func (it *Iterator) Key() string {
+	return it.keys[it.pos]
+}
+
+// Value ...
+func (it *Iterator) Value() []byte {
+	return it.data[it.keys[it.pos]]
+}
+
+// Index return applied index the iterator reads as of
+func (it *Iterator) Index() uint64 {
+	return it.index
+}
+
+// own is used to copy data shared with iterators before it's written, lock
+// must be held
+func (s *StateMachine) own() {
+	if !s.shared {
+		return
+	}
+	data := make(map[string][]byte, len(s.data))
+	for key, value := range s.data {
+		data[key] = value
+	}
+	expireAt := make(map[string]int64, len(s.expireAt))
+	for key, at := range s.expireAt {
+		expireAt[key] = at
+	}
+	s.data, s.expireAt, s.shared = data, expireAt, false
+}
@@ -1,44 +1,581 @@
 package dkvs
 
-import "encoding/json"
-import "sync"
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"dkvs/raft"
+)
+
+// ErrVersionMismatch is returned when a cas command's version is not the
+// current version of its key
+var ErrVersionMismatch = errors.New("version mismatch")
+
+// Results of a txn with compares, the branch it applied
+const (
+	TxnSuccess = "success"
+	TxnFailure = "failure"
+)
 
 // StateMachine ...
 type StateMachine struct {
 	sync.Mutex
-	data map[string]string
+	codec Codec
+	data  map[string][]byte
+	// contentTypes keep content type of values written with one
+	contentTypes map[string]string
+	// expireAt keep logical expiry of keys stored with TTL, now is the
+	// latest command time applied. Keys are deleted once now passes their
+	// expiry, expiry orders them by it.
+	expireAt map[string]int64
+	now      int64
+	expiry   expiry
+	// versions keep index of the log that last wrote each key
+	versions map[string]uint64
+	// sessions keep the last write applied of each client
+	sessions map[string]*session
+	// index is the index of the last command log applied
+	index uint64
+	// handlers apply custom commands by op
+	handlers map[CommandOp]CommandHandler
+	// watchers receive changes of each key
+	watchers map[string]map[*watcher]struct{}
+	// shared is set while data and expireAt may be read by an iterator
+	shared bool
+	// deleted keep index keys were deleted at since state was last saved
+	// or restored, so a delta snapshot can carry deletions
+	deleted map[string]uint64
+}
+
+// session is the result of the last write of a client, it's returned again
+// if the write is retried
+type session struct {
+	seq    uint64
+	result string
+	err    error
 }
 
 // NewStateMachine ...
-func NewStateMachine() *StateMachine {
+func NewStateMachine(config *Config) *StateMachine {
 	return &StateMachine{
-		data: make(map[string]string),
+		codec:        config.Codec,
+		data:         make(map[string][]byte),
+		contentTypes: make(map[string]string),
+		expireAt:     make(map[string]int64),
+		versions:     make(map[string]uint64),
+		sessions:     make(map[string]*session),
+		handlers:     make(map[CommandOp]CommandHandler),
+		watchers:     make(map[string]map[*watcher]struct{}),
+		deleted:      make(map[string]uint64),
 	}
 }
 
-// Get ...
+// fresh return an empty StateMachine applying commands the same way, with
+// the same codec and custom commands
+func (s *StateMachine) fresh() *StateMachine {
+	s.Lock()
+	handlers := s.handlers
+	s.Unlock()
+
+	return &StateMachine{
+		codec:        s.codec,
+		data:         make(map[string][]byte),
+		contentTypes: make(map[string]string),
+		expireAt:     make(map[string]int64),
+		versions:     make(map[string]uint64),
+		sessions:     make(map[string]*session),
+		handlers:     handlers,
+		watchers:     make(map[string]map[*watcher]struct{}),
+		deleted:      make(map[string]uint64),
+	}
+}
+
+// Get is used to read value of a key as string, expired key is treated as
+// absent
 func (s *StateMachine) Get(data interface{}) interface{} {
 	s.Lock()
 	defer s.Unlock()
 
 	key := data.(string)
+	if s.expired(key) {
+		return ""
+	}
+
+	return string(s.data[key])
+}
+
+// GetMany is used to read values of keys as of one applied index, which
+// is returned with them, so a write to several keys is seen whole or not
+// at all
+func (s *StateMachine) GetMany(keys []string) (map[string]string, uint64) {
+	s.Lock()
+	defer s.Unlock()
 
-	return s.data[key]
+	values := make(map[string]string, len(keys))
+	for _, key := range keys {
+		if s.expired(key) {
+			values[key] = ""
+			continue
+		}
+		values[key] = string(s.data[key])
+	}
+	return values, s.index
+}
+
+// GetVersions is used to read versions of keys as of one applied index,
+// which is returned with them. Absent or expired key has version 0.
+func (s *StateMachine) GetVersions(keys []string) (map[string]uint64, uint64) {
+	s.Lock()
+	defer s.Unlock()
+
+	versions := make(map[string]uint64, len(keys))
+	for _, key := range keys {
+		if s.expired(key) {
+			versions[key] = 0
+			continue
+		}
+		versions[key] = s.versions[key]
+	}
+	return versions, s.index
+}
+
+// Entry is a value as it was written, Version is the index of the log that
+// last wrote it
+type Entry struct {
+	Value       []byte
+	ContentType string
+	Version     uint64
 }
 
-// Set ...
+// GetEntry is used to read a key with its content type and version, and
+// whether key exists. Absent or expired key has version 0, an empty value
+// is still found.
+func (s *StateMachine) GetEntry(key string) (Entry, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	value, ok := s.data[key]
+	if !ok || s.expired(key) {
+		return Entry{}, false
+	}
+
+	return Entry{Value: value, ContentType: s.contentTypes[key], Version: s.versions[key]}, true
+}
+
+func (s *StateMachine) expired(key string) bool {
+	expireAt, ok := s.expireAt[key]
+	return ok && expireAt <= s.now
+}
+
+// Set is used to apply a command, every operation of a txn is applied
+// under one lock so they are visible all at once or not at all.
 func (s *StateMachine) Set(data interface{}) error {
+	cmd, err := s.decodeCommand(data)
+	if err != nil {
+		return err
+	}
+
 	s.Lock()
 	defer s.Unlock()
 
-	var kv KeyValue
+	_, err = s.applyOnce(cmd, 0)
+	return err
+}
+
+// SetBatch is used to apply many commands under one lock
+func (s *StateMachine) SetBatch(data []interface{}) []error {
+	errs := make([]error, len(data))
+	cmds := make([]*Command, len(data))
+	for i := range data {
+		cmds[i], errs[i] = s.decodeCommand(data[i])
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	for i, cmd := range cmds {
+		if cmd != nil {
+			_, errs[i] = s.applyOnce(cmd, 0)
+		}
+	}
+
+	return errs
+}
+
+// ApplyLogs is used by raft to apply many commands under one lock, keys
+// written are versioned with index of their log. Result of a custom
+// command is set on its log.
+func (s *StateMachine) ApplyLogs(logs []*raft.Log) []error {
+	errs := make([]error, len(logs))
+	cmds := make([]*Command, len(logs))
+	for i, log := range logs {
+		cmds[i], errs[i] = s.decodeCommand(log.Command)
+	}
 
-	err := json.Unmarshal(data.([]byte), &kv)
+	s.Lock()
+	defer s.Unlock()
+
+	for i, cmd := range cmds {
+		if cmd != nil {
+			var result string
+			result, errs[i] = s.applyOnce(cmd, logs[i].Index)
+			if result != "" {
+				logs[i].SetResult(result)
+			}
+		}
+		s.index = max(s.index, logs[i].Index)
+	}
+
+	return errs
+}
+
+// decodeCommand is used to decode command with the configured codec
+func (s *StateMachine) decodeCommand(data interface{}) (*Command, error) {
+	cmd, err := s.codec.Decode(data.([]byte))
 	if err != nil {
+		return nil, err
+	}
+
+	s.Lock()
+	handlers := s.handlers
+	s.Unlock()
+	if err := cmd.validate(handlers); err != nil {
+		return nil, err
+	}
+
+	return &cmd, nil
+}
+
+// applyOnce is used to apply a client write unless client already applied
+// it, a duplicate of the last write gets the same result
+func (s *StateMachine) applyOnce(cmd *Command, index uint64) (string, error) {
+	if cmd.ClientID == "" {
+		return s.apply(cmd, index)
+	}
+
+	last, ok := s.sessions[cmd.ClientID]
+	if ok && cmd.Seq <= last.seq {
+		if cmd.Seq == last.seq {
+			return last.result, last.err
+		}
+		return "", nil
+	}
+
+	result, err := s.apply(cmd, index)
+	s.sessions[cmd.ClientID] = &session{seq: cmd.Seq, result: result, err: err}
+	return result, err
+}
+
+// apply is used to apply a command written by log at index, a cas whose
+// version is stale is rejected without changing anything. Only custom
+// commands and txns with compares have a result, the latter is the branch
+// applied.
+func (s *StateMachine) apply(cmd *Command, index uint64) (string, error) {
+	if cmd.Time > s.now {
+		s.now = cmd.Time
+		s.expireKeys(index)
+	}
+
+	switch cmd.Op {
+	case OpCAS:
+		var current uint64
+		if !s.expired(cmd.Key) {
+			current = s.versions[cmd.Key]
+		}
+		if current != cmd.Version {
+			return "", ErrVersionMismatch
+		}
+		s.set(cmd, index)
+	case "", OpSet:
+		s.set(cmd, index)
+	case OpDelete:
+		s.delete(cmd.Key, index)
+	case OpTxn:
+		if len(cmd.Compare) == 0 {
+			s.applyTxn(cmd.Txn, index)
+			break
+		}
+		if s.compare(cmd.Compare) {
+			s.applyTxn(cmd.Txn, index)
+			return TxnSuccess, nil
+		}
+		s.applyTxn(cmd.Failure, index)
+		return TxnFailure, nil
+	default:
+		// Handler is only missing if it was registered on some nodes only
+		handler, ok := s.handlers[cmd.Op]
+		if !ok {
+			return "", fmt.Errorf("unknown command op: %s", cmd.Op)
+		}
+		return handler(&KV{sm: s, index: index}, cmd)
+	}
+	return "", nil
+}
+
+func (s *StateMachine) applyTxn(ops []*Command, index uint64) {
+	for _, op := range ops {
+		_, _ = s.apply(op, index)
+	}
+}
+
+// compare return whether every compare holds on current state, lock must
+// be held
+func (s *StateMachine) compare(cmps []*Compare) bool {
+	for _, cmp := range cmps {
+		var value []byte
+		var version uint64
+		if !s.expired(cmp.Key) {
+			value, version = s.data[cmp.Key], s.versions[cmp.Key]
+		}
+		switch cmp.Target {
+		case CompareValue:
+			if !bytes.Equal(value, cmp.Value) {
+				return false
+			}
+		case CompareVersion:
+			if version != cmp.Version {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (s *StateMachine) set(cmd *Command, index uint64) {
+	s.own()
+	s.data[cmd.Key] = cmd.Value
+	if cmd.ContentType != "" {
+		s.contentTypes[cmd.Key] = cmd.ContentType
+	} else {
+		delete(s.contentTypes, cmd.Key)
+	}
+	if cmd.ExpireAt != 0 {
+		s.expireAt[cmd.Key] = cmd.ExpireAt
+		s.trackExpiry(cmd.Key, cmd.ExpireAt)
+	} else {
+		delete(s.expireAt, cmd.Key)
+	}
+	s.versions[cmd.Key] = index
+	delete(s.deleted, cmd.Key)
+	s.notifyWatchers(cmd.Key, Change{Index: index, Value: string(cmd.Value)})
+}
+
+func (s *StateMachine) delete(key string, index uint64) {
+	s.own()
+	delete(s.data, key)
+	delete(s.contentTypes, key)
+	delete(s.expireAt, key)
+	delete(s.versions, key)
+	s.deleted[key] = index
+	s.notifyWatchers(key, Change{Index: index, Deleted: true})
+}
+
+// snapshot is the encoded state of StateMachine, errors of client sessions
+// are kept as text
+type snapshot struct {
+	Data         map[string][]byte          `json:"data"`
+	ContentTypes map[string]string          `json:"contentTypes"`
+	ExpireAt     map[string]int64           `json:"expireAt"`
+	Now          int64                      `json:"now"`
+	Versions     map[string]uint64          `json:"versions"`
+	Sessions     map[string]snapshotSession `json:"sessions"`
+	Index        uint64                     `json:"index"`
+}
+
+type snapshotSession struct {
+	Seq    uint64 `json:"seq"`
+	Result string `json:"result,omitempty"`
+	Err    string `json:"err,omitempty"`
+}
+
+// Snapshot is used to write every key with its expiry and version, and
+// client sessions so retries are still deduplicated after restore
+func (s *StateMachine) Snapshot(w io.Writer) error {
+	s.Lock()
+	defer s.Unlock()
+
+	snap := &snapshot{
+		Data:         s.data,
+		ContentTypes: s.contentTypes,
+		ExpireAt:     s.expireAt,
+		Now:          s.now,
+		Versions:     s.versions,
+		Sessions:     s.savedSessions(),
+		Index:        s.index,
+	}
+	s.deleted = make(map[string]uint64)
+	return json.NewEncoder(w).Encode(snap)
+}
+
+// savedSessions return client sessions as they're snapshotted, lock must
+// be held
+func (s *StateMachine) savedSessions() map[string]snapshotSession {
+	sessions := make(map[string]snapshotSession, len(s.sessions))
+	for client, session := range s.sessions {
+		saved := snapshotSession{Seq: session.seq, Result: session.result}
+		if session.err != nil {
+			saved.Err = session.err.Error()
+		}
+		sessions[client] = saved
+	}
+	return sessions
+}
+
+// restoreSessions return client sessions from a snapshot, errors are
+// matched back to the builtin ones
+func restoreSessions(snapshotted map[string]snapshotSession) map[string]*session {
+	sessions := make(map[string]*session, len(snapshotted))
+	for client, saved := range snapshotted {
+		restored := &session{seq: saved.Seq, result: saved.Result}
+		switch saved.Err {
+		case "":
+		case ErrVersionMismatch.Error():
+			restored.err = ErrVersionMismatch
+		default:
+			restored.err = errors.New(saved.Err)
+		}
+		sessions[client] = restored
+	}
+	return sessions
+}
+
+// Restore is used to replace state with snapshot
+func (s *StateMachine) Restore(r io.Reader) error {
+	snap := &snapshot{}
+	if err := json.NewDecoder(r).Decode(snap); err != nil {
 		return err
 	}
 
-	s.data[kv.Key] = kv.Value
+	sessions := restoreSessions(snap.Sessions)
+
+	s.Lock()
+	defer s.Unlock()
+	s.data = snap.Data
+	s.contentTypes = snap.ContentTypes
+	if s.contentTypes == nil {
+		s.contentTypes = make(map[string]string)
+	}
+	s.expireAt = snap.ExpireAt
+	s.shared = false
+	s.now = snap.Now
+	s.versions = snap.Versions
+	s.sessions = sessions
+	s.index = snap.Index
+	s.deleted = make(map[string]uint64)
+	s.rebuildExpiry()
+	s.closeWatchers()
+	return nil
+}
 
+// snapshotDelta is the encoded changes of StateMachine since Base, keys
+// written after it and keys deleted
+type snapshotDelta struct {
+	Base     uint64                     `json:"base"`
+	Entries  map[string]deltaEntry      `json:"entries"`
+	Deleted  []string                   `json:"deleted"`
+	Now      int64                      `json:"now"`
+	Sessions map[string]snapshotSession `json:"sessions"`
+	Index    uint64                     `json:"index"`
+}
+
+type deltaEntry struct {
+	Value       []byte `json:"value"`
+	ContentType string `json:"contentType,omitempty"`
+	ExpireAt    int64  `json:"expireAt,omitempty"`
+	Version     uint64 `json:"version"`
+}
+
+// SnapshotDelta is used to write keys written after log at base, keys
+// deleted since state was last saved or restored, and client sessions
+func (s *StateMachine) SnapshotDelta(w io.Writer, base uint64) error {
+	s.Lock()
+	defer s.Unlock()
+
+	delta := &snapshotDelta{
+		Base:     base,
+		Entries:  make(map[string]deltaEntry),
+		Deleted:  make([]string, 0, len(s.deleted)),
+		Now:      s.now,
+		Sessions: s.savedSessions(),
+		Index:    s.index,
+	}
+	for key, version := range s.versions {
+		if version > base {
+			delta.Entries[key] = deltaEntry{
+				Value:       s.data[key],
+				ContentType: s.contentTypes[key],
+				ExpireAt:    s.expireAt[key],
+				Version:     version,
+			}
+		}
+	}
+	for key := range s.deleted {
+		delta.Deleted = append(delta.Deleted, key)
+	}
+	s.deleted = make(map[string]uint64)
+	return json.NewEncoder(w).Encode(delta)
+}
+
+// RestoreDelta is used to apply a delta on state at its base, raft checks
+// the base as it may be past the last command log applied
+func (s *StateMachine) RestoreDelta(r io.Reader) error {
+	delta := &snapshotDelta{}
+	if err := json.NewDecoder(r).Decode(delta); err != nil {
+		return err
+	}
+	sessions := restoreSessions(delta.Sessions)
+
+	s.Lock()
+	defer s.Unlock()
+	s.own()
+	for key, entry := range delta.Entries {
+		s.data[key] = entry.Value
+		s.versions[key] = entry.Version
+		if entry.ContentType != "" {
+			s.contentTypes[key] = entry.ContentType
+		} else {
+			delete(s.contentTypes, key)
+		}
+		if entry.ExpireAt != 0 {
+			s.expireAt[key] = entry.ExpireAt
+		} else {
+			delete(s.expireAt, key)
+		}
+	}
+	for _, key := range delta.Deleted {
+		delete(s.data, key)
+		delete(s.contentTypes, key)
+		delete(s.expireAt, key)
+		delete(s.versions, key)
+	}
+	s.now = delta.Now
+	s.sessions = sessions
+	s.index = delta.Index
+	s.deleted = make(map[string]uint64)
+	s.rebuildExpiry()
+	s.closeWatchers()
+	return nil
+}
+
+// Reset is used to drop every key and client session, watchers are closed
+// as they would miss changes
+func (s *StateMachine) Reset() error {
+	s.Lock()
+	defer s.Unlock()
+	s.data = make(map[string][]byte)
+	s.contentTypes = make(map[string]string)
+	s.expireAt = make(map[string]int64)
+	s.shared = false
+	s.now = 0
+	s.versions = make(map[string]uint64)
+	s.sessions = make(map[string]*session)
+	s.index = 0
+	s.deleted = make(map[string]uint64)
+	s.rebuildExpiry()
+	s.closeWatchers()
 	return nil
 }
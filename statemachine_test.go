@@ -0,0 +1,400 @@
+package dkvs
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"dkvs/raft"
+)
+
+func TestStateMachineSetKeyValue(t *testing.T) {
+	sm := NewStateMachine(DefaultConfig())
+
+	data, _ := json.Marshal(&KeyValue{Key: "a", Value: []byte("b")})
+	if err := sm.Set(data); err != nil {
+		t.Fatal(err)
+	}
+	if v := sm.Get("a"); v != "b" {
+		t.Fatalf("Wrong value: %v", v)
+	}
+}
+
+func TestStateMachineTxnAllOrNothing(t *testing.T) {
+	sm := NewStateMachine(DefaultConfig())
+
+	cmd := &Command{
+		Op: OpTxn,
+		Txn: []*Command{
+			{Op: OpSet, Key: "a", Value: []byte("1")},
+			{Op: OpDelete},
+		},
+	}
+	data, _ := json.Marshal(cmd)
+	if err := sm.Set(data); err == nil {
+		t.Fatalf("Txn with invalid operation should fail")
+	}
+	if v := sm.Get("a"); v != "" {
+		t.Fatalf("Txn should not be partially applied: %v", v)
+	}
+
+	cmd.Txn[1].Key = "b"
+	data, _ = json.Marshal(cmd)
+	if err := sm.Set(data); err != nil {
+		t.Fatal(err)
+	}
+	if v := sm.Get("a"); v != "1" {
+		t.Fatalf("Wrong value: %v", v)
+	}
+}
+
+func TestStateMachineExpireDeterministic(t *testing.T) {
+	commands := []*Command{
+		{Op: OpSet, Key: "a", Value: []byte("1"), Time: 100, ExpireAt: 130},
+		{Op: OpSet, Key: "b", Value: []byte("2"), Time: 110},
+		{Op: OpSet, Key: "c", Value: []byte("3"), Time: 129},
+		{Op: OpSet, Key: "d", Value: []byte("4"), Time: 130},
+	}
+
+	// Visibility of a after each command, whatever time nodes apply it
+	want := []string{"1", "1", "1", ""}
+
+	var nodes []*StateMachine
+	for i := 0; i < 3; i++ {
+		nodes = append(nodes, NewStateMachine(DefaultConfig()))
+	}
+	for i, cmd := range commands {
+		data, _ := json.Marshal(cmd)
+		for n, sm := range nodes {
+			if err := sm.Set(data); err != nil {
+				t.Fatal(err)
+			}
+			if v := sm.Get("a"); v != want[i] {
+				t.Fatalf("Wrong value on node %d after command %d: %v (want %v)", n, i, v, want[i])
+			}
+		}
+		// Let wall clock move between nodes applying the same log
+		time.Sleep(time.Millisecond)
+	}
+
+	// Overwriting without TTL makes the key permanent again
+	data, _ := json.Marshal(&Command{Op: OpSet, Key: "a", Value: []byte("5"), Time: 140})
+	if err := nodes[0].Set(data); err != nil {
+		t.Fatal(err)
+	}
+	if v := nodes[0].Get("a"); v != "5" {
+		t.Fatalf("Overwritten key should not expire: %v", v)
+	}
+}
+
+func TestStateMachineCASVersion(t *testing.T) {
+	sm := NewStateMachine(DefaultConfig())
+
+	logs := make([]*raft.Log, 4)
+	commands := []*Command{
+		{Op: OpSet, Key: "a", Value: []byte("1")},
+		{Op: OpCAS, Key: "a", Value: []byte("2"), Version: 1},
+		{Op: OpCAS, Key: "a", Value: []byte("3"), Version: 1},
+		{Op: OpCAS, Key: "b", Value: []byte("4")},
+	}
+	for i, cmd := range commands {
+		data, _ := json.Marshal(cmd)
+		logs[i] = &raft.Log{Index: uint64(i + 1), Type: raft.LogCommand, Command: data}
+	}
+
+	errs := sm.ApplyLogs(logs)
+	if errs[0] != nil || errs[1] != nil || errs[3] != nil {
+		t.Fatalf("Unexpected errors: %v", errs)
+	}
+	if errs[2] != ErrVersionMismatch {
+		t.Fatalf("CAS with stale version should fail: %v", errs[2])
+	}
+	if e, _ := sm.GetEntry("a"); string(e.Value) != "2" || e.Version != 2 {
+		t.Fatalf("Wrong value or version: %s %d", e.Value, e.Version)
+	}
+	if e, _ := sm.GetEntry("b"); string(e.Value) != "4" || e.Version != 4 {
+		t.Fatalf("Wrong value or version: %s %d", e.Value, e.Version)
+	}
+}
+
+func TestStateMachineDedupClientWrites(t *testing.T) {
+	sm := NewStateMachine(DefaultConfig())
+
+	apply := func(index uint64, cmd *Command) error {
+		data, _ := json.Marshal(cmd)
+		return sm.ApplyLogs([]*raft.Log{{Index: index, Type: raft.LogCommand, Command: data}})[0]
+	}
+
+	first := &Command{Op: OpCAS, Key: "a", Value: []byte("1"), ClientID: "c", Seq: 1}
+	if err := apply(1, first); err != nil {
+		t.Fatal(err)
+	}
+	// Replayed cas gets its result again instead of a version mismatch
+	if err := apply(2, first); err != nil {
+		t.Fatalf("Duplicate should return cached result: %v", err)
+	}
+	if e, _ := sm.GetEntry("a"); e.Version != 1 {
+		t.Fatalf("Duplicate should not be applied: version %d", e.Version)
+	}
+
+	if err := apply(3, &Command{Op: OpSet, Key: "a", Value: []byte("2"), ClientID: "c", Seq: 2}); err != nil {
+		t.Fatal(err)
+	}
+	// An older write retried late doesn't overwrite a newer one
+	if err := apply(4, first); err != nil {
+		t.Fatal(err)
+	}
+	if e, _ := sm.GetEntry("a"); string(e.Value) != "2" || e.Version != 3 {
+		t.Fatalf("Old write should be skipped: %s %d", e.Value, e.Version)
+	}
+
+	// Other clients are tracked separately
+	if err := apply(5, &Command{Op: OpSet, Key: "a", Value: []byte("3"), ClientID: "d", Seq: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if v := sm.Get("a"); v != "3" {
+		t.Fatalf("Write of another client should be applied: %v", v)
+	}
+
+	if err := apply(6, &Command{Op: OpSet, Key: "a", ClientID: "d"}); err == nil {
+		t.Fatalf("Client write without seq should be rejected")
+	}
+}
+
+func TestStateMachineSnapshotRestore(t *testing.T) {
+	sm := NewStateMachine(DefaultConfig())
+
+	var logs []*raft.Log
+	for i, cmd := range []*Command{
+		{Op: OpSet, Key: "a", Value: []byte("1"), Time: 100, ExpireAt: 200},
+		{Op: OpSet, Key: "b", Value: []byte("2"), Time: 110},
+		{Op: OpCAS, Key: "b", Value: []byte("3"), Version: 1, ClientID: "c", Seq: 1},
+	} {
+		data, _ := json.Marshal(cmd)
+		logs = append(logs, &raft.Log{Index: uint64(i + 1), Type: raft.LogCommand, Command: data})
+	}
+	sm.ApplyLogs(logs)
+
+	var buf bytes.Buffer
+	if err := sm.Snapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	restored := NewStateMachine(DefaultConfig())
+	if err := restored.Restore(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if e, _ := restored.GetEntry("b"); string(e.Value) != "2" || e.Version != 2 {
+		t.Fatalf("Wrong restored value or version: %s %d", e.Value, e.Version)
+	}
+	// Expiry and client sessions survive restore
+	expire, _ := json.Marshal(&Command{Op: OpSet, Key: "c", Value: []byte("4"), Time: 200})
+	retry, _ := json.Marshal(&Command{Op: OpCAS, Key: "b", Value: []byte("3"), Version: 1, ClientID: "c", Seq: 1})
+	errs := restored.ApplyLogs([]*raft.Log{
+		{Index: 4, Type: raft.LogCommand, Command: expire},
+		{Index: 5, Type: raft.LogCommand, Command: retry},
+	})
+	if v := restored.Get("a"); v != "" {
+		t.Fatalf("Restored key should expire: %v", v)
+	}
+	if errs[1] != ErrVersionMismatch {
+		t.Fatalf("Retry should get the cached result: %v", errs[1])
+	}
+}
+
+func TestStateMachineExpiredKeysDeleted(t *testing.T) {
+	sm := NewStateMachine(DefaultConfig())
+	changes, cancel := sm.Watch("a")
+	defer cancel()
+
+	var logs []*raft.Log
+	for i, cmd := range []*Command{
+		{Op: OpSet, Key: "a", Value: []byte("1"), Time: 100, ExpireAt: 200},
+		{Op: OpSet, Key: "b", Value: []byte("2"), Time: 100, ExpireAt: 150},
+		// b is written again without TTL, its earlier expiry is stale
+		{Op: OpSet, Key: "b", Value: []byte("3"), Time: 110},
+		{Op: OpSet, Key: "c", Value: []byte("4"), Time: 200},
+	} {
+		data, _ := json.Marshal(cmd)
+		logs = append(logs, &raft.Log{Index: uint64(i + 1), Type: raft.LogCommand, Command: data})
+	}
+	sm.ApplyLogs(logs)
+
+	// Expired key is gone from state, not only hidden
+	sm.Lock()
+	_, inData := sm.data["a"]
+	_, inVersions := sm.versions["a"]
+	n := len(sm.expireAt)
+	sm.Unlock()
+	if inData || inVersions || n != 0 {
+		t.Fatalf("Expired key should be deleted: data %v versions %v expiry %d", inData, inVersions, n)
+	}
+	if v := sm.Get("b"); v != "3" {
+		t.Fatalf("Key written again without TTL should not expire: %v", v)
+	}
+	<-changes
+	if change := <-changes; !change.Deleted || change.Index != 4 {
+		t.Fatalf("Expiry should be a delete at the log passing it: %+v", change)
+	}
+
+	var buf bytes.Buffer
+	if err := sm.Snapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var snap snapshot
+	if err := json.Unmarshal(buf.Bytes(), &snap); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := snap.Data["a"]; ok {
+		t.Fatalf("Snapshot should not carry expired key")
+	}
+}
+
+func TestStateMachineWatchSlowWatcher(t *testing.T) {
+	sm := NewStateMachine(DefaultConfig())
+	changes, cancel := sm.Watch("a")
+	defer cancel()
+
+	// Watcher falling behind is closed rather than blocking apply
+	for i := 0; i <= watchBuffer; i++ {
+		data, _ := json.Marshal(&KeyValue{Key: "a", Value: []byte("b")})
+		if err := sm.Set(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n := 0
+	for range changes {
+		n++
+	}
+	if n != watchBuffer {
+		t.Fatalf("Wrong number of changes before close: %d", n)
+	}
+}
+
+func TestStateMachineScanConsistent(t *testing.T) {
+	sm := NewStateMachine(DefaultConfig())
+	set := func(cmd *Command) {
+		data, _ := json.Marshal(cmd)
+		if err := sm.Set(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, key := range []string{"a1", "a2", "a3", "b1"} {
+		set(&Command{Op: OpSet, Key: key, Value: []byte("old")})
+	}
+
+	// Writes applied partway through the scan aren't seen by it
+	it := sm.Scan("a")
+	if !it.Next() || it.Key() != "a1" {
+		t.Fatalf("Scan should start at first key")
+	}
+	set(&Command{Op: OpSet, Key: "a2", Value: []byte("new")})
+	set(&Command{Op: OpSet, Key: "a25", Value: []byte("new")})
+	set(&Command{Op: OpDelete, Key: "a3"})
+
+	got := map[string]string{it.Key(): string(it.Value())}
+	for it.Next() {
+		got[it.Key()] = string(it.Value())
+	}
+	want := map[string]string{"a1": "old", "a2": "old", "a3": "old"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Wrong scan result: %v", got)
+	}
+
+	got = make(map[string]string)
+	for it = sm.Scan("a"); it.Next(); {
+		got[it.Key()] = string(it.Value())
+	}
+	want = map[string]string{"a1": "old", "a2": "new", "a25": "new"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Wrong scan result after writes: %v", got)
+	}
+}
+
+func TestStateMachineDeltaSnapshots(t *testing.T) {
+	raftConfig := raft.DefaultConfig()
+	raftConfig.SnapshotDir = t.TempDir()
+	raftConfig.SnapshotDeltas = 2
+	addr := raft.NewInmemAddr()
+	start := func() *raft.Server {
+		s, err := raft.NewServer(raftConfig, raft.NewInmemTransport(addr), raft.NewInmemLogStore(), NewStateMachine(DefaultConfig()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Start()
+		deadline := time.Now().Add(20 * testElectionTimeout)
+		for s.State() != raft.Leader {
+			if time.Now().After(deadline) {
+				t.Fatalf("Server not promote to leader")
+			}
+			time.Sleep(testElectionTimeout / 10)
+		}
+		return s
+	}
+	do := func(s *raft.Server, cmd *Command) {
+		data, _ := json.Marshal(cmd)
+		if err := s.Do(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := start()
+	do(s, &Command{Op: OpSet, Key: "a", Value: []byte("1")})
+	do(s, &Command{Op: OpSet, Key: "b", Value: []byte("2")})
+	if err := s.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	// Each delta carries writes and deletes since the previous snapshot
+	do(s, &Command{Op: OpSet, Key: "a", Value: []byte("3")})
+	do(s, &Command{Op: OpDelete, Key: "b"})
+	if err := s.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	do(s, &Command{Op: OpSet, Key: "b", Value: []byte("4")})
+	do(s, &Command{Op: OpSet, Key: "c", Value: []byte("5")})
+	if err := s.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	s.Stop()
+
+	deltas, _ := filepath.Glob(filepath.Join(raftConfig.SnapshotDir, "delta-*.data"))
+	if len(deltas) != 2 {
+		t.Fatalf("Wrong number of delta snapshots: %v", deltas)
+	}
+
+	// Log is gone, restarted server only has the snapshot chain
+	s = start()
+	defer func() { s.Stop() }()
+	sm := s.StateMachine().(*StateMachine)
+	for key, value := range map[string]string{"a": "3", "b": "4", "c": "5"} {
+		if v := sm.Get(key); v != value {
+			t.Fatalf("Wrong value of %s restored from deltas: %q", key, v)
+		}
+	}
+	if e, _ := sm.GetEntry("b"); e.Version == 0 {
+		t.Fatalf("Restored key should keep its version")
+	}
+
+	// Full snapshot is taken right after a barrier, so its index is past
+	// the last command log
+	do(s, &Command{Op: OpSet, Key: "d", Value: []byte("6")})
+	if err := s.Barrier(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	do(s, &Command{Op: OpSet, Key: "d", Value: []byte("7")})
+	if err := s.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	s.Stop()
+
+	s = start()
+	if v := s.StateMachine().Get("d"); v != "7" {
+		t.Fatalf("Wrong value restored from delta on barrier: %q", v)
+	}
+}
@@ -0,0 +1,146 @@
+package dkvs
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"dkvs/raft"
+
+	"github.com/gorilla/mux"
+)
+
+// testCert is a certificate with its key, PEM encoded
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// newTestCert is used to create certificate signed by parent, it's self
+// signed CA if parent is nil
+func newTestCert(t *testing.T, name string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+		template.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+// newTestTLSConfig is used to load node certificate through NewTLSConfig
+func newTestTLSConfig(t *testing.T, node, ca *testCert) *tls.Config {
+	dir := t.TempDir()
+	files := map[string][]byte{"cert.pem": node.certPEM, "key.pem": node.keyPEM, "ca.pem": ca.certPEM}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	config, err := NewTLSConfig(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), filepath.Join(dir, "ca.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+func TestHTTPTransportMutualTLS(t *testing.T) {
+	ca := newTestCert(t, "ca", nil)
+	nodeConfig := newTestTLSConfig(t, newTestCert(t, "node", ca), ca)
+
+	config := DefaultConfig()
+	config.TLSConfig = nodeConfig
+	consumer := make(chan raft.RPC)
+	transport := NewHTTPTransport("", consumer, config)
+	s := newRaftServer(t, transport, NewStateMachine(config))
+	s.Start()
+	defer s.Stop()
+
+	r := mux.NewRouter()
+	r.HandleFunc("/request_vote", transport.RequestVoteHandle(consumer)).Methods("POST")
+	ts := httptest.NewUnstartedServer(r)
+	ts.TLS = nodeConfig
+	ts.StartTLS()
+	defer ts.Close()
+	target := strings.TrimPrefix(ts.URL, "https://")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// Peer with certificate signed by cluster CA
+	peerConfig := DefaultConfig()
+	peerConfig.TLSConfig = newTestTLSConfig(t, newTestCert(t, "peer", ca), ca)
+	var resp raft.RequestVoteResponse
+	if err := NewHTTPTransport("", nil, peerConfig).RequestVote(ctx, target, &raft.RequestVoteRequest{Term: 1, Candidate: "foo"}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Term != 1 || !resp.Granted {
+		t.Fatalf("Wrong vote response: %+v", resp)
+	}
+
+	// Peer trusting the cluster CA but presenting a certificate of another one
+	other := newTestCert(t, "other", nil)
+	untrusted := newTestTLSConfig(t, newTestCert(t, "untrusted", other), other)
+	untrusted.RootCAs = nodeConfig.RootCAs
+	untrustedConfig := DefaultConfig()
+	untrustedConfig.TLSConfig = untrusted
+	if err := NewHTTPTransport("", nil, untrustedConfig).RequestVote(ctx, target, &raft.RequestVoteRequest{Term: 2, Candidate: "bar"}, &raft.RequestVoteResponse{}); err == nil {
+		t.Fatalf("RPC with untrusted client certificate should be rejected")
+	}
+
+	// Plain HTTP client is rejected too
+	if err := NewHTTPTransport("", nil, DefaultConfig()).RequestVote(ctx, target, &raft.RequestVoteRequest{Term: 2, Candidate: "bar"}, &raft.RequestVoteResponse{}); err == nil {
+		t.Fatalf("RPC without TLS should be rejected")
+	}
+	if s.VotedFor() == "bar" {
+		t.Fatalf("Rejected RPC should not reach raft server")
+	}
+}
@@ -0,0 +1,80 @@
+package dkvs
+
+// watchBuffer is the number of changes a watcher may fall behind by, it's
+// closed rather than holding back apply once it's exceeded
+const watchBuffer = 64
+
+// Change is a write to a watched key applied by the log at Index, Deleted
+// is set if it removed the key
+type Change struct {
+	Index   uint64 `json:"index"`
+	Value   string `json:"value"`
+	Deleted bool   `json:"deleted,omitempty"`
+}
+
+type watcher struct {
+	ch chan Change
+}
+
+// Watch is used to receive every change applied to key from now on, in
+// apply order. The channel is closed once cancel is called, once watcher
+// falls watchBuffer changes behind and on restore from a snapshot, as
+// changes may be missed then.
+func (s *StateMachine) Watch(key string) (<-chan Change, func()) {
+	w := &watcher{ch: make(chan Change, watchBuffer)}
+
+	s.Lock()
+	if s.watchers[key] == nil {
+		s.watchers[key] = make(map[*watcher]struct{})
+	}
+	s.watchers[key][w] = struct{}{}
+	s.Unlock()
+
+	cancel := func() {
+		s.Lock()
+		defer s.Unlock()
+		s.unwatch(key, w)
+	}
+	return w.ch, cancel
+}
+
+// CloseWatchers is used to close every watcher, e.g. so streams end on
+// shutdown
+func (s *StateMachine) CloseWatchers() {
+	s.Lock()
+	defer s.Unlock()
+	s.closeWatchers()
+}
+
+func (s *StateMachine) closeWatchers() {
+	for key, watchers := range s.watchers {
+		for w := range watchers {
+			s.unwatch(key, w)
+		}
+	}
+}
+
+// notifyWatchers is used to send change of key to its watchers, lock must
+// be held
+func (s *StateMachine) notifyWatchers(key string, change Change) {
+	for w := range s.watchers[key] {
+		select {
+		case w.ch <- change:
+		default:
+			s.unwatch(key, w)
+		}
+	}
+}
+
+// unwatch is used to remove watcher of key and close its channel, lock
+// must be held
+func (s *StateMachine) unwatch(key string, w *watcher) {
+	if _, ok := s.watchers[key][w]; !ok {
+		return
+	}
+	delete(s.watchers[key], w)
+	if len(s.watchers[key]) == 0 {
+		delete(s.watchers, key)
+	}
+	close(w.ch)
+}